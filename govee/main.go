@@ -1,32 +1,21 @@
 package main
 
 import (
-	"errors"
 	"log"
 	"os"
 
-	"github.com/joho/godotenv"
-	_ "github.com/seanpden/govee_controller/pkg/cli_handler"
 	clihandler "github.com/seanpden/govee_controller/pkg/cli_handler"
+	"github.com/seanpden/govee_controller/pkg/redact"
 )
 
-func handleEnvVar() (string, error) {
-	err := godotenv.Load()
-	if err != nil {
-		return "", err
-	}
+func main() {
+	// API keys must never end up in the logs
+	log.SetOutput(redact.NewWriter(os.Stderr))
 
-	APIKEY := os.Getenv("GOVEE_APIKEY")
-	if APIKEY == "" {
-		return "", errors.New("APIKEY not set")
+	// completion has to work without any configuration
+	if clihandler.HandleCompletion(os.Args[1:]) {
+		return
 	}
-	return APIKEY, nil
-}
 
-func main() {
-	APIKEY, err := handleEnvVar()
-	if err != nil {
-		log.Fatal(err)
-	}
-	clihandler.HandleCLI(APIKEY)
+	clihandler.HandleCLI()
 }
@@ -0,0 +1,133 @@
+package apiwrapper
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/seanpden/govee_controller/pkg/structs"
+)
+
+// accounts maps the name of every registered account to its API key. Each key
+// has its own rate-limit budget, see GetRateLimit.
+var (
+	accountsMu sync.Mutex
+	accounts   = map[string]string{}
+)
+
+// RegisterAccount adds an account to the accounts commands are routed to.
+//
+// Devices listed by ListAllDevices are tagged with the account they belong
+// to, and the control functions send commands for a device with the API key
+// of its account instead of the key they were called with.
+//
+// Parameters:
+// - name: The name of the account, used to qualify clashing device names.
+// - APIKEY: The API key of the account.
+func RegisterAccount(name string, APIKEY string) {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	accounts[name] = APIKEY
+}
+
+// UnregisterAccount removes an account registered with RegisterAccount.
+func UnregisterAccount(name string) {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	delete(accounts, name)
+}
+
+// Accounts returns the names of the registered accounts in sorted order.
+func Accounts() []string {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+
+	var names []string
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AccountKey returns the API key of a registered account.
+func AccountKey(name string) (string, bool) {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	APIKEY, ok := accounts[name]
+	return APIKEY, ok
+}
+
+// AccountName returns the name of the registered account an API key belongs
+// to, or "default" for any other key.
+func AccountName(APIKEY string) string {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	for name, key := range accounts {
+		if key == APIKEY {
+			return name
+		}
+	}
+	return "default"
+}
+
+// KeyFor returns the API key to send requests for a device with: the key of the
+// device's account if it has one, APIKEY otherwise.
+func KeyFor(device structs.Device, APIKEY string) string {
+	if device.Account == "" {
+		return APIKEY
+	}
+	if accountKey, ok := AccountKey(device.Account); ok {
+		return accountKey
+	}
+	return APIKEY
+}
+
+// ListAllDevices lists the devices of every registered account as one list.
+//
+// Every device is tagged with its account. Device names that exist in more
+// than one account are qualified as "account/name" so each name stays unique.
+// Without registered accounts this is the same as ListDevices(APIKEY).
+//
+// Parameters:
+//
+// - APIKEY: The API key used when no account is registered.
+//
+// Returns:
+//
+// - structs.ListDevicesResponse: The merged list of devices.
+// - error: An error if listing the devices of any account fails.
+func ListAllDevices(APIKEY string) (structs.ListDevicesResponse, error) {
+	names := Accounts()
+	if len(names) == 0 {
+		return ListDevices(APIKEY)
+	}
+
+	var merged structs.ListDevicesResponse
+	for _, name := range names {
+		accountKey, _ := AccountKey(name)
+		data, err := ListDevices(accountKey)
+		if err != nil {
+			return structs.ListDevicesResponse{}, fmt.Errorf("account %s: %w", name, err)
+		}
+		for _, device := range data.Data.Devices {
+			device.Account = name
+			merged.Data.Devices = append(merged.Data.Devices, device)
+		}
+		merged.Code = data.Code
+		merged.Message = data.Message
+	}
+
+	// qualify the names that are used by more than one account
+	count := map[string]int{}
+	for _, device := range merged.Data.Devices {
+		count[device.DeviceName]++
+	}
+	for i, device := range merged.Data.Devices {
+		if count[device.DeviceName] > 1 {
+			merged.Data.Devices[i].DeviceName = device.Account + "/" + device.DeviceName
+		}
+	}
+
+	return merged, nil
+}
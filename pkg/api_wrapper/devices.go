@@ -6,18 +6,27 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
+	"github.com/seanpden/govee_controller/pkg/redact"
 	"github.com/seanpden/govee_controller/pkg/structs"
 	"github.com/seanpden/govee_controller/pkg/utils"
-	_ "github.com/seanpden/govee_controller/pkg/utils"
 )
 
+// BaseURL is the address of the Govee developer API. It can be changed to
+// point the wrapper at a proxy or a test server.
+var BaseURL = "https://developer-api.govee.com"
+
+// HTTPClient is the client every request is sent with.
+var HTTPClient = &http.Client{}
+
 // createHeader generates the headers for an HTTP request.
 //
 // It takes in a pointer to an http.Request object and an API key string.
 // The function modifies the request object by adding three header fields:
 // "accept" with the value "application/json", "content-type" with the value
 // "application/json", and "Govee-API-Key" with the value of the API key.
+// Use redact.Header before logging the headers of a request.
 //
 // Parameters:
 // - req: A pointer to an http.Request object.
@@ -47,6 +56,11 @@ func constructPayload(device string, model string, cmd structs.Command) (io.Read
 
 // makeRequest sends an HTTP request to the specified URL using the given method and API key.
 //
+// The API key is registered with the redact package, so it is removed from the
+// returned error and from anything else passing through redact. GET requests
+// that fail with a network error or a 5xx status are retried once, commands
+// are never resent. Every attempt is reported to Observer.
+//
 // Parameters:
 // - method: The HTTP method to use for the request.
 // - url: The URL to send the request to.
@@ -56,32 +70,122 @@ func constructPayload(device string, model string, cmd structs.Command) (io.Read
 // - []byte: The response body as a byte array.
 // - error: An error if any occurred during the request or response handling.
 func makeRequest(method string, url string, payload io.Reader, APIKEY string) ([]byte, error) {
+	redact.Register(APIKEY)
+
+	// buffer the payload so it can be traced
+	var payloadBytes []byte
+	if payload != nil {
+		var err error
+		payloadBytes, err = io.ReadAll(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		body, status, err := sendRequest(method, url, payloadBytes, APIKEY)
+		observe(method, url, payloadBytes, APIKEY, status, time.Since(start), attempt, err)
+
+		if attempt >= getRetries || !retryable(method, status, err) {
+			return body, redact.Error(err)
+		}
+		time.Sleep(retryDelay)
+	}
+}
+
+// sendRequest sends a single request and returns the body and status code of
+// the response. The status is 0 if no response was received.
+func sendRequest(method string, url string, payload []byte, APIKEY string) ([]byte, int, error) {
+	// every API key has its own budget, don't waste requests on an exhausted one
+	err := checkRateLimit(APIKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	// create the request, err handling
-	req, err := http.NewRequest(method, url, payload)
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	createHeader(req, APIKEY)
 
+	// in a dry run only show what would change a device
+	if DryRun && !readOnly(method, url) {
+		traceRequest(DryRunOutput, req, payload)
+		return dryRunResponse, http.StatusOK, nil
+	}
+
+	if Trace != nil {
+		traceRequest(Trace, req, payload)
+	}
+
 	// make the request, err handling
-	res, err := http.DefaultClient.Do(req)
+	start := time.Now()
+	res, err := HTTPClient.Do(req)
 	if err != nil {
-		return nil, err
+		if Trace != nil {
+			traceError(Trace, err, time.Since(start))
+		}
+		return nil, 0, err
+	}
+
+	defer res.Body.Close()
+
+	// keep track of the remaining request budget, even for failed requests
+	recordRateLimit(APIKEY, res.Header)
+
+	// read body, also for failed requests so it can be traced
+	body, err := io.ReadAll(res.Body)
+	if Trace != nil {
+		traceResponse(Trace, res, body, time.Since(start))
 	}
 
 	// check if response is a 200
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
+		return nil, res.StatusCode, fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
 	}
 
-	// read body and return response as []byte
-	defer res.Body.Close()
-	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return nil, res.StatusCode, err
+	}
+	return body, res.StatusCode, nil
+}
+
+// ResolveDevices looks up device names in the devices.json registry, the same
+// way the control functions do.
+//
+// Parameters:
+//
+// - devices: The device names to look up.
+//
+// Returns:
+//
+// - []structs.Device: The registry entries of the names that were found.
+// - []string: The names that are not in the registry, commands skip them.
+// - error: An error if the registry could not be loaded.
+func ResolveDevices(devices []string) ([]structs.Device, []string, error) {
+	devicesJSON, err := utils.LoadFromJSON(utils.RegistryFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var found []structs.Device
+	var missing []string
+	for _, device := range devices {
+		matched := false
+		for _, deviceJSON := range devicesJSON.Data.Devices {
+			if device == deviceJSON.DeviceName {
+				found = append(found, deviceJSON)
+				matched = true
+			}
+		}
+		if !matched {
+			missing = append(missing, device)
+		}
 	}
-	return body, nil
+	return found, missing, nil
 }
 
 // ListDevices retrieves a list of devices using the provided API key.
@@ -96,7 +200,7 @@ func makeRequest(method string, url string, payload io.Reader, APIKEY string) ([
 // - error: An error if the API request fails.
 func ListDevices(APIKEY string) (structs.ListDevicesResponse, error) {
 	// instantiate vars needed for api request
-	url := "https://developer-api.govee.com/v1/devices"
+	url := BaseURL + "/v1/devices"
 	method := "GET"
 
 	// make request, error handling
@@ -129,7 +233,7 @@ func ListDevices(APIKEY string) (structs.ListDevicesResponse, error) {
 // - error: An error if the API request fails.
 func GetDeviceState(device string, model string, APIKEY string) (structs.DeviceStateResponse, error) {
 	// instantiate vars needed for api request
-	url := fmt.Sprintf("https://developer-api.govee.com/v1/devices/state?device=%s&model=%s", device, model)
+	url := fmt.Sprintf("%s/v1/devices/state?device=%s&model=%s", BaseURL, device, model)
 	method := "GET"
 
 	// make request, error handling
@@ -161,7 +265,7 @@ func GetDeviceState(device string, model string, APIKEY string) (structs.DeviceS
 // - error: An error object if there was a problem loading the devices or retrieving their states.
 func GetManyDeviceStates(devices []string, APIKEY string) ([]structs.DeviceStateResponse, error) {
 	// load a list of devices from a json file
-	devicesJSON, err := utils.LoadFromJSON("devices.json")
+	devicesJSON, err := utils.LoadFromJSON(utils.RegistryFile)
 	if err != nil {
 		return []structs.DeviceStateResponse{}, err
 	}
@@ -173,7 +277,7 @@ func GetManyDeviceStates(devices []string, APIKEY string) ([]structs.DeviceState
 	for _, device := range devices {
 		for _, deviceJSON := range devicesJSON.Data.Devices {
 			if device == deviceJSON.DeviceName {
-				deviceState, err := GetDeviceState(deviceJSON.Device, deviceJSON.Model, APIKEY)
+				deviceState, err := GetDeviceState(deviceJSON.Device, deviceJSON.Model, KeyFor(deviceJSON, APIKEY))
 
 				if err != nil {
 					return []structs.DeviceStateResponse{}, err
@@ -195,12 +299,12 @@ func GetManyDeviceStates(devices []string, APIKEY string) ([]structs.DeviceState
 //
 // The function returns a structs.ControlDeviceResponse and an error.
 func TurnDeviceOn(devices []string, apiKey string) (structs.ControlDeviceResponse, error) {
-	devicesJSON, err := utils.LoadFromJSON("devices.json")
+	devicesJSON, err := utils.LoadFromJSON(utils.RegistryFile)
 	if err != nil {
 		return structs.ControlDeviceResponse{}, err
 	}
 
-	url := "https://developer-api.govee.com/v1/devices/control"
+	url := BaseURL + "/v1/devices/control"
 	cmd := structs.Command{
 		Name:  "turn",
 		Value: "on",
@@ -215,7 +319,7 @@ func TurnDeviceOn(devices []string, apiKey string) (structs.ControlDeviceRespons
 				if err != nil {
 					return response, err
 				}
-				body, err := makeRequest("PUT", url, payload, apiKey)
+				body, err := makeRequest("PUT", url, payload, KeyFor(deviceJSON, apiKey))
 				if err != nil {
 					return response, err
 				}
@@ -232,12 +336,12 @@ func TurnDeviceOn(devices []string, apiKey string) (structs.ControlDeviceRespons
 }
 
 func TurnDeviceOff(devices []string, apiKey string) (structs.ControlDeviceResponse, error) {
-	devicesJSON, err := utils.LoadFromJSON("devices.json")
+	devicesJSON, err := utils.LoadFromJSON(utils.RegistryFile)
 	if err != nil {
 		return structs.ControlDeviceResponse{}, err
 	}
 
-	url := "https://developer-api.govee.com/v1/devices/control"
+	url := BaseURL + "/v1/devices/control"
 	cmd := structs.Command{
 		Name:  "turn",
 		Value: "off",
@@ -252,7 +356,7 @@ func TurnDeviceOff(devices []string, apiKey string) (structs.ControlDeviceRespon
 				if err != nil {
 					return response, err
 				}
-				body, err := makeRequest("PUT", url, payload, apiKey)
+				body, err := makeRequest("PUT", url, payload, KeyFor(deviceJSON, apiKey))
 				if err != nil {
 					return response, err
 				}
@@ -270,7 +374,7 @@ func TurnDeviceOff(devices []string, apiKey string) (structs.ControlDeviceRespon
 }
 
 func SetDeviceBrightness(devices []string, brightness int, apiKey string) (structs.ControlDeviceResponse, error) {
-	devicesJSON, err := utils.LoadFromJSON("devices.json")
+	devicesJSON, err := utils.LoadFromJSON(utils.RegistryFile)
 	if err != nil {
 		return structs.ControlDeviceResponse{}, err
 	}
@@ -280,7 +384,7 @@ func SetDeviceBrightness(devices []string, brightness int, apiKey string) (struc
 		return structs.ControlDeviceResponse{}, fmt.Errorf("brightness must be between 0-100")
 	}
 
-	url := "https://developer-api.govee.com/v1/devices/control"
+	url := BaseURL + "/v1/devices/control"
 	cmd := structs.Command{
 		Name:  "brightness",
 		Value: brightness,
@@ -295,7 +399,7 @@ func SetDeviceBrightness(devices []string, brightness int, apiKey string) (struc
 				if err != nil {
 					return response, err
 				}
-				body, err := makeRequest("PUT", url, payload, apiKey)
+				body, err := makeRequest("PUT", url, payload, KeyFor(deviceJSON, apiKey))
 				if err != nil {
 					return response, err
 				}
@@ -313,7 +417,7 @@ func SetDeviceBrightness(devices []string, brightness int, apiKey string) (struc
 }
 
 func SetDeviceRGB(devices []string, r int, g int, b int, apiKey string) (structs.ControlDeviceResponse, error) {
-	devicesJSON, err := utils.LoadFromJSON("devices.json")
+	devicesJSON, err := utils.LoadFromJSON(utils.RegistryFile)
 	if err != nil {
 		return structs.ControlDeviceResponse{}, err
 	}
@@ -323,7 +427,7 @@ func SetDeviceRGB(devices []string, r int, g int, b int, apiKey string) (structs
 		return structs.ControlDeviceResponse{}, fmt.Errorf("r, g, and b must be between 0 and 255")
 	}
 
-	url := "https://developer-api.govee.com/v1/devices/control"
+	url := BaseURL + "/v1/devices/control"
 	cmd := structs.Command{
 		Name: "color",
 		Value: struct {
@@ -348,7 +452,7 @@ func SetDeviceRGB(devices []string, r int, g int, b int, apiKey string) (structs
 				if err != nil {
 					return response, err
 				}
-				body, err := makeRequest("PUT", url, payload, apiKey)
+				body, err := makeRequest("PUT", url, payload, KeyFor(deviceJSON, apiKey))
 				if err != nil {
 					return response, err
 				}
@@ -366,7 +470,7 @@ func SetDeviceRGB(devices []string, r int, g int, b int, apiKey string) (structs
 }
 
 func SetDeviceColorTemp(devices []string, colorTemp int, apiKey string) (structs.ControlDeviceResponse, error) {
-	devicesJSON, err := utils.LoadFromJSON("devices.json")
+	devicesJSON, err := utils.LoadFromJSON(utils.RegistryFile)
 	if err != nil {
 		return structs.ControlDeviceResponse{}, err
 	}
@@ -376,7 +480,7 @@ func SetDeviceColorTemp(devices []string, colorTemp int, apiKey string) (structs
 		return structs.ControlDeviceResponse{}, fmt.Errorf("colorTemp must be between 2000-9000")
 	}
 
-	url := "https://developer-api.govee.com/v1/devices/control"
+	url := BaseURL + "/v1/devices/control"
 	cmd := structs.Command{
 		Name:  "colorTem",
 		Value: colorTemp,
@@ -391,7 +495,7 @@ func SetDeviceColorTemp(devices []string, colorTemp int, apiKey string) (structs
 				if err != nil {
 					return response, err
 				}
-				body, err := makeRequest("PUT", url, payload, apiKey)
+				body, err := makeRequest("PUT", url, payload, KeyFor(deviceJSON, apiKey))
 				if err != nil {
 					return response, err
 				}
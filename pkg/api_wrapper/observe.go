@@ -0,0 +1,80 @@
+package apiwrapper
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// getRetries is how many times a failed GET request is retried, and
+// retryDelay the wait before a retry.
+const (
+	getRetries = 1
+	retryDelay = 200 * time.Millisecond
+)
+
+// RequestInfo describes one attempt of a request to the Govee API.
+type RequestInfo struct {
+	Method string
+	// Endpoint is the path of the request, e.g. /v1/devices/control.
+	Endpoint string
+	// Device is the device id the request is about, empty when listing
+	// devices.
+	Device string
+	// Account is the registered account the API key belongs to, "default"
+	// for the key commands are called with.
+	Account string
+	// Status is the status code of the response, 0 if there was none.
+	Status   int
+	Duration time.Duration
+	// Attempt counts from 0, a retry has an Attempt above 0.
+	Attempt int
+	// RateLimited reports a request refused before it was sent because the
+	// budget of its key is exhausted.
+	RateLimited bool
+	Err         error
+}
+
+// Observer, if set, is called after every attempt of every request, e.g. to
+// collect metrics. It must not block.
+var Observer func(RequestInfo)
+
+func observe(method string, rawURL string, payload []byte, APIKEY string, status int, duration time.Duration, attempt int, err error) {
+	if Observer == nil {
+		return
+	}
+
+	info := RequestInfo{
+		Method:      method,
+		Account:     AccountName(APIKEY),
+		Status:      status,
+		Duration:    duration,
+		Attempt:     attempt,
+		RateLimited: errors.Is(err, ErrRateLimited),
+		Err:         err,
+	}
+	if u, parseErr := url.Parse(rawURL); parseErr == nil {
+		info.Endpoint = u.Path
+		info.Device = u.Query().Get("device")
+	}
+	if info.Device == "" && len(payload) > 0 {
+		var body struct {
+			Device string `json:"device"`
+		}
+		if json.Unmarshal(payload, &body) == nil {
+			info.Device = body.Device
+		}
+	}
+	Observer(info)
+}
+
+// retryable reports whether a failed attempt is worth retrying. Only GET
+// requests are, a command might have been applied before it failed.
+func retryable(method string, status int, err error) bool {
+	if err == nil || method != http.MethodGet || errors.Is(err, ErrRateLimited) {
+		return false
+	}
+	return status == 0 || status >= 500
+}
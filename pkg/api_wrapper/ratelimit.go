@@ -0,0 +1,111 @@
+package apiwrapper
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/structs"
+)
+
+// rateLimits holds the most recent rate-limit budget reported by the Govee API
+// for each API key.
+var (
+	rateLimitsMu sync.Mutex
+	rateLimits   = map[string]structs.RateLimit{}
+)
+
+// ErrRateLimited is returned instead of sending a request when the API key
+// has no budget left until the reported reset time.
+var ErrRateLimited = errors.New("rate limit budget exhausted")
+
+// checkRateLimit returns ErrRateLimited if the last response for the API key
+// reported an exhausted budget that has not been reset yet.
+func checkRateLimit(APIKEY string) error {
+	limit, ok := GetRateLimit(APIKEY)
+	if !ok || limit.Remaining > 0 || limit.Reset.IsZero() || time.Now().After(limit.Reset) {
+		return nil
+	}
+	return fmt.Errorf("%w until %s", ErrRateLimited, limit.Reset.Local().Format(time.Kitchen))
+}
+
+// recordRateLimit stores the rate-limit budget found in the response headers.
+//
+// The Govee API reports the daily account budget in the API-RateLimit-*
+// headers and the short term budget in the X-RateLimit-* headers. The daily
+// budget is preferred, the short term one is only used if it is missing.
+//
+// Parameters:
+// - APIKEY: The API key the request was made with.
+// - header: The headers of the response.
+func recordRateLimit(APIKEY string, header http.Header) {
+	limit, ok := parseRateLimit(header, "API-RateLimit-")
+	if !ok {
+		limit, ok = parseRateLimit(header, "X-RateLimit-")
+	}
+	if !ok {
+		return
+	}
+
+	rateLimitsMu.Lock()
+	defer rateLimitsMu.Unlock()
+	rateLimits[APIKEY] = limit
+}
+
+func parseRateLimit(header http.Header, prefix string) (structs.RateLimit, bool) {
+	remaining, err := strconv.Atoi(header.Get(prefix + "Remaining"))
+	if err != nil {
+		return structs.RateLimit{}, false
+	}
+
+	// limit and reset are informational, a missing value is left zeroed
+	limit, _ := strconv.Atoi(header.Get(prefix + "Limit"))
+	var reset time.Time
+	if unix, err := strconv.ParseInt(header.Get(prefix+"Reset"), 10, 64); err == nil {
+		reset = time.Unix(unix, 0)
+	}
+
+	return structs.RateLimit{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     reset,
+	}, true
+}
+
+// GetRateLimit returns the last rate-limit budget reported for an API key.
+//
+// Parameters:
+//
+// - APIKEY: The API key to look up.
+//
+// Returns:
+//
+// - structs.RateLimit: The last reported budget.
+// - bool: False if no request with this key has reported a budget yet.
+func GetRateLimit(APIKEY string) (structs.RateLimit, bool) {
+	rateLimitsMu.Lock()
+	defer rateLimitsMu.Unlock()
+	limit, ok := rateLimits[APIKEY]
+	return limit, ok
+}
+
+// ResetRateLimits forgets the budgets reported for the given API keys, or for
+// every key if none is given, so an exhausted budget doesn't outlive a test.
+//
+// Parameters:
+//
+// - keys: The API keys to forget, all of them if empty.
+func ResetRateLimits(keys ...string) {
+	rateLimitsMu.Lock()
+	defer rateLimitsMu.Unlock()
+	if len(keys) == 0 {
+		clear(rateLimits)
+		return
+	}
+	for _, key := range keys {
+		delete(rateLimits, key)
+	}
+}
@@ -0,0 +1,264 @@
+package apiwrapper
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// OpenAPIURL is the address of the v2 Govee API, which lists and sets the
+// light scenes and segments. It can be changed like BaseURL, or emptied where
+// there is no v2 API, e.g. when simulating.
+var OpenAPIURL = "https://openapi.api.govee.com"
+
+// ErrNoOpenAPI is returned for scenes and segments when OpenAPIURL is empty.
+var ErrNoOpenAPI = errors.New("scenes and segments need the v2 Govee API, which is not available here")
+
+// ErrNoScene is returned when no scene of a device matches a name.
+var ErrNoScene = errors.New("no matching scene")
+
+// sceneListPaths are the v2 endpoints listing the built-in and DIY scenes.
+// They are POST requests that change nothing, so they are sent in dry runs.
+var sceneListPaths = []string{"/router/api/v1/device/scenes", "/router/api/v1/device/diy-scenes"}
+
+// readOnly reports whether a request changes nothing on a device.
+func readOnly(method string, url string) bool {
+	if method == "GET" {
+		return true
+	}
+	for _, path := range sceneListPaths {
+		if strings.HasSuffix(url, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// v2Request sends a request to the v2 API and checks the code of its
+// response.
+func v2Request(path string, payload structs.V2Payload, APIKEY string) (structs.V2Response, error) {
+	if OpenAPIURL == "" {
+		return structs.V2Response{}, ErrNoOpenAPI
+	}
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return structs.V2Response{}, err
+	}
+	data, err := json.Marshal(structs.V2Request{RequestID: hex.EncodeToString(id), Payload: payload})
+	if err != nil {
+		return structs.V2Response{}, err
+	}
+
+	body, err := makeRequest("POST", OpenAPIURL+path, bytes.NewReader(data), APIKEY)
+	if err != nil {
+		return structs.V2Response{}, err
+	}
+	var response structs.V2Response
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return structs.V2Response{}, err
+	}
+	if response.Code != 200 {
+		return response, fmt.Errorf("%d %s", response.Code, response.Message)
+	}
+	return response, nil
+}
+
+// ListDeviceScenes lists the built-in light scenes and the DIY scenes of a
+// device with the v2 API.
+//
+// Parameters:
+// - device: The registry entry of the device.
+// - APIKEY: The API key used when the device has no account.
+//
+// Returns:
+// - []structs.LightScene: The scenes, built-in scenes first.
+// - error: An error if either listing fails.
+func ListDeviceScenes(device structs.Device, APIKEY string) ([]structs.LightScene, error) {
+	var scenes []structs.LightScene
+	for _, path := range sceneListPaths {
+		response, err := v2Request(path, structs.V2Payload{SKU: device.Model, Device: device.Device}, KeyFor(device, APIKEY))
+		if err != nil {
+			return nil, err
+		}
+		for _, capability := range response.Payload.Capabilities {
+			if capability.Parameters == nil {
+				continue
+			}
+			for _, option := range capability.Parameters.Options {
+				scenes = append(scenes, structs.LightScene{
+					Name:     option.Name,
+					Type:     capability.Type,
+					Instance: capability.Instance,
+					Value:    option.Value,
+				})
+			}
+		}
+	}
+	return scenes, nil
+}
+
+// DeviceScenes returns the scenes of a device from the devices.json registry,
+// listing them and caching them there the first time or when refresh is set.
+//
+// Parameters:
+// - name: The name of the device, as found in devices.json.
+// - APIKEY: The API key used when the device has no account.
+// - refresh: List the scenes again even if they are cached.
+//
+// Returns:
+// - []structs.LightScene: The scenes of the device.
+// - error: An error if the device is unknown or the scenes can't be listed.
+func DeviceScenes(name string, APIKEY string, refresh bool) ([]structs.LightScene, error) {
+	registry, err := utils.LoadFromJSON(utils.RegistryFile)
+	if err != nil {
+		return nil, err
+	}
+	for i, device := range registry.Data.Devices {
+		if device.DeviceName != name {
+			continue
+		}
+		if len(device.Scenes) > 0 && !refresh {
+			return device.Scenes, nil
+		}
+		scenes, err := ListDeviceScenes(device, APIKEY)
+		if err != nil {
+			return nil, err
+		}
+		registry.Data.Devices[i].Scenes = scenes
+		utils.SaveToJSON(registry)
+		return scenes, nil
+	}
+	return nil, fmt.Errorf("%s is not in devices.json", name)
+}
+
+// SetLightScene switches a device to one of its scenes.
+//
+// Parameters:
+// - device: The registry entry of the device.
+// - scene: The scene, as listed by ListDeviceScenes.
+// - apiKey: The API key used when the device has no account.
+//
+// Returns:
+// - structs.V2Response: The response of the v2 API.
+// - error: An error if the request fails or is rejected.
+func SetLightScene(device structs.Device, scene structs.LightScene, apiKey string) (structs.V2Response, error) {
+	capability := structs.V2Capability{Type: scene.Type, Instance: scene.Instance, Value: scene.Value}
+	return v2Request("/router/api/v1/device/control", structs.V2Payload{SKU: device.Model, Device: device.Device, Capability: &capability}, KeyFor(device, apiKey))
+}
+
+// normalizeScene lowercases a scene name and drops everything but letters
+// and digits, so "Candle-light" matches "candlelight".
+func normalizeScene(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// MatchScene finds the scene a name refers to, ignoring case, spaces and
+// punctuation. An exact match wins, then a single scene starting with or
+// containing the name, then the single closest name within a few typos.
+//
+// Parameters:
+// - scenes: The scenes of a device.
+// - name: The name typed by the user.
+//
+// Returns:
+// - structs.LightScene: The matching scene.
+// - error: ErrNoScene, naming the closest scenes or the ambiguous ones.
+func MatchScene(scenes []structs.LightScene, name string) (structs.LightScene, error) {
+	query := normalizeScene(name)
+	if query == "" {
+		return structs.LightScene{}, fmt.Errorf("%w: the name is empty", ErrNoScene)
+	}
+	for _, scene := range scenes {
+		if normalizeScene(scene.Name) == query {
+			return scene, nil
+		}
+	}
+
+	matchers := []func(string) bool{
+		func(candidate string) bool { return strings.HasPrefix(candidate, query) },
+		func(candidate string) bool { return strings.Contains(candidate, query) },
+	}
+	for _, matches := range matchers {
+		var found []structs.LightScene
+		for _, scene := range scenes {
+			if matches(normalizeScene(scene.Name)) {
+				found = append(found, scene)
+			}
+		}
+		if len(found) == 1 {
+			return found[0], nil
+		}
+		if len(found) > 1 {
+			return structs.LightScene{}, fmt.Errorf("%w: %q could be %s", ErrNoScene, name, sceneNames(found, 5))
+		}
+	}
+
+	// typos, the closest name within a quarter of the length
+	ranked := make([]structs.LightScene, len(scenes))
+	copy(ranked, scenes)
+	distances := map[string]int{}
+	for _, scene := range ranked {
+		distances[scene.Name] = levenshtein(query, normalizeScene(scene.Name))
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return distances[ranked[i].Name] < distances[ranked[j].Name] })
+	limit := max(1, len(query)/4)
+	if len(ranked) > 0 && distances[ranked[0].Name] <= limit && (len(ranked) == 1 || distances[ranked[1].Name] > distances[ranked[0].Name]) {
+		return ranked[0], nil
+	}
+	if len(ranked) == 0 {
+		return structs.LightScene{}, fmt.Errorf("%w: the device has no scenes", ErrNoScene)
+	}
+	return structs.LightScene{}, fmt.Errorf("%w for %q, did you mean %s?", ErrNoScene, name, sceneNames(ranked, 3))
+}
+
+// sceneNames lists up to n scene names for an error message.
+func sceneNames(scenes []structs.LightScene, n int) string {
+	var names []string
+	for i, scene := range scenes {
+		if i == n {
+			names = append(names, "...")
+			break
+		}
+		names = append(names, fmt.Sprintf("%q", scene.Name))
+	}
+	return strings.Join(names, ", ")
+}
+
+// levenshtein returns the edit distance between two strings.
+func levenshtein(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current := make([]int, len(rb)+1)
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(rb)]
+}
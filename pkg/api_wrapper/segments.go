@@ -0,0 +1,143 @@
+package apiwrapper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// segmentType is the v2 capability setting the color and brightness of
+// segments.
+const segmentType = "devices.capabilities.segment_color_setting"
+
+// ErrNoSegments is returned for devices whose segments can't be set.
+var ErrNoSegments = errors.New("no segments")
+
+// ListV2Devices lists the devices of a key with their v2 capabilities.
+//
+// Parameters:
+// - APIKEY: The API key used to authenticate the request.
+//
+// Returns:
+// - structs.V2DevicesResponse: The devices and their capabilities.
+// - error: An error if the API request fails.
+func ListV2Devices(APIKEY string) (structs.V2DevicesResponse, error) {
+	if OpenAPIURL == "" {
+		return structs.V2DevicesResponse{}, ErrNoOpenAPI
+	}
+	body, err := makeRequest("GET", OpenAPIURL+"/router/api/v1/user/devices", nil, APIKEY)
+	if err != nil {
+		return structs.V2DevicesResponse{}, err
+	}
+	var response structs.V2DevicesResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return structs.V2DevicesResponse{}, err
+	}
+	if response.Code != 200 {
+		return response, fmt.Errorf("%d %s", response.Code, response.Message)
+	}
+	return response, nil
+}
+
+// SegmentCount returns the number of segments a device has according to its
+// capabilities, 0 if its segments can't be set.
+func SegmentCount(capabilities []structs.V2Capability) int {
+	for _, capability := range capabilities {
+		if capability.Type != segmentType || capability.Instance != "segmentedColorRgb" || capability.Parameters == nil {
+			continue
+		}
+		for _, field := range capability.Parameters.Fields {
+			if field.FieldName == "segment" && field.ElementRange != nil {
+				return field.ElementRange.Max + 1
+			}
+		}
+	}
+	return 0
+}
+
+// DeviceSegments returns the number of segments of a device from the
+// devices.json registry, discovering it from the v2 capabilities and caching
+// it there the first time or when refresh is set.
+//
+// Parameters:
+// - name: The name of the device, as found in devices.json.
+// - APIKEY: The API key used when the device has no account.
+// - refresh: Discover the segments again even if they are cached.
+//
+// Returns:
+// - int: The number of segments.
+// - error: An error if the device is unknown or has no segments.
+func DeviceSegments(name string, APIKEY string, refresh bool) (int, error) {
+	registry, err := utils.LoadFromJSON(utils.RegistryFile)
+	if err != nil {
+		return 0, err
+	}
+	for i, device := range registry.Data.Devices {
+		if device.DeviceName != name {
+			continue
+		}
+		if device.Segments > 0 && !refresh {
+			return device.Segments, nil
+		}
+		response, err := ListV2Devices(KeyFor(device, APIKEY))
+		if err != nil {
+			return 0, err
+		}
+		count := 0
+		for _, listed := range response.Data {
+			if listed.Device == device.Device {
+				count = SegmentCount(listed.Capabilities)
+			}
+		}
+		if count == 0 {
+			return 0, fmt.Errorf("%s (%s) has %w", name, device.Model, ErrNoSegments)
+		}
+		registry.Data.Devices[i].Segments = count
+		utils.SaveToJSON(registry)
+		return count, nil
+	}
+	return 0, fmt.Errorf("%s is not in devices.json", name)
+}
+
+// SetSegmentColor paints segments of a device one color.
+//
+// Parameters:
+// - device: The registry entry of the device.
+// - segments: The indexes of the segments, from 0.
+// - color: The color.
+// - apiKey: The API key used when the device has no account.
+//
+// Returns:
+// - structs.V2Response: The response of the v2 API.
+// - error: An error if the values are out of range or the request fails.
+func SetSegmentColor(device structs.Device, segments []int, color structs.Color, apiKey string) (structs.V2Response, error) {
+	if color.R > 255 || color.R < 0 || color.G > 255 || color.G < 0 || color.B > 255 || color.B < 0 {
+		return structs.V2Response{}, fmt.Errorf("r, g, and b must be between 0 and 255")
+	}
+	rgb := color.R<<16 | color.G<<8 | color.B
+	capability := structs.V2Capability{Type: segmentType, Instance: "segmentedColorRgb", Value: map[string]any{"segment": segments, "rgb": rgb}}
+	return v2Request("/router/api/v1/device/control", structs.V2Payload{SKU: device.Model, Device: device.Device, Capability: &capability}, KeyFor(device, apiKey))
+}
+
+// SetSegmentBrightness sets the brightness of segments of a device.
+//
+// Parameters:
+// - device: The registry entry of the device.
+// - segments: The indexes of the segments, from 0.
+// - brightness: The brightness, between 0-100.
+// - apiKey: The API key used when the device has no account.
+//
+// Returns:
+// - structs.V2Response: The response of the v2 API.
+// - error: An error if the values are out of range or the request fails.
+func SetSegmentBrightness(device structs.Device, segments []int, brightness int, apiKey string) (structs.V2Response, error) {
+	if brightness < 0 || brightness > 100 {
+		return structs.V2Response{}, fmt.Errorf("brightness must be between 0-100")
+	}
+	capability := structs.V2Capability{Type: segmentType, Instance: "segmentedBrightness", Value: map[string]any{"segment": segments, "brightness": brightness}}
+	return v2Request("/router/api/v1/device/control", structs.V2Payload{SKU: device.Model, Device: device.Device, Capability: &capability}, KeyFor(device, apiKey))
+}
@@ -0,0 +1,70 @@
+package apiwrapper
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/redact"
+)
+
+// Trace, if set, receives a description of every request sent and every
+// response received: method, URL, headers, payload, status, latency and body.
+// The API key is redacted.
+var Trace io.Writer
+
+// DryRun stops requests that would change a device from being sent. They are
+// written to DryRunOutput instead and answered with a successful response.
+// Read-only requests such as listing devices are still sent.
+var DryRun bool
+
+// DryRunOutput receives the requests skipped because of DryRun.
+var DryRunOutput io.Writer = os.Stdout
+
+// dryRunResponse is returned for every request skipped because of DryRun.
+var dryRunResponse = []byte(`{"code":200,"message":"dry run, request not sent","data":{}}`)
+
+// traceRequest writes a request and its payload to w.
+func traceRequest(w io.Writer, req *http.Request, payload []byte) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--> %s %s\n", req.Method, req.URL)
+	writeHeaders(&b, req.Header)
+	if len(payload) > 0 {
+		fmt.Fprintf(&b, "    %s\n", strings.TrimSpace(redact.String(string(payload))))
+	}
+	io.WriteString(w, b.String())
+}
+
+// traceResponse writes a response, its body and the time it took to w.
+func traceResponse(w io.Writer, res *http.Response, body []byte, latency time.Duration) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<-- %s (%s)\n", res.Status, latency.Round(time.Millisecond))
+	writeHeaders(&b, res.Header)
+	if len(body) > 0 {
+		fmt.Fprintf(&b, "    %s\n", strings.TrimSpace(redact.String(string(body))))
+	}
+	io.WriteString(w, b.String())
+}
+
+// traceError writes a request that failed without a response to w.
+func traceError(w io.Writer, err error, latency time.Duration) {
+	fmt.Fprintf(w, "<-- error: %s (%s)\n", redact.String(err.Error()), latency.Round(time.Millisecond))
+}
+
+func writeHeaders(b *strings.Builder, header http.Header) {
+	header = redact.Header(header)
+
+	var names []string
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(b, "    %s: %s\n", name, strings.Join(header[name], ", "))
+	}
+}
@@ -0,0 +1,295 @@
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/seanpden/govee_controller/pkg/redact"
+)
+
+// ErrNoInteraction is returned by a Replayer for a request that was not
+// recorded.
+var ErrNoInteraction = errors.New("no recorded interaction")
+
+// Cassette is a list of recorded requests and their responses, saved as a
+// JSON fixture file.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a request and its response. API keys and device ids are
+// scrubbed from both.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method string `json:"method"`
+	// URL is the path and query of the request, the host is left out so a
+	// cassette replays against any base URL.
+	URL  string `json:"url"`
+	Body string `json:"body,omitempty"`
+}
+
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body"`
+}
+
+// keptHeaders are the response headers recorded, the others are dropped.
+var keptHeaders = []string{"Content-Type", "API-RateLimit-Limit", "API-RateLimit-Remaining", "API-RateLimit-Reset", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"}
+
+// deviceID matches the 8 byte device ids of the Govee API and 6 byte MAC
+// addresses, also when their colons are escaped in a URL.
+var deviceID = regexp.MustCompile(`(?i)\b[0-9a-f]{2}(?:(?::|%3a)[0-9a-f]{2}){5}(?:(?::|%3a)[0-9a-f]{2}){0,2}\b`)
+
+// placeholderPrefix starts every scrubbed device id, ids starting with it are
+// left alone so scrubbing twice changes nothing.
+const placeholderPrefix = "00:00:00:00"
+
+// Load reads a cassette from a fixture file.
+func Load(path string) (Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Cassette{}, err
+	}
+	var cassette Cassette
+	err = json.Unmarshal(data, &cassette)
+	if err != nil {
+		return Cassette{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return cassette, nil
+}
+
+// Save writes a cassette to a fixture file, creating its directory.
+func (c Cassette) Save(path string) error {
+	// keep & and < readable in the URLs and bodies
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(c)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, data.Bytes(), 0644)
+}
+
+// Recorder is an http.RoundTripper sending requests with Transport and
+// saving every request and response it sees to a cassette file, e.g. with
+// apiwrapper.HTTPClient.Transport = cassette.NewRecorder(path, nil).
+type Recorder struct {
+	path      string
+	transport http.RoundTripper
+
+	mu       sync.Mutex
+	cassette Cassette
+	ids      map[string]string
+}
+
+// NewRecorder returns a recorder writing to path, which is replaced. A nil
+// transport sends with http.DefaultTransport.
+func NewRecorder(path string, transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{path: path, transport: transport, ids: map[string]string{}}
+}
+
+// RoundTrip sends the request and records it with its response. The
+// cassette is saved after every interaction, so nothing is lost if the
+// program exits early. Requests that get no response are not recorded.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resBody, err := readBody(&res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	for _, name := range keptHeaders {
+		if values := res.Header.Values(name); len(values) > 0 {
+			header[name] = values
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, Interaction{
+		Request: Request{
+			Method: req.Method,
+			URL:    r.scrub(req.URL.RequestURI()),
+			Body:   r.scrub(string(body)),
+		},
+		Response: Response{
+			Status: res.StatusCode,
+			Header: header,
+			Body:   r.scrub(string(resBody)),
+		},
+	})
+	err = r.cassette.Save(r.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not save the cassette: %w", err)
+	}
+	return res, nil
+}
+
+// scrub removes the registered secrets and replaces every device id with a
+// placeholder, the same id always getting the same placeholder.
+func (r *Recorder) scrub(s string) string {
+	s = redact.String(s)
+	return deviceID.ReplaceAllStringFunc(s, func(match string) string {
+		separator := ":"
+		if strings.Contains(strings.ToLower(match), "%3a") {
+			separator = "%3A"
+		}
+		id := strings.ToUpper(strings.ReplaceAll(strings.ReplaceAll(match, "%3A", ":"), "%3a", ":"))
+		if strings.HasPrefix(id, placeholderPrefix) {
+			return match
+		}
+		placeholder, ok := r.ids[id]
+		if !ok {
+			// keep the length, 6 byte MACs stay 6 bytes
+			octets := strings.Count(id, ":") + 1
+			n := len(r.ids) + 1
+			parts := make([]string, octets)
+			for i := range parts {
+				parts[i] = "00"
+			}
+			parts[octets-2] = fmt.Sprintf("%02X", n>>8&0xff)
+			parts[octets-1] = fmt.Sprintf("%02X", n&0xff)
+			placeholder = strings.Join(parts, ":")
+			r.ids[id] = placeholder
+		}
+		return strings.ReplaceAll(placeholder, ":", separator)
+	})
+}
+
+// Replayer is an http.RoundTripper serving the responses of a cassette
+// instead of sending requests, e.g. with
+// apiwrapper.HTTPClient.Transport = cassette.NewReplayer(c).
+type Replayer struct {
+	mu       sync.Mutex
+	cassette Cassette
+	used     []bool
+}
+
+// NewReplayer returns a replayer serving the interactions of a cassette.
+func NewReplayer(cassette Cassette) *Replayer {
+	return &Replayer{cassette: cassette, used: make([]bool, len(cassette.Interactions))}
+}
+
+// RoundTrip answers a request with the first unused recorded interaction
+// with the same method, path, query and body. Once every matching
+// interaction has been used, the last one is served again, so a replay may
+// poll more often than the recording did. The host is ignored, and so is the
+// random requestId of v2 requests.
+func (p *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	uri := req.URL.RequestURI()
+	normalized := normalizeBody(string(body))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	last := -1
+	for i, interaction := range p.cassette.Interactions {
+		if interaction.Request.Method != req.Method || interaction.Request.URL != uri || normalizeBody(interaction.Request.Body) != normalized {
+			continue
+		}
+		last = i
+		if !p.used[i] {
+			break
+		}
+	}
+	if last < 0 {
+		return nil, fmt.Errorf("%w for %s %s", ErrNoInteraction, req.Method, uri)
+	}
+	p.used[last] = true
+
+	recorded := p.cassette.Interactions[last].Response
+	header := recorded.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(recorded.Body)),
+		ContentLength: int64(len(recorded.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Unused returns the interactions that were never replayed, a regression
+// test can check it to make sure every recorded request is still sent.
+func (p *Replayer) Unused() []Interaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var unused []Interaction
+	for i, used := range p.used {
+		if !used {
+			unused = append(unused, p.cassette.Interactions[i])
+		}
+	}
+	return unused
+}
+
+// readBody reads a request or response body and replaces it with a copy, so
+// it can still be read.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	data, err := io.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return nil, err
+	}
+	*body = io.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+// normalizeBody re-encodes a JSON body so formatting and key order don't
+// matter, and drops the requestId of v2 requests.
+func normalizeBody(body string) string {
+	var value any
+	if json.Unmarshal([]byte(body), &value) != nil {
+		return strings.TrimSpace(body)
+	}
+	if object, ok := value.(map[string]any); ok {
+		delete(object, "requestId")
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
@@ -0,0 +1,344 @@
+package circadian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/poller"
+	"github.com/seanpden/govee_controller/pkg/solar"
+	"github.com/seanpden/govee_controller/pkg/structs"
+)
+
+// Curve maps the time of day to a color temperature and a brightness: the
+// minimum at night, rising after sunrise to the maximum at midday and falling
+// back until sunset.
+type Curve struct {
+	MinKelvin     int
+	MaxKelvin     int
+	MinBrightness int
+	MaxBrightness int
+	// At, if set, places the day between the actual sunrise and sunset.
+	At *solar.Coordinates
+	// Sunrise and Sunset are the times since midnight used without At, or
+	// when the sun doesn't rise or set that day.
+	Sunrise time.Duration
+	Sunset  time.Duration
+}
+
+// DefaultCurve returns a curve from 2200K at 10% at night to 6500K at 100%
+// at midday, with the day from 7:00 to 19:00.
+func DefaultCurve() Curve {
+	return Curve{
+		MinKelvin:     2200,
+		MaxKelvin:     6500,
+		MinBrightness: 10,
+		MaxBrightness: 100,
+		Sunrise:       7 * time.Hour,
+		Sunset:        19 * time.Hour,
+	}
+}
+
+// Validate checks the ranges of the curve.
+func (c Curve) Validate() error {
+	if c.MinKelvin < 2000 || c.MaxKelvin > 9000 || c.MinKelvin > c.MaxKelvin {
+		return fmt.Errorf("color temperature must be a range within 2000-9000, got %d-%d", c.MinKelvin, c.MaxKelvin)
+	}
+	if c.MinBrightness < 1 || c.MaxBrightness > 100 || c.MinBrightness > c.MaxBrightness {
+		return fmt.Errorf("brightness must be a range within 1-100, got %d-%d", c.MinBrightness, c.MaxBrightness)
+	}
+	if c.Sunrise >= c.Sunset || c.Sunset > 24*time.Hour {
+		return errors.New("sunrise must come before sunset")
+	}
+	return nil
+}
+
+// day returns the sunrise and sunset of the day of t.
+func (c Curve) day(t time.Time) (time.Time, time.Time) {
+	year, month, day := t.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	rise, set := midnight.Add(c.Sunrise), midnight.Add(c.Sunset)
+	if c.At != nil {
+		solarRise, okRise := solar.Sunrise.Time(t, *c.At)
+		solarSet, okSet := solar.Sunset.Time(t, *c.At)
+		if okRise && okSet && solarRise.Before(solarSet) {
+			rise, set = solarRise, solarSet
+		}
+	}
+	return rise, set
+}
+
+// Level returns the position of t on the curve, 0 at night and 1 at midday.
+func (c Curve) Level(t time.Time) float64 {
+	rise, set := c.day(t)
+	if t.Before(rise) || !t.Before(set) {
+		return 0
+	}
+	progress := float64(t.Sub(rise)) / float64(set.Sub(rise))
+	return math.Sin(math.Pi * progress)
+}
+
+// Target returns the color temperature and brightness for t.
+func (c Curve) Target(t time.Time) (int, int) {
+	level := c.Level(t)
+	kelvin := c.MinKelvin + int(math.Round(level*float64(c.MaxKelvin-c.MinKelvin)))
+	brightness := c.MinBrightness + int(math.Round(level*float64(c.MaxBrightness-c.MinBrightness)))
+	return kelvin, brightness
+}
+
+// Update is what a step did for one device.
+type Update struct {
+	Device     string
+	Kelvin     int
+	Brightness int
+	// Sent is true when a command was sent, Skipped says why not.
+	Sent    bool
+	Skipped string
+	Err     error
+}
+
+// Reasons a device is skipped.
+const (
+	SkippedOff       = "off"
+	SkippedPaused    = "paused"
+	SkippedManual    = "manual change"
+	SkippedUnchanged = "unchanged"
+)
+
+// deviceState is what the mode remembers about a device.
+type deviceState struct {
+	sent        bool
+	kelvin      int
+	brightness  int
+	pausedUntil time.Time
+}
+
+// Mode keeps devices on a curve. Every interval it reads the state of each
+// device and, when the device is on, sends the color temperature and
+// brightness of the curve if they moved by at least a step.
+//
+// A device whose state no longer matches what was last sent was changed by
+// hand: it is left alone for PauseFor, or until it is turned off and on
+// again.
+type Mode struct {
+	// APIKEY is used for devices without an account.
+	APIKEY  string
+	Devices []string
+	Curve   Curve
+	// Interval is the shortest time between two steps, it grows when the
+	// budget of a key can't afford it.
+	Interval time.Duration
+	// KelvinStep and BrightnessStep are the smallest changes sent.
+	KelvinStep     int
+	BrightnessStep int
+	PauseFor       time.Duration
+	// Quota and Reserve bound the requests like the poller's.
+	Quota   int
+	Reserve float64
+	// Handler, if set, is called with the update of every device.
+	Handler func(Update)
+
+	devices map[string]*deviceState
+}
+
+// New returns a mode for devices following the default curve.
+func New(APIKEY string, devices []string) *Mode {
+	return &Mode{
+		APIKEY:         APIKEY,
+		Devices:        devices,
+		Curve:          DefaultCurve(),
+		Interval:       5 * time.Minute,
+		KelvinStep:     100,
+		BrightnessStep: 3,
+		PauseFor:       2 * time.Hour,
+		Quota:          poller.DefaultQuota,
+		Reserve:        0.25,
+		devices:        map[string]*deviceState{},
+	}
+}
+
+// Run steps until ctx is cancelled.
+func (m *Mode) Run(ctx context.Context) error {
+	err := m.Curve.Validate()
+	if err != nil {
+		return err
+	}
+	for {
+		wait := m.nextInterval()
+		m.Step(time.Now())
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// nextInterval returns Interval, or longer if a key's budget requires it.
+// Each device costs a state request and up to two commands per step.
+func (m *Mode) nextInterval() time.Duration {
+	interval := m.Interval
+	registry, _, err := apiwrapper.ResolveDevices(m.Devices)
+	if err != nil {
+		return interval
+	}
+	perKey := map[string]int{}
+	for _, device := range registry {
+		perKey[apiwrapper.KeyFor(device, m.APIKEY)] += 3
+	}
+	for key, requests := range perKey {
+		interval = max(interval, poller.BudgetInterval(key, requests, m.Quota, m.Reserve, time.Now()))
+	}
+	return interval
+}
+
+// Step moves every device towards the curve at now.
+func (m *Mode) Step(now time.Time) []Update {
+	if m.devices == nil {
+		m.devices = map[string]*deviceState{}
+	}
+	kelvin, brightness := m.Curve.Target(now)
+
+	found, missing, err := apiwrapper.ResolveDevices(m.Devices)
+	var updates []Update
+	if err != nil {
+		return m.report(append(updates, Update{Err: err}))
+	}
+	for _, name := range missing {
+		updates = append(updates, Update{Device: name, Err: errors.New("not in devices.json")})
+	}
+	for _, device := range found {
+		updates = append(updates, m.stepDevice(device, kelvin, brightness, now))
+	}
+	return m.report(updates)
+}
+
+func (m *Mode) report(updates []Update) []Update {
+	if m.Handler != nil {
+		for _, update := range updates {
+			m.Handler(update)
+		}
+	}
+	return updates
+}
+
+func (m *Mode) stepDevice(device structs.Device, kelvin int, brightness int, now time.Time) Update {
+	name := device.DeviceName
+	kelvin = clampKelvin(device, kelvin)
+	update := Update{Device: name, Kelvin: kelvin, Brightness: brightness}
+
+	d, ok := m.devices[name]
+	if !ok {
+		d = &deviceState{}
+		m.devices[name] = d
+	}
+
+	key := apiwrapper.KeyFor(device, m.APIKEY)
+	response, err := apiwrapper.GetDeviceState(device.Device, device.Model, key)
+	if err == nil && response.Code != 200 {
+		err = fmt.Errorf("%d %s", response.Code, response.Message)
+	}
+	if err != nil {
+		update.Err = err
+		return update
+	}
+	state := poller.Merge(response.Data.Properties)
+
+	if state.Power != "on" {
+		// turning the device off and on again resumes the curve
+		*d = deviceState{}
+		update.Skipped = SkippedOff
+		return update
+	}
+	if now.Before(d.pausedUntil) {
+		update.Skipped = SkippedPaused
+		return update
+	}
+	if !d.pausedUntil.IsZero() {
+		*d = deviceState{}
+	}
+	if d.sent && changedByHand(*d, state) {
+		d.pausedUntil = now.Add(m.PauseFor)
+		update.Skipped = SkippedManual
+		return update
+	}
+
+	sendKelvin := !d.sent || abs(kelvin-d.kelvin) >= m.KelvinStep
+	sendBrightness := !d.sent || abs(brightness-d.brightness) >= m.BrightnessStep
+	if !sendKelvin && !sendBrightness {
+		update.Skipped = SkippedUnchanged
+		return update
+	}
+
+	var target control.State
+	if sendKelvin {
+		target.ColorTem = &kelvin
+		d.kelvin = kelvin
+	}
+	if sendBrightness {
+		target.Brightness = &brightness
+		d.brightness = brightness
+	}
+	d.sent = true
+	update.Sent = true
+	update.Err = control.Apply([]string{name}, target, m.APIKEY)
+	return update
+}
+
+// changedByHand reports whether the state differs from what was last sent.
+// Devices report 0 for the color temperature while showing a color.
+func changedByHand(d deviceState, state poller.State) bool {
+	if state.Brightness != 0 && abs(state.Brightness-d.brightness) > 1 {
+		return true
+	}
+	if state.ColorTem != 0 && abs(state.ColorTem-d.kelvin) > 50 {
+		return true
+	}
+	return state.ColorTem == 0 && state.Color != nil && (state.Color.R != 0 || state.Color.G != 0 || state.Color.B != 0)
+}
+
+// clampKelvin keeps a color temperature within the range of a device.
+func clampKelvin(device structs.Device, kelvin int) int {
+	limits := device.Properties.ColorTem.Range
+	if limits.Min != 0 && kelvin < limits.Min {
+		kelvin = limits.Min
+	}
+	if limits.Max != 0 && kelvin > limits.Max {
+		kelvin = limits.Max
+	}
+	return kelvin
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Preview returns the targets of the curve every step from midnight of the
+// day of t, for showing the curve.
+func (c Curve) Preview(t time.Time, step time.Duration) []Target {
+	year, month, day := t.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	var targets []Target
+	for at := midnight; at.Day() == day; at = at.Add(step) {
+		kelvin, brightness := c.Target(at)
+		targets = append(targets, Target{Time: at, Kelvin: kelvin, Brightness: brightness})
+	}
+	return targets
+}
+
+// Target is a point of the curve.
+type Target struct {
+	Time       time.Time
+	Kelvin     int
+	Brightness int
+}
@@ -0,0 +1,218 @@
+package clihandler
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/config"
+	"github.com/seanpden/govee_controller/pkg/credentials"
+	"github.com/seanpden/govee_controller/pkg/redact"
+	"golang.org/x/term"
+)
+
+// credentialName is the name the API key of a profile is stored under.
+func credentialName(profile string) string {
+	if profile == "" {
+		return "default"
+	}
+	return profile
+}
+
+// stdin is shared by every prompt, a reader per prompt would buffer the
+// lines meant for the next ones when the input is piped.
+var stdin = bufio.NewReader(os.Stdin)
+
+// readSecret reads a line without echoing it when stdin is a terminal.
+func readSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		secret, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimSpace(string(secret)), err
+	}
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// openStore returns the credential store, asking for the passphrase if the
+// store is passphrase protected and $GOVEE_PASSPHRASE is not set.
+func openStore() (credentials.Store, error) {
+	store := credentials.DefaultStore()
+	if store.Passphrase != "" {
+		return store, nil
+	}
+
+	kdf, err := store.KDF()
+	if err != nil {
+		return store, err
+	}
+	if kdf == credentials.KDFScrypt {
+		store.Passphrase, err = readSecret("Credential store passphrase: ")
+		if err != nil {
+			return store, err
+		}
+	}
+	return store, nil
+}
+
+// storedAPIKey returns the API key stored under name, or an empty string if
+// there is none.
+func storedAPIKey(name string) (string, error) {
+	if !credentials.DefaultStore().Exists() {
+		return "", nil
+	}
+	store, err := openStore()
+	if err != nil {
+		return "", err
+	}
+	key, _, err := store.Get(name)
+	return key, err
+}
+
+// validateAPIKey checks a key by listing the devices of its account.
+func validateAPIKey(APIKEY string) (int, error) {
+	data, err := apiwrapper.ListDevices(APIKEY)
+	if err != nil {
+		return 0, err
+	}
+	if data.Code != 200 {
+		return 0, fmt.Errorf("%d %s", data.Code, data.Message)
+	}
+	return len(data.Data.Devices), nil
+}
+
+func handleAuth(args []string, cfg config.Config, profile string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: auth login|logout|status")
+		return
+	}
+	name := credentialName(profile)
+
+	switch args[0] {
+	case "login":
+		flags := flag.NewFlagSet("auth login", flag.ContinueOnError)
+		usePassphrase := flags.Bool("passphrase", false, "protect the credential store with a passphrase instead of a key file")
+		err := flags.Parse(args[1:])
+		if err != nil {
+			return
+		}
+		handleAuthLogin(name, *usePassphrase)
+
+	case "logout":
+		store, err := openStore()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		removed, err := store.Delete(name)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if !removed {
+			fmt.Printf("No API key stored for %s\n", name)
+			return
+		}
+		fmt.Printf("Removed the API key of %s\n", name)
+
+	case "status":
+		handleAuthStatus(name, cfg)
+
+	default:
+		fmt.Println("Usage: auth login|logout|status")
+	}
+	return
+}
+
+func handleAuthLogin(name string, usePassphrase bool) {
+	APIKEY, err := readSecret("Govee API key: ")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if APIKEY == "" {
+		fmt.Println("No API key given")
+		return
+	}
+	redact.Register(APIKEY)
+
+	count, err := validateAPIKey(APIKEY)
+	if err != nil {
+		fmt.Println("The API key was rejected:", err)
+		return
+	}
+
+	store, err := openStore()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if usePassphrase && store.Passphrase == "" {
+		passphrase, err := readSecret("New passphrase: ")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		confirm, err := readSecret("Repeat passphrase: ")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if passphrase == "" || passphrase != confirm {
+			fmt.Println(errors.New("passphrases are empty or do not match"))
+			return
+		}
+		store.Passphrase = passphrase
+	}
+
+	err = store.Set(name, APIKEY)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Logged in as %s, %d devices found. The key is stored in %s\n", name, count, store.Path)
+	return
+}
+
+func handleAuthStatus(name string, cfg config.Config) {
+	stored, err := storedAPIKey(name)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// the key actually used follows the config layering, the store comes last
+	APIKEY, source := cfg.APIKey, "config file or environment"
+	if APIKEY == "" {
+		APIKEY, source = stored, "credential store"
+	}
+	if APIKEY == "" {
+		fmt.Printf("Not logged in (%s)\n", name)
+		return
+	}
+	redact.Register(APIKEY)
+
+	fmt.Printf("Profile:  %s\n", name)
+	fmt.Printf("API key:  %s (from %s)\n", redact.Mask(APIKEY), source)
+
+	count, err := validateAPIKey(APIKEY)
+	if err != nil {
+		fmt.Println("Status:  ", err)
+		return
+	}
+	fmt.Printf("Status:   valid, %d devices\n", count)
+	if limit, ok := apiwrapper.GetRateLimit(APIKEY); ok {
+		fmt.Printf("Budget:   %d/%d requests left\n", limit.Remaining, limit.Limit)
+	}
+	return
+}
@@ -0,0 +1,90 @@
+package clihandler
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/metrics"
+	mqttbridge "github.com/seanpden/govee_controller/pkg/mqtt_bridge"
+	"github.com/seanpden/govee_controller/pkg/redact"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// envOr returns the value of an environment variable, or fallback if it is
+// not set.
+func envOr(name string, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+func handleBridge(args []string, APIKEY string) {
+	flags := flag.NewFlagSet("bridge", flag.ContinueOnError)
+	broker := flags.String("broker", envOr("GOVEE_MQTT_BROKER", "tcp://localhost:1883"), "MQTT broker URL ($GOVEE_MQTT_BROKER)")
+	username := flags.String("username", os.Getenv("GOVEE_MQTT_USERNAME"), "broker username ($GOVEE_MQTT_USERNAME), the password is read from $GOVEE_MQTT_PASSWORD")
+	clientID := flags.String("client-id", "govee-bridge", "MQTT client id")
+	prefix := flags.String("prefix", "govee", "root of the device topics")
+	discovery := flags.String("discovery-prefix", "homeassistant", "Home Assistant discovery prefix, empty to disable discovery")
+	poll := flags.Duration("poll", time.Minute, "shortest interval between state polls")
+	maxPoll := flags.Duration("max-poll", 10*time.Minute, "longest interval between state polls while nothing changes")
+	metricsAddr := flags.String("metrics-addr", "", "serve Prometheus metrics at http://<addr>/metrics, e.g. 127.0.0.1:9101")
+	err := flags.Parse(args)
+	if err != nil {
+		return
+	}
+
+	// the bridge announces the devices of the registry, make sure it is current
+	data, err := apiwrapper.ListAllDevices(APIKEY)
+	if err != nil {
+		fmt.Println("Could not refresh devices.json, using the cached registry:", err)
+	} else {
+		utils.SaveToJSON(data)
+	}
+
+	password := os.Getenv("GOVEE_MQTT_PASSWORD")
+	redact.Register(password)
+
+	b := mqttbridge.New(nil, APIKEY)
+	b.Prefix = *prefix
+	b.DiscoveryPrefix = *discovery
+	b.Poller.Interval = *poll
+	b.Poller.MaxInterval = *maxPoll
+	b.Client = mqttbridge.NewPahoClient(mqttbridge.Options{
+		Broker:      *broker,
+		ClientID:    *clientID,
+		Username:    *username,
+		Password:    password,
+		WillTopic:   b.StatusTopic(),
+		WillPayload: "offline",
+		OnReconnect: b.Republish,
+	})
+
+	if *metricsAddr != "" {
+		m := metrics.New(APIKEY, b.Poller)
+		apiwrapper.Observer = m.Observe
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", m)
+		go func() {
+			err := http.ListenAndServe(*metricsAddr, mux)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	fmt.Printf("Bridging devices to %s under %s/, press Ctrl+C to stop\n", *broker, *prefix)
+	err = b.Run(ctx)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package clihandler
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/circadian"
+)
+
+// handleCircadian keeps the devices on the circadian curve until interrupted,
+// or prints today's curve with -preview.
+func handleCircadian(devices deviceSliceFlag, args []string, APIKEY string) {
+	// the devices may come before the flags, e.g. circadian desk -interval 2m
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = args[1:]
+	}
+
+	defaults := circadian.New(APIKEY, devices)
+	flags := flag.NewFlagSet("circadian", flag.ContinueOnError)
+	interval := flags.Duration("interval", defaults.Interval, "shortest time between two updates")
+	pause := flags.Duration("pause", defaults.PauseFor, "how long a device changed by hand is left alone")
+	minKelvin := flags.Int("min-kelvin", defaults.Curve.MinKelvin, "color temperature at night")
+	maxKelvin := flags.Int("max-kelvin", defaults.Curve.MaxKelvin, "color temperature at midday")
+	minBrightness := flags.Int("min-brightness", defaults.Curve.MinBrightness, "brightness at night")
+	maxBrightness := flags.Int("max-brightness", defaults.Curve.MaxBrightness, "brightness at midday")
+	sunrise := flags.Duration("sunrise", defaults.Curve.Sunrise, "start of the day without latitude and longitude in the config")
+	sunset := flags.Duration("sunset", defaults.Curve.Sunset, "end of the day without latitude and longitude in the config")
+	preview := flags.Bool("preview", false, "print today's curve and exit")
+	err := flags.Parse(args)
+	if err != nil {
+		return
+	}
+
+	mode := defaults
+	mode.Interval = *interval
+	mode.PauseFor = *pause
+	mode.Curve = circadian.Curve{
+		MinKelvin:     *minKelvin,
+		MaxKelvin:     *maxKelvin,
+		MinBrightness: *minBrightness,
+		MaxBrightness: *maxBrightness,
+		At:            coordinates,
+		Sunrise:       *sunrise,
+		Sunset:        *sunset,
+	}
+	err = mode.Curve.Validate()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if *preview {
+		for _, target := range mode.Curve.Preview(time.Now(), 30*time.Minute) {
+			fmt.Printf("%s  %dK  %d%%\n", target.Time.Format("15:04"), target.Kelvin, target.Brightness)
+		}
+		return
+	}
+
+	if len(devices) == 0 {
+		fmt.Println("Usage: circadian <device[,device...]> [-interval 5m] [-pause 2h] [-min-kelvin 2200] [-max-kelvin 6500] [-min-brightness 10] [-max-brightness 100] [-preview]")
+		return
+	}
+	mode.Handler = func(update circadian.Update) {
+		switch {
+		case update.Err != nil:
+			fmt.Printf("%s  %s: %v\n", time.Now().Format(time.TimeOnly), update.Device, update.Err)
+		case update.Sent:
+			fmt.Printf("%s  %s: %dK %d%%\n", time.Now().Format(time.TimeOnly), update.Device, update.Kelvin, update.Brightness)
+		case update.Skipped == circadian.SkippedManual:
+			fmt.Printf("%s  %s: changed by hand, paused for %v\n", time.Now().Format(time.TimeOnly), update.Device, mode.PauseFor)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	fmt.Printf("Following the circadian curve on %s, press Ctrl+C to stop\n", strings.Join(devices, ", "))
+	err = mode.Run(ctx)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return
+}
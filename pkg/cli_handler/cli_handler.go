@@ -3,10 +3,20 @@ package clihandler
 import (
 	"flag"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/cassette"
+	"github.com/seanpden/govee_controller/pkg/config"
+	"github.com/seanpden/govee_controller/pkg/redact"
+	"github.com/seanpden/govee_controller/pkg/scheduler"
+	"github.com/seanpden/govee_controller/pkg/simulator"
+	"github.com/seanpden/govee_controller/pkg/solar"
+	"github.com/seanpden/govee_controller/pkg/tui"
+	"github.com/seanpden/govee_controller/pkg/utils"
 )
 
 type deviceSliceFlag []string
@@ -28,7 +38,7 @@ func handleTurnDeviceOnOff(device deviceSliceFlag, value string, APIKEY string)
 		if err != nil {
 			fmt.Println(err)
 		}
-		fmt.Println(data)
+		printData(data)
 		return
 	}
 	if value == "off" {
@@ -37,7 +47,7 @@ func handleTurnDeviceOnOff(device deviceSliceFlag, value string, APIKEY string)
 		if err != nil {
 			fmt.Println(err)
 		}
-		fmt.Println(data)
+		printData(data)
 		return
 	}
 	fmt.Println("Invalid value")
@@ -46,11 +56,14 @@ func handleTurnDeviceOnOff(device deviceSliceFlag, value string, APIKEY string)
 
 func handleListDevices(APIKEY string) {
 	fmt.Println("Getting list of devices")
-	data, err := apiwrapper.ListDevices(APIKEY)
+	data, err := apiwrapper.ListAllDevices(APIKEY)
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
-	fmt.Println(data)
+	// keep the device registry the other commands resolve names from up to date
+	utils.SaveToJSON(data)
+	printData(data)
 	return
 }
 
@@ -60,7 +73,7 @@ func handleGetDeviceState(device deviceSliceFlag, APIKEY string) {
 	if err != nil {
 		fmt.Println(err)
 	}
-	fmt.Println(data)
+	printData(data)
 	return
 }
 
@@ -74,93 +87,411 @@ func handleSetBrightness(device deviceSliceFlag, value string, APIKEY string) {
 	if err != nil {
 		fmt.Println(err)
 	}
-	fmt.Println(data)
+	printData(data)
 	return
 }
 
 func handleSetColor(device deviceSliceFlag, value string, APIKEY string) {
 	fmt.Println("Setting device color")
-	color := strings.Split(value, ",")
-	r, err := strconv.Atoi(color[0])
+	color, err := utils.ParseColor(value)
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
-	g, err := strconv.Atoi(color[1])
+	data, err := apiwrapper.SetDeviceRGB(device, color.R, color.G, color.B, APIKEY)
 	if err != nil {
 		fmt.Println(err)
 	}
-	b, err := strconv.Atoi(color[2])
+	printData(data)
+	return
+}
+
+func handleColorTemp(device deviceSliceFlag, value string, APIKEY string) {
+	fmt.Println("Setting device color temp")
+	colorTemp, err := strconv.Atoi(value)
 	if err != nil {
 		fmt.Println(err)
 	}
-	data, err := apiwrapper.SetDeviceRGB(device, r, g, b, APIKEY)
+	data, err := apiwrapper.SetDeviceColorTemp(device, colorTemp, APIKEY)
 	if err != nil {
 		fmt.Println(err)
 	}
-	fmt.Println(data)
+	printData(data)
 	return
 }
 
-func handleColorTemp(device deviceSliceFlag, value string, APIKEY string) {
-	fmt.Println("Setting device color temp")
-	colorTemp, err := strconv.Atoi(value)
+func handleTUI(value string, APIKEY string) {
+	interval := 30 * time.Second
+	if value != "" {
+		var err error
+		interval, err = time.ParseDuration(value)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	err := tui.Run(APIKEY, interval)
 	if err != nil {
 		fmt.Println(err)
 	}
-	data, err := apiwrapper.SetDeviceColorTemp(device, colorTemp, APIKEY)
+	return
+}
+
+// commands lists every command HandleCLI understands, for completion.
+var commands = []string{"turn", "list", "get", "brightness", "color", "color_temp", "scene", "segment", "gradient", "tui", "serve", "bridge", "schedule", "circadian", "rules", "effect", "token", "lansim", "config", "auth", "completion"}
+
+var (
+	deviceFlag deviceSliceFlag
+	cmdFlag    = flag.String("CMD", "", "what command to execute")
+	valueFlag  = flag.String("VALUE", "", "what the command value is. e.g. 'on', 'off', 'red', '255,255,255', '30s' for the tui refresh interval, etc.")
+
+	profileFlag   = flag.String("profile", "", "which profile of the config file to use")
+	configFlag    = flag.String("config", "", "path of the config file (default "+config.DefaultPath()+")")
+	outputFlag    = flag.String("output", "", "output format, 'text' or 'json'")
+	timeoutFlag   = flag.Duration("timeout", 0, "timeout of each API request, e.g. '10s'")
+	baseURLFlag   = flag.String("base-url", "", "address of the Govee API")
+	transportFlag = flag.String("transport", "", "how to reach devices, only 'cloud' so far")
+
+	verboseFlag  = flag.Bool("verbose", false, "trace every API request and response on stderr")
+	dryRunFlag   = flag.Bool("dry-run", false, "resolve devices and validate values, print the requests instead of sending them")
+	recordFlag   = flag.String("record", "", "save every API request and response to this cassette file, with the API key and device ids scrubbed")
+	replayFlag   = flag.String("replay", "", "answer API requests from this cassette file instead of the Govee API")
+	simulateFlag = flag.Bool("simulate", false, "control the virtual devices of "+simulator.DefaultPath+" instead of real ones, no API key needed")
+)
+
+// output is the format results are printed in.
+var output = config.OutputText
+
+func init() {
+	flag.Var(&deviceFlag, "DEVICE", "what device(s) or group(s) to execute command on")
+}
+
+// printData prints a result in the configured output format.
+func printData(data any) {
+	if output == config.OutputJSON {
+		err := utils.PrettyPrintJSON(data)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	fmt.Println(data)
+}
+
+// coordinates is the place of the devices from the config, nil if not set.
+var coordinates *solar.Coordinates
+
+// loadConfig resolves the config from the config file, the environment and
+// the flags, and applies it to the api wrapper.
+func loadConfig() (config.Config, string, error) {
+	cfg, profile, err := config.Load(config.Options{
+		Path:    *configFlag,
+		Profile: *profileFlag,
+		Flags: config.Config{
+			BaseURL:   *baseURLFlag,
+			Transport: *transportFlag,
+			Timeout:   config.Duration(*timeoutFlag),
+			Output:    *outputFlag,
+		},
+	})
+	if err != nil {
+		return config.Config{}, "", err
+	}
+
+	output = cfg.Output
+	apiwrapper.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	apiwrapper.HTTPClient.Timeout = time.Duration(cfg.Timeout)
+	if cfg.Latitude != nil && cfg.Longitude != nil {
+		coordinates = &solar.Coordinates{Latitude: *cfg.Latitude, Longitude: *cfg.Longitude}
+		scheduler.Coordinates = coordinates
+	}
+	return cfg, profile, nil
+}
+
+// startSimulator points the api wrapper at a simulator of the virtual home
+// and its own device registry, refreshed right away so device names resolve.
+// The simulated devices need no key, and no accounts. The simulator only
+// serves the v1 API, so scenes and segments are turned off.
+func startSimulator(cfg *config.Config) (*simulator.Simulator, error) {
+	sim, err := simulator.Start(simulator.DefaultPath)
+	if err != nil {
+		return nil, err
+	}
+	apiwrapper.BaseURL = sim.URL
+	apiwrapper.OpenAPIURL = ""
+	utils.RegistryFile = simulator.RegistryFile
+	cfg.APIKey, cfg.Accounts = "simulate", nil
+
+	data, err := apiwrapper.ListDevices(cfg.APIKey)
+	if err != nil {
+		sim.Close()
+		return nil, err
+	}
+	utils.SaveToJSON(data)
+	fmt.Fprintf(os.Stderr, "simulating %d devices from %s\n", len(data.Data.Devices), simulator.DefaultPath)
+	return sim, nil
+}
+
+// registerAccounts registers the configured accounts with the api wrapper, so
+// commands are routed to the account each device belongs to. A top level API
+// key next to the accounts is registered as the "default" account.
+func registerAccounts(cfg config.Config) {
+	if len(cfg.Accounts) == 0 {
+		return
+	}
+	for name, key := range cfg.Accounts {
+		apiwrapper.RegisterAccount(name, key)
+	}
+	if cfg.APIKey == "" {
+		return
+	}
+	for _, key := range cfg.Accounts {
+		if key == cfg.APIKey {
+			return
+		}
+	}
+	apiwrapper.RegisterAccount("default", cfg.APIKey)
+}
+
+// reportDevices shows which registry entries the given names resolve to, so a
+// command that does nothing can be told apart from one that found no device.
+func reportDevices(device deviceSliceFlag) {
+	found, missing, err := apiwrapper.ResolveDevices(device)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, d := range found {
+		fmt.Printf("Device %q is %s (%s)\n", d.DeviceName, d.Device, d.Model)
+	}
+	for _, name := range missing {
+		fmt.Printf("Device %q is not in devices.json and will be skipped, run 'list' to refresh it\n", name)
+	}
+	return
+}
+
+func handleShowConfig(cfg config.Config, profile string) {
+	if profile != "" {
+		fmt.Println("Profile:", profile)
+	}
+	err := utils.PrettyPrintJSON(cfg.Redacted())
 	if err != nil {
 		fmt.Println(err)
 	}
-	fmt.Println(data)
 	return
 }
 
-func HandleCLI(APIKEY string) {
-	var Device deviceSliceFlag
-	Cmd := flag.String("CMD", "", "what command to execute")
-	Value := flag.String("VALUE", "", "what the command value is. e.g. 'on', 'off', '255,255,255', etc.")
-	flag.Var(&Device, "DEVICE", "what device(s) to execute command on")
+// HandleCLI parses the command line and runs the requested command.
+//
+// Commands can be given with flags (-CMD color -DEVICE x -VALUE red) or
+// positionally (color x red). Settings come from the config file, the
+// environment and the flags, see config.Load.
+func HandleCLI() {
 	flag.Parse()
 
+	// positional form: <cmd> [device[,device...]] [value]
+	args := flag.Args()
+	// the words after the command, for commands that take their own arguments
+	cmdArgs := args
+	if *cmdFlag == "" && len(args) > 0 {
+		cmdArgs = args[1:]
+		*cmdFlag = args[0]
+		if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+			deviceFlag.Set(args[1])
+		}
+		if len(args) > 2 {
+			*valueFlag = args[2]
+		}
+	}
+
+	cfg, profile, err := loadConfig()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if *cmdFlag == "config" {
+		handleShowConfig(cfg, profile)
+		return
+	}
+
+	if *cmdFlag == "auth" {
+		handleAuth(cmdArgs, cfg, profile)
+		return
+	}
+
+	if *cmdFlag == "token" {
+		handleToken(cmdArgs)
+		return
+	}
+
+	if *cmdFlag == "lansim" {
+		handleLANSim(cmdArgs)
+		return
+	}
+
+	if *cmdFlag == "rules" && len(cmdArgs) > 0 && cmdArgs[0] == "check" {
+		handleRules(cmdArgs, "")
+		return
+	}
+
+	// editing the jobs needs no key, only running them does
+	if *cmdFlag == "schedule" && (len(cmdArgs) == 0 || (cmdArgs[0] != "run" && cmdArgs[0] != "now")) {
+		handleSchedule(cmdArgs, "")
+		return
+	}
+
+	if *recordFlag != "" {
+		apiwrapper.HTTPClient.Transport = cassette.NewRecorder(*recordFlag, nil)
+	}
+	if *replayFlag != "" {
+		recorded, err := cassette.Load(*replayFlag)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		apiwrapper.HTTPClient.Transport = cassette.NewReplayer(recorded)
+		// the recorded responses need no key
+		if cfg.APIKey == "" && len(cfg.Accounts) == 0 {
+			cfg.APIKey = "replay"
+		}
+	}
+
+	if *simulateFlag {
+		sim, err := startSimulator(&cfg)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer sim.Close()
+	}
+
+	// the credential store is only used when no key is configured
+	if cfg.APIKey == "" {
+		cfg.APIKey, err = storedAPIKey(credentialName(profile))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	APIKEY := cfg.APIKey
+	if APIKEY == "" && len(cfg.Accounts) == 0 {
+		fmt.Println("APIKEY not set. Run 'auth login', export GOVEE_APIKEY, add it to .env or set api_key in " + config.DefaultPath())
+		return
+	}
+	registerAccounts(cfg)
+
+	// fall back to the configured default devices
+	if len(deviceFlag) == 0 {
+		deviceFlag = append(deviceFlag, cfg.Devices...)
+	}
+
+	if *verboseFlag {
+		apiwrapper.Trace = redact.NewWriter(os.Stderr)
+	}
+	apiwrapper.DryRun = *dryRunFlag
+
+	// replace group names with the devices in the group
+	groups, err := utils.LoadGroups("groups.json")
+	if err == nil {
+		deviceFlag = utils.ExpandGroups(deviceFlag, groups)
+	}
+
 	// if "all" is in the device slice, get all device names and set it to the device slice
-	if len(Device) == 1 && Device[0] == "all" {
-		data, err := apiwrapper.ListDevices(APIKEY)
+	if len(deviceFlag) == 1 && deviceFlag[0] == "all" {
+		data, err := apiwrapper.ListAllDevices(APIKEY)
 		if err != nil {
 			fmt.Println(err)
 		}
+		deviceFlag = nil
 		for _, device := range data.Data.Devices {
-			Device = append(Device, device.DeviceName)
+			deviceFlag = append(deviceFlag, device.DeviceName)
 		}
 	}
 
-	if *Cmd == "turn" {
-		handleTurnDeviceOnOff(Device, *Value, APIKEY)
+	if (*verboseFlag || *dryRunFlag) && len(deviceFlag) > 0 {
+		reportDevices(deviceFlag)
+	}
+
+	if *cmdFlag == "turn" {
+		handleTurnDeviceOnOff(deviceFlag, *valueFlag, APIKEY)
 		return
 	}
 
-	if *Cmd == "list" {
+	if *cmdFlag == "list" {
 		handleListDevices(APIKEY)
 		return
 	}
 
-	if *Cmd == "get" {
+	if *cmdFlag == "get" {
 		// TODO: Fix response
-		handleGetDeviceState(Device, APIKEY)
+		handleGetDeviceState(deviceFlag, APIKEY)
+		return
+	}
+
+	if *cmdFlag == "brightness" {
+		handleSetBrightness(deviceFlag, *valueFlag, APIKEY)
+		return
+	}
+
+	if *cmdFlag == "color" {
+		handleSetColor(deviceFlag, *valueFlag, APIKEY)
+		return
+	}
+
+	if *cmdFlag == "color_temp" {
+		handleColorTemp(deviceFlag, *valueFlag, APIKEY)
+		return
+	}
+
+	if *cmdFlag == "serve" {
+		handleServe(cmdArgs, APIKEY)
+		return
+	}
+
+	if *cmdFlag == "bridge" {
+		handleBridge(cmdArgs, APIKEY)
+		return
+	}
+
+	if *cmdFlag == "schedule" {
+		handleSchedule(cmdArgs, APIKEY)
+		return
+	}
+
+	if *cmdFlag == "rules" {
+		handleRules(cmdArgs, APIKEY)
+		return
+	}
+
+	if *cmdFlag == "scene" {
+		handleScene(deviceFlag, cmdArgs, APIKEY)
+		return
+	}
+
+	if *cmdFlag == "segment" {
+		handleSegment(deviceFlag, cmdArgs, APIKEY)
+		return
+	}
+
+	if *cmdFlag == "gradient" {
+		handleGradient(deviceFlag, cmdArgs, APIKEY)
 		return
 	}
 
-	if *Cmd == "brightness" {
-		handleSetBrightness(Device, *Value, APIKEY)
+	if *cmdFlag == "effect" {
+		handleEffect(deviceFlag, *valueFlag, cmdArgs, APIKEY)
 		return
 	}
 
-	if *Cmd == "color" {
-		handleSetColor(Device, *Value, APIKEY)
+	if *cmdFlag == "circadian" {
+		handleCircadian(deviceFlag, cmdArgs, APIKEY)
 		return
 	}
 
-	if *Cmd == "color_temp" {
-		handleColorTemp(Device, *Value, APIKEY)
+	if *cmdFlag == "tui" {
+		handleTUI(*valueFlag, APIKEY)
 		return
 	}
 
@@ -0,0 +1,72 @@
+package clihandler
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/seanpden/govee_controller/pkg/completion"
+)
+
+// HandleCompletion handles the commands that must work without an API key:
+// "completion <shell>", which prints a completion script, and the hidden
+// "__complete", which the scripts call to get candidates.
+//
+// It returns true if args was one of these commands and has been handled.
+func HandleCompletion(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	switch args[0] {
+	case "completion":
+		if len(args) < 2 {
+			fmt.Println("Usage: completion bash|zsh|fish")
+			return true
+		}
+		script, err := completion.Script(args[1], filepath.Base(os.Args[0]))
+		if err != nil {
+			fmt.Println(err)
+			return true
+		}
+		fmt.Print(script)
+		return true
+
+	case "__complete":
+		if len(args) < 2 {
+			return true
+		}
+		src := completion.LoadSource(commands, flagNames())
+
+		var candidates []string
+		if args[1] == "bash" {
+			point, err := strconv.Atoi(os.Getenv("COMP_POINT"))
+			if err != nil {
+				point = -1
+			}
+			bashWord := ""
+			if len(args) > 2 {
+				bashWord = args[2]
+			}
+			candidates = completion.BashCandidates(src, os.Getenv("COMP_LINE"), point, bashWord)
+		} else {
+			candidates = completion.Complete(src, args[2:])
+		}
+
+		for _, candidate := range candidates {
+			fmt.Println(candidate)
+		}
+		return true
+	}
+	return false
+}
+
+func flagNames() []string {
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+	})
+	return names
+}
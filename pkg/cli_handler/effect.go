@@ -0,0 +1,87 @@
+package clihandler
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/config"
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/effects"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// handleEffect plays an effect on the devices and restores their state, or
+// prints its frames with -preview.
+func handleEffect(devices deviceSliceFlag, name string, args []string, APIKEY string) {
+	usage := "Usage: effect <device[,device...]> <" + strings.Join(effects.Names, "|") + "> [-color red] [-times 3] [-period 2s] [-preview]"
+	// the devices and the effect come before the flags, e.g. effect desk flash -color red
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet("effect", flag.ContinueOnError)
+	color := flags.String("color", "", "color of flash, strobe and breathe, white by default")
+	times := flags.Int("times", 0, "how many times the pattern repeats, 0 for the effect's default")
+	period := flags.Duration("period", 0, "length of one repeat, 0 for the effect's default")
+	preview := flags.Bool("preview", false, "print the frames and the requests they cost and exit")
+	err := flags.Parse(args)
+	if err != nil {
+		return
+	}
+
+	effect := effects.Effect{Name: name, Times: *times, Period: config.Duration(*period)}
+	if *color != "" {
+		parsed, err := utils.ParseColor(*color)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		c := control.Color(parsed)
+		effect.Color = &c
+	}
+	frames, err := effect.Frames()
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println(usage)
+		return
+	}
+
+	player := effects.New(APIKEY)
+	if *preview {
+		for _, frame := range frames {
+			data, _ := json.Marshal(frame.State)
+			fmt.Printf("%-8v %s\n", max(frame.Hold, player.MinFrame), data)
+		}
+		fmt.Printf("%d frames, %d requests per device\n", len(frames), effects.Cost(frames))
+		return
+	}
+	if len(devices) == 0 {
+		fmt.Println(usage)
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	start := time.Now()
+	result, err := player.Play(ctx, devices, effect)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if result.Frames == 0 {
+		return
+	}
+	fmt.Printf("Played %d frames of %s in %v\n", result.Frames, name, time.Since(start).Round(time.Second))
+	if result.Stretched {
+		fmt.Printf("Frames were slowed to %v, the shortest the cloud API allows\n", player.MinFrame)
+	}
+	if !result.Restored {
+		fmt.Println("The previous state could not be fully restored")
+	}
+	return
+}
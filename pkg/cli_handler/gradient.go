@@ -0,0 +1,64 @@
+package clihandler
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/seanpden/govee_controller/pkg/gradient"
+)
+
+// handleGradient paints a gradient across the devices in order, e.g. a group
+// from left to right, or prints the color of each device with -preview.
+func handleGradient(devices deviceSliceFlag, args []string, APIKEY string) {
+	usage := "Usage: gradient <device[,device...]|group> <color|palette> [color|palette...] [-reverse] [-preview]\nPalettes: " + strings.Join(gradient.PaletteNames(), ", ")
+	// the devices come first, then the colors
+	var words []string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = args[1:]
+	}
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		words = append(words, args[0])
+		args = args[1:]
+	}
+	flags := flag.NewFlagSet("gradient", flag.ContinueOnError)
+	reverse := flags.Bool("reverse", false, "run the gradient from the last device to the first")
+	preview := flags.Bool("preview", false, "print the color of each device and exit")
+	err := flags.Parse(args)
+	if err != nil {
+		return
+	}
+	if len(devices) == 0 || len(words) == 0 {
+		fmt.Println(usage)
+		return
+	}
+
+	colors, err := gradient.ParseColors(words)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	order := slices.Clone([]string(devices))
+	if *reverse {
+		slices.Reverse(order)
+	}
+
+	if *preview {
+		for i, color := range gradient.Blend(colors, len(order)) {
+			fmt.Printf("%-20s #%02x%02x%02x\n", order[i], color.R, color.G, color.B)
+		}
+		return
+	}
+
+	assignments, _ := gradient.Render(order, colors, APIKEY)
+	for _, assignment := range assignments {
+		if assignment.Err != nil {
+			fmt.Printf("%s: %v\n", assignment.Device, assignment.Err)
+			continue
+		}
+		color := assignment.Color
+		fmt.Printf("%-20s #%02x%02x%02x\n", assignment.Device, color.R, color.G, color.B)
+	}
+	return
+}
@@ -0,0 +1,103 @@
+package clihandler
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/seanpden/govee_controller/pkg/lansim"
+	"github.com/seanpden/govee_controller/pkg/simulator"
+)
+
+// handleLANSim answers the Govee LAN protocol on loopback for the devices of
+// the virtual home, until interrupted. Each device gets its own loopback
+// address, 127.0.0.2 and up, like devices on a network have their own IP.
+// Where only 127.0.0.1 is on loopback, like on macOS without
+// 'ifconfig lo0 alias', the devices share it on ports after the control port.
+func handleLANSim(args []string) {
+	flags := flag.NewFlagSet("lansim", flag.ContinueOnError)
+	home := flags.String("home", simulator.DefaultPath, "virtual home the devices are read from, created if missing")
+	scan := flags.String("scan", fmt.Sprintf("127.0.0.1:%d", lansim.ScanPort), "address scans are received on")
+	controlPort := flags.Int("control-port", lansim.ControlPort, "port every device receives commands on")
+	replyPort := flags.Int("reply-port", lansim.ReplyPort, "port answers are sent to, 0 to answer to the port the request came from")
+	loss := flags.Float64("loss", 0, "probability of losing each packet, between 0 and 1")
+	delay := flags.Duration("delay", 0, "delay of every answer, e.g. 200ms")
+	seed := flags.Int64("seed", 1, "seed of the packet loss")
+	err := flags.Parse(args)
+	if err != nil {
+		return
+	}
+	if *loss < 0 || *loss > 1 {
+		fmt.Println("loss must be between 0 and 1")
+		return
+	}
+
+	virtual, err := simulator.Load(*home)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	aliases := loopbackAliases(len(virtual.Devices))
+	if !aliases {
+		fmt.Println("127.0.0.2 and up are not on loopback, each device gets its own port on 127.0.0.1 instead")
+		fmt.Println("On macOS, add one address per device with e.g. 'sudo ifconfig lo0 alias 127.0.0.2 up'")
+	}
+	var devices []lansim.Device
+	for i, device := range virtual.Devices {
+		state := device.State
+		addr := fmt.Sprintf("127.0.0.%d:%d", i+2, *controlPort)
+		if !aliases {
+			addr = fmt.Sprintf("127.0.0.1:%d", *controlPort+i+1)
+		}
+		devices = append(devices, lansim.Device{
+			Device: device.Device,
+			SKU:    device.Model,
+			Addr:   addr,
+			State: lansim.State{
+				On:               state.Power == "on",
+				Brightness:       state.Brightness,
+				Color:            state.Color,
+				ColorTemInKelvin: state.ColorTem,
+			},
+		})
+	}
+
+	sim := lansim.New(devices...)
+	sim.ScanAddr, sim.ReplyPort, sim.Seed = *scan, *replyPort, *seed
+	sim.SetLoss(*loss)
+	sim.SetDelay(*delay)
+	err = sim.Start()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer sim.Close()
+
+	fmt.Printf("Answering scans on %s\n", sim.ScanAddress())
+	for i, device := range devices {
+		fmt.Printf("%-20s %-8s %s\n", virtual.Devices[i].DeviceName, device.SKU, sim.DeviceAddress(device.Device))
+	}
+	fmt.Println("Press Ctrl+C to stop")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+	return
+}
+
+// loopbackAliases reports whether the n loopback addresses from 127.0.0.2 can
+// be listened on. Linux routes all of 127.0.0.0/8 to loopback, macOS only
+// 127.0.0.1 unless more are aliased.
+func loopbackAliases(n int) bool {
+	for i := range n {
+		conn, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.%d:0", i+2))
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+	return true
+}
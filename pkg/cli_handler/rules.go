@@ -0,0 +1,117 @@
+package clihandler
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	mqttbridge "github.com/seanpden/govee_controller/pkg/mqtt_bridge"
+	"github.com/seanpden/govee_controller/pkg/poller"
+	"github.com/seanpden/govee_controller/pkg/redact"
+	"github.com/seanpden/govee_controller/pkg/rules"
+)
+
+const rulesUsage = "Usage: rules check | eval <rule> | run [-broker tcp://host:1883] [-poll 1m] [-rules rules.yaml]"
+
+// handleRules validates, evaluates and runs the automation rules.
+func handleRules(args []string, APIKEY string) {
+	if len(args) == 0 {
+		fmt.Println(rulesUsage)
+		return
+	}
+
+	flags := flag.NewFlagSet("rules "+args[0], flag.ContinueOnError)
+	rulesFile := flags.String("rules", "rules.yaml", "rules file")
+	broker := flags.String("broker", os.Getenv("GOVEE_MQTT_BROKER"), "MQTT broker URL for mqtt triggers ($GOVEE_MQTT_BROKER), none if empty")
+	username := flags.String("username", os.Getenv("GOVEE_MQTT_USERNAME"), "broker username ($GOVEE_MQTT_USERNAME), the password is read from $GOVEE_MQTT_PASSWORD")
+	poll := flags.Duration("poll", time.Minute, "shortest interval between state polls for state triggers")
+
+	// the rule name comes before the flags, e.g. rules eval porch -rules home.yaml
+	var name string
+	rest := args[1:]
+	if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		name, rest = rest[0], rest[1:]
+	}
+	err := flags.Parse(rest)
+	if err != nil {
+		return
+	}
+
+	switch args[0] {
+	case "check":
+		file, err := rules.Load(*rulesFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, rule := range file.Rules {
+			status := ""
+			if rule.Disabled {
+				status = " (disabled)"
+			}
+			fmt.Printf("%-24s on %-32s %d conditions, %d actions%s\n", rule.Name, rule.Trigger, len(rule.Conditions), len(rule.Actions), status)
+		}
+		for name, webhook := range file.Webhooks {
+			fmt.Printf("webhook %s is authenticated by its %s signature\n", name, webhook.Signature)
+		}
+		fmt.Printf("%s: %d rules are valid\n", *rulesFile, len(file.Rules))
+
+	case "eval":
+		if APIKEY == "" {
+			fmt.Println(rulesUsage)
+			return
+		}
+		engine := rules.New(*rulesFile, APIKEY)
+		_, err := engine.Reload()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, rule := range engine.Rules() {
+			if rule.Name == name {
+				fmt.Println(engine.Evaluate(context.Background(), rule, "the command line", nil))
+				return
+			}
+		}
+		fmt.Printf("no rule named %q in %s\n", name, *rulesFile)
+
+	case "run":
+		if APIKEY == "" {
+			fmt.Println(rulesUsage)
+			return
+		}
+		engine := rules.New(*rulesFile, APIKEY)
+		engine.Poller = poller.New(APIKEY)
+		engine.Poller.Interval = *poll
+		engine.Poller.Handler = engine.HandlePoll
+		engine.Poller.Active = engine.WantsState
+		if *broker != "" {
+			password := os.Getenv("GOVEE_MQTT_PASSWORD")
+			redact.Register(password)
+			engine.MQTT = mqttbridge.NewPahoClient(mqttbridge.Options{Broker: *broker, ClientID: "govee-rules", Username: *username, Password: password})
+			err := engine.MQTT.Connect()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			defer engine.MQTT.Disconnect()
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		go engine.Poller.Run(ctx)
+		fmt.Printf("Running the rules in %s, press Ctrl+C to stop\n", *rulesFile)
+		err := engine.Run(ctx)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+	default:
+		fmt.Println(rulesUsage)
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package clihandler
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/config"
+)
+
+// handleScene switches the devices to a built-in or DIY light scene, or
+// lists their scenes when no name is given.
+func handleScene(devices deviceSliceFlag, args []string, APIKEY string) {
+	// the devices come first, the rest of the words are the scene name
+	var words []string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = args[1:]
+	}
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		words = append(words, args[0])
+		args = args[1:]
+	}
+	flags := flag.NewFlagSet("scene", flag.ContinueOnError)
+	refresh := flags.Bool("refresh", false, "list the scenes again instead of using the ones cached in devices.json")
+	err := flags.Parse(args)
+	if err != nil {
+		return
+	}
+	if len(devices) == 0 {
+		fmt.Println("Usage: scene <device[,device...]> [scene name] [-refresh]")
+		return
+	}
+
+	name := strings.Join(words, " ")
+	found, missing, err := apiwrapper.ResolveDevices(devices)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, device := range missing {
+		fmt.Printf("%s is not in devices.json, run 'list' to refresh it\n", device)
+	}
+
+	for _, device := range found {
+		scenes, err := apiwrapper.DeviceScenes(device.DeviceName, APIKEY, *refresh)
+		if err != nil {
+			fmt.Printf("%s: %v\n", device.DeviceName, err)
+			continue
+		}
+
+		if name == "" {
+			if output == config.OutputJSON {
+				printData(scenes)
+				continue
+			}
+			fmt.Printf("%s (%d scenes):\n", device.DeviceName, len(scenes))
+			for _, scene := range scenes {
+				kind := ""
+				if scene.Instance == "diyScene" {
+					kind = " (DIY)"
+				}
+				fmt.Printf("  %s%s\n", scene.Name, kind)
+			}
+			continue
+		}
+
+		scene, err := apiwrapper.MatchScene(scenes, name)
+		if err != nil {
+			fmt.Printf("%s: %v\n", device.DeviceName, err)
+			continue
+		}
+		_, err = apiwrapper.SetLightScene(device, scene, APIKEY)
+		if err != nil {
+			fmt.Printf("%s: %v\n", device.DeviceName, err)
+			continue
+		}
+		fmt.Printf("%s: %s\n", device.DeviceName, scene.Name)
+	}
+	return
+}
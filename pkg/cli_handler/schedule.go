@@ -0,0 +1,295 @@
+package clihandler
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/config"
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/scheduler"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+const scheduleUsage = "Usage: schedule list | add <name> (-cron '0 7 * * *' | -solar sunset-30m) [-tz Europe/Paris] [-jitter 5m] [-missed skip|once] (-devices a,b [-power on] [-brightness 50] [-color red] [-color-temp 3000] | -scene s | -routine r) | edit <name> [flags] | remove|enable|disable|now <name> | history [name] [-n 20] | run"
+
+// handleSchedule manages the jobs in jobs.json and runs them.
+func handleSchedule(args []string, APIKEY string) {
+	if len(args) == 0 {
+		fmt.Println(scheduleUsage)
+		return
+	}
+
+	flags := flag.NewFlagSet("schedule "+args[0], flag.ContinueOnError)
+	jobFile := flags.String("jobs", "jobs.json", "job store")
+	historyFile := flags.String("history", "history.jsonl", "history of the runs")
+	count := flags.Int("n", 20, "number of runs to show")
+	flags.String("cron", "", "cron expression, e.g. '30 7 * * 1-5' or @daily")
+	flags.String("solar", "", "solar event with an optional offset instead of -cron, e.g. sunset-30m or civil-dawn+10m, needs latitude and longitude in the config")
+	flags.String("tz", "", "IANA time zone of the schedule, local time if empty")
+	flags.Duration("jitter", 0, "random delay added to every run, up to this duration")
+	flags.String("missed", "", "what to do with runs missed while not running: skip or once")
+	flags.String("devices", "", "comma separated devices or groups to set")
+	flags.String("power", "", "on or off")
+	flags.Int("brightness", 0, "brightness, 0-100")
+	flags.String("color", "", "color name, #rrggbb or r,g,b")
+	flags.Int("color-temp", 0, "color temperature in kelvin")
+	flags.String("scene", "", "scene from scenes.json to apply")
+	flags.String("routine", "", "routine from routines.json to run")
+
+	// the name comes before the flags, e.g. schedule add wake -cron '0 7 * * *'
+	var name string
+	rest := args[1:]
+	if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		name, rest = rest[0], rest[1:]
+	}
+	err := flags.Parse(rest)
+	if err != nil {
+		return
+	}
+	store := scheduler.Store{Path: *jobFile}
+	history := scheduler.NewHistory(*historyFile)
+
+	switch args[0] {
+	case "list":
+		jobs, err := store.Load()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if len(jobs) == 0 {
+			fmt.Println("No jobs")
+			return
+		}
+		for _, job := range jobs {
+			next := "disabled"
+			if !job.Disabled {
+				at, err := job.Next(time.Now())
+				if err != nil {
+					next = err.Error()
+				} else if at.IsZero() {
+					next = "never"
+				} else {
+					next = "next " + at.Local().Format(time.DateTime)
+				}
+			}
+			fmt.Printf("%s  %-16s %-20s %-28s %s\n", job.ID, job.Name, job.When(), job.Describe(), next)
+		}
+
+	case "add":
+		job := scheduler.Job{Name: name}
+		err = applyJobFlags(&job, flags)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		job, err = store.Add(job)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("Added job %s (%s): %s at %s\n", job.Name, job.ID, job.Describe(), job.When())
+
+	case "edit":
+		var flagErr error
+		job, err := store.Update(name, func(job *scheduler.Job) {
+			flagErr = applyJobFlags(job, flags)
+		})
+		if flagErr != nil {
+			err = flagErr
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("Updated job %s (%s): %s at %s\n", job.Name, job.ID, job.Describe(), job.When())
+
+	case "enable", "disable":
+		job, err := store.Update(name, func(job *scheduler.Job) {
+			job.Disabled = args[0] == "disable"
+		})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		verb := "Enabled"
+		if job.Disabled {
+			verb = "Disabled"
+		}
+		fmt.Printf("%s job %s (%s)\n", verb, job.Name, job.ID)
+
+	case "remove":
+		job, err := store.Remove(name)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("Removed job %s (%s)\n", job.Name, job.ID)
+
+	case "history":
+		runs, err := history.Load()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		var shown []scheduler.Run
+		for _, run := range runs {
+			if name == "" || run.Job == name || run.JobID == name {
+				shown = append(shown, run)
+			}
+		}
+		if len(shown) > *count {
+			shown = shown[len(shown)-*count:]
+		}
+		for _, run := range shown {
+			printRun(run)
+		}
+
+	case "now":
+		if APIKEY == "" {
+			fmt.Println(scheduleUsage)
+			return
+		}
+		job, err := store.Find(name)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		s := scheduler.New(APIKEY)
+		s.Jobs, s.History = store, history
+		printRun(s.RunJob(context.Background(), job, time.Now(), false))
+
+	case "run":
+		if APIKEY == "" {
+			fmt.Println(scheduleUsage)
+			return
+		}
+		s := scheduler.New(APIKEY)
+		s.Jobs, s.History = store, history
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		fmt.Printf("Running the jobs in %s, press Ctrl+C to stop\n", *jobFile)
+		err = s.Run(ctx)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+	default:
+		fmt.Println(scheduleUsage)
+	}
+	return
+}
+
+// applyJobFlags sets the fields of a job from the flags given on the command
+// line. Choosing an action replaces the previous one. The job is left
+// unchanged if a flag is invalid.
+func applyJobFlags(original *scheduler.Job, flags *flag.FlagSet) error {
+	var err error
+	job := *original
+	// state flags change the job's state, keeping the fields they don't set
+	var state *control.State
+	if job.State != nil {
+		copied := *job.State
+		state = &copied
+	}
+	action := ""
+	flags.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch f.Name {
+		case "cron":
+			job.Cron, job.Solar = value, ""
+		case "solar":
+			job.Solar, job.Cron = value, ""
+		case "tz":
+			job.TimeZone = value
+		case "jitter":
+			jitter, _ := time.ParseDuration(value)
+			job.Jitter = config.Duration(jitter)
+		case "missed":
+			job.Missed = value
+		case "devices":
+			job.Devices = splitList(value)
+			action = "state"
+		case "scene":
+			job.Scene = value
+			action = "scene"
+		case "routine":
+			job.Routine = value
+			action = "routine"
+		case "power", "brightness", "color", "color-temp":
+			if state == nil {
+				state = &control.State{}
+			}
+			action = "state"
+			if setErr := setStateFlag(state, f.Name, value); setErr != nil {
+				err = setErr
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "state":
+		job.State, job.Scene, job.Routine = state, "", ""
+	case "scene":
+		job.State, job.Devices, job.Routine = nil, nil, ""
+	case "routine":
+		job.State, job.Devices, job.Scene = nil, nil, ""
+	}
+	*original = job
+	return nil
+}
+
+func setStateFlag(state *control.State, name string, value string) error {
+	var n int
+	if name == "brightness" || name == "color-temp" {
+		_, err := fmt.Sscan(value, &n)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	switch name {
+	case "power":
+		state.Power = value
+	case "brightness":
+		state.Brightness = &n
+	case "color-temp":
+		state.ColorTem = &n
+	case "color":
+		color, err := utils.ParseColor(value)
+		if err != nil {
+			return err
+		}
+		c := control.Color(color)
+		state.Color = &c
+	}
+	return nil
+}
+
+// printRun prints a run with the outcome for every device.
+func printRun(run scheduler.Run) {
+	status := "ok"
+	if !run.OK() {
+		status = "failed"
+	}
+	if run.Missed {
+		status += " (missed run)"
+	}
+	fmt.Printf("%s  %-16s %s\n", run.Scheduled.Local().Format(time.DateTime), run.Job, status)
+	if run.Error != "" {
+		fmt.Printf("    %s\n", run.Error)
+	}
+	for _, outcome := range run.Outcomes {
+		result := "ok"
+		if outcome.Error != "" {
+			result = outcome.Error
+		}
+		fmt.Printf("    %-20s %s\n", outcome.Device, result)
+	}
+}
@@ -0,0 +1,91 @@
+package clihandler
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/gradient"
+	"github.com/seanpden/govee_controller/pkg/segments"
+	"github.com/seanpden/govee_controller/pkg/structs"
+)
+
+const segmentUsage = "Usage: segment <device[,device...]> [all|0-4,7] [color|palette...] [-brightness 50] [-refresh]"
+
+// handleSegment colors segments of RGBIC devices, several colors make a
+// gradient across them. Without segments it prints how many a device has.
+func handleSegment(devices deviceSliceFlag, args []string, APIKEY string) {
+	// the devices come first, then the segments and the colors
+	var words []string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = args[1:]
+	}
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		words = append(words, args[0])
+		args = args[1:]
+	}
+	flags := flag.NewFlagSet("segment", flag.ContinueOnError)
+	brightness := flags.Int("brightness", -1, "brightness of the segments, 0-100")
+	refresh := flags.Bool("refresh", false, "discover the segments again instead of using the count cached in devices.json")
+	err := flags.Parse(args)
+	if err != nil {
+		return
+	}
+	if len(devices) == 0 || (len(words) == 1 && *brightness < 0) {
+		fmt.Println(segmentUsage)
+		return
+	}
+
+	var colors []structs.Color
+	if len(words) > 1 {
+		colors, err = gradient.ParseColors(words[1:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	found, missing, err := apiwrapper.ResolveDevices(devices)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, device := range missing {
+		fmt.Printf("%s is not in devices.json, run 'list' to refresh it\n", device)
+	}
+	for _, device := range found {
+		count, err := apiwrapper.DeviceSegments(device.DeviceName, APIKEY, *refresh)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if len(words) == 0 {
+			fmt.Printf("%s has %d segments, 0-%d\n", device.DeviceName, count, count-1)
+			continue
+		}
+
+		indexes, err := segments.ParseRange(words[0], count)
+		if err != nil {
+			fmt.Printf("%s: %v\n", device.DeviceName, err)
+			continue
+		}
+		if len(colors) > 0 {
+			requests, err := segments.Paint(device, indexes, colors, APIKEY)
+			if err != nil {
+				fmt.Printf("%s: %v\n", device.DeviceName, err)
+				continue
+			}
+			fmt.Printf("%s: painted segments %s in %d requests\n", device.DeviceName, words[0], requests)
+		}
+		if *brightness >= 0 {
+			_, err := apiwrapper.SetSegmentBrightness(device, indexes, *brightness, APIKEY)
+			if err != nil {
+				fmt.Printf("%s: %v\n", device.DeviceName, err)
+				continue
+			}
+			fmt.Printf("%s: segments %s at %d%%\n", device.DeviceName, words[0], *brightness)
+		}
+	}
+	return
+}
@@ -0,0 +1,69 @@
+package clihandler
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/rules"
+	"github.com/seanpden/govee_controller/pkg/scheduler"
+	"github.com/seanpden/govee_controller/pkg/server"
+	"github.com/seanpden/govee_controller/pkg/tokens"
+)
+
+func handleServe(args []string, APIKEY string) {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:8080", "address to listen on, use ':8080' to serve the whole network")
+	tokenFile := flags.String("tokens", "tokens.json", "token store, authentication is required once it exists")
+	auditFile := flags.String("audit", "audit.log", "audit trail of changes and refused requests, empty to disable")
+	poll := flags.Duration("poll", time.Minute, "shortest interval between state polls for the event streams, 0 to disable")
+	maxPoll := flags.Duration("max-poll", 10*time.Minute, "longest interval between state polls while nothing changes")
+	rulesFile := flags.String("rules", "rules.yaml", "automation rules to run while serving, reloaded when edited, unused if missing")
+	jobFile := flags.String("jobs", "jobs.json", "scheduled jobs to run while serving, see the schedule command, empty to disable")
+	err := flags.Parse(args)
+	if err != nil {
+		return
+	}
+
+	s := server.New(APIKEY)
+	apiwrapper.Observer = s.Metrics.Observe
+	s.Poller.Interval = *poll
+	s.Poller.MaxInterval = *maxPoll
+	store := tokens.Store{Path: *tokenFile}
+	enabled, err := store.Enabled()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if enabled {
+		s.Tokens = &store
+	}
+	if *auditFile != "" {
+		s.Audit = &server.AuditLog{Path: *auditFile}
+	}
+
+	if _, err := os.Stat(*rulesFile); err == nil {
+		s.Rules = rules.New(*rulesFile, APIKEY)
+		s.Rules.Poller = s.Poller
+	}
+	if *jobFile != "" {
+		jobs := scheduler.New(APIKEY)
+		jobs.Jobs.Path = *jobFile
+		go func() {
+			err := jobs.Run(context.Background())
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	err = server.ListenAndServe(*addr, s)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return
+}
@@ -0,0 +1,130 @@
+package clihandler
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/server"
+	"github.com/seanpden/govee_controller/pkg/tokens"
+)
+
+const tokenUsage = "Usage: token create <name> [-devices a,b] [-groups g] [-actions read,control,scenes] | list | revoke <id|name> | audit [-n 20]"
+
+// splitList splits a comma separated flag value, an empty value is no items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// handleToken manages the bearer tokens of the local server.
+func handleToken(args []string) {
+	if len(args) == 0 {
+		fmt.Println(tokenUsage)
+		return
+	}
+
+	flags := flag.NewFlagSet("token "+args[0], flag.ContinueOnError)
+	tokenFile := flags.String("tokens", "tokens.json", "token store")
+	devices := flags.String("devices", "", "comma separated devices the token is limited to")
+	groups := flags.String("groups", "", "comma separated groups the token is limited to")
+	actions := flags.String("actions", tokens.ActionRead, "comma separated actions: read, control, scenes")
+	auditFile := flags.String("audit", "audit.log", "audit trail")
+	count := flags.Int("n", 20, "number of audit entries to show")
+
+	// the name comes before the flags, e.g. token create tablet -actions read
+	var name string
+	rest := args[1:]
+	if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		name, rest = rest[0], rest[1:]
+	}
+	err := flags.Parse(rest)
+	if err != nil {
+		return
+	}
+	store := tokens.Store{Path: *tokenFile}
+
+	switch args[0] {
+	case "create":
+		secret, token, err := store.Create(name, splitList(*devices), splitList(*groups), splitList(*actions))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("Created token %s (%s) allowed to %s on %s\n", token.Name, token.ID, strings.Join(token.Actions, ", "), tokenScope(token))
+		fmt.Println("Give this token to the client, it is not shown again:")
+		fmt.Println(secret)
+
+	case "list":
+		list, err := store.Load()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		enabled, err := store.Enabled()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if !enabled {
+			fmt.Println("No tokens, the server does not require authentication")
+			return
+		}
+		if len(list) == 0 {
+			fmt.Println("No tokens, the server refuses every request")
+			return
+		}
+		for _, token := range list {
+			status := "active"
+			if token.Revoked != nil {
+				status = "revoked " + token.Revoked.Format(time.DateOnly)
+			}
+			fmt.Printf("%s  %-16s %-20s %-28s %s\n", token.ID, token.Name, strings.Join(token.Actions, ","), tokenScope(token), status)
+		}
+
+	case "revoke":
+		token, err := store.Revoke(name)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("Revoked token %s (%s)\n", token.Name, token.ID)
+
+	case "audit":
+		entries, err := server.ReadAuditLog(*auditFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if len(entries) > *count {
+			entries = entries[len(entries)-*count:]
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s  %-16s %-6s %-28s %d %s\n", entry.Time.Local().Format(time.DateTime), entry.Token, entry.Method, entry.Path, entry.Status, entry.Body)
+		}
+
+	default:
+		fmt.Println(tokenUsage)
+	}
+	return
+}
+
+// tokenScope describes the devices a token covers.
+func tokenScope(token tokens.Token) string {
+	if token.AllDevices() {
+		return "all devices"
+	}
+	var scope []string
+	scope = append(scope, token.Devices...)
+	for _, group := range token.Groups {
+		scope = append(scope, "group "+group)
+	}
+	return strings.Join(scope, ", ")
+}
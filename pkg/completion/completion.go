@@ -0,0 +1,297 @@
+package completion
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/seanpden/govee_controller/pkg/effects"
+	"github.com/seanpden/govee_controller/pkg/gradient"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// Device is the part of a cached device completion needs to know about.
+type Device struct {
+	Name   string
+	TemMin int
+	TemMax int
+	// Scenes are the names of the light scenes cached for the device.
+	Scenes []string
+}
+
+// Source holds everything candidates are completed from.
+type Source struct {
+	Commands []string
+	Flags    []string
+	Devices  []Device
+	Groups   []string
+}
+
+// LoadSource reads the device registry (devices.json) and the device groups
+// (groups.json) from the current directory. Missing or broken files are
+// ignored, completion should never fail because of them.
+func LoadSource(commands []string, flags []string) Source {
+	src := Source{Commands: commands, Flags: flags}
+
+	devices, err := utils.LoadFromJSON(utils.RegistryFile)
+	if err == nil {
+		for _, device := range devices.Data.Devices {
+			var scenes []string
+			for _, scene := range device.Scenes {
+				scenes = append(scenes, scene.Name)
+			}
+			src.Devices = append(src.Devices, Device{
+				Name:   device.DeviceName,
+				TemMin: device.Properties.ColorTem.Range.Min,
+				TemMax: device.Properties.ColorTem.Range.Max,
+				Scenes: scenes,
+			})
+		}
+	}
+
+	groups, err := utils.LoadGroups("groups.json")
+	if err == nil {
+		for name := range groups {
+			src.Groups = append(src.Groups, name)
+		}
+		sort.Strings(src.Groups)
+	}
+
+	return src
+}
+
+// Complete returns the candidates for the last element of args, given the
+// words before it. args does not include the program name, its last element
+// is the (possibly empty) word being completed.
+//
+// Both the flag form (-CMD color -DEVICE x -VALUE red) and the positional
+// form (color x red) are understood.
+func Complete(src Source, args []string) []string {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	current := args[len(args)-1]
+	words := args[:len(args)-1]
+
+	// the word after a flag is that flag's value
+	if len(words) > 0 {
+		switch strings.TrimLeft(words[len(words)-1], "-") {
+		case "CMD":
+			return filter(src.Commands, current)
+		case "DEVICE":
+			return completeDevices(src, current)
+		case "VALUE":
+			cmd, devices := parseWords(words)
+			return filter(values(src, cmd, devices), current)
+		}
+	}
+
+	if strings.HasPrefix(current, "-") {
+		return filter(src.Flags, current)
+	}
+
+	cmd, _ := parseWords(words)
+	positional := positionalWords(words)
+	switch len(positional) {
+	case 0:
+		return filter(src.Commands, current)
+	case 1:
+		switch cmd {
+		case "completion":
+			return filter([]string{"bash", "zsh", "fish"}, current)
+		case "auth":
+			return filter([]string{"login", "logout", "status"}, current)
+		case "token":
+			return filter([]string{"create", "list", "revoke", "audit"}, current)
+		case "rules":
+			return filter([]string{"check", "eval", "run"}, current)
+		case "schedule":
+			return filter([]string{"list", "add", "edit", "remove", "enable", "disable", "now", "history", "run"}, current)
+		case "list", "config", "serve", "bridge", "lansim":
+			return nil
+		case "tui":
+			return filter(values(src, cmd, nil), current)
+		}
+		return completeDevices(src, current)
+	case 2:
+		return filter(values(src, cmd, splitDevices(positional[1])), current)
+	}
+	return nil
+}
+
+// parseWords finds the command and the devices in the words typed so far.
+func parseWords(words []string) (string, []string) {
+	var cmd string
+	var devices []string
+
+	positional := positionalWords(words)
+	if len(positional) > 0 {
+		cmd = positional[0]
+	}
+	if len(positional) > 1 {
+		devices = splitDevices(positional[1])
+	}
+
+	for i := 0; i < len(words)-1; i++ {
+		switch strings.TrimLeft(words[i], "-") {
+		case "CMD":
+			cmd = words[i+1]
+		case "DEVICE":
+			devices = append(devices, splitDevices(words[i+1])...)
+		}
+	}
+	return cmd, devices
+}
+
+// positionalWords drops the flags and their values from words.
+func positionalWords(words []string) []string {
+	var positional []string
+	for i := 0; i < len(words); i++ {
+		if strings.HasPrefix(words[i], "-") {
+			// flags given as -FLAG=value do not consume the next word
+			if !strings.Contains(words[i], "=") && takesValue(words[i]) {
+				i++
+			}
+			continue
+		}
+		positional = append(positional, words[i])
+	}
+	return positional
+}
+
+func takesValue(flag string) bool {
+	switch strings.TrimLeft(flag, "-") {
+	case "h", "help":
+		return false
+	}
+	return true
+}
+
+func splitDevices(value string) []string {
+	var devices []string
+	for _, device := range strings.Split(value, ",") {
+		if device != "" {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+// completeDevices completes a comma separated list of devices and groups,
+// only the part after the last comma is completed.
+func completeDevices(src Source, current string) []string {
+	prefix := ""
+	if i := strings.LastIndex(current, ","); i >= 0 {
+		prefix, current = current[:i+1], current[i+1:]
+	}
+
+	names := []string{"all"}
+	names = append(names, src.Groups...)
+	for _, device := range src.Devices {
+		names = append(names, device.Name)
+	}
+
+	var candidates []string
+	for _, name := range filter(names, current) {
+		candidates = append(candidates, prefix+name)
+	}
+	return candidates
+}
+
+// values returns the candidate values for a command. For color_temp the range
+// is narrowed down to what every given device supports.
+func values(src Source, cmd string, devices []string) []string {
+	switch cmd {
+	case "turn":
+		return []string{"on", "off"}
+	case "brightness":
+		return steps(0, 100, 10)
+	case "color":
+		var names []string
+		for _, named := range utils.NamedColors {
+			names = append(names, named.Name)
+		}
+		return names
+	case "color_temp":
+		min, max := 2000, 9000
+		for _, name := range devices {
+			for _, device := range src.Devices {
+				if device.Name != name || device.TemMin == 0 || device.TemMax == 0 {
+					continue
+				}
+				if device.TemMin > min {
+					min = device.TemMin
+				}
+				if device.TemMax < max {
+					max = device.TemMax
+				}
+			}
+		}
+		return steps(min, max, 500)
+	case "tui":
+		return []string{"10s", "30s", "1m", "5m"}
+	case "effect":
+		return effects.Names
+	case "segment":
+		return []string{"all"}
+	case "gradient":
+		names := gradient.PaletteNames()
+		for _, named := range utils.NamedColors {
+			names = append(names, named.Name)
+		}
+		return names
+	case "scene":
+		// the scenes the devices have in common
+		var names []string
+		matched := false
+		for _, name := range devices {
+			for _, device := range src.Devices {
+				if device.Name != name {
+					continue
+				}
+				if matched {
+					names = common(names, device.Scenes)
+				} else {
+					names, matched = device.Scenes, true
+				}
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// steps lists the values from min to max in increments of step, always
+// including both ends.
+func steps(min, max, step int) []string {
+	var values []string
+	for value := min; value < max; value += step {
+		values = append(values, fmt.Sprint(value))
+	}
+	return append(values, fmt.Sprint(max))
+}
+
+// filter keeps the candidates starting with prefix, ignoring case.
+func filter(candidates []string, prefix string) []string {
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(prefix)) {
+			matches = append(matches, candidate)
+		}
+	}
+	return matches
+}
+
+// common returns the names in both lists.
+func common(names []string, other []string) []string {
+	var kept []string
+	for _, name := range names {
+		for _, candidate := range other {
+			if name == candidate {
+				kept = append(kept, name)
+				break
+			}
+		}
+	}
+	return kept
+}
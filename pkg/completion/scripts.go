@@ -0,0 +1,171 @@
+package completion
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Script returns the completion script for shell. The scripts call back into
+// the program with the hidden __complete command, so the candidates always
+// reflect the current device registry.
+//
+// Parameters:
+// - shell: One of "bash", "zsh" or "fish".
+// - program: The name the program is invoked as.
+//
+// Returns:
+// - string: The completion script.
+// - error: An error if the shell is not supported.
+func Script(shell string, program string) (string, error) {
+	fn := "_" + strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' {
+			return '_'
+		}
+		return r
+	}, program)
+
+	switch shell {
+	case "bash":
+		return fmt.Sprintf(bashScript, fn, program, program, fn, program), nil
+	case "zsh":
+		return fmt.Sprintf(zshScript, program, fn, program, fn, program), nil
+	case "fish":
+		return fmt.Sprintf(fishScript, program, fn), nil
+	}
+	return "", fmt.Errorf("unsupported shell %q, expected bash, zsh or fish", shell)
+}
+
+// bash splits words on COMP_WORDBREAKS, which includes the ':' found in
+// device names, so the whole line is handed over and the candidates come back
+// already escaped and trimmed to the part bash is going to replace.
+const bashScript = `# bash completion for %[2]s
+# source <(%[2]s completion bash)
+%[1]s() {
+    local IFS=$'\n'
+    COMPREPLY=($(COMP_LINE="$COMP_LINE" COMP_POINT="$COMP_POINT" %[3]s __complete bash "${COMP_WORDS[COMP_CWORD]}" 2>/dev/null))
+}
+complete -F %[4]s %[5]s
+`
+
+const zshScript = `#compdef %[1]s
+# source <(%[1]s completion zsh)
+%[2]s() {
+    local -a candidates
+    candidates=("${(@f)$(%[3]s __complete zsh "${(@Q)words[2,CURRENT]}" 2>/dev/null)}")
+    compadd -a candidates
+}
+compdef %[4]s %[5]s
+`
+
+const fishScript = `# fish completion for %[1]s
+# %[1]s completion fish | source
+function %[2]s
+    set -l tokens (commandline -opc)
+    %[1]s __complete fish $tokens[2..-1] (commandline -ct | string unescape) 2>/dev/null
+end
+complete -c %[1]s -f -a '(%[2]s)'
+`
+
+// BashCandidates completes the command line bash hands over in COMP_LINE and
+// COMP_POINT. bashWord is the word bash considers current, which can be just
+// the tail of the real word when it contains a COMP_WORDBREAKS character.
+func BashCandidates(src Source, line string, point int, bashWord string) []string {
+	if point >= 0 && point <= len(line) {
+		line = line[:point]
+	}
+
+	words, raw := splitShellWords(line)
+	// drop the program name
+	if len(words) > 0 {
+		words, raw = words[1:], raw[1:]
+	}
+	if len(words) == 0 {
+		words, raw = []string{""}, []string{""}
+	}
+	rawCurrent := raw[len(raw)-1]
+
+	var candidates []string
+	for _, candidate := range Complete(src, words) {
+		escaped := bashQuote(candidate, rawCurrent)
+		if strings.HasSuffix(rawCurrent, bashWord) && len(rawCurrent) >= len(bashWord) {
+			trim := len(rawCurrent) - len(bashWord)
+			if trim > len(escaped) {
+				continue
+			}
+			escaped = escaped[trim:]
+		}
+		candidates = append(candidates, escaped)
+	}
+	return candidates
+}
+
+// bashQuote escapes a candidate the same way the user started quoting it.
+func bashQuote(candidate string, rawCurrent string) string {
+	if strings.HasPrefix(rawCurrent, `"`) {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(candidate) + `"`
+	}
+	if strings.HasPrefix(rawCurrent, "'") {
+		return "'" + strings.ReplaceAll(candidate, "'", `'\''`) + "'"
+	}
+
+	var b strings.Builder
+	for _, r := range candidate {
+		if strings.ContainsRune(" \t()[]{};&|<>!$`'\"\\*?", r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// splitShellWords splits a command line into words the way a shell would,
+// returning both the unquoted words and the raw text of each word. A trailing
+// blank starts a new empty word.
+func splitShellWords(line string) ([]string, []string) {
+	var words, raw []string
+	var word, rawWord strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			rawWord.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			rawWord.WriteRune(r)
+			escaped = true
+			inWord = true
+		case quote != 0:
+			rawWord.WriteRune(r)
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			rawWord.WriteRune(r)
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				raw = append(raw, rawWord.String())
+				word.Reset()
+				rawWord.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			rawWord.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	// the last word is the one being completed, it may be empty
+	words = append(words, word.String())
+	raw = append(raw, rawWord.String())
+	return words, raw
+}
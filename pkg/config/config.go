@@ -0,0 +1,308 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/seanpden/govee_controller/pkg/redact"
+)
+
+// Transports of Config.Transport. Only the cloud API exists so far, LAN and
+// auto are refused by Validate until a LAN transport does.
+const (
+	TransportCloud = "cloud"
+	TransportLAN   = "lan"
+	TransportAuto  = "auto"
+)
+
+// Output formats accepted for Config.Output.
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// Config holds the settings of the controller. Every layer (defaults, config
+// file, profile, environment, flags) is a Config, zero fields in a layer leave
+// the value from the layer below untouched.
+type Config struct {
+	APIKey    string   `json:"api_key,omitempty"`
+	BaseURL   string   `json:"base_url,omitempty"`
+	Transport string   `json:"transport,omitempty"`
+	Timeout   Duration `json:"timeout,omitempty"`
+	Output    string   `json:"output,omitempty"`
+	Devices   []string `json:"devices,omitempty"`
+	// Accounts maps account names to API keys, for controlling the devices
+	// of several Govee accounts at once.
+	Accounts map[string]string `json:"accounts,omitempty"`
+	// Latitude and Longitude place the devices, for schedules relative to
+	// sunrise and sunset. Both are needed, in degrees, north and east
+	// positive.
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+// File is the layout of the per-user config file. The top level settings are
+// shared by every profile, a profile overrides them.
+type File struct {
+	Config
+	DefaultProfile string            `json:"default_profile,omitempty"`
+	Profiles       map[string]Config `json:"profiles,omitempty"`
+}
+
+// Options select where Load reads the config from.
+type Options struct {
+	// Path of the config file, DefaultPath() if empty.
+	Path string
+	// Profile to use, falls back to GOVEE_PROFILE and then the file's
+	// default_profile.
+	Profile string
+	// Flags holds the settings given on the command line.
+	Flags Config
+}
+
+// Duration is a time.Duration written as "10s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Defaults returns the built-in settings.
+func Defaults() Config {
+	return Config{
+		BaseURL:   "https://developer-api.govee.com",
+		Transport: TransportCloud,
+		Timeout:   Duration(10 * time.Second),
+		Output:    OutputText,
+	}
+}
+
+// DefaultPath returns the location of the per-user config file,
+// $GOVEE_CONFIG or govee/config.json in the user's config directory.
+func DefaultPath() string {
+	if path := os.Getenv("GOVEE_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "govee.json"
+	}
+	return filepath.Join(dir, "govee", "config.json")
+}
+
+// Load resolves the settings from every layer, in increasing priority:
+// built-in defaults, the config file, the selected profile, environment
+// variables (including a .env file in the current directory) and flags.
+//
+// Parameters:
+// - opts: Where to read the config file from and the flag layer.
+//
+// Returns:
+// - Config: The resolved settings.
+// - string: The name of the profile used, empty if none.
+// - error: An error if a layer could not be read or the result is invalid.
+func Load(opts Options) (Config, string, error) {
+	// a missing .env is fine, the variables may already be exported
+	err := godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Config{}, "", err
+	}
+
+	path := opts.Path
+	if path == "" {
+		path = DefaultPath()
+	}
+	file, err := LoadFile(path)
+	if err != nil {
+		return Config{}, "", err
+	}
+
+	cfg := Defaults()
+	cfg.Merge(file.Config)
+
+	profile := opts.Profile
+	if profile == "" {
+		profile = os.Getenv("GOVEE_PROFILE")
+	}
+	if profile == "" {
+		profile = file.DefaultProfile
+	}
+	if profile != "" {
+		profileCfg, ok := file.Profiles[profile]
+		if !ok {
+			return Config{}, "", fmt.Errorf("profile %q not found in %s", profile, path)
+		}
+		cfg.Merge(profileCfg)
+	}
+
+	envCfg, err := FromEnv()
+	if err != nil {
+		return Config{}, "", err
+	}
+	cfg.Merge(envCfg)
+	cfg.Merge(opts.Flags)
+
+	return cfg, profile, cfg.Validate()
+}
+
+// LoadFile reads a config file. A missing file is not an error and results in
+// an empty File.
+func LoadFile(path string) (File, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return File{}, nil
+	}
+	if err != nil {
+		return File{}, err
+	}
+
+	var file File
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return File{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return file, nil
+}
+
+// FromEnv reads the environment layer: GOVEE_APIKEY, GOVEE_BASE_URL,
+// GOVEE_TRANSPORT, GOVEE_TIMEOUT, GOVEE_OUTPUT, GOVEE_DEVICES (comma
+// separated), GOVEE_LATITUDE and GOVEE_LONGITUDE.
+func FromEnv() (Config, error) {
+	cfg := Config{
+		APIKey:    os.Getenv("GOVEE_APIKEY"),
+		BaseURL:   os.Getenv("GOVEE_BASE_URL"),
+		Transport: os.Getenv("GOVEE_TRANSPORT"),
+		Output:    os.Getenv("GOVEE_OUTPUT"),
+	}
+
+	if timeout := os.Getenv("GOVEE_TIMEOUT"); timeout != "" {
+		parsed, err := time.ParseDuration(timeout)
+		if err != nil {
+			return Config{}, fmt.Errorf("GOVEE_TIMEOUT: %w", err)
+		}
+		cfg.Timeout = Duration(parsed)
+	}
+
+	if devices := os.Getenv("GOVEE_DEVICES"); devices != "" {
+		cfg.Devices = strings.Split(devices, ",")
+	}
+
+	for name, field := range map[string]**float64{"GOVEE_LATITUDE": &cfg.Latitude, "GOVEE_LONGITUDE": &cfg.Longitude} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %w", name, err)
+		}
+		*field = &parsed
+	}
+
+	return cfg, nil
+}
+
+// Merge overrides the settings in c with every non-zero setting in other.
+func (c *Config) Merge(other Config) {
+	if other.APIKey != "" {
+		c.APIKey = other.APIKey
+	}
+	if other.BaseURL != "" {
+		c.BaseURL = other.BaseURL
+	}
+	if other.Transport != "" {
+		c.Transport = other.Transport
+	}
+	if other.Timeout != 0 {
+		c.Timeout = other.Timeout
+	}
+	if other.Output != "" {
+		c.Output = other.Output
+	}
+	if len(other.Devices) > 0 {
+		c.Devices = other.Devices
+	}
+	if len(other.Accounts) > 0 {
+		c.Accounts = other.Accounts
+	}
+	if other.Latitude != nil {
+		c.Latitude = other.Latitude
+	}
+	if other.Longitude != nil {
+		c.Longitude = other.Longitude
+	}
+}
+
+// Validate checks that the settings hold accepted values. A missing API key is
+// not checked here, not every command needs one.
+func (c Config) Validate() error {
+	switch c.Transport {
+	case TransportCloud:
+	case TransportLAN, TransportAuto:
+		return fmt.Errorf("transport %q is not supported yet, use %s", c.Transport, TransportCloud)
+	default:
+		return fmt.Errorf("transport must be %s, got %q", TransportCloud, c.Transport)
+	}
+
+	switch c.Output {
+	case OutputText, OutputJSON:
+	default:
+		return fmt.Errorf("output must be %s or %s, got %q", OutputText, OutputJSON, c.Output)
+	}
+
+	if c.Timeout < 0 {
+		return errors.New("timeout can not be negative")
+	}
+
+	if !strings.HasPrefix(c.BaseURL, "http://") && !strings.HasPrefix(c.BaseURL, "https://") {
+		return fmt.Errorf("base url must start with http:// or https://, got %q", c.BaseURL)
+	}
+
+	if (c.Latitude == nil) != (c.Longitude == nil) {
+		return errors.New("latitude and longitude must be set together")
+	}
+	if c.Latitude != nil && (*c.Latitude < -90 || *c.Latitude > 90) {
+		return fmt.Errorf("latitude must be between -90 and 90, got %v", *c.Latitude)
+	}
+	if c.Longitude != nil && (*c.Longitude < -180 || *c.Longitude > 180) {
+		return fmt.Errorf("longitude must be between -180 and 180, got %v", *c.Longitude)
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of c that is safe to print, only the last four
+// characters of the API keys are kept.
+func (c Config) Redacted() Config {
+	c.APIKey = redact.Mask(c.APIKey)
+	if c.Accounts != nil {
+		accounts := map[string]string{}
+		for name, key := range c.Accounts {
+			accounts[name] = redact.Mask(key)
+		}
+		c.Accounts = accounts
+	}
+	return c
+}
@@ -0,0 +1,208 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/config"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// ErrUnknownDevice is returned for device names that are not in the device
+// registry, which the API would otherwise skip without a word.
+var ErrUnknownDevice = errors.New("device is not in devices.json, run 'list' to refresh it")
+
+// State is a desired device state. Only the fields that are set are applied.
+type State struct {
+	Power      string `json:"power,omitempty"`
+	Brightness *int   `json:"brightness,omitempty"`
+	Color      *Color `json:"color,omitempty"`
+	ColorTem   *int   `json:"colorTem,omitempty"`
+}
+
+// Color is a structs.Color that can also be given as a color name, "#rrggbb"
+// or "r,g,b" in JSON, see utils.ParseColor.
+type Color structs.Color
+
+func (c *Color) UnmarshalJSON(data []byte) error {
+	var text string
+	if json.Unmarshal(data, &text) == nil {
+		color, err := utils.ParseColor(text)
+		if err != nil {
+			return err
+		}
+		*c = Color(color)
+		return nil
+	}
+
+	var color structs.Color
+	err := json.Unmarshal(data, &color)
+	if err != nil {
+		return err
+	}
+	*c = Color(color)
+	return nil
+}
+
+// Scene is a named set of device states, applied in order.
+type Scene []SceneStep
+
+// SceneStep sets the devices (or groups) to a state.
+type SceneStep struct {
+	Devices []string `json:"devices"`
+	State   State    `json:"state"`
+}
+
+// LoadScenes loads the scenes from a JSON file mapping scene names to steps,
+// e.g. {"movie": [{"devices": ["office"], "state": {"power": "on", "brightness": 20}}]}.
+func LoadScenes(filepath string) (map[string]Scene, error) {
+	file, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	var scenes map[string]Scene
+	err = json.Unmarshal(file, &scenes)
+	if err != nil {
+		return nil, err
+	}
+
+	return scenes, nil
+}
+
+// IsEmpty reports whether the state sets nothing.
+func (s State) IsEmpty() bool {
+	return s.Power == "" && s.Brightness == nil && s.Color == nil && s.ColorTem == nil
+}
+
+// Validate checks the values of the state against the ranges the control
+// functions accept, without sending anything.
+func (s State) Validate() error {
+	if s.IsEmpty() {
+		return errors.New("state sets nothing, expected power, brightness, color or colorTem")
+	}
+	if s.Power != "" && s.Power != "on" && s.Power != "off" {
+		return fmt.Errorf("power must be on or off, got %q", s.Power)
+	}
+	if s.Brightness != nil && (*s.Brightness < 0 || *s.Brightness > 100) {
+		return errors.New("brightness must be between 0-100")
+	}
+	if s.Color != nil {
+		c := s.Color
+		if c.R > 255 || c.R < 0 || c.G > 255 || c.G < 0 || c.B > 255 || c.B < 0 {
+			return errors.New("r, g, and b must be between 0 and 255")
+		}
+	}
+	if s.ColorTem != nil && (*s.ColorTem < 2000 || *s.ColorTem > 9000) {
+		return errors.New("colorTem must be between 2000-9000")
+	}
+	return nil
+}
+
+// Apply sets devices to a state. A device is turned on before and turned off
+// after the other settings are applied, since a device that is off ignores
+// them.
+//
+// Parameters:
+// - devices: The names of the devices, as found in devices.json.
+// - state: The state to apply.
+// - APIKEY: The API key used for devices without an account.
+//
+// Returns:
+// - error: The validation error, or the errors of every unknown device and
+// every command that failed.
+func Apply(devices []string, state State, APIKEY string) error {
+	err := state.Validate()
+	if err != nil {
+		return err
+	}
+
+	// the known devices are still set when some names don't resolve
+	_, missing, err := apiwrapper.ResolveDevices(devices)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, name := range missing {
+		errs = append(errs, fmt.Errorf("%q: %w", name, ErrUnknownDevice))
+	}
+	devices = slices.DeleteFunc(slices.Clone(devices), func(name string) bool {
+		return slices.Contains(missing, name)
+	})
+	if len(devices) == 0 {
+		return errors.Join(errs...)
+	}
+
+	if state.Power == "on" {
+		errs = append(errs, check(apiwrapper.TurnDeviceOn(devices, APIKEY)))
+	}
+	if state.Brightness != nil {
+		errs = append(errs, check(apiwrapper.SetDeviceBrightness(devices, *state.Brightness, APIKEY)))
+	}
+	if state.Color != nil {
+		errs = append(errs, check(apiwrapper.SetDeviceRGB(devices, state.Color.R, state.Color.G, state.Color.B, APIKEY)))
+	}
+	if state.ColorTem != nil {
+		errs = append(errs, check(apiwrapper.SetDeviceColorTemp(devices, *state.ColorTem, APIKEY)))
+	}
+	if state.Power == "off" {
+		errs = append(errs, check(apiwrapper.TurnDeviceOff(devices, APIKEY)))
+	}
+	return errors.Join(errs...)
+}
+
+// ApplyScene applies every step of a scene in order, expanding group names.
+func ApplyScene(scene Scene, groups map[string][]string, APIKEY string) error {
+	var errs []error
+	for _, step := range scene {
+		errs = append(errs, Apply(utils.ExpandGroups(step.Devices, groups), step.State, APIKEY))
+	}
+	return errors.Join(errs...)
+}
+
+// check turns a response the API rejected into an error.
+func check(response structs.ControlDeviceResponse, err error) error {
+	if err != nil {
+		return err
+	}
+	// an empty response means no device matched, nothing was sent
+	if response.Code != 0 && response.Code != 200 {
+		return fmt.Errorf("%d %s", response.Code, response.Message)
+	}
+	return nil
+}
+
+// Routine is a named sequence of steps with waits in between, e.g. a slow
+// wake-up light.
+type Routine []RoutineStep
+
+// RoutineStep applies a state to devices (or groups), or applies a scene,
+// then waits before the next step.
+type RoutineStep struct {
+	Devices []string        `json:"devices,omitempty"`
+	State   State           `json:"state,omitempty"`
+	Scene   string          `json:"scene,omitempty"`
+	Wait    config.Duration `json:"wait,omitempty"`
+}
+
+// LoadRoutines loads the routines from a JSON file mapping routine names to
+// steps, e.g. {"wake-up": [{"devices": ["bedroom"], "state": {"power": "on", "brightness": 1}, "wait": "5m"}]}.
+func LoadRoutines(filepath string) (map[string]Routine, error) {
+	file, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	var routines map[string]Routine
+	err = json.Unmarshal(file, &routines)
+	if err != nil {
+		return nil, err
+	}
+
+	return routines, nil
+}
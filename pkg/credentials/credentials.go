@@ -0,0 +1,268 @@
+package credentials
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Key derivation methods recorded in the store file.
+const (
+	KDFScrypt  = "scrypt"
+	KDFKeyFile = "keyfile"
+)
+
+// scrypt parameters recommended for interactive logins.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+	keySize = 32
+)
+
+// ErrPassphraseRequired is returned when the store is passphrase protected
+// and no passphrase was given.
+var ErrPassphraseRequired = errors.New("credential store is passphrase protected")
+
+// Store is an encrypted file holding API keys by name, usually the name of a
+// config profile. The keys are sealed with AES-256-GCM, the encryption key is
+// either derived from a passphrase or read from a separate key file.
+type Store struct {
+	// Path of the encrypted store.
+	Path string
+	// KeyFile holds the random encryption key when no passphrase is used. It
+	// is created on the first save.
+	KeyFile string
+	// Passphrase, if set, is used to derive the encryption key with scrypt.
+	Passphrase string
+}
+
+// envelope is the on-disk layout of the store.
+type envelope struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// DefaultStore returns the store in the user's config directory, using
+// $GOVEE_PASSPHRASE as passphrase if it is set.
+func DefaultStore() Store {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	dir = filepath.Join(dir, "govee")
+	return Store{
+		Path:       filepath.Join(dir, "credentials.enc"),
+		KeyFile:    filepath.Join(dir, "credentials.key"),
+		Passphrase: os.Getenv("GOVEE_PASSPHRASE"),
+	}
+}
+
+// Exists reports whether the store file has been created.
+func (s Store) Exists() bool {
+	_, err := os.Stat(s.Path)
+	return err == nil
+}
+
+// KDF returns how the existing store file is protected, KDFScrypt or
+// KDFKeyFile. It is empty if the store does not exist yet.
+func (s Store) KDF() (string, error) {
+	env, err := s.readEnvelope()
+	if err != nil || env == nil {
+		return "", err
+	}
+	return env.KDF, nil
+}
+
+// Load decrypts and returns every stored key. A store that does not exist yet
+// holds no keys.
+func (s Store) Load() (map[string]string, error) {
+	env, err := s.readEnvelope()
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		return map[string]string{}, nil
+	}
+
+	key, err := s.encryptionKey(env.KDF, env.Salt, false)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, env.Nonce, env.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("could not decrypt the credential store, wrong passphrase or key file")
+	}
+
+	keys := map[string]string{}
+	err = json.Unmarshal(plaintext, &keys)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Save encrypts and writes keys, replacing the store. An empty map removes
+// the store file.
+func (s Store) Save(keys map[string]string) error {
+	if len(keys) == 0 {
+		err := os.Remove(s.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	env := envelope{Version: 1, KDF: KDFKeyFile}
+	if s.Passphrase != "" {
+		env.KDF = KDFScrypt
+		env.Salt = make([]byte, 16)
+		_, err := rand.Read(env.Salt)
+		if err != nil {
+			return err
+		}
+	}
+
+	key, err := s.encryptionKey(env.KDF, env.Salt, true)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	env.Nonce = make([]byte, gcm.NonceSize())
+	_, err = rand.Read(env.Nonce)
+	if err != nil {
+		return err
+	}
+	env.Ciphertext = gcm.Seal(nil, env.Nonce, plaintext, nil)
+
+	data, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.Path), 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.Path, data, 0600)
+}
+
+// Get returns the key stored under name.
+func (s Store) Get(name string) (string, bool, error) {
+	keys, err := s.Load()
+	if err != nil {
+		return "", false, err
+	}
+	key, ok := keys[name]
+	return key, ok, nil
+}
+
+// Set stores key under name, keeping the other keys.
+func (s Store) Set(name string, key string) error {
+	keys, err := s.Load()
+	if err != nil {
+		return err
+	}
+	keys[name] = key
+	return s.Save(keys)
+}
+
+// Delete removes the key stored under name. It reports whether there was one.
+func (s Store) Delete(name string) (bool, error) {
+	keys, err := s.Load()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := keys[name]; !ok {
+		return false, nil
+	}
+	delete(keys, name)
+	return true, s.Save(keys)
+}
+
+// readEnvelope reads the store file, returning nil if it does not exist.
+func (s Store) readEnvelope() (*envelope, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var env envelope
+	err = json.Unmarshal(data, &env)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Path, err)
+	}
+	if env.Version != 1 {
+		return nil, fmt.Errorf("%s: unsupported version %d", s.Path, env.Version)
+	}
+	return &env, nil
+}
+
+// encryptionKey returns the AES key for the given derivation method. With
+// create set a missing key file is generated.
+func (s Store) encryptionKey(kdf string, salt []byte, create bool) ([]byte, error) {
+	switch kdf {
+	case KDFScrypt:
+		if s.Passphrase == "" {
+			return nil, ErrPassphraseRequired
+		}
+		return scrypt.Key([]byte(s.Passphrase), salt, scryptN, scryptR, scryptP, keySize)
+
+	case KDFKeyFile:
+		key, err := os.ReadFile(s.KeyFile)
+		if errors.Is(err, fs.ErrNotExist) && create {
+			key = make([]byte, keySize)
+			_, err = rand.Read(key)
+			if err != nil {
+				return nil, err
+			}
+			err = os.MkdirAll(filepath.Dir(s.KeyFile), 0700)
+			if err != nil {
+				return nil, err
+			}
+			return key, os.WriteFile(s.KeyFile, key, 0600)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != keySize {
+			return nil, fmt.Errorf("%s: key file must hold %d bytes", s.KeyFile, keySize)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key derivation %q", kdf)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,364 @@
+package effects
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/config"
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/poller"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// Names of the effects.
+const (
+	Flash   = "flash"
+	Breathe = "breathe"
+	Strobe  = "strobe"
+	Cycle   = "cycle"
+	Police  = "police"
+)
+
+// Names lists every effect, for help and completion.
+var Names = []string{Breathe, Cycle, Flash, Police, Strobe}
+
+// CloudMinFrame is the shortest time a frame is shown through the cloud API,
+// which takes a few hundred milliseconds per command.
+const CloudMinFrame = time.Second
+
+// ErrOverBudget is returned instead of starting an effect the rate limit
+// budget of a key can't afford.
+var ErrOverBudget = errors.New("not enough rate limit budget for the effect")
+
+// ErrBusy is returned for devices already playing an effect.
+var ErrBusy = errors.New("already playing an effect")
+
+// Effect is a timed pattern of colors and brightness.
+type Effect struct {
+	Name string `json:"name"`
+	// Color is the color of flash, strobe and breathe, white by default.
+	Color *control.Color `json:"color,omitempty"`
+	// Times is how many times the pattern repeats.
+	Times int `json:"times,omitempty"`
+	// Period is the length of one repeat.
+	Period config.Duration `json:"period,omitempty"`
+}
+
+// defaults holds the repeats and period of every effect.
+var defaults = map[string]struct {
+	times  int
+	period time.Duration
+}{
+	Flash:   {3, 2 * time.Second},
+	Strobe:  {10, 2 * time.Second},
+	Breathe: {2, 12 * time.Second},
+	Cycle:   {1, 14 * time.Second},
+	Police:  {4, 2 * time.Second},
+}
+
+// Frame is a state shown for a while.
+type Frame struct {
+	State control.State
+	Hold  time.Duration
+}
+
+// Validate checks the name and values of the effect.
+func (e Effect) Validate() error {
+	if _, ok := defaults[e.Name]; !ok {
+		return fmt.Errorf("unknown effect %q, expected one of %s", e.Name, strings.Join(Names, ", "))
+	}
+	if e.Times < 0 || e.Period < 0 {
+		return errors.New("times and period can not be negative")
+	}
+	if e.Color != nil && (e.Name == Cycle || e.Name == Police) {
+		return fmt.Errorf("the %s effect has its own colors", e.Name)
+	}
+	return nil
+}
+
+// Frames returns the frames of the effect, the first one turns the devices
+// on at full brightness.
+func (e Effect) Frames() ([]Frame, error) {
+	err := e.Validate()
+	if err != nil {
+		return nil, err
+	}
+	times, period := defaults[e.Name].times, defaults[e.Name].period
+	if e.Times > 0 {
+		times = e.Times
+	}
+	if e.Period > 0 {
+		period = time.Duration(e.Period)
+	}
+	color := control.Color{R: 255, G: 255, B: 255}
+	if e.Color != nil {
+		color = *e.Color
+	}
+
+	var frames []Frame
+	switch e.Name {
+	case Flash, Strobe:
+		for i := 0; i < times; i++ {
+			frames = append(frames, Frame{State: control.State{Power: "on"}, Hold: period / 2})
+			frames = append(frames, Frame{State: control.State{Power: "off"}, Hold: period / 2})
+		}
+		// end on, the state is restored from there
+		frames = frames[:len(frames)-1]
+		frames[0].State.Color = &color
+	case Breathe:
+		levels := []int{60, 25, 5, 25, 60, 100}
+		for i := 0; i < times; i++ {
+			for _, level := range levels {
+				frames = append(frames, Frame{State: control.State{Brightness: &level}, Hold: period / time.Duration(len(levels))})
+			}
+		}
+		frames = append([]Frame{{State: control.State{Color: &color}, Hold: period / time.Duration(len(levels))}}, frames...)
+	case Cycle:
+		names := []string{"red", "orange", "yellow", "green", "cyan", "blue", "purple"}
+		for i := 0; i < times; i++ {
+			for _, name := range names {
+				parsed, _ := utils.ParseColor(name)
+				c := control.Color(parsed)
+				frames = append(frames, Frame{State: control.State{Color: &c}, Hold: period / time.Duration(len(names))})
+			}
+		}
+	case Police:
+		red, blue := control.Color{R: 255}, control.Color{B: 255}
+		for i := 0; i < times; i++ {
+			frames = append(frames, Frame{State: control.State{Color: &red}, Hold: period / 2})
+			frames = append(frames, Frame{State: control.State{Color: &blue}, Hold: period / 2})
+		}
+	}
+	full := 100
+	frames[0].State.Power = "on"
+	frames[0].State.Brightness = &full
+	return frames, nil
+}
+
+// commands returns the number of commands a state sends to each device.
+func commands(state control.State) int {
+	n := 0
+	for _, set := range []bool{state.Power != "", state.Brightness != nil, state.Color != nil, state.ColorTem != nil} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// Cost returns the requests an effect sends to each device: its frames, the
+// state read before and the commands restoring it after.
+func Cost(frames []Frame) int {
+	requests := 1 + 3
+	for _, frame := range frames {
+		requests += commands(frame.State)
+	}
+	return requests
+}
+
+// Player plays effects on devices and restores their state afterwards.
+//
+// Frames are paced for the cloud API, the only transport so far: a frame
+// shorter than MinFrame is stretched to it. A faster transport can lower it.
+type Player struct {
+	// APIKEY is used for devices without an account.
+	APIKEY   string
+	MinFrame time.Duration
+	// Quota and Reserve bound the requests like the poller's, an effect that
+	// would eat into the reserve is refused.
+	Quota   int
+	Reserve float64
+}
+
+// New returns a player for the cloud API.
+func New(APIKEY string) *Player {
+	return &Player{APIKEY: APIKEY, MinFrame: CloudMinFrame, Quota: poller.DefaultQuota, Reserve: 0.25}
+}
+
+// Result is what playing an effect did.
+type Result struct {
+	Frames int
+	// Stretched is true when frames were shown longer than asked, to stay
+	// within MinFrame.
+	Stretched bool
+	// Restored is false when the state of the devices couldn't be restored.
+	Restored bool
+}
+
+// busy holds the devices playing an effect.
+var (
+	busyMu sync.Mutex
+	busy   = map[string]bool{}
+)
+
+func reserve(names []string) error {
+	busyMu.Lock()
+	defer busyMu.Unlock()
+	for _, name := range names {
+		if busy[name] {
+			return fmt.Errorf("%s is %w", name, ErrBusy)
+		}
+	}
+	for _, name := range names {
+		busy[name] = true
+	}
+	return nil
+}
+
+func release(names []string) {
+	busyMu.Lock()
+	defer busyMu.Unlock()
+	for _, name := range names {
+		delete(busy, name)
+	}
+}
+
+// Play plays an effect on devices, then restores the state they were in.
+// Cancelling ctx stops the effect early, the state is still restored.
+//
+// Parameters:
+// - ctx: Stops the effect.
+// - devices: The names of the devices, as found in devices.json.
+// - effect: The effect to play.
+//
+// Returns:
+// - Result: What was played.
+// - error: ErrOverBudget or ErrBusy before starting, or the errors of the commands that failed.
+func (p *Player) Play(ctx context.Context, devices []string, effect Effect) (Result, error) {
+	var result Result
+	frames, err := effect.Frames()
+	if err != nil {
+		return result, err
+	}
+	found, missing, err := apiwrapper.ResolveDevices(devices)
+	if err != nil {
+		return result, err
+	}
+	if len(missing) > 0 {
+		return result, fmt.Errorf("%s not in devices.json", strings.Join(missing, ", "))
+	}
+	err = p.checkBudget(found, Cost(frames))
+	if err != nil {
+		return result, err
+	}
+
+	var names []string
+	for _, device := range found {
+		names = append(names, device.DeviceName)
+	}
+	err = reserve(names)
+	if err != nil {
+		return result, err
+	}
+	defer release(names)
+
+	// without the prior state the devices couldn't be put back
+	prior := map[string]poller.State{}
+	for _, device := range found {
+		state, err := p.state(device)
+		if err != nil {
+			return result, fmt.Errorf("reading the state of %s: %w", device.DeviceName, err)
+		}
+		prior[device.DeviceName] = state
+	}
+
+	var errs []error
+	for _, frame := range frames {
+		if ctx.Err() != nil {
+			break
+		}
+		hold := frame.Hold
+		if hold < p.MinFrame {
+			hold = p.MinFrame
+			result.Stretched = true
+		}
+		shown := time.Now()
+		errs = append(errs, control.Apply(names, frame.State, p.APIKEY))
+		result.Frames++
+
+		timer := time.NewTimer(hold - time.Since(shown))
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	result.Restored = true
+	for _, name := range names {
+		err := control.Apply([]string{name}, restoreState(prior[name]), p.APIKEY)
+		if err != nil {
+			result.Restored = false
+			errs = append(errs, fmt.Errorf("restoring %s: %w", name, err))
+		}
+	}
+	return result, errors.Join(errs...)
+}
+
+// checkBudget refuses an effect costing requests per device that any key
+// can't afford without eating into its reserve.
+func (p *Player) checkBudget(devices []structs.Device, requests int) error {
+	perKey := map[string]int{}
+	for _, device := range devices {
+		perKey[apiwrapper.KeyFor(device, p.APIKEY)] += requests
+	}
+	keys := make([]string, 0, len(perKey))
+	for key := range perKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	for _, key := range keys {
+		remaining := p.Quota
+		if limit, ok := apiwrapper.GetRateLimit(key); ok && limit.Reset.After(now) {
+			remaining = limit.Remaining
+		}
+		usable := int(float64(remaining) * (1 - p.Reserve))
+		if perKey[key] > usable {
+			return fmt.Errorf("%w: it needs %d requests, %d are left to spare", ErrOverBudget, perKey[key], usable)
+		}
+	}
+	return nil
+}
+
+func (p *Player) state(device structs.Device) (poller.State, error) {
+	response, err := apiwrapper.GetDeviceState(device.Device, device.Model, apiwrapper.KeyFor(device, p.APIKEY))
+	if err == nil && response.Code != 200 {
+		err = fmt.Errorf("%d %s", response.Code, response.Message)
+	}
+	if err != nil {
+		return poller.State{}, err
+	}
+	return poller.Merge(response.Data.Properties), nil
+}
+
+// restoreState returns the state putting a device back as it was. Devices
+// report a color temperature of 0 while showing a color.
+func restoreState(prior poller.State) control.State {
+	// an effect stopped early can leave devices off, the power is always set
+	state := control.State{Power: "off"}
+	if prior.Power == "on" {
+		state.Power = "on"
+	}
+	if prior.Brightness > 0 {
+		brightness := prior.Brightness
+		state.Brightness = &brightness
+	}
+	switch {
+	case prior.ColorTem != 0:
+		kelvin := prior.ColorTem
+		state.ColorTem = &kelvin
+	case prior.Color != nil:
+		color := control.Color(*prior.Color)
+		state.Color = &color
+	}
+	return state
+}
@@ -0,0 +1,467 @@
+package govetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/structs"
+)
+
+// State is the simulated state of a device on the fake server.
+type State struct {
+	Online     bool   `json:"online"`
+	Power      string `json:"power"`
+	Brightness int    `json:"brightness"`
+	// Color and ColorTem are exclusive, setting one clears the other.
+	Color    structs.Color `json:"color"`
+	ColorTem int           `json:"colorTem,omitempty"`
+}
+
+// Fault makes the fake server fail matching requests, e.g. with a 500, or
+// with a 200 carrying an API error code like the real API does for invalid
+// commands.
+type Fault struct {
+	// Method, Path and Device select the requests that fail, empty fields
+	// match every request. Device is the device id of a state or control
+	// request.
+	Method string
+	Path   string
+	Device string
+	// Status is the HTTP status of the response, 200 if zero.
+	Status int
+	// Code and Message are the body of the response, Code defaults to the
+	// status.
+	Code    int
+	Message string
+	// Times is the number of requests that fail, 0 fails every request.
+	Times int
+}
+
+// Request is a request received by the fake server.
+type Request struct {
+	Method string
+	Path   string
+	Key    string
+	// Device and Cmd are set for state and control requests.
+	Device string
+	Cmd    *structs.Command
+}
+
+// Server is an in-process fake of the v1 Govee API: it lists its devices,
+// reports their state and applies control commands to it, like the real API
+// would, without a network or an API key. Tests start it with
+// testapi.Start.
+type Server struct {
+	// URL is the base URL of the server, for apiwrapper.BaseURL.
+	URL string
+
+	server *http.Server
+
+	mu       sync.Mutex
+	devices  []structs.Device
+	states   map[string]*State
+	key      string
+	accounts map[string]bool
+	owners   map[string]string
+	latency  time.Duration
+	limit    int
+	reset    time.Time
+	used     map[string]int
+	faults   []*Fault
+	requests []Request
+	onChange func(id string, state State)
+}
+
+// NewDevice returns a controllable device supporting every v1 command and
+// color temperatures between 2000K and 9000K.
+//
+// Parameters:
+// - id: The device id, a MAC address such as "AA:BB:CC:DD:EE:FF:00:11".
+// - model: The model, e.g. "H6072".
+// - name: The name of the device.
+//
+// Returns:
+// - structs.Device: The device, as listed by the API.
+func NewDevice(id string, model string, name string) structs.Device {
+	device := structs.Device{
+		Device:       id,
+		Model:        model,
+		DeviceName:   name,
+		Controllable: true,
+		Retrievable:  true,
+		SupportCmds:  []string{"turn", "brightness", "color", "colorTem"},
+	}
+	device.Properties.ColorTem.Range.Min = 2000
+	device.Properties.ColorTem.Range.Max = 9000
+	return device
+}
+
+// NewServer starts a fake Govee API on a free loopback port with devices,
+// every device online, off, at full brightness and white. Close it when
+// done.
+//
+// Parameters:
+// - devices: The inventory of the server, more can be added with AddDevice.
+//
+// Returns:
+// - *Server: The running server.
+// - error: An error if no loopback port could be listened on.
+func NewServer(devices ...structs.Device) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{states: map[string]*State{}, accounts: map[string]bool{}, owners: map[string]string{}, used: map[string]int{}}
+	for _, device := range devices {
+		s.AddDevice(device)
+	}
+	s.server = &http.Server{Handler: http.HandlerFunc(s.serveHTTP)}
+	s.URL = "http://" + listener.Addr().String()
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// AddDevice adds a device to the inventory, in its default state.
+func (s *Server) AddDevice(device structs.Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices = append(s.devices, device)
+	s.states[device.Device] = &State{Online: true, Power: "off", Brightness: 100, Color: structs.Color{R: 255, G: 255, B: 255}}
+}
+
+// AddAccount adds devices that only requests with key can list, query and
+// control, like the devices of another Govee account. The key is accepted
+// even if RequireKey was called.
+func (s *Server) AddAccount(key string, devices ...structs.Device) {
+	for _, device := range devices {
+		s.AddDevice(device)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts[key] = true
+	for _, device := range devices {
+		s.owners[device.Device] = key
+	}
+}
+
+// SetState replaces the state of a device, e.g. to take it offline.
+func (s *Server) SetState(id string, state State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[id] = &state
+}
+
+// State returns the state of a device, and false if there is no such device.
+func (s *Server) State(id string) (State, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[id]
+	if !ok {
+		return State{}, false
+	}
+	return *state, true
+}
+
+// RequireKey makes the server reject requests with any other API key, like
+// the real API does with a 401. By default every key is accepted.
+func (s *Server) RequireKey(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = key
+}
+
+// SetLatency delays every response.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// SetRateLimit gives every API key a budget of limit requests until reset,
+// reported in the API-RateLimit-* headers. Requests over the budget get a
+// 429. A limit of 0 removes the budget.
+func (s *Server) SetRateLimit(limit int, reset time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit, s.reset, s.used = limit, reset, map[string]int{}
+}
+
+// Inject makes matching requests fail, see Fault.
+func (s *Server) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+// OnChange calls fn with the new state of a device after every control
+// command that changed it. fn is called while the server is locked and must
+// not call the server's methods.
+func (s *Server) OnChange(fn func(id string, state State)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = fn
+}
+
+// Requests returns the requests received so far, oldest first.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// ClearRequests forgets the requests received so far.
+func (s *Server) ClearRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+}
+
+// Commands returns the control commands received so far, as "device
+// name=value", oldest first.
+func (s *Server) Commands() []string {
+	var commands []string
+	for _, request := range s.Requests() {
+		if request.Cmd != nil {
+			commands = append(commands, fmt.Sprintf("%s %s=%v", request.Device, request.Cmd.Name, request.Cmd.Value))
+		}
+	}
+	return commands
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	request := Request{Method: r.Method, Path: r.URL.Path, Key: r.Header.Get("Govee-API-Key")}
+	var payload structs.Payload
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v1/devices/state":
+		request.Device = r.URL.Query().Get("device")
+		payload.Device, payload.Model = request.Device, r.URL.Query().Get("model")
+	case r.Method == "PUT" && r.URL.Path == "/v1/devices/control":
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, 400, "invalid json: "+err.Error(), nil)
+			return
+		}
+		request.Device, request.Cmd = payload.Device, &payload.Cmd
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	latency := s.latency
+	s.mu.Unlock()
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if request.Key == "" || (s.key != "" && request.Key != s.key && !s.accounts[request.Key]) {
+		writeResponse(w, http.StatusUnauthorized, 401, "Invalid API Key", nil)
+		return
+	}
+	if s.limit > 0 {
+		if time.Now().After(s.reset) {
+			s.used = map[string]int{}
+		}
+		if s.used[request.Key] >= s.limit {
+			s.writeRateLimit(w, request.Key)
+			writeResponse(w, http.StatusTooManyRequests, 429, "Too Many Requests", nil)
+			return
+		}
+		s.used[request.Key]++
+		s.writeRateLimit(w, request.Key)
+	}
+	if fault := s.fault(request); fault != nil {
+		status := fault.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		code := fault.Code
+		if code == 0 {
+			code = status
+		}
+		writeResponse(w, status, code, fault.Message, nil)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v1/devices":
+		var devices []structs.Device
+		for _, device := range s.devices {
+			if s.visible(device.Device, request.Key) {
+				devices = append(devices, device)
+			}
+		}
+		writeResponse(w, http.StatusOK, 200, "Success", map[string]any{"devices": devices})
+	case r.Method == "GET" && r.URL.Path == "/v1/devices/state":
+		s.handleState(w, payload, request.Key)
+	case r.Method == "PUT" && r.URL.Path == "/v1/devices/control":
+		s.handleControl(w, payload, request.Key)
+	default:
+		writeResponse(w, http.StatusNotFound, 404, "Not Found", nil)
+	}
+}
+
+// fault returns the first fault matching a request, using up one of its
+// times.
+func (s *Server) fault(request Request) *Fault {
+	for i, fault := range s.faults {
+		if (fault.Method != "" && fault.Method != request.Method) || (fault.Path != "" && fault.Path != request.Path) || (fault.Device != "" && fault.Device != request.Device) {
+			continue
+		}
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+	return nil
+}
+
+func (s *Server) writeRateLimit(w http.ResponseWriter, key string) {
+	w.Header().Set("API-RateLimit-Limit", strconv.Itoa(s.limit))
+	w.Header().Set("API-RateLimit-Remaining", strconv.Itoa(s.limit-s.used[key]))
+	w.Header().Set("API-RateLimit-Reset", strconv.FormatInt(s.reset.Unix(), 10))
+}
+
+// visible reports whether the account of key has a device.
+func (s *Server) visible(id string, key string) bool {
+	owner, ok := s.owners[id]
+	return !ok || owner == key
+}
+
+// device finds a device of the account of key by id and model, the real API
+// needs both.
+func (s *Server) device(id string, model string, key string) (structs.Device, bool) {
+	for _, device := range s.devices {
+		if device.Device == id && device.Model == model && s.visible(id, key) {
+			return device, true
+		}
+	}
+	return structs.Device{}, false
+}
+
+func (s *Server) handleState(w http.ResponseWriter, payload structs.Payload, key string) {
+	device, ok := s.device(payload.Device, payload.Model, key)
+	if !ok || !device.Retrievable {
+		writeResponse(w, http.StatusBadRequest, 400, "devices not exist", nil)
+		return
+	}
+	state := s.states[device.Device]
+	// like the real API, only the properties the device supports are reported
+	supports := func(cmd string) bool {
+		return len(device.SupportCmds) == 0 || slices.Contains(device.SupportCmds, cmd)
+	}
+	properties := []map[string]any{
+		{"online": state.Online},
+		{"powerState": state.Power},
+	}
+	if supports("brightness") {
+		properties = append(properties, map[string]any{"brightness": state.Brightness})
+	}
+	if state.ColorTem > 0 && supports("colorTem") {
+		properties = append(properties, map[string]any{"colorTem": state.ColorTem})
+	} else if supports("color") {
+		properties = append(properties, map[string]any{"color": state.Color})
+	}
+	writeResponse(w, http.StatusOK, 200, "Success", map[string]any{"device": device.Device, "model": device.Model, "properties": properties})
+}
+
+func (s *Server) handleControl(w http.ResponseWriter, payload structs.Payload, key string) {
+	device, ok := s.device(payload.Device, payload.Model, key)
+	if !ok || !device.Controllable {
+		writeResponse(w, http.StatusBadRequest, 400, "devices not exist", nil)
+		return
+	}
+	state := s.states[device.Device]
+	if !state.Online {
+		writeResponse(w, http.StatusBadRequest, 400, "device offline", nil)
+		return
+	}
+
+	if len(device.SupportCmds) > 0 && !slices.Contains(device.SupportCmds, payload.Cmd.Name) {
+		writeResponse(w, http.StatusBadRequest, 400, "unsupported command "+payload.Cmd.Name, nil)
+		return
+	}
+
+	// the values are decoded as float64 and map[string]any
+	value := payload.Cmd.Value
+	invalid := func() {
+		writeResponse(w, http.StatusBadRequest, 400, fmt.Sprintf("invalid value for %s: %v", payload.Cmd.Name, value), nil)
+	}
+	switch payload.Cmd.Name {
+	case "turn":
+		if value != "on" && value != "off" {
+			invalid()
+			return
+		}
+		state.Power = value.(string)
+	case "brightness":
+		brightness, ok := number(value)
+		if !ok || brightness < 0 || brightness > 100 {
+			invalid()
+			return
+		}
+		state.Brightness = brightness
+	case "color":
+		rgb, _ := value.(map[string]any)
+		r, okR := number(rgb["r"])
+		g, okG := number(rgb["g"])
+		b, okB := number(rgb["b"])
+		if !okR || !okG || !okB || min(r, g, b) < 0 || max(r, g, b) > 255 {
+			invalid()
+			return
+		}
+		state.Color, state.ColorTem = structs.Color{R: r, G: g, B: b}, 0
+	case "colorTem":
+		kelvin, ok := number(value)
+		if !ok || kelvin < device.Properties.ColorTem.Range.Min || kelvin > device.Properties.ColorTem.Range.Max {
+			invalid()
+			return
+		}
+		state.ColorTem = kelvin
+	default:
+		writeResponse(w, http.StatusBadRequest, 400, "unsupported command "+payload.Cmd.Name, nil)
+		return
+	}
+	if s.onChange != nil {
+		s.onChange(device.Device, *state)
+	}
+	writeResponse(w, http.StatusOK, 200, "Success", map[string]any{})
+}
+
+// number converts a JSON number to an int.
+func number(value any) (int, bool) {
+	f, ok := value.(float64)
+	if !ok || f != float64(int(f)) {
+		return 0, false
+	}
+	return int(f), true
+}
+
+func writeResponse(w http.ResponseWriter, status int, code int, message string, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body := map[string]any{"code": code, "message": message}
+	if data != nil {
+		body["data"] = data
+	}
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,34 @@
+package testapi
+
+import (
+	"testing"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/govetest"
+	"github.com/seanpden/govee_controller/pkg/structs"
+)
+
+// Start starts a fake Govee API and points the api wrapper at it until the
+// test ends. It lives apart from package govetest so that the simulator,
+// which serves the same fake, doesn't link the testing package.
+//
+// Parameters:
+// - t: The test the server belongs to.
+// - devices: The inventory of the server.
+//
+// Returns:
+// - *govetest.Server: The running server, closed when the test ends.
+func Start(t testing.TB, devices ...structs.Device) *govetest.Server {
+	t.Helper()
+	s, err := govetest.NewServer(devices...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL := apiwrapper.BaseURL
+	apiwrapper.BaseURL = s.URL
+	t.Cleanup(func() {
+		apiwrapper.BaseURL = baseURL
+		s.Close()
+	})
+	return s
+}
@@ -0,0 +1,191 @@
+package gradient
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// Palettes are named lists of colors a gradient can be made from.
+var Palettes = map[string][]structs.Color{
+	"sunset":  {{R: 255, G: 94, B: 58}, {R: 255, G: 149, B: 0}, {R: 255, G: 42, B: 104}, {R: 90, G: 20, B: 140}},
+	"ocean":   {{R: 0, G: 40, B: 120}, {R: 0, G: 119, B: 182}, {R: 0, G: 180, B: 216}, {R: 144, G: 224, B: 239}},
+	"forest":  {{R: 20, G: 80, B: 30}, {R: 60, G: 140, B: 50}, {R: 150, G: 190, B: 60}},
+	"fire":    {{R: 255, G: 0, B: 0}, {R: 255, G: 90, B: 0}, {R: 255, G: 190, B: 0}},
+	"aurora":  {{R: 0, G: 255, B: 140}, {R: 0, G: 170, B: 255}, {R: 140, G: 60, B: 255}},
+	"pastel":  {{R: 255, G: 179, B: 186}, {R: 255, G: 223, B: 186}, {R: 186, G: 255, B: 201}, {R: 186, G: 225, B: 255}},
+	"rainbow": {{R: 255}, {R: 255, G: 127}, {R: 255, G: 255}, {G: 255}, {B: 255}, {R: 127, B: 255}},
+}
+
+// PaletteNames returns the names of the palettes, sorted.
+func PaletteNames() []string {
+	names := make([]string, 0, len(Palettes))
+	for name := range Palettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseColors parses the stops of a gradient. Each word is a palette name,
+// standing for the colors of the palette, or a color as accepted by
+// utils.ParseColor.
+//
+// Parameters:
+// - words: The palette names and colors.
+//
+// Returns:
+// - []structs.Color: The colors, in order.
+// - error: An error naming the first word that is neither.
+func ParseColors(words []string) ([]structs.Color, error) {
+	var colors []structs.Color
+	for _, word := range words {
+		if palette, ok := Palettes[strings.ToLower(word)]; ok {
+			colors = append(colors, palette...)
+			continue
+		}
+		color, err := utils.ParseColor(word)
+		if err != nil {
+			return nil, fmt.Errorf("%w, or a palette: %s", err, strings.Join(PaletteNames(), ", "))
+		}
+		colors = append(colors, color)
+	}
+	return colors, nil
+}
+
+// Blend returns n colors blending evenly through colors, the first and last
+// ones are the first and last colors. Colors are interpolated in OKLab, so
+// the steps look evenly spaced and a blend through dark colors doesn't
+// brighten or muddy halfway like it does in RGB.
+func Blend(colors []structs.Color, n int) []structs.Color {
+	blended := make([]structs.Color, n)
+	if len(colors) == 0 {
+		return blended
+	}
+	stops := make([]oklab, len(colors))
+	for i, color := range colors {
+		stops[i] = toOKLab(color)
+	}
+	for i := range blended {
+		if len(colors) == 1 || n == 1 {
+			blended[i] = colors[0]
+			continue
+		}
+		// position along the colors, between stops
+		position := float64(i) / float64(n-1) * float64(len(colors)-1)
+		stop := min(int(position), len(colors)-2)
+		t := position - float64(stop)
+		from, to := stops[stop], stops[stop+1]
+		blended[i] = fromOKLab(oklab{
+			L: from.L + t*(to.L-from.L),
+			A: from.A + t*(to.A-from.A),
+			B: from.B + t*(to.B-from.B),
+		})
+	}
+	return blended
+}
+
+// Assignment is the color a device was given.
+type Assignment struct {
+	Device string
+	Color  structs.Color
+	Err    error
+}
+
+// Render paints a gradient across devices, in the order given: the first
+// device gets the first color and the last device the last one. The devices
+// are set concurrently.
+//
+// Parameters:
+// - devices: The names of the devices, as found in devices.json.
+// - colors: The stops of the gradient.
+// - APIKEY: The API key used for devices without an account.
+//
+// Returns:
+// - []Assignment: The color of each device and whether setting it failed.
+// - error: The errors of every device that failed.
+func Render(devices []string, colors []structs.Color, APIKEY string) ([]Assignment, error) {
+	if len(devices) == 0 || len(colors) == 0 {
+		return nil, errors.New("nothing to paint, expected devices and colors")
+	}
+	blended := Blend(colors, len(devices))
+	assignments := make([]Assignment, len(devices))
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		assignments[i] = Assignment{Device: device, Color: blended[i]}
+		wg.Add(1)
+		go func(assignment *Assignment) {
+			defer wg.Done()
+			color := control.Color(assignment.Color)
+			assignment.Err = control.Apply([]string{assignment.Device}, control.State{Color: &color}, APIKEY)
+		}(&assignments[i])
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, assignment := range assignments {
+		if assignment.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", assignment.Device, assignment.Err))
+		}
+	}
+	return assignments, errors.Join(errs...)
+}
+
+// oklab is a color in the OKLab perceptual color space.
+type oklab struct {
+	L, A, B float64
+}
+
+// toOKLab converts an sRGB color to OKLab, see
+// https://bottosson.github.io/posts/oklab/.
+func toOKLab(color structs.Color) oklab {
+	r, g, b := toLinear(color.R), toLinear(color.G), toLinear(color.B)
+	l := math.Cbrt(0.4122214708*r + 0.5363325363*g + 0.0514459929*b)
+	m := math.Cbrt(0.2119034982*r + 0.6806995451*g + 0.1073969566*b)
+	s := math.Cbrt(0.0883024619*r + 0.2817188376*g + 0.6299787005*b)
+	return oklab{
+		L: 0.2104542553*l + 0.7936177850*m - 0.0040720468*s,
+		A: 1.9779984951*l - 2.4285922050*m + 0.4505937099*s,
+		B: 0.0259040371*l + 0.7827717662*m - 0.8086757660*s,
+	}
+}
+
+// fromOKLab converts an OKLab color back to sRGB, clamping colors outside
+// the sRGB gamut.
+func fromOKLab(color oklab) structs.Color {
+	l := math.Pow(color.L+0.3963377774*color.A+0.2158037573*color.B, 3)
+	m := math.Pow(color.L-0.1055613458*color.A-0.0638541728*color.B, 3)
+	s := math.Pow(color.L-0.0894841775*color.A-1.2914855480*color.B, 3)
+	return structs.Color{
+		R: fromLinear(4.0767416621*l - 3.3077115913*m + 0.2309699292*s),
+		G: fromLinear(-1.2684380046*l + 2.6097574011*m - 0.3413193965*s),
+		B: fromLinear(-0.0041960863*l - 0.7034186147*m + 1.7076147010*s),
+	}
+}
+
+// toLinear converts an sRGB component to linear light.
+func toLinear(component int) float64 {
+	c := float64(component) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// fromLinear converts linear light to an sRGB component.
+func fromLinear(c float64) int {
+	c = min(max(c, 0), 1)
+	if c <= 0.0031308 {
+		c *= 12.92
+	} else {
+		c = 1.055*math.Pow(c, 1/2.4) - 0.055
+	}
+	return int(math.Round(c * 255))
+}
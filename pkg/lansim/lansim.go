@@ -0,0 +1,317 @@
+package lansim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/structs"
+)
+
+// The ports of the Govee LAN protocol: devices listen for scans on
+// ScanPort (multicast to 239.255.255.250) and for commands on ControlPort,
+// and send their answers to ReplyPort of the client.
+const (
+	ScanPort    = 4001
+	ReplyPort   = 4002
+	ControlPort = 4003
+)
+
+// State is the state of a simulated device, as reported by devStatus.
+type State struct {
+	On         bool          `json:"on"`
+	Brightness int           `json:"brightness"`
+	Color      structs.Color `json:"color"`
+	// ColorTemInKelvin is 0 while the device shows Color.
+	ColorTemInKelvin int `json:"colorTemInKelvin"`
+}
+
+// Device is a simulated device with LAN control enabled.
+type Device struct {
+	// Device is the device id reported by scan, e.g. "1F:80:C5:32:32:36:72:4E".
+	Device string
+	SKU    string
+	// Addr is the address the device listens for commands on,
+	// "127.0.0.1:0" (any free port) if empty.
+	Addr  string
+	State State
+}
+
+// message is the envelope of every LAN packet.
+type message struct {
+	Msg struct {
+		Cmd  string          `json:"cmd"`
+		Data json.RawMessage `json:"data"`
+	} `json:"msg"`
+}
+
+// Simulator answers the Govee LAN protocol for its devices on loopback:
+// scan requests on ScanAddr, turn, brightness, colorwc and devStatus on the
+// address of each device. Like real devices, only scan and devStatus are
+// answered, the other commands are applied silently.
+type Simulator struct {
+	// ScanAddr is the address scans are received on, "127.0.0.1:0" if empty.
+	ScanAddr string
+	// ReplyPort is the port answers are sent to on the client's address.
+	// 0 answers to the address the request came from, which is what tests
+	// listening on a random port need.
+	ReplyPort int
+	// Seed seeds the packet loss, so a lossy test is deterministic.
+	Seed int64
+
+	mu       sync.Mutex
+	devices  []*device
+	scan     net.PacketConn
+	loss     float64
+	delay    time.Duration
+	random   *rand.Rand
+	commands []string
+	wg       sync.WaitGroup
+	closed   bool
+}
+
+// device is a device and the connection it listens on.
+type device struct {
+	Device
+	conn net.PacketConn
+}
+
+// New returns a simulator for devices, Start it to listen.
+func New(devices ...Device) *Simulator {
+	s := &Simulator{}
+	for _, d := range devices {
+		s.devices = append(s.devices, &device{Device: d})
+	}
+	return s
+}
+
+// Start listens on the scan address and on the address of every device.
+func (s *Simulator) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.random = rand.New(rand.NewSource(s.Seed))
+
+	var err error
+	s.scan, err = net.ListenPacket("udp", orLoopback(s.ScanAddr))
+	if err != nil {
+		return err
+	}
+	for _, d := range s.devices {
+		d.conn, err = net.ListenPacket("udp", orLoopback(d.Addr))
+		if err != nil {
+			s.closeLocked()
+			return fmt.Errorf("%s: %w", d.Device.Device, err)
+		}
+	}
+
+	s.serve(s.scan, nil)
+	for _, d := range s.devices {
+		s.serve(d.conn, d)
+	}
+	return nil
+}
+
+// Close stops listening and waits for the pending answers.
+func (s *Simulator) Close() error {
+	s.mu.Lock()
+	err := s.closeLocked()
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Simulator) closeLocked() error {
+	s.closed = true
+	var errs []error
+	if s.scan != nil {
+		errs = append(errs, s.scan.Close())
+	}
+	for _, d := range s.devices {
+		if d.conn != nil {
+			errs = append(errs, d.conn.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ScanAddress returns the address scans are received on, once started.
+func (s *Simulator) ScanAddress() net.Addr {
+	return s.scan.LocalAddr()
+}
+
+// DeviceAddress returns the address a device receives commands on, once
+// started, and nil if there is no such device.
+func (s *Simulator) DeviceAddress(id string) net.Addr {
+	for _, d := range s.devices {
+		if d.Device.Device == id && d.conn != nil {
+			return d.conn.LocalAddr()
+		}
+	}
+	return nil
+}
+
+// State returns the state of a device, and false if there is no such device.
+func (s *Simulator) State(id string) (State, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		if d.Device.Device == id {
+			return d.State, true
+		}
+	}
+	return State{}, false
+}
+
+// SetLoss drops packets with probability loss, between 0 and 1: requests
+// are lost on their way in and answers on their way out.
+func (s *Simulator) SetLoss(loss float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loss = loss
+}
+
+// SetDelay delays every answer.
+func (s *Simulator) SetDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = delay
+}
+
+// Commands returns the commands the devices received and did not lose, as
+// "device cmd data", oldest first.
+func (s *Simulator) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// serve reads the packets of a connection until it is closed. d is nil for
+// the scan connection.
+func (s *Simulator) serve(conn net.PacketConn, d *device) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg message
+			if json.Unmarshal(buf[:n], &msg) != nil {
+				continue
+			}
+			s.handle(msg, from, d)
+		}
+	}()
+}
+
+func (s *Simulator) handle(msg message, from net.Addr, d *device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.lost() {
+		return
+	}
+
+	if d == nil {
+		if msg.Msg.Cmd != "scan" {
+			return
+		}
+		// every device answers a scan, from its own address
+		for _, d := range s.devices {
+			s.reply(d, from, "scan", map[string]any{
+				"ip":              d.conn.LocalAddr().(*net.UDPAddr).IP.String(),
+				"device":          d.Device.Device,
+				"sku":             d.SKU,
+				"bleVersionHard":  "3.01.01",
+				"bleVersionSoft":  "1.03.01",
+				"wifiVersionHard": "1.00.10",
+				"wifiVersionSoft": "1.02.03",
+			})
+		}
+		return
+	}
+
+	s.commands = append(s.commands, fmt.Sprintf("%s %s %s", d.Device.Device, msg.Msg.Cmd, msg.Msg.Data))
+	switch msg.Msg.Cmd {
+	case "turn":
+		var data struct {
+			Value int `json:"value"`
+		}
+		if json.Unmarshal(msg.Msg.Data, &data) == nil && (data.Value == 0 || data.Value == 1) {
+			d.State.On = data.Value == 1
+		}
+	case "brightness":
+		var data struct {
+			Value int `json:"value"`
+		}
+		if json.Unmarshal(msg.Msg.Data, &data) == nil && data.Value >= 1 && data.Value <= 100 {
+			d.State.Brightness = data.Value
+		}
+	case "colorwc":
+		var data struct {
+			Color            structs.Color `json:"color"`
+			ColorTemInKelvin int           `json:"colorTemInKelvin"`
+		}
+		if json.Unmarshal(msg.Msg.Data, &data) != nil {
+			return
+		}
+		// a color temperature wins over the color
+		if data.ColorTemInKelvin > 0 {
+			d.State.ColorTemInKelvin = data.ColorTemInKelvin
+		} else if max(data.Color.R, data.Color.G, data.Color.B) <= 255 && min(data.Color.R, data.Color.G, data.Color.B) >= 0 {
+			d.State.Color, d.State.ColorTemInKelvin = data.Color, 0
+		}
+	case "devStatus":
+		onOff := 0
+		if d.State.On {
+			onOff = 1
+		}
+		s.reply(d, from, "devStatus", map[string]any{
+			"onOff":            onOff,
+			"brightness":       d.State.Brightness,
+			"color":            map[string]int{"r": d.State.Color.R, "g": d.State.Color.G, "b": d.State.Color.B},
+			"colorTemInKelvin": d.State.ColorTemInKelvin,
+		})
+	}
+}
+
+// reply sends an answer from a device to the client, after the delay unless
+// it is lost. Called with s.mu held.
+func (s *Simulator) reply(d *device, from net.Addr, cmd string, data any) {
+	if s.lost() {
+		return
+	}
+	to := from
+	if s.ReplyPort != 0 {
+		to = &net.UDPAddr{IP: from.(*net.UDPAddr).IP, Port: s.ReplyPort}
+	}
+	packet, err := json.Marshal(map[string]any{"msg": map[string]any{"cmd": cmd, "data": data}})
+	if err != nil {
+		return
+	}
+
+	s.wg.Add(1)
+	delay := s.delay
+	go func() {
+		defer s.wg.Done()
+		time.Sleep(delay)
+		d.conn.WriteTo(packet, to)
+	}()
+}
+
+// lost reports whether a packet is dropped. Called with s.mu held.
+func (s *Simulator) lost() bool {
+	return s.loss > 0 && s.random.Float64() < s.loss
+}
+
+func orLoopback(addr string) string {
+	if addr == "" {
+		return "127.0.0.1:0"
+	}
+	return addr
+}
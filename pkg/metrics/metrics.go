@@ -0,0 +1,243 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/poller"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// buckets are the upper bounds of the request latency histogram, in seconds.
+var buckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects the requests made to the Govee API and serves them, with
+// the remaining budget of every API key and the state of every polled device,
+// in the Prometheus text format.
+type Metrics struct {
+	// APIKEY is the key used for devices without an account, its budget is
+	// reported as account "default".
+	APIKEY string
+	// Poller, if set, provides the device state gauges.
+	Poller *poller.Poller
+
+	mu          sync.Mutex
+	requests    map[string]float64
+	retries     map[string]float64
+	rateLimited map[string]float64
+	latency     map[string]*histogram
+	names       map[string]string
+}
+
+type histogram struct {
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+// New returns an empty Metrics. Set apiwrapper.Observer to its Observe method
+// to collect the requests.
+func New(APIKEY string, p *poller.Poller) *Metrics {
+	return &Metrics{
+		APIKEY:      APIKEY,
+		Poller:      p,
+		requests:    map[string]float64{},
+		retries:     map[string]float64{},
+		rateLimited: map[string]float64{},
+		latency:     map[string]*histogram{},
+		names:       map[string]string{},
+	}
+}
+
+// Observe records an attempt of a request, it is an apiwrapper.Observer.
+func (m *Metrics) Observe(info apiwrapper.RequestInfo) {
+	device := m.deviceName(info.Device)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := strconv.Itoa(info.Status)
+	if info.Status == 0 {
+		status = "error"
+	}
+	if info.RateLimited {
+		// refused before it was sent, it is not an API request
+		m.rateLimited[labels("account", info.Account, "reason", "budget")]++
+		return
+	}
+	if info.Status == http.StatusTooManyRequests {
+		m.rateLimited[labels("account", info.Account, "reason", "429")]++
+	}
+	m.requests[labels("endpoint", info.Endpoint, "method", info.Method, "status", status, "device", device)]++
+	if info.Attempt > 0 {
+		m.retries[labels("endpoint", info.Endpoint)]++
+	}
+
+	key := labels("endpoint", info.Endpoint)
+	h, ok := m.latency[key]
+	if !ok {
+		h = &histogram{counts: make([]float64, len(buckets))}
+		m.latency[key] = h
+	}
+	seconds := info.Duration.Seconds()
+	for i, bound := range buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// deviceName returns the registry name of a device id, or the id itself.
+func (m *Metrics) deviceName(id string) string {
+	if id == "" {
+		return ""
+	}
+	m.mu.Lock()
+	name, ok := m.names[id]
+	m.mu.Unlock()
+	if ok {
+		return name
+	}
+
+	registry, err := utils.LoadFromJSON(utils.RegistryFile)
+	if err != nil {
+		return id
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, device := range registry.Data.Devices {
+		m.names[device.Device] = device.DeviceName
+	}
+	if _, ok := m.names[id]; !ok {
+		// don't reload the registry for every request about an unknown id
+		m.names[id] = id
+	}
+	return m.names[id]
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Write(w)
+}
+
+// Write writes the metrics in the Prometheus text format.
+func (m *Metrics) Write(w io.Writer) {
+	m.mu.Lock()
+	writeFamily(w, "govee_api_requests_total", "counter", "Requests sent to the Govee API.", m.requests)
+	writeFamily(w, "govee_api_retries_total", "counter", "Requests to the Govee API that were retries.", m.retries)
+	writeFamily(w, "govee_api_rate_limited_total", "counter", "Requests refused for lack of budget, locally or with a 429.", m.rateLimited)
+	writeHistograms(w, "govee_api_request_duration_seconds", "Latency of requests to the Govee API.", m.latency)
+	m.mu.Unlock()
+
+	remaining, limit, reset := map[string]float64{}, map[string]float64{}, map[string]float64{}
+	accounts := map[string]string{"default": m.APIKEY}
+	for _, name := range apiwrapper.Accounts() {
+		accounts[name], _ = apiwrapper.AccountKey(name)
+	}
+	for name, key := range accounts {
+		budget, ok := apiwrapper.GetRateLimit(key)
+		if key == "" || !ok {
+			continue
+		}
+		label := labels("account", name)
+		remaining[label] = float64(budget.Remaining)
+		limit[label] = float64(budget.Limit)
+		if !budget.Reset.IsZero() {
+			reset[label] = float64(budget.Reset.Unix())
+		}
+	}
+	writeFamily(w, "govee_api_quota_remaining", "gauge", "Requests left in the budget of each account, as last reported by the API.", remaining)
+	writeFamily(w, "govee_api_quota_limit", "gauge", "Size of the budget of each account.", limit)
+	writeFamily(w, "govee_api_quota_reset_timestamp_seconds", "gauge", "When the budget of each account resets.", reset)
+
+	if m.Poller == nil {
+		return
+	}
+	online, power, brightness, updated := map[string]float64{}, map[string]float64{}, map[string]float64{}, map[string]float64{}
+	for name, state := range m.Poller.States() {
+		label := labels("device", name)
+		online[label] = boolValue(state.Online)
+		power[label] = boolValue(state.Power == "on")
+		brightness[label] = float64(state.Brightness)
+		updated[label] = float64(state.Updated.Unix())
+	}
+	writeFamily(w, "govee_device_online", "gauge", "Whether the device is connected to the Govee cloud.", online)
+	writeFamily(w, "govee_device_power_on", "gauge", "Whether the device is turned on.", power)
+	writeFamily(w, "govee_device_brightness", "gauge", "Brightness of the device, 0-100.", brightness)
+	writeFamily(w, "govee_device_last_poll_timestamp_seconds", "gauge", "When the state of the device was last polled.", updated)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// labelEscaper escapes label values the way the text format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats label pairs as {name="value",...}, leaving out empty values.
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func writeFamily(w io.Writer, name string, kind string, help string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, key, formatValue(values[key]))
+	}
+}
+
+func writeHistograms(w io.Writer, name string, help string, histograms map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		h := histograms[key]
+		// the le label goes after the series' own labels
+		prefix := strings.TrimSuffix(key, "}")
+		if prefix == "" {
+			prefix = "{"
+		} else {
+			prefix += ","
+		}
+		for i, bound := range buckets {
+			fmt.Fprintf(w, "%s_bucket%sle=\"%s\"} %s\n", name, prefix, formatValue(bound), formatValue(h.counts[i]))
+		}
+		fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %s\n", name, prefix, formatValue(h.count))
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, key, formatValue(h.sum))
+		fmt.Fprintf(w, "%s_count%s %s\n", name, key, formatValue(h.count))
+	}
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,440 @@
+package mqttbridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/poller"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// maxTransitionSteps caps the brightness commands sent for one transition,
+// each step costs a request of the daily budget.
+const maxTransitionSteps = 10
+
+// Bridge connects the devices of the registry to an MQTT broker.
+//
+// Each device gets the topics <Prefix>/<device>/state (retained JSON state),
+// <Prefix>/<device>/set (JSON commands), <Prefix>/<device>/availability and
+// <Prefix>/<device>/error, where <device> is the Slug of the device name. The
+// state and command payloads follow the Home Assistant MQTT light JSON schema.
+type Bridge struct {
+	Client Client
+	APIKEY string
+	// Prefix is the root of the bridge's topics.
+	Prefix string
+	// DiscoveryPrefix is where Home Assistant discovery configs are
+	// published, empty disables discovery.
+	DiscoveryPrefix string
+	// Poller reports state changes, which are published to the state topics.
+	Poller *poller.Poller
+
+	mu          sync.Mutex
+	devices     map[string]structs.Device
+	published   map[string]string
+	transitions map[string]context.CancelFunc
+}
+
+// StatePayload is the JSON published to a state topic.
+type StatePayload struct {
+	State      string         `json:"state"`
+	Brightness *int           `json:"brightness,omitempty"`
+	ColorMode  string         `json:"color_mode,omitempty"`
+	Color      *structs.Color `json:"color,omitempty"`
+	ColorTemp  *int           `json:"color_temp,omitempty"`
+}
+
+// Command is the JSON accepted on a set topic. Home Assistant sends "state"
+// as ON or OFF, other clients may send "power" as on or off instead. The
+// color takes the same forms as the CLI, color_temp is in kelvin and
+// transition in seconds.
+type Command struct {
+	State      string         `json:"state,omitempty"`
+	Power      string         `json:"power,omitempty"`
+	Brightness *int           `json:"brightness,omitempty"`
+	Color      *control.Color `json:"color,omitempty"`
+	ColorTemp  *int           `json:"color_temp,omitempty"`
+	Transition float64        `json:"transition,omitempty"`
+}
+
+// New returns a bridge publishing under "govee" with Home Assistant
+// discovery under "homeassistant".
+func New(client Client, APIKEY string) *Bridge {
+	b := &Bridge{
+		Client:          client,
+		APIKEY:          APIKEY,
+		Prefix:          "govee",
+		DiscoveryPrefix: "homeassistant",
+		Poller:          poller.New(APIKEY),
+		devices:         map[string]structs.Device{},
+		published:       map[string]string{},
+		transitions:     map[string]context.CancelFunc{},
+	}
+	b.Poller.Handler = b.handlePoll
+	return b
+}
+
+// StatusTopic is where the bridge publishes "online" and, as its last will,
+// "offline".
+func (b *Bridge) StatusTopic() string {
+	return b.Prefix + "/bridge/status"
+}
+
+// Topic returns the topic of a device for a kind of message, e.g. "state".
+func (b *Bridge) Topic(device string, kind string) string {
+	return fmt.Sprintf("%s/%s/%s", b.Prefix, Slug(device), kind)
+}
+
+// Slug turns a device name into a topic level: lower case, with every run of
+// other characters than letters and digits replaced by "_".
+func Slug(name string) string {
+	var slug strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			slug.WriteRune(r)
+			underscore = false
+		} else if !underscore && slug.Len() > 0 {
+			slug.WriteByte('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(slug.String(), "_")
+}
+
+// Run connects to the broker, publishes the discovery configs, handles
+// commands and publishes state changes until ctx is done.
+func (b *Bridge) Run(ctx context.Context) error {
+	err := b.Client.Connect()
+	if err != nil {
+		return err
+	}
+	defer b.Client.Disconnect()
+
+	err = b.Start()
+	if err != nil {
+		return err
+	}
+	go b.Poller.Run(ctx)
+
+	<-ctx.Done()
+	b.mu.Lock()
+	for _, cancel := range b.transitions {
+		cancel()
+	}
+	b.mu.Unlock()
+	return b.Client.Publish(b.StatusTopic(), true, []byte("offline"))
+}
+
+// Start loads the registry, announces the bridge and its devices and
+// subscribes to the command topics of a connected client. Run calls it.
+func (b *Bridge) Start() error {
+	registry, err := utils.LoadFromJSON(utils.RegistryFile)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	for _, device := range registry.Data.Devices {
+		b.devices[Slug(device.DeviceName)] = device
+	}
+	b.mu.Unlock()
+
+	err = b.Client.Publish(b.StatusTopic(), true, []byte("online"))
+	if err != nil {
+		return err
+	}
+
+	if b.DiscoveryPrefix != "" {
+		for _, device := range registry.Data.Devices {
+			if !device.Controllable {
+				continue
+			}
+			payload, err := json.Marshal(b.Discovery(device))
+			if err != nil {
+				return err
+			}
+			err = b.Client.Publish(b.DiscoveryTopic(device), true, payload)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return b.Client.Subscribe(b.Prefix+"/+/set", b.handleSet)
+}
+
+// Republish announces the bridge and the availability of every polled
+// device again, e.g. after a reconnect: the broker has published the will
+// meanwhile.
+func (b *Bridge) Republish() {
+	err := b.Client.Publish(b.StatusTopic(), true, []byte("online"))
+	if err != nil {
+		log.Printf("mqtt: %v", err)
+		return
+	}
+	for device, state := range b.Poller.States() {
+		availability := "offline"
+		if state.Online {
+			availability = "online"
+		}
+		b.Client.Publish(b.Topic(device, "availability"), true, []byte(availability))
+	}
+}
+
+// handleSet applies a command received on a set topic.
+func (b *Bridge) handleSet(topic string, payload []byte) {
+	slug := strings.Split(topic, "/")[len(strings.Split(b.Prefix, "/"))]
+	b.mu.Lock()
+	device, ok := b.devices[slug]
+	b.mu.Unlock()
+	if !ok {
+		log.Printf("mqtt: command for unknown device %q", slug)
+		return
+	}
+
+	var cmd Command
+	err := json.Unmarshal(payload, &cmd)
+	if err == nil {
+		err = b.Apply(device.DeviceName, cmd)
+	}
+	if err != nil {
+		log.Printf("mqtt: %s: %v", device.DeviceName, err)
+		b.Client.Publish(b.Topic(device.DeviceName, "error"), false, []byte(err.Error()))
+	}
+}
+
+// ToState returns the control.State a command asks for.
+func (cmd Command) ToState() control.State {
+	state := control.State{
+		Power:      strings.ToLower(cmd.Power),
+		Brightness: cmd.Brightness,
+		Color:      cmd.Color,
+		ColorTem:   cmd.ColorTemp,
+	}
+	if cmd.State != "" {
+		state.Power = strings.ToLower(cmd.State)
+	}
+	return state
+}
+
+// Apply sends a command to a device. With a transition, the brightness is
+// stepped from the last known brightness to the new one over the transition
+// time, in the background.
+func (b *Bridge) Apply(device string, cmd Command) error {
+	state := cmd.ToState()
+	err := state.Validate()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	if cancel, ok := b.transitions[device]; ok {
+		cancel()
+		delete(b.transitions, device)
+	}
+	b.mu.Unlock()
+
+	known, _ := b.Poller.State(device)
+	if cmd.Transition > 0 && state.Brightness != nil && state.Power != "off" {
+		target := *state.Brightness
+		// everything but the brightness is applied right away, a device that
+		// is off is turned on at the lowest brightness first
+		from := known.Brightness
+		state.Brightness = nil
+		if known.Power != "on" {
+			from = 1
+			state.Power = "on"
+			state.Brightness = &from
+		}
+		if !state.IsEmpty() {
+			err = control.Apply([]string{device}, state, b.APIKEY)
+			if err != nil {
+				return err
+			}
+		}
+		b.publishOptimistic(device, known, state)
+		b.startTransition(device, from, target, time.Duration(cmd.Transition*float64(time.Second)))
+		return nil
+	}
+
+	err = control.Apply([]string{device}, state, b.APIKEY)
+	if err != nil {
+		return err
+	}
+	b.publishOptimistic(device, known, state)
+	return nil
+}
+
+// startTransition steps the brightness of a device in the background.
+func (b *Bridge) startTransition(device string, from int, to int, duration time.Duration) {
+	steps := min(max(int(duration/time.Second), 1), maxTransitionSteps)
+	ctx, cancel := context.WithCancel(context.Background())
+	b.mu.Lock()
+	b.transitions[device] = cancel
+	b.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		for i := 1; i <= steps; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(duration / time.Duration(steps)):
+			}
+			brightness := from + (to-from)*i/steps
+			err := control.Apply([]string{device}, control.State{Brightness: &brightness}, b.APIKEY)
+			if err != nil {
+				log.Printf("mqtt: transition of %s: %v", device, err)
+				return
+			}
+			known, _ := b.Poller.State(device)
+			b.publishOptimistic(device, known, control.State{Brightness: &brightness})
+		}
+	}()
+}
+
+// publishOptimistic publishes the state a command should have left a device
+// in, before the poller confirms it, and asks the poller to check soon.
+func (b *Bridge) publishOptimistic(device string, known poller.State, applied control.State) {
+	if applied.Power != "" {
+		known.Power = applied.Power
+	}
+	if applied.Brightness != nil {
+		known.Brightness = *applied.Brightness
+	}
+	if applied.Color != nil {
+		color := structs.Color(*applied.Color)
+		known.Color = &color
+		known.ColorTem = 0
+	}
+	if applied.ColorTem != nil {
+		known.ColorTem = *applied.ColorTem
+		known.Color = nil
+	}
+	b.publishState(device, known)
+	b.Poller.Wake()
+}
+
+// handlePoll publishes the states and availability the poller reports.
+func (b *Bridge) handlePoll(event poller.Event) {
+	switch event.Kind {
+	case poller.KindError:
+		return
+	case poller.KindInitial, poller.KindOnline, poller.KindOffline:
+		availability := "offline"
+		if event.State.Online {
+			availability = "online"
+		}
+		b.Client.Publish(b.Topic(event.Device, "availability"), true, []byte(availability))
+	}
+	b.publishState(event.Device, event.State)
+}
+
+// publishState publishes the state of a device, unless it is unchanged.
+func (b *Bridge) publishState(device string, state poller.State) {
+	payload := StatePayload{State: "OFF"}
+	if state.Power == "on" {
+		payload.State = "ON"
+	}
+	if state.Brightness != 0 {
+		payload.Brightness = &state.Brightness
+	}
+	switch {
+	case state.ColorTem != 0:
+		payload.ColorMode = "color_temp"
+		payload.ColorTemp = &state.ColorTem
+	case state.Color != nil:
+		payload.ColorMode = "rgb"
+		payload.Color = state.Color
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	topic := b.Topic(device, "state")
+	b.mu.Lock()
+	if b.published[topic] == string(data) {
+		b.mu.Unlock()
+		return
+	}
+	b.published[topic] = string(data)
+	b.mu.Unlock()
+
+	err = b.Client.Publish(topic, true, data)
+	if err != nil {
+		log.Printf("mqtt: %v", err)
+	}
+}
+
+// DiscoveryTopic returns the Home Assistant discovery topic of a device.
+func (b *Bridge) DiscoveryTopic(device structs.Device) string {
+	return fmt.Sprintf("%s/light/%s/config", b.DiscoveryPrefix, uniqueID(device))
+}
+
+func uniqueID(device structs.Device) string {
+	return "govee_" + strings.ToLower(strings.ReplaceAll(device.Device, ":", ""))
+}
+
+// Discovery returns the Home Assistant discovery config of a device, a JSON
+// schema light whose features follow the device's SupportCmds and color
+// temperature range.
+func (b *Bridge) Discovery(device structs.Device) map[string]any {
+	config := map[string]any{
+		// a null name makes the light use the device name
+		"name":          nil,
+		"unique_id":     uniqueID(device),
+		"object_id":     Slug(device.DeviceName),
+		"schema":        "json",
+		"state_topic":   b.Topic(device.DeviceName, "state"),
+		"command_topic": b.Topic(device.DeviceName, "set"),
+		"availability": []map[string]string{
+			{"topic": b.StatusTopic()},
+			{"topic": b.Topic(device.DeviceName, "availability")},
+		},
+		"availability_mode": "all",
+		"device": map[string]any{
+			"identifiers":  []string{device.Device},
+			"manufacturer": "Govee",
+			"model":        device.Model,
+			"name":         device.DeviceName,
+		},
+	}
+
+	var modes []string
+	if slices.Contains(device.SupportCmds, "color") {
+		modes = append(modes, "rgb")
+	}
+	if slices.Contains(device.SupportCmds, "colorTem") {
+		modes = append(modes, "color_temp")
+		minKelvin, maxKelvin := device.Properties.ColorTem.Range.Min, device.Properties.ColorTem.Range.Max
+		if minKelvin == 0 || maxKelvin == 0 {
+			minKelvin, maxKelvin = 2000, 9000
+		}
+		config["color_temp_kelvin"] = true
+		config["min_kelvin"] = minKelvin
+		config["max_kelvin"] = maxKelvin
+	}
+	brightness := slices.Contains(device.SupportCmds, "brightness")
+	if len(modes) == 0 && brightness {
+		modes = append(modes, "brightness")
+	}
+	if len(modes) == 0 {
+		modes = append(modes, "onoff")
+	}
+	config["supported_color_modes"] = modes
+	config["brightness"] = brightness
+	if brightness {
+		config["brightness_scale"] = 100
+	}
+	return config
+}
@@ -0,0 +1,133 @@
+package mqttbridge
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Handler is called with the topic and payload of every message received on
+// a subscription.
+type Handler func(topic string, payload []byte)
+
+// Client is the part of an MQTT client the bridge uses, so it can run against
+// a real broker or the in-process MemoryBroker.
+type Client interface {
+	Connect() error
+	Publish(topic string, retained bool, payload []byte) error
+	Subscribe(filter string, handler Handler) error
+	Disconnect()
+}
+
+// Options configures the connection to a broker.
+type Options struct {
+	// Broker is the broker URL, e.g. tcp://localhost:1883.
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// WillTopic receives WillPayload, retained, when the connection is lost.
+	WillTopic   string
+	WillPayload string
+	// OnReconnect is called once the subscriptions are restored after the
+	// connection to the broker was lost, e.g. to publish the retained
+	// topics the will has overwritten again.
+	OnReconnect func()
+}
+
+// pahoClient adapts the paho client to Client. Messages are sent with QoS 1.
+//
+// The session is clean, so the broker forgets the subscriptions when the
+// connection is lost. The client remembers them and subscribes again on
+// every reconnect.
+type pahoClient struct {
+	client      mqtt.Client
+	onReconnect func()
+
+	mu            sync.Mutex
+	subscriptions map[string]Handler
+	connected     bool
+}
+
+// NewPahoClient returns a Client connecting to a real broker.
+func NewPahoClient(opts Options) Client {
+	c := &pahoClient{onReconnect: opts.OnReconnect, subscriptions: map[string]Handler{}}
+	options := mqtt.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientID).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetOnConnectHandler(c.handleConnect)
+	if opts.WillTopic != "" {
+		options.SetWill(opts.WillTopic, opts.WillPayload, 1, true)
+	}
+	c.client = mqtt.NewClient(options)
+	return c
+}
+
+// handleConnect restores the subscriptions after a reconnect. paho calls it
+// in a goroutine of its own after every successful connection.
+func (c *pahoClient) handleConnect(client mqtt.Client) {
+	c.mu.Lock()
+	reconnect := c.connected
+	c.connected = true
+	subscriptions := maps.Clone(c.subscriptions)
+	c.mu.Unlock()
+	if !reconnect {
+		return
+	}
+
+	for filter, handler := range subscriptions {
+		err := wait(client.Subscribe(filter, 1, deliver(handler)))
+		if err != nil {
+			log.Printf("mqtt: subscribing to %s again: %v", filter, err)
+		}
+	}
+	if c.onReconnect != nil {
+		c.onReconnect()
+	}
+}
+
+// wait waits for a paho token and returns its error.
+func wait(token mqtt.Token) error {
+	if !token.WaitTimeout(30 * time.Second) {
+		return fmt.Errorf("timed out waiting for the broker")
+	}
+	return token.Error()
+}
+
+func (c *pahoClient) Connect() error {
+	return wait(c.client.Connect())
+}
+
+func (c *pahoClient) Publish(topic string, retained bool, payload []byte) error {
+	return wait(c.client.Publish(topic, 1, retained, payload))
+}
+
+func (c *pahoClient) Subscribe(filter string, handler Handler) error {
+	err := wait(c.client.Subscribe(filter, 1, deliver(handler)))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscriptions[filter] = handler
+	return nil
+}
+
+func deliver(handler Handler) mqtt.MessageHandler {
+	return func(_ mqtt.Client, msg mqtt.Message) {
+		handler(msg.Topic(), msg.Payload())
+	}
+}
+
+func (c *pahoClient) Disconnect() {
+	c.client.Disconnect(250)
+}
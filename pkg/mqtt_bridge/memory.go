@@ -0,0 +1,142 @@
+package mqttbridge
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// MemoryBroker is an in-process stand-in for an MQTT broker, for tests and
+// dry runs. It keeps retained messages and supports the + and # wildcards.
+// Messages are delivered synchronously, in the publishing goroutine.
+type MemoryBroker struct {
+	mu       sync.Mutex
+	retained map[string][]byte
+	subs     []memorySubscription
+}
+
+type memorySubscription struct {
+	client  *memoryClient
+	filter  string
+	handler Handler
+}
+
+// NewMemoryBroker returns an empty broker.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{retained: map[string][]byte{}}
+}
+
+// Client returns a new client of the broker.
+func (b *MemoryBroker) Client() Client {
+	return &memoryClient{broker: b}
+}
+
+// Retained returns the retained message of a topic.
+func (b *MemoryBroker) Retained(topic string) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+func (b *MemoryBroker) publish(topic string, retained bool, payload []byte) {
+	b.mu.Lock()
+	if retained {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+	var handlers []Handler
+	for _, sub := range b.subs {
+		if sub.client.connected() && Match(sub.filter, topic) {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+}
+
+func (b *MemoryBroker) subscribe(client *memoryClient, filter string, handler Handler) {
+	b.mu.Lock()
+	b.subs = append(b.subs, memorySubscription{client: client, filter: filter, handler: handler})
+	var topics []string
+	for topic := range b.retained {
+		if Match(filter, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	b.mu.Unlock()
+
+	// like a broker, send the retained messages matching a new subscription
+	for _, topic := range topics {
+		payload, ok := b.Retained(topic)
+		if ok {
+			handler(topic, payload)
+		}
+	}
+}
+
+type memoryClient struct {
+	broker *MemoryBroker
+	mu     sync.Mutex
+	online bool
+}
+
+func (c *memoryClient) connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.online
+}
+
+func (c *memoryClient) Connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.online = true
+	return nil
+}
+
+func (c *memoryClient) Publish(topic string, retained bool, payload []byte) error {
+	if !c.connected() {
+		return errors.New("not connected")
+	}
+	c.broker.publish(topic, retained, payload)
+	return nil
+}
+
+func (c *memoryClient) Subscribe(filter string, handler Handler) error {
+	if !c.connected() {
+		return errors.New("not connected")
+	}
+	c.broker.subscribe(c, filter, handler)
+	return nil
+}
+
+func (c *memoryClient) Disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.online = false
+}
+
+// Match reports whether a topic matches a subscription filter with the MQTT
+// + (one level) and # (all remaining levels) wildcards.
+func Match(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
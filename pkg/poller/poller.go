@@ -0,0 +1,370 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// Kind is the kind of transition an Event reports.
+type Kind string
+
+const (
+	// KindInitial is the first state polled for a device.
+	KindInitial Kind = "initial"
+	// KindOnline and KindOffline report the device's connection to the cloud.
+	KindOnline  Kind = "online"
+	KindOffline Kind = "offline"
+	// KindPower reports the device being turned on or off.
+	KindPower Kind = "power"
+	// KindBrightness reports a brightness change.
+	KindBrightness Kind = "brightness"
+	// KindColor reports a color change.
+	KindColor Kind = "color"
+	// KindColorTem reports a color temperature change.
+	KindColorTem Kind = "colorTem"
+	// KindError reports a failed poll, the last known state is kept.
+	KindError Kind = "error"
+)
+
+// DefaultQuota is the daily request budget of a Govee API key.
+const DefaultQuota = 10000
+
+// State is the last known state of a device, merged from the separate
+// properties the Govee API reports.
+type State struct {
+	Online     bool           `json:"online"`
+	Power      string         `json:"power,omitempty"`
+	Brightness int            `json:"brightness,omitempty"`
+	Color      *structs.Color `json:"color,omitempty"`
+	ColorTem   int            `json:"colorTem,omitempty"`
+	// Updated is when the state was last polled successfully.
+	Updated time.Time `json:"updated"`
+	// Changed is when the state last changed.
+	Changed time.Time `json:"changed"`
+}
+
+// Event reports one transition of a device.
+type Event struct {
+	Kind   Kind
+	Device string
+	Time   time.Time
+	// Prev is the state before the transition, zero for KindInitial.
+	Prev State
+	// State is the state after the transition, the last known state for
+	// KindError.
+	State State
+	// Err is the poll error for KindError.
+	Err error
+}
+
+// Value returns the new value of the field the event is about, e.g. the
+// brightness for KindBrightness.
+func (e Event) Value() any {
+	switch e.Kind {
+	case KindOnline, KindOffline:
+		return e.State.Online
+	case KindPower:
+		return e.State.Power
+	case KindBrightness:
+		return e.State.Brightness
+	case KindColor:
+		return e.State.Color
+	case KindColorTem:
+		return e.State.ColorTem
+	case KindError:
+		return e.Err.Error()
+	}
+	return nil
+}
+
+// Poller periodically polls the state of the registry's retrievable devices,
+// keeps their last known state and reports every transition.
+//
+// The interval adapts to activity: it starts at Interval, doubles after every
+// poll without changes up to MaxInterval, and drops back to Interval when a
+// device changes or Wake is called. It never polls faster than the remaining
+// daily budget of each API key allows.
+type Poller struct {
+	// APIKEY is used for devices without an account.
+	APIKEY string
+	// Interval is the shortest time between two polls.
+	Interval time.Duration
+	// MaxInterval is the longest time between two polls of a quiet registry.
+	MaxInterval time.Duration
+	// Quota is the daily request budget of each API key, used until the API
+	// reports the actual budget.
+	Quota int
+	// Reserve is the share of the budget left for commands, between 0 and 1.
+	Reserve float64
+	// Handler, if set, is called with every event.
+	Handler func(Event)
+	// Events, if set, receives every event. The poller blocks until the
+	// event is received.
+	Events chan<- Event
+	// Active, if set, is asked before every poll, polls are skipped while it
+	// returns false.
+	Active func() bool
+
+	mu       sync.Mutex
+	states   map[string]State
+	interval time.Duration
+	wake     chan struct{}
+	now      func() time.Time
+}
+
+// New returns a poller with the default intervals and budget.
+func New(APIKEY string) *Poller {
+	return &Poller{
+		APIKEY:      APIKEY,
+		Interval:    time.Minute,
+		MaxInterval: 10 * time.Minute,
+		Quota:       DefaultQuota,
+		Reserve:     0.25,
+		states:      map[string]State{},
+		wake:        make(chan struct{}, 1),
+		now:         time.Now,
+	}
+}
+
+// States returns a copy of the last known state of every polled device.
+func (p *Poller) States() map[string]State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return maps.Clone(p.states)
+}
+
+// State returns the last known state of a device.
+func (p *Poller) State(device string) (State, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.states[device]
+	return state, ok
+}
+
+// CurrentInterval returns the time until the next poll, as of the last poll.
+func (p *Poller) CurrentInterval() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.interval == 0 {
+		return p.Interval
+	}
+	return p.interval
+}
+
+// Wake resets the interval and polls as soon as Interval has passed since the
+// last poll, e.g. after a command was sent or a client started watching.
+func (p *Poller) Wake() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run polls until ctx is done.
+func (p *Poller) Run(ctx context.Context) {
+	var last time.Time
+	for {
+		if p.Active == nil || p.Active() {
+			last = p.now()
+			p.Poll()
+		}
+
+		timer := time.NewTimer(p.CurrentInterval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			continue
+		case <-p.wake:
+			timer.Stop()
+		}
+
+		p.mu.Lock()
+		p.interval = p.Interval
+		p.mu.Unlock()
+		// never poll faster than Interval, however often Wake is called
+		if wait := p.Interval - p.now().Sub(last); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// Poll polls every retrievable device of the registry once, reports the
+// transitions and computes the next interval.
+func (p *Poller) Poll() {
+	registry, err := utils.LoadFromJSON(utils.RegistryFile)
+	if err != nil {
+		p.emit(Event{Kind: KindError, Time: p.now(), Err: err})
+		return
+	}
+
+	// requests per poll for each key, to spread every key's budget
+	perKey := map[string]int{}
+	changed := false
+	for _, device := range registry.Data.Devices {
+		if !device.Retrievable {
+			continue
+		}
+		key := apiwrapper.KeyFor(device, p.APIKEY)
+		perKey[key]++
+		if p.pollDevice(device, key) {
+			changed = true
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interval = p.nextInterval(changed, perKey)
+}
+
+// pollDevice polls one device and reports whether its state changed.
+func (p *Poller) pollDevice(device structs.Device, APIKEY string) bool {
+	name := device.DeviceName
+	response, err := apiwrapper.GetDeviceState(device.Device, device.Model, APIKEY)
+	if err == nil && response.Code != 200 {
+		err = fmt.Errorf("%d %s", response.Code, response.Message)
+	}
+	now := p.now()
+
+	p.mu.Lock()
+	prev, known := p.states[name]
+	if err != nil {
+		p.mu.Unlock()
+		p.emit(Event{Kind: KindError, Device: name, Time: now, Prev: prev, State: prev, Err: err})
+		return false
+	}
+
+	next := Merge(response.Data.Properties)
+	next.Updated = now
+	events := Transitions(prev, next)
+	if !known {
+		events = []Kind{KindInitial}
+	}
+	next.Changed = prev.Changed
+	if len(events) > 0 {
+		next.Changed = now
+	}
+	p.states[name] = next
+	p.mu.Unlock()
+
+	for _, kind := range events {
+		p.emit(Event{Kind: kind, Device: name, Time: now, Prev: prev, State: next})
+	}
+	return known && len(events) > 0
+}
+
+func (p *Poller) emit(event Event) {
+	if p.Handler != nil {
+		p.Handler(event)
+	}
+	if p.Events != nil {
+		p.Events <- event
+	}
+}
+
+// nextInterval backs off while nothing changes, and stays above the interval
+// each key's remaining budget allows. It is called with p.mu held.
+func (p *Poller) nextInterval(changed bool, perKey map[string]int) time.Duration {
+	interval := p.Interval
+	if !changed && p.interval != 0 {
+		interval = min(p.interval*2, max(p.MaxInterval, p.Interval))
+	}
+	for key, requests := range perKey {
+		interval = max(interval, p.budgetInterval(key, requests))
+	}
+	return interval
+}
+
+// budgetInterval returns the shortest interval at which polling requests
+// for a key leaves the reserved share of its budget for commands.
+func (p *Poller) budgetInterval(APIKEY string, requests int) time.Duration {
+	return BudgetInterval(APIKEY, requests, p.Quota, p.Reserve, p.now())
+}
+
+// BudgetInterval returns the shortest interval at which sending requests
+// every time for a key leaves a reserved share of its budget.
+//
+// Parameters:
+// - APIKEY: The key the requests are sent with.
+// - requests: The number of requests sent every interval.
+// - quota: The daily budget, used until the API reports the actual one.
+// - reserve: The share of the budget to leave, between 0 and 1.
+// - now: The current time.
+//
+// Returns:
+// - time.Duration: The shortest interval, until the reset if the budget is spent.
+func BudgetInterval(APIKEY string, requests int, quota int, reserve float64, now time.Time) time.Duration {
+	remaining := float64(quota)
+	window := 24 * time.Hour
+	if limit, ok := apiwrapper.GetRateLimit(APIKEY); ok && limit.Reset.After(now) {
+		remaining = float64(limit.Remaining)
+		window = limit.Reset.Sub(now)
+	}
+
+	usable := remaining * (1 - reserve)
+	if usable < float64(requests) {
+		// nothing left until the reset, wait for it
+		return window
+	}
+	return time.Duration(float64(window) * float64(requests) / usable)
+}
+
+// Merge folds the properties of a state response into a State.
+func Merge(properties []structs.Properties) State {
+	var state State
+	for _, prop := range properties {
+		// each property arrives as its own object, only one field is set
+		switch {
+		case prop.Online:
+			state.Online = true
+		case prop.PowerState != "":
+			state.Power = prop.PowerState
+		case prop.Brightness != 0:
+			state.Brightness = prop.Brightness
+		case prop.Color != nil:
+			state.Color = prop.Color
+		case prop.ColorTemInKelvin != nil:
+			state.ColorTem = *prop.ColorTemInKelvin
+		case prop.ColorTem != nil:
+			state.ColorTem = *prop.ColorTem
+		}
+	}
+	return state
+}
+
+// Transitions returns the kinds of change between two states.
+func Transitions(prev State, next State) []Kind {
+	var kinds []Kind
+	if prev.Online != next.Online {
+		if next.Online {
+			kinds = append(kinds, KindOnline)
+		} else {
+			kinds = append(kinds, KindOffline)
+		}
+	}
+	if prev.Power != next.Power {
+		kinds = append(kinds, KindPower)
+	}
+	if prev.Brightness != next.Brightness {
+		kinds = append(kinds, KindBrightness)
+	}
+	if (prev.Color == nil) != (next.Color == nil) || (prev.Color != nil && *prev.Color != *next.Color) {
+		kinds = append(kinds, KindColor)
+	}
+	if prev.ColorTem != next.ColorTem {
+		kinds = append(kinds, KindColorTem)
+	}
+	return kinds
+}
@@ -0,0 +1,132 @@
+package redact
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Placeholder replaces every secret in redacted output.
+const Placeholder = "[REDACTED]"
+
+// sensitiveHeaders are never shown, whatever their value.
+var sensitiveHeaders = []string{"Govee-API-Key", "Authorization"}
+
+// secrets holds every value registered with Register.
+var (
+	secretsMu sync.RWMutex
+	secrets   = map[string]struct{}{}
+)
+
+// minSecretLength is the length below which a value is not treated as a
+// secret, replacing every occurrence of a very short string would mangle the
+// output without protecting anything.
+const minSecretLength = 6
+
+// Register adds a secret, e.g. an API key, that String, Error, Writer and
+// Header remove from anything passing through them. Values shorter than
+// minSecretLength are ignored.
+func Register(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets[secret] = struct{}{}
+}
+
+// String replaces every registered secret in s with Placeholder. Longer
+// secrets are replaced first, so a secret containing another one is never
+// left partly visible.
+func String(s string) string {
+	secretsMu.RLock()
+	sorted := make([]string, 0, len(secrets))
+	for secret := range secrets {
+		sorted = append(sorted, secret)
+	}
+	secretsMu.RUnlock()
+
+	slices.SortFunc(sorted, func(a, b string) int { return len(b) - len(a) })
+	for _, secret := range sorted {
+		s = strings.ReplaceAll(s, secret, Placeholder)
+	}
+	return s
+}
+
+// Mask hides all but the last four characters of a secret, so a key can be
+// recognized without being revealed.
+func Mask(secret string) string {
+	if len(secret) > 4 {
+		return strings.Repeat("*", len(secret)-4) + secret[len(secret)-4:]
+	}
+	if secret != "" {
+		return "****"
+	}
+	return ""
+}
+
+// Header returns a copy of h with the values of sensitive headers and any
+// registered secret replaced with Placeholder.
+func Header(h http.Header) http.Header {
+	redacted := h.Clone()
+	for name, values := range redacted {
+		for i, value := range values {
+			values[i] = String(value)
+		}
+		redacted[name] = values
+	}
+	for _, name := range sensitiveHeaders {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, Placeholder)
+		}
+	}
+	return redacted
+}
+
+// redactedError hides the secrets in the message of an error, while keeping
+// the original error available to errors.Is and errors.As.
+type redactedError struct {
+	err error
+}
+
+func (e redactedError) Error() string {
+	return String(e.err.Error())
+}
+
+func (e redactedError) Unwrap() error {
+	return e.err
+}
+
+// Error wraps err so its message never contains a registered secret. A nil
+// error stays nil.
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(redactedError); ok {
+		return err
+	}
+	return redactedError{err}
+}
+
+type writer struct {
+	w io.Writer
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	_, err := io.WriteString(w.w, String(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	// report the original length, callers like the log package expect it
+	return len(p), nil
+}
+
+// NewWriter returns a writer that removes every registered secret before
+// writing to w. Secrets are only found within a single Write call, which is
+// how the log package writes its lines.
+func NewWriter(w io.Writer) io.Writer {
+	return writer{w}
+}
@@ -0,0 +1,641 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/effects"
+	mqttbridge "github.com/seanpden/govee_controller/pkg/mqtt_bridge"
+	"github.com/seanpden/govee_controller/pkg/poller"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// ErrUnknownWebhook is returned for a webhook no rule is triggered by.
+var ErrUnknownWebhook = errors.New("no rule is triggered by this webhook")
+
+// ErrInvalidPayload is returned for a webhook whose body isn't JSON.
+var ErrInvalidPayload = errors.New("the payload must be JSON")
+
+// Evaluation records why a rule did or didn't run.
+type Evaluation struct {
+	Rule    string
+	Trigger string
+	// Payload is the payload of the webhook or MQTT message that triggered
+	// the rule, conditions and templates can refer to it.
+	Payload any
+	Time    time.Time
+	// Conditions holds each condition checked with its result, checking
+	// stops at the first one that doesn't hold.
+	Conditions []ConditionResult
+	// Ran is true when every condition held and the actions ran.
+	Ran     bool
+	Actions []ActionResult
+}
+
+// ConditionResult is a checked condition.
+type ConditionResult struct {
+	Condition string
+	Held      bool
+	Err       error
+}
+
+// ActionResult is an action that ran.
+type ActionResult struct {
+	Action string
+	Err    error
+}
+
+// String formats the evaluation for the log.
+func (e Evaluation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "rule %q triggered by %s", e.Rule, e.Trigger)
+	for _, condition := range e.Conditions {
+		fmt.Fprintf(&b, "; %s: %v", condition.Condition, condition.Held)
+		if condition.Err != nil {
+			fmt.Fprintf(&b, " (%v)", condition.Err)
+		}
+	}
+	if !e.Ran {
+		b.WriteString("; skipped")
+		return b.String()
+	}
+	for _, action := range e.Actions {
+		fmt.Fprintf(&b, "; %s", action.Action)
+		if action.Err != nil {
+			fmt.Fprintf(&b, " failed: %v", action.Err)
+		}
+	}
+	return b.String()
+}
+
+// Engine runs the rules of a file, reloading it when it changes.
+//
+// State triggers need the Poller's events, pass them to HandlePoll. MQTT
+// triggers need a connected MQTT client. Groups and scenes are read from
+// groups.json and scenes.json when an action runs.
+type Engine struct {
+	Path string
+	// APIKEY is used for devices without an account.
+	APIKEY string
+	// Poller, if set, provides the device states conditions are checked
+	// against, devices it doesn't know are polled directly.
+	Poller *poller.Poller
+	// MQTT, if set, is subscribed to the topics of the MQTT triggers.
+	MQTT mqttbridge.Client
+	// Log, if set, receives every evaluation instead of the standard logger.
+	Log func(Evaluation)
+	// Effects, if set, plays the effect actions instead of a player for the
+	// cloud API.
+	Effects *effects.Player
+
+	mu         sync.Mutex
+	file       File
+	variables  map[string]any
+	modTime    time.Time
+	next       map[string]time.Time
+	files      map[string]time.Time
+	subscribed map[string]bool
+	wg         sync.WaitGroup
+}
+
+// New returns an engine for the rules in path. Call Reload or Run to load
+// them.
+func New(path string, APIKEY string) *Engine {
+	return &Engine{Path: path, APIKEY: APIKEY, variables: map[string]any{}, subscribed: map[string]bool{}}
+}
+
+// Reload loads the rules if the file changed since the last load. Invalid
+// rules are refused and the previous ones are kept.
+//
+// Returns:
+// - bool: Whether new rules were loaded.
+// - error: The error of reading or validating the file.
+func (e *Engine) Reload() (bool, error) {
+	info, err := os.Stat(e.Path)
+	if err != nil {
+		return false, err
+	}
+	e.mu.Lock()
+	unchanged := info.ModTime().Equal(e.modTime)
+	e.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	file, err := Load(e.Path)
+	e.mu.Lock()
+	e.modTime = info.ModTime()
+	if err != nil {
+		e.mu.Unlock()
+		return false, err
+	}
+
+	// variables keep their values across reloads, new ones start at their
+	// initial value
+	variables := map[string]any{}
+	for name, value := range file.Variables {
+		variables[name] = value
+	}
+	for name, value := range e.variables {
+		variables[name] = value
+	}
+	e.file, e.variables = file, variables
+
+	now := time.Now()
+	e.next = map[string]time.Time{}
+	e.files = map[string]time.Time{}
+	var topics []string
+	for _, rule := range file.Rules {
+		switch {
+		case rule.Trigger.Schedule != nil:
+			e.next[rule.Name], _ = rule.Trigger.Schedule.next(now)
+		case rule.Trigger.File != "":
+			e.files[rule.Trigger.File] = modTime(rule.Trigger.File)
+		case rule.Trigger.MQTT != nil && !e.subscribed[rule.Trigger.MQTT.Topic]:
+			topics = append(topics, rule.Trigger.MQTT.Topic)
+		}
+	}
+	e.mu.Unlock()
+
+	// subscriptions are never dropped, messages no rule wants are ignored
+	for _, topic := range topics {
+		if e.MQTT == nil {
+			break
+		}
+		err := e.MQTT.Subscribe(topic, e.handleMQTT)
+		if err != nil {
+			log.Printf("rules: subscribe %s: %v", topic, err)
+			continue
+		}
+		e.mu.Lock()
+		e.subscribed[topic] = true
+		e.mu.Unlock()
+	}
+	return true, nil
+}
+
+// modTime returns the modification time of a file, zero if it is missing.
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Rules returns the loaded rules.
+func (e *Engine) Rules() []Rule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Rules
+}
+
+// Variable returns the value of a variable.
+func (e *Engine) Variable(name string) any {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.variables[name]
+}
+
+// WantsState reports whether a rule has a state trigger, so the poller has
+// to keep polling.
+func (e *Engine) WantsState() bool {
+	for _, rule := range e.Rules() {
+		if rule.Trigger.State != nil && !rule.Disabled {
+			return true
+		}
+	}
+	return false
+}
+
+// Run checks the rules file, the schedules and the watched files every
+// second until ctx is cancelled, then waits for the running rules.
+func (e *Engine) Run(ctx context.Context) error {
+	defer e.wg.Wait()
+	_, err := e.Reload()
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			loaded, err := e.Reload()
+			if err != nil {
+				log.Printf("rules: %v, keeping the previous rules", err)
+			} else if loaded {
+				log.Printf("rules: reloaded %s", e.Path)
+			}
+			e.Tick(ctx, now)
+		}
+	}
+}
+
+// Tick fires the rules whose schedule is due or whose file changed.
+func (e *Engine) Tick(ctx context.Context, now time.Time) {
+	e.mu.Lock()
+	var due []Rule
+	for _, rule := range e.file.Rules {
+		switch {
+		case rule.Trigger.Schedule != nil:
+			next := e.next[rule.Name]
+			if next.IsZero() || now.Before(next) {
+				continue
+			}
+			e.next[rule.Name], _ = rule.Trigger.Schedule.next(now)
+			due = append(due, rule)
+		case rule.Trigger.File != "":
+			changed := modTime(rule.Trigger.File)
+			if changed.Equal(e.files[rule.Trigger.File]) {
+				continue
+			}
+			e.files[rule.Trigger.File] = changed
+			due = append(due, rule)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, rule := range due {
+		e.fire(ctx, rule, nil)
+	}
+}
+
+// HandlePoll fires the rules triggered by a poller event.
+func (e *Engine) HandlePoll(event poller.Event) {
+	for _, rule := range e.Rules() {
+		trigger := rule.Trigger.State
+		if trigger == nil || trigger.Device != event.Device || poller.Kind(trigger.Change) != event.Kind {
+			continue
+		}
+		if trigger.To != "" && !strings.EqualFold(trigger.To, valueString(event.Value())) {
+			continue
+		}
+		e.fire(context.Background(), rule, nil)
+	}
+}
+
+// valueString formats an event value to compare with a trigger's To, colors
+// as "r,g,b".
+func valueString(value any) string {
+	if color, ok := value.(*structs.Color); ok && color != nil {
+		return fmt.Sprintf("%d,%d,%d", color.R, color.G, color.B)
+	}
+	return fmt.Sprint(value)
+}
+
+// Signed reports whether a webhook is authenticated by its signature
+// rather than by a bearer token.
+func (e *Engine) Signed(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.file.Webhooks[name]
+	return ok
+}
+
+// Webhook verifies the signature of a request to a webhook, if it has one,
+// and fires the rules it triggers with its JSON body as the payload.
+//
+// Parameters:
+// - name: The name of the webhook.
+// - header: The headers of the request.
+// - body: The body of the request, empty for no payload.
+//
+// Returns:
+// - int: The number of rules fired.
+// - error: ErrUnknownWebhook, ErrBadSignature or ErrInvalidPayload.
+func (e *Engine) Webhook(name string, header http.Header, body []byte) (int, error) {
+	e.mu.Lock()
+	webhook, signed := e.file.Webhooks[name]
+	e.mu.Unlock()
+	if signed {
+		err := webhook.Verify(header, body)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var payload any
+	if len(body) > 0 && json.Unmarshal(body, &payload) != nil {
+		return 0, ErrInvalidPayload
+	}
+	fired := 0
+	for _, rule := range e.Rules() {
+		if rule.Trigger.Webhook != name || rule.Disabled {
+			continue
+		}
+		e.fire(context.Background(), rule, payload)
+		fired++
+	}
+	if fired == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownWebhook, name)
+	}
+	return fired, nil
+}
+
+// Targets returns the devices, with groups expanded, and the scenes the
+// enabled rules of a webhook would act on for a body, following the rules
+// they invoke. Templates are filled the way Evaluate fills them, actions
+// whose templates fail are left out since they don't run. The server checks
+// the targets against the scope of the token calling an unsigned webhook.
+//
+// Parameters:
+// - name: The name of the webhook.
+// - body: The JSON body of the webhook request, empty for none.
+//
+// Returns:
+// - []string: The devices the actions set.
+// - []string: The scenes the actions apply.
+// - error: ErrInvalidPayload if the body isn't JSON.
+func (e *Engine) Targets(name string, body []byte) ([]string, []string, error) {
+	var payload any
+	if len(body) > 0 && json.Unmarshal(body, &payload) != nil {
+		return nil, nil, ErrInvalidPayload
+	}
+	// no groups.json means no groups
+	groups, _ := utils.LoadGroups("groups.json")
+	data := e.templateData(Evaluation{Payload: payload})
+	rules := e.Rules()
+
+	var devices, scenes []string
+	visited := map[string]bool{}
+	var collect func(rule Rule)
+	collect = func(rule Rule) {
+		if visited[rule.Name] {
+			return
+		}
+		visited[rule.Name] = true
+		for _, action := range rule.Actions {
+			filled, err := action.fill(data)
+			if err != nil {
+				continue
+			}
+			devices = append(devices, utils.ExpandGroups(filled.Devices, groups)...)
+			if filled.Scene != "" {
+				scenes = append(scenes, filled.Scene)
+			}
+			// later templates see the variables the action sets
+			for variable, value := range filled.Set {
+				data[variable] = value
+			}
+			for _, invoked := range rules {
+				if filled.Rule != "" && invoked.Name == filled.Rule {
+					collect(invoked)
+				}
+			}
+		}
+	}
+	for _, rule := range rules {
+		if rule.Trigger.Webhook == name && !rule.Disabled {
+			collect(rule)
+		}
+	}
+	return devices, scenes, nil
+}
+
+func (e *Engine) handleMQTT(topic string, payload []byte) {
+	for _, rule := range e.Rules() {
+		trigger := rule.Trigger.MQTT
+		if trigger == nil || !mqttbridge.Match(trigger.Topic, topic) {
+			continue
+		}
+		if trigger.Payload != "" && trigger.Payload != string(payload) {
+			continue
+		}
+		// JSON payloads can be referred to field by field
+		var decoded any
+		if json.Unmarshal(payload, &decoded) != nil {
+			decoded = string(payload)
+		}
+		e.fire(context.Background(), rule, decoded)
+	}
+}
+
+// fire evaluates a rule in the background.
+func (e *Engine) fire(ctx context.Context, rule Rule, payload any) {
+	if rule.Disabled {
+		return
+	}
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		evaluation := e.Evaluate(ctx, rule, rule.Trigger.String(), payload)
+		if e.Log != nil {
+			e.Log(evaluation)
+		} else {
+			log.Print(evaluation)
+		}
+	}()
+}
+
+// Wait waits for the rules fired so far to finish.
+func (e *Engine) Wait() {
+	e.wg.Wait()
+}
+
+// Evaluate checks the conditions of a rule and runs its actions if they all
+// hold.
+//
+// Parameters:
+// - ctx: Cancels the delays.
+// - rule: The rule to evaluate.
+// - trigger: What triggered it, for the log.
+// - payload: The payload of the trigger, nil if none.
+//
+// Returns:
+// - Evaluation: The result of every condition and action.
+func (e *Engine) Evaluate(ctx context.Context, rule Rule, trigger string, payload any) Evaluation {
+	evaluation := Evaluation{Rule: rule.Name, Trigger: trigger, Payload: payload, Time: time.Now()}
+	for _, condition := range rule.Conditions {
+		held, err := e.check(condition, evaluation)
+		evaluation.Conditions = append(evaluation.Conditions, ConditionResult{Condition: condition.String(), Held: held, Err: err})
+		if !held {
+			return evaluation
+		}
+	}
+
+	evaluation.Ran = true
+	for _, action := range rule.Actions {
+		filled, err := action.fill(e.templateData(evaluation))
+		if err == nil {
+			action = filled
+			err = e.run(ctx, action, &evaluation)
+		}
+		evaluation.Actions = append(evaluation.Actions, ActionResult{Action: action.String(), Err: err})
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return evaluation
+}
+
+// templateData returns the variables and the payload of an evaluation, for
+// templates and variable conditions.
+func (e *Engine) templateData(evaluation Evaluation) map[string]any {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	data := make(map[string]any, len(e.variables)+1)
+	for name, value := range e.variables {
+		data[name] = value
+	}
+	data["payload"] = evaluation.Payload
+	return data
+}
+
+// check reports whether a condition holds for an evaluation.
+func (e *Engine) check(condition Condition, evaluation Evaluation) (bool, error) {
+	switch {
+	case condition.Time != nil:
+		return checkTime(*condition.Time, evaluation.Time), nil
+	case condition.Device != nil:
+		state, err := e.deviceState(condition.Device.Device)
+		if err != nil {
+			return false, err
+		}
+		return checkDevice(*condition.Device, state), nil
+	case condition.Variable != nil:
+		value, _ := lookup(e.templateData(evaluation), condition.Variable.Name)
+		return fmt.Sprint(value) == fmt.Sprint(condition.Variable.Equals), nil
+	}
+	return false, nil
+}
+
+func checkTime(condition TimeCondition, now time.Time) bool {
+	if len(condition.Days) > 0 {
+		today := false
+		for _, day := range condition.Days {
+			if weekdays[strings.ToLower(day)] == now.Weekday() {
+				today = true
+			}
+		}
+		if !today {
+			return false
+		}
+	}
+
+	sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	after, _ := clock(condition.After)
+	before, _ := clock(condition.Before)
+	switch {
+	case condition.After != "" && condition.Before != "" && after > before:
+		// across midnight
+		return sinceMidnight >= after || sinceMidnight < before
+	case condition.After != "" && sinceMidnight < after:
+		return false
+	case condition.Before != "" && sinceMidnight >= before:
+		return false
+	}
+	return true
+}
+
+func checkDevice(condition DeviceCondition, state poller.State) bool {
+	if condition.Power != "" && condition.Power != state.Power {
+		return false
+	}
+	if condition.Online != nil && *condition.Online != state.Online {
+		return false
+	}
+	if condition.BrightnessAbove != nil && state.Brightness <= *condition.BrightnessAbove {
+		return false
+	}
+	if condition.BrightnessBelow != nil && state.Brightness >= *condition.BrightnessBelow {
+		return false
+	}
+	return true
+}
+
+// deviceState returns the state of a device from the poller, or polls it.
+func (e *Engine) deviceState(name string) (poller.State, error) {
+	if e.Poller != nil {
+		if state, ok := e.Poller.State(name); ok {
+			return state, nil
+		}
+	}
+	found, _, err := apiwrapper.ResolveDevices([]string{name})
+	if err != nil {
+		return poller.State{}, err
+	}
+	if len(found) == 0 {
+		return poller.State{}, fmt.Errorf("%s is not in devices.json", name)
+	}
+	device := found[0]
+	response, err := apiwrapper.GetDeviceState(device.Device, device.Model, apiwrapper.KeyFor(device, e.APIKEY))
+	if err == nil && response.Code != 200 {
+		err = fmt.Errorf("%d %s", response.Code, response.Message)
+	}
+	if err != nil {
+		return poller.State{}, err
+	}
+	return poller.Merge(response.Data.Properties), nil
+}
+
+// run runs one action.
+func (e *Engine) run(ctx context.Context, action Action, evaluation *Evaluation) error {
+	switch {
+	case action.State != nil:
+		// no groups.json means no groups
+		groups, _ := utils.LoadGroups("groups.json")
+		return control.Apply(utils.ExpandGroups(action.Devices, groups), *action.State, e.APIKEY)
+	case action.Effect != nil:
+		player := e.Effects
+		if player == nil {
+			player = effects.New(e.APIKEY)
+		}
+		groups, _ := utils.LoadGroups("groups.json")
+		_, err := player.Play(ctx, utils.ExpandGroups(action.Devices, groups), *action.Effect)
+		return err
+	case action.Scene != "":
+		scenes, err := control.LoadScenes("scenes.json")
+		if err != nil {
+			return err
+		}
+		scene, ok := scenes[action.Scene]
+		if !ok {
+			return fmt.Errorf("no scene named %q", action.Scene)
+		}
+		groups, _ := utils.LoadGroups("groups.json")
+		return control.ApplyScene(scene, groups, e.APIKEY)
+	case action.Delay > 0:
+		timer := time.NewTimer(time.Duration(action.Delay))
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	case action.Rule != "":
+		for _, rule := range e.Rules() {
+			if rule.Name == action.Rule {
+				invoked := e.Evaluate(ctx, rule, "rule "+evaluation.Rule, evaluation.Payload)
+				if e.Log != nil {
+					e.Log(invoked)
+				} else {
+					log.Print(invoked)
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("no rule named %q", action.Rule)
+	case len(action.Set) > 0:
+		e.mu.Lock()
+		for name, value := range action.Set {
+			e.variables[name] = value
+		}
+		e.mu.Unlock()
+	}
+	return nil
+}
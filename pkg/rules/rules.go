@@ -0,0 +1,481 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/config"
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/effects"
+	"github.com/seanpden/govee_controller/pkg/poller"
+	"github.com/seanpden/govee_controller/pkg/scheduler"
+	"gopkg.in/yaml.v3"
+)
+
+// File is the layout of the rules file.
+//
+//	variables:
+//	  away: false
+//	rules:
+//	  - name: porch light
+//	    trigger:
+//	      schedule: {solar: sunset-30m}
+//	    conditions:
+//	      - variable: {name: away, equals: false}
+//	    actions:
+//	      - devices: [Porch]
+//	        state: {power: on, brightness: 60}
+//	      - delay: 5h
+//	      - devices: [Porch]
+//	        state: {power: off}
+type File struct {
+	// Variables holds the initial values of the variables, actions can
+	// change them and conditions test them.
+	Variables map[string]any `json:"variables,omitempty"`
+	// Webhooks authenticates webhooks by signature, by webhook name.
+	Webhooks map[string]Webhook `json:"webhooks,omitempty"`
+	Rules    []Rule             `json:"rules"`
+}
+
+// Rule runs its actions when its trigger fires and all its conditions hold.
+type Rule struct {
+	Name       string      `json:"name"`
+	Disabled   bool        `json:"disabled,omitempty"`
+	Trigger    Trigger     `json:"trigger"`
+	Conditions []Condition `json:"conditions,omitempty"`
+	Actions    []Action    `json:"actions"`
+}
+
+// Trigger is what makes a rule run, exactly one field is set. A rule without
+// a trigger only runs when another rule invokes it.
+type Trigger struct {
+	State    *StateTrigger    `json:"state,omitempty"`
+	Schedule *ScheduleTrigger `json:"schedule,omitempty"`
+	// Webhook is the name of the webhook, POST /hooks/{name}.
+	Webhook string       `json:"webhook,omitempty"`
+	MQTT    *MQTTTrigger `json:"mqtt,omitempty"`
+	// File is a path whose modification fires the rule.
+	File string `json:"file,omitempty"`
+}
+
+// StateTrigger fires when the poller reports a change of a device.
+type StateTrigger struct {
+	Device string `json:"device"`
+	// Change is the kind of change: power, brightness, color, colorTem,
+	// online or offline.
+	Change string `json:"change"`
+	// To, if set, is the new value the change must have, e.g. "on".
+	To string `json:"to,omitempty"`
+}
+
+// ScheduleTrigger fires on a cron expression or a solar event, like a job of
+// the scheduler.
+type ScheduleTrigger struct {
+	Cron     string `json:"cron,omitempty"`
+	Solar    string `json:"solar,omitempty"`
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// MQTTTrigger fires on a message published to a topic.
+type MQTTTrigger struct {
+	// Topic is a topic filter, + and # wildcards are allowed.
+	Topic string `json:"topic"`
+	// Payload, if set, is the payload the message must have.
+	Payload string `json:"payload,omitempty"`
+}
+
+// Condition must hold for the actions to run, exactly one field is set.
+type Condition struct {
+	Time     *TimeCondition     `json:"time,omitempty"`
+	Device   *DeviceCondition   `json:"device,omitempty"`
+	Variable *VariableCondition `json:"variable,omitempty"`
+}
+
+// TimeCondition holds between two times of day, across midnight if After is
+// later than Before, and on the given days.
+type TimeCondition struct {
+	// After and Before are "15:04" times, either can be left out.
+	After  string `json:"after,omitempty"`
+	Before string `json:"before,omitempty"`
+	// Days are three letter week days, e.g. [mon, tue], every day if empty.
+	Days []string `json:"days,omitempty"`
+}
+
+// DeviceCondition holds when the state of a device matches every field set.
+type DeviceCondition struct {
+	Device          string `json:"device"`
+	Power           string `json:"power,omitempty"`
+	Online          *bool  `json:"online,omitempty"`
+	BrightnessAbove *int   `json:"brightnessAbove,omitempty"`
+	BrightnessBelow *int   `json:"brightnessBelow,omitempty"`
+}
+
+// VariableCondition holds when a variable has a value. The name can be a
+// dotted path into a variable or into the payload of the webhook that
+// triggered the rule, e.g. payload.build.status.
+type VariableCondition struct {
+	Name   string `json:"name"`
+	Equals any    `json:"equals"`
+}
+
+// Action is one step of a rule, exactly one kind is set: a state or an
+// effect for devices, a scene, a delay, another rule or variables to set. Its strings can be
+// templates, see template.go.
+type Action struct {
+	Devices []string        `json:"devices,omitempty"`
+	State   *control.State  `json:"state,omitempty"`
+	Effect  *effects.Effect `json:"effect,omitempty"`
+	Scene   string          `json:"scene,omitempty"`
+	Delay   config.Duration `json:"delay,omitempty"`
+	Rule    string          `json:"rule,omitempty"`
+	Set     map[string]any  `json:"set,omitempty"`
+
+	// template holds the decoded action when it has templates.
+	template any
+}
+
+// Load reads and validates a rules file.
+func Load(path string) (File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return File{}, err
+	}
+	file, err := Parse(data)
+	if err != nil {
+		return File{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return file, nil
+}
+
+// Parse parses and validates rules written in YAML (or JSON, which is YAML).
+func Parse(data []byte) (File, error) {
+	// go through JSON so the rules share the JSON forms of the other files,
+	// e.g. colors by name and durations as "5m"
+	var raw any
+	err := yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return File{}, err
+	}
+	converted, err := json.Marshal(raw)
+	if err != nil {
+		return File{}, err
+	}
+
+	var file File
+	decoder := json.NewDecoder(bytes.NewReader(converted))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&file)
+	if err != nil {
+		return File{}, err
+	}
+	err = file.Validate()
+	if err != nil {
+		return File{}, err
+	}
+	file.registerSecrets()
+	return file, nil
+}
+
+// Validate checks every rule, and that the rules a rule invokes exist and
+// don't invoke it back.
+func (f File) Validate() error {
+	names := map[string]Rule{}
+	var errs []error
+	for i, rule := range f.Rules {
+		if rule.Name == "" {
+			errs = append(errs, fmt.Errorf("rule %d has no name", i+1))
+			continue
+		}
+		if _, ok := names[rule.Name]; ok {
+			errs = append(errs, fmt.Errorf("rule %q is defined twice", rule.Name))
+			continue
+		}
+		names[rule.Name] = rule
+		err := rule.validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %q: %w", rule.Name, err))
+		}
+	}
+	for name, webhook := range f.Webhooks {
+		err := webhook.validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("webhook %q: %w", name, err))
+		}
+		used := false
+		for _, rule := range f.Rules {
+			used = used || rule.Trigger.Webhook == name
+		}
+		if !used {
+			errs = append(errs, fmt.Errorf("webhook %q triggers no rule", name))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for _, rule := range f.Rules {
+		err := checkInvocations(rule.Name, names, nil)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkInvocations follows the rules invoked by a rule, path holds the rules
+// invoking it.
+func checkInvocations(name string, rules map[string]Rule, path []string) error {
+	for _, seen := range path {
+		if seen == name {
+			return fmt.Errorf("rules invoke each other in a loop: %s -> %s", strings.Join(path, " -> "), name)
+		}
+	}
+	rule, ok := rules[name]
+	if !ok {
+		return fmt.Errorf("rule %q invokes unknown rule %q", path[len(path)-1], name)
+	}
+	for _, action := range rule.Actions {
+		if action.Rule == "" {
+			continue
+		}
+		err := checkInvocations(action.Rule, rules, append(path, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r Rule) validate() error {
+	err := r.Trigger.validate()
+	if err != nil {
+		return fmt.Errorf("trigger: %w", err)
+	}
+	for i, condition := range r.Conditions {
+		err = condition.validate()
+		if err != nil {
+			return fmt.Errorf("condition %d: %w", i+1, err)
+		}
+	}
+	if len(r.Actions) == 0 {
+		return errors.New("no actions")
+	}
+	for i, action := range r.Actions {
+		err = action.validate()
+		if err != nil {
+			return fmt.Errorf("action %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// count returns how many of the values are set.
+func count(set ...bool) int {
+	n := 0
+	for _, ok := range set {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+func (t Trigger) validate() error {
+	switch count(t.State != nil, t.Schedule != nil, t.Webhook != "", t.MQTT != nil, t.File != "") {
+	case 0:
+		return nil
+	case 1:
+	default:
+		return errors.New("set only one of state, schedule, webhook, mqtt and file")
+	}
+
+	switch {
+	case t.State != nil:
+		if t.State.Device == "" {
+			return errors.New("state needs a device")
+		}
+		switch poller.Kind(t.State.Change) {
+		case poller.KindPower, poller.KindBrightness, poller.KindColor, poller.KindColorTem, poller.KindOnline, poller.KindOffline:
+		default:
+			return fmt.Errorf("unknown change %q, expected power, brightness, color, colorTem, online or offline", t.State.Change)
+		}
+	case t.Schedule != nil:
+		_, err := t.Schedule.next(time.Now())
+		return err
+	case t.MQTT != nil:
+		if t.MQTT.Topic == "" {
+			return errors.New("mqtt needs a topic")
+		}
+	}
+	return nil
+}
+
+// next returns when the schedule fires after t.
+func (s ScheduleTrigger) next(t time.Time) (time.Time, error) {
+	job := scheduler.Job{Cron: s.Cron, Solar: s.Solar, TimeZone: s.TimeZone}
+	return job.Next(t)
+}
+
+// String describes the trigger for the evaluation log.
+func (t Trigger) String() string {
+	switch {
+	case t.State != nil:
+		description := fmt.Sprintf("%s %s", t.State.Device, t.State.Change)
+		if t.State.To != "" {
+			description += " to " + t.State.To
+		}
+		return description
+	case t.Schedule != nil:
+		return "schedule " + t.Schedule.Cron + t.Schedule.Solar
+	case t.Webhook != "":
+		return "webhook " + t.Webhook
+	case t.MQTT != nil:
+		return "mqtt " + t.MQTT.Topic
+	case t.File != "":
+		return "file " + t.File
+	}
+	return "none"
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// clock parses a "15:04" time into the time since midnight.
+func clock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("time %q must be written as 15:04", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (c Condition) validate() error {
+	if count(c.Time != nil, c.Device != nil, c.Variable != nil) != 1 {
+		return errors.New("set exactly one of time, device and variable")
+	}
+	switch {
+	case c.Time != nil:
+		if c.Time.After == "" && c.Time.Before == "" && len(c.Time.Days) == 0 {
+			return errors.New("time needs after, before or days")
+		}
+		for _, value := range []string{c.Time.After, c.Time.Before} {
+			if value == "" {
+				continue
+			}
+			if _, err := clock(value); err != nil {
+				return err
+			}
+		}
+		for _, day := range c.Time.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				return fmt.Errorf("unknown day %q, expected mon, tue, wed, thu, fri, sat or sun", day)
+			}
+		}
+	case c.Device != nil:
+		if c.Device.Device == "" {
+			return errors.New("device needs a device")
+		}
+		if c.Device.Power != "" && c.Device.Power != "on" && c.Device.Power != "off" {
+			return fmt.Errorf("power must be on or off, got %q", c.Device.Power)
+		}
+	case c.Variable != nil:
+		if c.Variable.Name == "" {
+			return errors.New("variable needs a name")
+		}
+	}
+	return nil
+}
+
+// String describes the condition for the evaluation log.
+func (c Condition) String() string {
+	switch {
+	case c.Time != nil:
+		description := "time"
+		if c.Time.After != "" {
+			description += " after " + c.Time.After
+		}
+		if c.Time.Before != "" {
+			description += " before " + c.Time.Before
+		}
+		if len(c.Time.Days) > 0 {
+			description += " on " + strings.Join(c.Time.Days, ",")
+		}
+		return description
+	case c.Device != nil:
+		var parts []string
+		if c.Device.Power != "" {
+			parts = append(parts, "power="+c.Device.Power)
+		}
+		if c.Device.Online != nil {
+			parts = append(parts, fmt.Sprintf("online=%v", *c.Device.Online))
+		}
+		if c.Device.BrightnessAbove != nil {
+			parts = append(parts, fmt.Sprintf("brightness>%d", *c.Device.BrightnessAbove))
+		}
+		if c.Device.BrightnessBelow != nil {
+			parts = append(parts, fmt.Sprintf("brightness<%d", *c.Device.BrightnessBelow))
+		}
+		return fmt.Sprintf("device %s %s", c.Device.Device, strings.Join(parts, " "))
+	case c.Variable != nil:
+		return fmt.Sprintf("variable %s=%v", c.Variable.Name, c.Variable.Equals)
+	}
+	return "none"
+}
+
+func (a Action) validate() error {
+	if a.template != nil {
+		// checked once filled in
+		return nil
+	}
+	if count(a.State != nil, a.Effect != nil, a.Scene != "", a.Delay != 0, a.Rule != "", len(a.Set) > 0) != 1 {
+		return errors.New("set exactly one of state, effect, scene, delay, rule and set")
+	}
+	if a.State != nil || a.Effect != nil {
+		if len(a.Devices) == 0 {
+			return errors.New("a state or an effect needs devices")
+		}
+		if a.Effect != nil {
+			return a.Effect.Validate()
+		}
+		return a.State.Validate()
+	}
+	if len(a.Devices) > 0 {
+		return errors.New("devices go with a state or an effect")
+	}
+	if a.Delay < 0 {
+		return errors.New("delay can not be negative")
+	}
+	return nil
+}
+
+// String describes the action for the evaluation log.
+func (a Action) String() string {
+	if a.template != nil {
+		data, _ := json.Marshal(a.template)
+		return string(data)
+	}
+	switch {
+	case a.State != nil:
+		data, _ := json.Marshal(a.State)
+		return fmt.Sprintf("%v %s", a.Devices, data)
+	case a.Effect != nil:
+		return fmt.Sprintf("%v effect %s", a.Devices, a.Effect.Name)
+	case a.Scene != "":
+		return "scene " + a.Scene
+	case a.Delay != 0:
+		return "delay " + time.Duration(a.Delay).String()
+	case a.Rule != "":
+		return "rule " + a.Rule
+	case len(a.Set) > 0:
+		data, _ := json.Marshal(a.Set)
+		return "set " + string(data)
+	}
+	return "nothing"
+}
@@ -0,0 +1,242 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Actions can use Go templates in their strings, filled in when they run
+// from the variables and the JSON payload of the webhook that triggered the
+// rule, e.g.
+//
+//	- devices: ["{{ .payload.team }} light"]
+//	  state: {color: '{{ if eq .payload.status "failed" }}red{{ else }}green{{ end }}'}
+//
+// Templated actions are checked when they run rather than when the file is
+// loaded, since their values are only known then.
+
+// hasTemplate reports whether a decoded JSON value holds a template.
+func hasTemplate(value any) bool {
+	switch value := value.(type) {
+	case string:
+		return strings.Contains(value, "{{")
+	case []any:
+		for _, item := range value {
+			if hasTemplate(item) {
+				return true
+			}
+		}
+	case map[string]any:
+		for _, item := range value {
+			if hasTemplate(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withoutTemplates returns a copy of a decoded JSON value without the
+// templated strings, so the rest can be checked when the file is loaded.
+func withoutTemplates(value any) any {
+	switch value := value.(type) {
+	case []any:
+		var items []any
+		for _, item := range value {
+			if !hasTemplate(item) || isContainer(item) {
+				items = append(items, withoutTemplates(item))
+			}
+		}
+		return items
+	case map[string]any:
+		items := map[string]any{}
+		for key, item := range value {
+			if !hasTemplate(item) || isContainer(item) {
+				items[key] = withoutTemplates(item)
+			}
+		}
+		return items
+	}
+	return value
+}
+
+func isContainer(value any) bool {
+	switch value.(type) {
+	case []any, map[string]any:
+		return true
+	}
+	return false
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("action").Option("missingkey=error").Parse(text)
+}
+
+// checkTemplates parses every template of a decoded JSON value.
+func checkTemplates(value any) error {
+	switch value := value.(type) {
+	case string:
+		if strings.Contains(value, "{{") {
+			_, err := parseTemplate(value)
+			return err
+		}
+	case []any:
+		for _, item := range value {
+			err := checkTemplates(item)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		for _, item := range value {
+			err := checkTemplates(item)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fill executes the templates of a decoded JSON value with data.
+func fill(value any, data map[string]any) (any, error) {
+	switch value := value.(type) {
+	case string:
+		if !strings.Contains(value, "{{") {
+			return value, nil
+		}
+		tmpl, err := parseTemplate(value)
+		if err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		err = tmpl.Execute(&b, data)
+		if err != nil {
+			return nil, err
+		}
+		return b.String(), nil
+	case []any:
+		items := make([]any, len(value))
+		for i, item := range value {
+			filled, err := fill(item, data)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = filled
+		}
+		return items, nil
+	case map[string]any:
+		items := map[string]any{}
+		for key, item := range value {
+			filled, err := fill(item, data)
+			if err != nil {
+				return nil, err
+			}
+			items[key] = filled
+		}
+		return items, nil
+	}
+	return value, nil
+}
+
+// decodeStrict decodes JSON refusing unknown fields.
+func decodeStrict(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// plainAction is an Action without its UnmarshalJSON method.
+type plainAction Action
+
+func (a *Action) UnmarshalJSON(data []byte) error {
+	var raw any
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	if !hasTemplate(raw) {
+		return decodeStrict(data, (*plainAction)(a))
+	}
+
+	if object, ok := raw.(map[string]any); ok && hasTemplate(object["rule"]) {
+		// the rules invoked are checked for loops when the file is loaded
+		return errors.New("the rule of an action can not be a template")
+	}
+	err = checkTemplates(raw)
+	if err != nil {
+		return err
+	}
+	stripped, err := json.Marshal(withoutTemplates(raw))
+	if err != nil {
+		return err
+	}
+	err = decodeStrict(stripped, (*plainAction)(a))
+	if err != nil {
+		return err
+	}
+	a.template = raw
+	return nil
+}
+
+// fill returns the action with its templates executed with data.
+func (a Action) fill(data map[string]any) (Action, error) {
+	if a.template == nil {
+		return a, nil
+	}
+	raw, err := fill(a.template, data)
+	if err != nil {
+		return Action{}, err
+	}
+	// templates render strings, the numbers of a state are converted back
+	object, _ := raw.(map[string]any)
+	if state, ok := object["state"].(map[string]any); ok {
+		for _, key := range []string{"brightness", "colorTem"} {
+			text, ok := state[key].(string)
+			if !ok {
+				continue
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(text))
+			if err != nil {
+				return Action{}, fmt.Errorf("%s: %q is not a number", key, text)
+			}
+			state[key] = n
+		}
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return Action{}, err
+	}
+	var filled Action
+	err = decodeStrict(encoded, (*plainAction)(&filled))
+	if err != nil {
+		return Action{}, err
+	}
+	err = filled.validate()
+	if err != nil {
+		return Action{}, fmt.Errorf("%s: %w", filled, err)
+	}
+	return filled, nil
+}
+
+// lookup returns the value at a dotted path such as payload.build.status in
+// data, and whether it exists.
+func lookup(data map[string]any, path string) (any, bool) {
+	var value any = data
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		value, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
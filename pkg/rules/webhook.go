@@ -0,0 +1,131 @@
+package rules
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/seanpden/govee_controller/pkg/redact"
+)
+
+// ErrBadSignature is returned for a webhook request whose signature or token
+// doesn't match the secret of the webhook.
+var ErrBadSignature = errors.New("invalid webhook signature")
+
+// Signature styles of webhooks.
+const (
+	// SignatureGitHub expects X-Hub-Signature-256: sha256=<hex HMAC-SHA256
+	// of the body>.
+	SignatureGitHub = "github"
+	// SignatureGitLab expects X-Gitlab-Token: <secret>.
+	SignatureGitLab = "gitlab"
+	// SignatureHMAC expects the hex HMAC-SHA256 of the body, optionally
+	// prefixed with sha256=, in X-Signature or Header.
+	SignatureHMAC = "hmac"
+)
+
+// Webhook configures how the requests of a webhook are authenticated. A
+// webhook with a secret is authenticated by its signature instead of a
+// bearer token, for senders such as GitHub that can't set one.
+//
+//	webhooks:
+//	  ci:
+//	    signature: github
+//	    secretEnv: CI_WEBHOOK_SECRET
+type Webhook struct {
+	Signature string `json:"signature"`
+	// Header overrides the header holding the signature of hmac webhooks.
+	Header string `json:"header,omitempty"`
+	// Secret is the shared secret, or SecretEnv names the environment
+	// variable holding it to keep it out of the file.
+	Secret    string `json:"secret,omitempty"`
+	SecretEnv string `json:"secretEnv,omitempty"`
+}
+
+func (w Webhook) validate() error {
+	switch w.Signature {
+	case SignatureGitHub, SignatureGitLab, SignatureHMAC:
+	default:
+		return fmt.Errorf("unknown signature %q, expected %s, %s or %s", w.Signature, SignatureGitHub, SignatureGitLab, SignatureHMAC)
+	}
+	if w.Header != "" && w.Signature != SignatureHMAC {
+		return fmt.Errorf("header is only used by %s signatures", SignatureHMAC)
+	}
+	if count(w.Secret != "", w.SecretEnv != "") != 1 {
+		return errors.New("set exactly one of secret and secretEnv")
+	}
+	if w.SecretEnv != "" && os.Getenv(w.SecretEnv) == "" {
+		return fmt.Errorf("$%s is not set", w.SecretEnv)
+	}
+	return nil
+}
+
+// secret returns the shared secret of the webhook.
+func (w Webhook) secret() string {
+	if w.SecretEnv != "" {
+		return os.Getenv(w.SecretEnv)
+	}
+	return w.Secret
+}
+
+// Verify checks the signature of a request to the webhook.
+//
+// Parameters:
+// - header: The headers of the request.
+// - body: The body of the request, as received.
+//
+// Returns:
+// - error: ErrBadSignature if the signature is missing or wrong.
+func (w Webhook) Verify(header http.Header, body []byte) error {
+	secret := w.secret()
+	if secret == "" {
+		return fmt.Errorf("%w: the webhook has no secret", ErrBadSignature)
+	}
+
+	if w.Signature == SignatureGitLab {
+		token := header.Get("X-Gitlab-Token")
+		if token == "" {
+			return fmt.Errorf("%w: expected an X-Gitlab-Token header", ErrBadSignature)
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return ErrBadSignature
+		}
+		return nil
+	}
+
+	name := "X-Hub-Signature-256"
+	if w.Signature == SignatureHMAC {
+		name = "X-Signature"
+		if w.Header != "" {
+			name = w.Header
+		}
+	}
+	signature := header.Get(name)
+	hexDigest, found := strings.CutPrefix(signature, "sha256=")
+	if signature == "" || (w.Signature == SignatureGitHub && !found) {
+		return fmt.Errorf("%w: expected a %s: sha256=<signature> header", ErrBadSignature, name)
+	}
+	got, err := hex.DecodeString(hexDigest)
+	if err != nil {
+		return fmt.Errorf("%w: the signature is not hexadecimal", ErrBadSignature)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// registerSecrets keeps the secrets of the webhooks out of logs and traces.
+func (f File) registerSecrets() {
+	for _, webhook := range f.Webhooks {
+		redact.Register(webhook.secret())
+	}
+}
@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outcome is the result of a run for one device.
+type Outcome struct {
+	Device string `json:"device"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Run records one run of a job.
+type Run struct {
+	JobID string `json:"jobId"`
+	Job   string `json:"job"`
+	// Scheduled is the time the run was due, Started can be later because of
+	// jitter or downtime.
+	Scheduled time.Time `json:"scheduled"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	// Missed marks a run that was due while the scheduler was not running.
+	Missed   bool      `json:"missed,omitempty"`
+	Outcomes []Outcome `json:"outcomes,omitempty"`
+	// Error is set when the job could not run at all, e.g. for an unknown
+	// scene.
+	Error string `json:"error,omitempty"`
+}
+
+// OK reports whether the run succeeded for every device.
+func (r Run) OK() bool {
+	if r.Error != "" {
+		return false
+	}
+	for _, outcome := range r.Outcomes {
+		if outcome.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// History is the file the runs are appended to, one JSON object per line.
+type History struct {
+	Path string
+	mu   *sync.Mutex
+}
+
+// NewHistory returns the history kept in path.
+func NewHistory(path string) History {
+	return History{Path: path, mu: &sync.Mutex{}}
+}
+
+// Append adds a run to the history.
+func (h History) Append(run Run) error {
+	if h.mu != nil {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+	}
+	file, err := os.OpenFile(h.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(run)
+}
+
+// Load returns every run, oldest first. A missing file holds no runs.
+func (h History) Load() ([]Run, error) {
+	file, err := os.Open(h.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var runs []Run
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var run Run
+		if json.Unmarshal(scanner.Bytes(), &run) == nil {
+			runs = append(runs, run)
+		}
+	}
+	return runs, scanner.Err()
+}
+
+// lastScheduled returns the latest scheduled time of every job in the
+// history.
+func (h History) lastScheduled() (map[string]time.Time, error) {
+	runs, err := h.Load()
+	if err != nil {
+		return nil, err
+	}
+	last := map[string]time.Time{}
+	for _, run := range runs {
+		if run.Scheduled.After(last[run.JobID]) {
+			last[run.JobID] = run.Scheduled
+		}
+	}
+	return last, nil
+}
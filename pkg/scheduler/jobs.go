@@ -0,0 +1,284 @@
+package scheduler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/seanpden/govee_controller/pkg/config"
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/solar"
+)
+
+// Missed-run policies, applied when a run was due while the scheduler was not
+// running.
+const (
+	// MissedSkip drops missed runs, the job runs again at its next time.
+	MissedSkip = "skip"
+	// MissedRunOnce runs the job once as soon as the scheduler is back,
+	// however many runs were missed.
+	MissedRunOnce = "once"
+)
+
+// ErrNotFound is returned when no job has the given id or name.
+var ErrNotFound = errors.New("no such job")
+
+// Coordinates is the place solar schedules are computed for, set from the
+// latitude and longitude in the config. Solar jobs are refused without it.
+var Coordinates *solar.Coordinates
+
+// Job runs an action on a cron schedule, or daily at a solar event.
+//
+// The action is one of: a state applied to devices (or groups), a scene from
+// scenes.json or a routine from routines.json.
+type Job struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Cron is a standard five field cron expression, or a descriptor such as
+	// @daily or @every 1h.
+	Cron string `json:"cron,omitempty"`
+	// Solar is a solar event with an optional offset, e.g. "sunset-30m",
+	// used instead of Cron, see solar.Parse.
+	Solar string `json:"solar,omitempty"`
+	// TimeZone is the IANA time zone the schedule is evaluated in, local
+	// time if empty.
+	TimeZone string `json:"timeZone,omitempty"`
+	// Jitter delays every run by a random time up to this duration.
+	Jitter config.Duration `json:"jitter,omitempty"`
+	// Missed is MissedSkip (the default) or MissedRunOnce.
+	Missed   string `json:"missed,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+
+	Devices []string       `json:"devices,omitempty"`
+	State   *control.State `json:"state,omitempty"`
+	Scene   string         `json:"scene,omitempty"`
+	Routine string         `json:"routine,omitempty"`
+
+	Created time.Time `json:"created"`
+}
+
+// Validate checks the schedule, time zone, policy and action of a job.
+func (j Job) Validate() error {
+	if j.Name == "" {
+		return errors.New("a job needs a name")
+	}
+	_, err := j.schedule()
+	if err != nil {
+		return err
+	}
+	if j.Missed != "" && j.Missed != MissedSkip && j.Missed != MissedRunOnce {
+		return fmt.Errorf("missed must be %s or %s, got %q", MissedSkip, MissedRunOnce, j.Missed)
+	}
+
+	actions := 0
+	if j.State != nil {
+		actions++
+		if len(j.Devices) == 0 {
+			return errors.New("a job setting a state needs devices")
+		}
+		err = j.State.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	if j.Scene != "" {
+		actions++
+	}
+	if j.Routine != "" {
+		actions++
+	}
+	if actions != 1 {
+		return errors.New("a job needs exactly one action: a state for devices, a scene or a routine")
+	}
+	return nil
+}
+
+// schedule parses the cron expression or the solar event in the job's time
+// zone.
+func (j Job) schedule() (cron.Schedule, error) {
+	location := time.Local
+	if j.TimeZone != "" {
+		var err error
+		location, err = time.LoadLocation(j.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("time zone %q: %w", j.TimeZone, err)
+		}
+	}
+	if (j.Cron == "") == (j.Solar == "") {
+		return nil, errors.New("a job needs either a cron expression or a solar event")
+	}
+	if j.Solar != "" {
+		if Coordinates == nil {
+			return nil, errors.New("solar schedules need the latitude and longitude in the config")
+		}
+		schedule, err := solar.Parse(j.Solar, *Coordinates, location)
+		if err != nil {
+			return nil, err
+		}
+		return schedule, nil
+	}
+
+	schedule, err := cron.ParseStandard(j.Cron)
+	if err != nil {
+		return nil, fmt.Errorf("cron %q: %w", j.Cron, err)
+	}
+	return inLocation{schedule, location}, nil
+}
+
+// inLocation evaluates a schedule in a time zone.
+type inLocation struct {
+	cron.Schedule
+	location *time.Location
+}
+
+func (s inLocation) Next(t time.Time) time.Time {
+	return s.Schedule.Next(t.In(s.location))
+}
+
+// Next returns the first time the job is due after t, the zero time if it
+// is never due again.
+func (j Job) Next(t time.Time) (time.Time, error) {
+	schedule, err := j.schedule()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return schedule.Next(t), nil
+}
+
+// When returns the schedule of the job as it was given.
+func (j Job) When() string {
+	if j.Solar != "" {
+		return j.Solar
+	}
+	return j.Cron
+}
+
+// Describe returns a short description of the job's action.
+func (j Job) Describe() string {
+	switch {
+	case j.Scene != "":
+		return "scene " + j.Scene
+	case j.Routine != "":
+		return "routine " + j.Routine
+	case j.State != nil:
+		data, _ := json.Marshal(j.State)
+		return fmt.Sprintf("%v %s", j.Devices, data)
+	}
+	return "nothing"
+}
+
+// Store is the JSON file holding the jobs. The scheduler reads it on every
+// tick, so jobs edited from the CLI apply without a restart.
+type Store struct {
+	Path string
+}
+
+// Load returns every job. A missing file holds no jobs.
+func (s Store) Load() ([]Job, error) {
+	file, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []Job
+	err = json.Unmarshal(file, &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Path, err)
+	}
+	return jobs, nil
+}
+
+// Save writes the jobs.
+func (s Store) Save(jobs []Job) error {
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.Path, data, 0644)
+}
+
+// Add validates a job, gives it an id and stores it.
+func (s Store) Add(job Job) (Job, error) {
+	err := job.Validate()
+	if err != nil {
+		return job, err
+	}
+	jobs, err := s.Load()
+	if err != nil {
+		return job, err
+	}
+	for _, existing := range jobs {
+		if existing.Name == job.Name {
+			return job, fmt.Errorf("a job named %q already exists", job.Name)
+		}
+	}
+
+	id := make([]byte, 4)
+	_, err = rand.Read(id)
+	if err != nil {
+		return job, err
+	}
+	job.ID = hex.EncodeToString(id)
+	job.Created = time.Now().UTC().Truncate(time.Second)
+	return job, s.Save(append(jobs, job))
+}
+
+// Update changes the job with the given id or name and stores it if it is
+// still valid.
+func (s Store) Update(idOrName string, change func(*Job)) (Job, error) {
+	jobs, err := s.Load()
+	if err != nil {
+		return Job{}, err
+	}
+	for i := range jobs {
+		if jobs[i].ID != idOrName && jobs[i].Name != idOrName {
+			continue
+		}
+		job := jobs[i]
+		change(&job)
+		err = job.Validate()
+		if err != nil {
+			return job, err
+		}
+		jobs[i] = job
+		return job, s.Save(jobs)
+	}
+	return Job{}, fmt.Errorf("%w: %s", ErrNotFound, idOrName)
+}
+
+// Remove deletes the job with the given id or name.
+func (s Store) Remove(idOrName string) (Job, error) {
+	jobs, err := s.Load()
+	if err != nil {
+		return Job{}, err
+	}
+	for i, job := range jobs {
+		if job.ID == idOrName || job.Name == idOrName {
+			return job, s.Save(append(jobs[:i], jobs[i+1:]...))
+		}
+	}
+	return Job{}, fmt.Errorf("%w: %s", ErrNotFound, idOrName)
+}
+
+// Find returns the job with the given id or name.
+func (s Store) Find(idOrName string) (Job, error) {
+	jobs, err := s.Load()
+	if err != nil {
+		return Job{}, err
+	}
+	for _, job := range jobs {
+		if job.ID == idOrName || job.Name == idOrName {
+			return job, nil
+		}
+	}
+	return Job{}, fmt.Errorf("%w: %s", ErrNotFound, idOrName)
+}
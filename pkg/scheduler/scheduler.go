@@ -0,0 +1,290 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// grace is how late a run may start and still count as on time, later runs
+// follow the job's missed-run policy.
+const grace = 2 * time.Minute
+
+// recheck is the longest the scheduler sleeps before reading the jobs again,
+// so edits made from the CLI are picked up.
+const recheck = 30 * time.Second
+
+// Scheduler runs the jobs of a Store and records every run in a History.
+//
+// Groups, scenes and routines are read from groups.json, scenes.json and
+// routines.json in the current directory when a job runs.
+type Scheduler struct {
+	Jobs    Store
+	History History
+	// APIKEY is the key used for devices without an account.
+	APIKEY string
+
+	last map[string]time.Time
+	wg   sync.WaitGroup
+}
+
+// New returns a scheduler for the jobs in jobs.json, keeping the history in
+// history.jsonl.
+func New(APIKEY string) *Scheduler {
+	return &Scheduler{
+		Jobs:    Store{Path: "jobs.json"},
+		History: NewHistory("history.jsonl"),
+		APIKEY:  APIKEY,
+	}
+}
+
+// Run runs the jobs until ctx is cancelled, then waits for the running jobs.
+//
+// Runs that were due while the scheduler was not running are found from the
+// history: a job that never ran counts from its creation.
+func (s *Scheduler) Run(ctx context.Context) error {
+	defer s.wg.Wait()
+	last, err := s.History.lastScheduled()
+	if err != nil {
+		return err
+	}
+	s.last = last
+
+	for {
+		wait := s.Tick(ctx)
+		if wait > recheck {
+			wait = recheck
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// Tick starts the jobs that are due and returns the time until the next one.
+func (s *Scheduler) Tick(ctx context.Context) time.Duration {
+	if s.last == nil {
+		last, err := s.History.lastScheduled()
+		if err != nil {
+			log.Println(err)
+			return recheck
+		}
+		s.last = last
+	}
+	jobs, err := s.Jobs.Load()
+	if err != nil {
+		log.Println(err)
+		return recheck
+	}
+
+	now := time.Now()
+	wait := recheck
+	for _, job := range jobs {
+		if job.Disabled {
+			continue
+		}
+		since, ok := s.last[job.ID]
+		if !ok || since.Before(job.Created) {
+			since = job.Created
+		}
+
+		// the latest time the job was due, there may have been many
+		due := time.Time{}
+		next, err := job.Next(since)
+		if err != nil {
+			log.Printf("job %s: %v", job.Name, err)
+			continue
+		}
+		for i := 0; !next.IsZero() && !next.After(now) && i < 100000; i++ {
+			due = next
+			next, _ = job.Next(next)
+		}
+		if until := next.Sub(now); !next.IsZero() && until < wait {
+			wait = until
+		}
+		if due.IsZero() {
+			continue
+		}
+
+		s.last[job.ID] = due
+		if now.Sub(due) <= grace {
+			s.start(ctx, job, due, false)
+		} else if job.Missed == MissedRunOnce {
+			s.start(ctx, job, due, true)
+		}
+	}
+	return wait
+}
+
+// Wait waits for the jobs started by Tick to finish.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// start runs a job in the background after its jitter.
+func (s *Scheduler) start(ctx context.Context, job Job, scheduled time.Time, missed bool) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if job.Jitter > 0 && !missed {
+			timer := time.NewTimer(time.Duration(rand.Int63n(int64(job.Jitter))))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		run := s.RunJob(ctx, job, scheduled, missed)
+		if !run.OK() {
+			log.Printf("job %s failed: %s", job.Name, summary(run))
+		}
+	}()
+}
+
+// RunJob runs a job now and appends the run to the history.
+//
+// Parameters:
+// - ctx: Cancels the waits of a routine.
+// - job: The job to run.
+// - scheduled: The time the run was due.
+// - missed: Whether the run was due while the scheduler was not running.
+//
+// Returns:
+// - Run: The run, with the outcome for every device.
+func (s *Scheduler) RunJob(ctx context.Context, job Job, scheduled time.Time, missed bool) Run {
+	run := Run{JobID: job.ID, Job: job.Name, Scheduled: scheduled, Started: time.Now(), Missed: missed}
+	err := s.apply(ctx, job, &run)
+	if err != nil {
+		run.Error = err.Error()
+	}
+	run.Finished = time.Now()
+
+	err = s.History.Append(run)
+	if err != nil {
+		log.Println(err)
+	}
+	return run
+}
+
+// apply runs the action of a job, adding an outcome per device to run.
+func (s *Scheduler) apply(ctx context.Context, job Job, run *Run) error {
+	// no groups.json means no groups
+	groups, _ := utils.LoadGroups("groups.json")
+
+	switch {
+	case job.State != nil:
+		s.applyState(utils.ExpandGroups(job.Devices, groups), *job.State, run)
+	case job.Scene != "":
+		scenes, err := control.LoadScenes("scenes.json")
+		if err != nil {
+			return err
+		}
+		scene, ok := scenes[job.Scene]
+		if !ok {
+			return fmt.Errorf("no scene named %q", job.Scene)
+		}
+		for _, step := range scene {
+			s.applyState(utils.ExpandGroups(step.Devices, groups), step.State, run)
+		}
+	case job.Routine != "":
+		routines, err := control.LoadRoutines("routines.json")
+		if err != nil {
+			return err
+		}
+		routine, ok := routines[job.Routine]
+		if !ok {
+			return fmt.Errorf("no routine named %q", job.Routine)
+		}
+		return s.applyRoutine(ctx, routine, groups, run)
+	}
+	return nil
+}
+
+func (s *Scheduler) applyRoutine(ctx context.Context, routine control.Routine, groups map[string][]string, run *Run) error {
+	var scenes map[string]control.Scene
+	for i, step := range routine {
+		if step.Scene != "" {
+			if scenes == nil {
+				var err error
+				scenes, err = control.LoadScenes("scenes.json")
+				if err != nil {
+					return err
+				}
+			}
+			scene, ok := scenes[step.Scene]
+			if !ok {
+				return fmt.Errorf("step %d: no scene named %q", i+1, step.Scene)
+			}
+			for _, sceneStep := range scene {
+				s.applyState(utils.ExpandGroups(sceneStep.Devices, groups), sceneStep.State, run)
+			}
+		} else if !step.State.IsEmpty() {
+			s.applyState(utils.ExpandGroups(step.Devices, groups), step.State, run)
+		}
+
+		if step.Wait > 0 && i < len(routine)-1 {
+			timer := time.NewTimer(time.Duration(step.Wait))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return errors.New("stopped before the routine finished")
+			case <-timer.C:
+			}
+		}
+	}
+	return nil
+}
+
+// applyState applies a state to every device on its own, so a failure is
+// recorded for the device it happened to.
+func (s *Scheduler) applyState(devices []string, state control.State, run *Run) {
+	_, missing, err := apiwrapper.ResolveDevices(devices)
+	if err != nil {
+		missing = nil
+	}
+	for _, device := range devices {
+		outcome := Outcome{Device: device}
+		if contains(missing, device) {
+			outcome.Error = "not in devices.json"
+		} else if err := control.Apply([]string{device}, state, s.APIKEY); err != nil {
+			outcome.Error = err.Error()
+		}
+		run.Outcomes = append(run.Outcomes, outcome)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// summary describes the failures of a run.
+func summary(run Run) string {
+	if run.Error != "" {
+		return run.Error
+	}
+	var failed []string
+	for _, outcome := range run.Outcomes {
+		if outcome.Error != "" {
+			failed = append(failed, outcome.Device+": "+outcome.Error)
+		}
+	}
+	return fmt.Sprint(failed)
+}
@@ -0,0 +1,100 @@
+package segments
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/gradient"
+	"github.com/seanpden/govee_controller/pkg/structs"
+)
+
+// ParseRange parses the segments of a device with count segments, given as
+// "all" or as comma separated indexes and ranges from 0, e.g. "0-4,7".
+//
+// Parameters:
+// - spec: The segments.
+// - count: The number of segments of the device.
+//
+// Returns:
+// - []int: The indexes of the segments, sorted and without duplicates.
+// - error: An error if the spec is invalid or out of range.
+func ParseRange(spec string, count int) ([]int, error) {
+	if strings.EqualFold(spec, "all") {
+		all := make([]int, count)
+		for i := range all {
+			all[i] = i
+		}
+		return all, nil
+	}
+
+	seen := map[int]bool{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid segment %q, expected an index, a range such as 0-4 or all", part)
+		}
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(to)
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid segment range %q", part)
+			}
+		}
+		if first < 0 || last >= count {
+			return nil, fmt.Errorf("segment %s is out of range, the device has segments 0-%d", part, count-1)
+		}
+		for i := first; i <= last; i++ {
+			seen[i] = true
+		}
+	}
+
+	indexes := make([]int, 0, len(seen))
+	for i := range seen {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
+
+// Paint colors segments of a device: one color paints them all, more colors
+// blend across them in order, see gradient.Blend. Segments getting the same
+// color share a request.
+//
+// Parameters:
+// - device: The registry entry of the device.
+// - segments: The indexes of the segments, in the order the colors blend.
+// - colors: The colors.
+// - APIKEY: The API key used when the device has no account.
+//
+// Returns:
+// - int: The number of requests sent.
+// - error: The errors of every request that failed.
+func Paint(device structs.Device, segments []int, colors []structs.Color, APIKEY string) (int, error) {
+	if len(segments) == 0 || len(colors) == 0 {
+		return 0, errors.New("nothing to paint, expected segments and colors")
+	}
+	blended := gradient.Blend(colors, len(segments))
+
+	// group the segments by color, in the order the colors first appear
+	var order []structs.Color
+	groups := map[structs.Color][]int{}
+	for i, color := range blended {
+		if _, ok := groups[color]; !ok {
+			order = append(order, color)
+		}
+		groups[color] = append(groups[color], segments[i])
+	}
+
+	var errs []error
+	for _, color := range order {
+		_, err := apiwrapper.SetSegmentColor(device, groups[color], color, APIKEY)
+		errs = append(errs, err)
+	}
+	return len(order), errors.Join(errs...)
+}
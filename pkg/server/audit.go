@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/redact"
+)
+
+// maxAuditBody is how much of a request body is kept in the audit trail.
+const maxAuditBody = 4096
+
+// AuditEntry records a request that changed something, or that was refused
+// for lack of a valid token.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Token   string    `json:"token"`
+	TokenID string    `json:"tokenId,omitempty"`
+	Remote  string    `json:"remote"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Body    string    `json:"body,omitempty"`
+	Status  int       `json:"status"`
+}
+
+// AuditLog appends audit entries to a file as JSON lines.
+type AuditLog struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// Record appends an entry to the audit log.
+func (a *AuditLog) Record(entry AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.OpenFile(a.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(entry)
+}
+
+// ReadAuditLog returns the entries of an audit log file, oldest first.
+func ReadAuditLog(path string) ([]AuditEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// audited reports whether a request belongs in the audit trail: everything
+// but reads, and every refused request.
+func audited(r *http.Request, status int) bool {
+	return (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// readBody returns the start of the request body and restores it for the
+// handler. It fails if the body is over maxRequestBody.
+func readBody(r *http.Request) (string, error) {
+	if r.Body == nil {
+		return "", nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if len(body) > maxAuditBody {
+		body = body[:maxAuditBody]
+	}
+	return redact.String(string(body)), nil
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/tokens"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// errUnauthorized marks requests without a valid token.
+var errUnauthorized = errors.New("unauthorized")
+
+// errForbidden marks requests the token does not allow.
+var errForbidden = errors.New("forbidden")
+
+type tokenKey struct{}
+
+// publicPaths are served without a token.
+var publicPaths = map[string]bool{"/openapi.json": true}
+
+// streamPaths also accept the token as ?access_token=, since browsers cannot
+// set headers on EventSource and WebSocket connections.
+var streamPaths = map[string]bool{"/events": true, "/events/ws": true}
+
+// authenticate checks the bearer token of a request when the server has a
+// token store, and returns the request carrying the token.
+func (s *Server) authenticate(r *http.Request) (*http.Request, error) {
+	if s.Tokens == nil || publicPaths[r.URL.Path] {
+		return r, nil
+	}
+	// senders of signed webhooks can't send a token, handleHook checks the
+	// signature instead
+	if name, ok := strings.CutPrefix(r.URL.Path, "/hooks/"); ok && s.Rules != nil && s.Rules.Signed(name) {
+		return r, nil
+	}
+
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok && streamPaths[r.URL.Path] {
+		secret = r.URL.Query().Get("access_token")
+		ok = secret != ""
+	}
+	if !ok || secret == "" {
+		return r, fmt.Errorf("%w: expected an Authorization: Bearer <token> header", errUnauthorized)
+	}
+	token, err := s.Tokens.Authenticate(secret)
+	if errors.Is(err, tokens.ErrInvalidToken) {
+		return r, fmt.Errorf("%w: %v", errUnauthorized, err)
+	}
+	if err != nil {
+		return r, err
+	}
+	return r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)), nil
+}
+
+// requestToken returns the token of a request, nil when authentication is off.
+func requestToken(r *http.Request) *tokens.Token {
+	token, ok := r.Context().Value(tokenKey{}).(tokens.Token)
+	if !ok {
+		return nil
+	}
+	return &token
+}
+
+// allow checks that the request's token may perform action.
+func allow(r *http.Request, action string) error {
+	token := requestToken(r)
+	if token == nil || token.Allows(action) {
+		return nil
+	}
+	return fmt.Errorf("%w: token %q may not %s", errForbidden, token.Name, action)
+}
+
+// allowDevices checks that the request's token covers every device.
+func allowDevices(r *http.Request, devices []string) error {
+	token := requestToken(r)
+	if token == nil || token.AllDevices() {
+		return nil
+	}
+	groups := loadGroups()
+	for _, device := range devices {
+		if !token.CoversDevice(device, deviceID(device), groups) {
+			return fmt.Errorf("%w: token %q has no access to %q", errForbidden, token.Name, device)
+		}
+	}
+	return nil
+}
+
+// allowGroup checks that the request's token covers a group, either by name
+// or because it covers every device in it.
+func allowGroup(r *http.Request, group string, members []string) error {
+	token := requestToken(r)
+	if token == nil || token.CoversGroup(group) {
+		return nil
+	}
+	if allowDevices(r, members) == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: token %q has no access to group %q", errForbidden, token.Name, group)
+}
+
+// allowScene checks that the request's token covers every device of a scene.
+func allowScene(r *http.Request, scene control.Scene) error {
+	groups := loadGroups()
+	for _, step := range scene {
+		err := allowDevices(r, utils.ExpandGroups(step.Devices, groups))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errMissing reports a group or scene that doesn't exist. Tokens limited to
+// some devices are refused as they would be for one that exists, so they
+// can't probe which names exist.
+func errMissing(r *http.Request, kind string, name string) error {
+	token := requestToken(r)
+	if token == nil || token.AllDevices() {
+		return fmt.Errorf("%s %q %w", kind, name, errNotFound)
+	}
+	return fmt.Errorf("%w: token %q has no access to %s %q", errForbidden, token.Name, kind, name)
+}
+
+// visibleDevices filters a device list down to what the request's token covers.
+func visibleDevices(r *http.Request, devices []structs.Device) []structs.Device {
+	token := requestToken(r)
+	if token == nil || token.AllDevices() {
+		return devices
+	}
+	groups := loadGroups()
+	visible := []structs.Device{}
+	for _, device := range devices {
+		if token.CoversDevice(device.DeviceName, device.Device, groups) {
+			visible = append(visible, device)
+		}
+	}
+	return visible
+}
+
+// visibleGroups filters the groups down to what the request's token covers.
+func visibleGroups(r *http.Request, groups map[string][]string) map[string][]string {
+	token := requestToken(r)
+	if token == nil || token.AllDevices() {
+		return groups
+	}
+	visible := map[string][]string{}
+	for name, members := range groups {
+		if allowGroup(r, name, members) == nil {
+			visible[name] = members
+		}
+	}
+	return visible
+}
+
+// deviceID returns the device id of a device name, or "" if it is unknown.
+func deviceID(name string) string {
+	device, err := findDevice(name)
+	if err != nil {
+		return ""
+	}
+	return device.Device
+}
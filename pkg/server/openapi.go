@@ -0,0 +1,270 @@
+package server
+
+// openAPISpec describes the API served by Server, served at /openapi.json.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Govee controller local API",
+    "version": "1.0.0",
+    "description": "Controls Govee devices through the Govee developer API without exposing the API key. When tokens are issued with 'govee token create', every request needs a bearer token, limited to the token's devices, groups and actions (read, control, scenes)."
+  },
+  "security": [{"bearer": []}],
+  "paths": {
+    "/devices": {
+      "get": {
+        "summary": "List the devices in the registry",
+        "parameters": [
+          {"name": "refresh", "in": "query", "schema": {"type": "boolean"}, "description": "Refresh the registry from the Govee API first"}
+        ],
+        "responses": {
+          "200": {"description": "The devices", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Device"}}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/devices/{id}/state": {
+      "get": {
+        "summary": "Get the current state of a device",
+        "parameters": [{"$ref": "#/components/parameters/DeviceID"}],
+        "responses": {
+          "200": {"description": "The state reported by the Govee API", "content": {"application/json": {"schema": {"type": "object"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/devices/{id}": {
+      "put": {
+        "summary": "Set the power, brightness, color or color temperature of a device",
+        "parameters": [{"$ref": "#/components/parameters/DeviceID"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/State"}}}},
+        "responses": {
+          "200": {"description": "The state was applied"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/devices/{id}/segments": {
+      "put": {
+        "summary": "Set the color or brightness of segments of an RGBIC device",
+        "description": "Several colors blend across the segments in order. The number of segments is discovered from the device's capabilities and cached in devices.json.",
+        "parameters": [{"$ref": "#/components/parameters/DeviceID"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {
+          "type": "object",
+          "required": ["segments"],
+          "properties": {
+            "segments": {"type": "string", "description": "all, or indexes and ranges from 0 such as 0-4,7"},
+            "color": {"$ref": "#/components/schemas/Color"},
+            "colors": {"type": "array", "items": {"$ref": "#/components/schemas/Color"}},
+            "brightness": {"type": "integer", "minimum": 0, "maximum": 100}
+          }
+        }}}},
+        "responses": {
+          "200": {"description": "The segments were set"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"},
+          "501": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/groups": {
+      "get": {
+        "summary": "List the device groups",
+        "responses": {
+          "200": {"description": "Group names mapped to device names", "content": {"application/json": {"schema": {"type": "object", "additionalProperties": {"type": "array", "items": {"type": "string"}}}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/groups/{name}/{action}": {
+      "post": {
+        "summary": "Control every device of a group",
+        "parameters": [
+          {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "action", "in": "path", "required": true, "schema": {"type": "string", "enum": ["on", "off", "state", "gradient"]}, "description": "state takes a State body, gradient a Gradient body blended across the devices of the group in order, in the OKLab color space, setting them concurrently"}
+        ],
+        "requestBody": {"content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/State"}, {"$ref": "#/components/schemas/Gradient"}]}}}},
+        "responses": {
+          "200": {"description": "The state was applied"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/events": {
+      "get": {
+        "summary": "Stream device state changes and command results as Server-Sent Events",
+        "description": "Each device's last known state is sent first as a snapshot event, then state events carry the changed fields and command events the result of commands sent through this server. Devices are polled by the server while at least one stream is open.",
+        "parameters": [
+          {"$ref": "#/components/parameters/StreamDevices"},
+          {"$ref": "#/components/parameters/AccessToken"}
+        ],
+        "responses": {
+          "200": {"description": "An event stream of Event objects", "content": {"text/event-stream": {"schema": {"$ref": "#/components/schemas/Event"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/events/ws": {
+      "get": {
+        "summary": "Stream the same events as /events over a WebSocket, one JSON Event per text message",
+        "parameters": [
+          {"$ref": "#/components/parameters/StreamDevices"},
+          {"$ref": "#/components/parameters/AccessToken"}
+        ],
+        "responses": {
+          "101": {"description": "Switching to the WebSocket protocol"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "summary": "Prometheus metrics",
+        "description": "API requests by endpoint, status and device, retries, rate-limit rejections, latency, the remaining budget of each account and the state of each device. Devices are polled while /metrics is being scraped. Tokens limited to some devices are refused.",
+        "responses": {
+          "200": {"description": "Metrics in the Prometheus text format", "content": {"text/plain": {"schema": {"type": "string"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/scenes": {
+      "get": {
+        "summary": "List the scenes",
+        "responses": {
+          "200": {"description": "Scene names mapped to their steps"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/scenes/{name}/apply": {
+      "post": {
+        "summary": "Apply a scene",
+        "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "The scene was applied"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/hooks/{name}": {
+      "post": {
+        "summary": "Fire the rules triggered by a webhook",
+        "description": "A JSON body is available to the conditions and templates of the rules as payload. The rules run in the background. Webhooks configured with a secret need no token: they are authenticated by an X-Hub-Signature-256 (github), X-Gitlab-Token (gitlab) or X-Signature (hmac) header instead. A token limited to some devices can only fire a webhook whose actions, filled with the payload, stay within them.",
+        "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {"required": false, "content": {"application/json": {"schema": {}}}},
+        "responses": {
+          "202": {"description": "The rules were fired"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer"}
+    },
+    "parameters": {
+      "DeviceID": {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}, "description": "Device name or device id (MAC address)"},
+      "StreamDevices": {"name": "devices", "in": "query", "schema": {"type": "string"}, "description": "Comma separated devices or groups to watch, all if empty"},
+      "AccessToken": {"name": "access_token", "in": "query", "schema": {"type": "string"}, "description": "Bearer token, for clients that cannot set the Authorization header"}
+    },
+    "schemas": {
+      "Device": {
+        "type": "object",
+        "properties": {
+          "device": {"type": "string"},
+          "model": {"type": "string"},
+          "deviceName": {"type": "string"},
+          "controllable": {"type": "boolean"},
+          "retrievable": {"type": "boolean"},
+          "supportCmds": {"type": "array", "items": {"type": "string"}},
+          "account": {"type": "string"}
+        }
+      },
+      "State": {
+        "type": "object",
+        "properties": {
+          "power": {"type": "string", "enum": ["on", "off"]},
+          "brightness": {"type": "integer", "minimum": 0, "maximum": 100},
+          "color": {"$ref": "#/components/schemas/Color"},
+          "colorTem": {"type": "integer", "minimum": 2000, "maximum": 9000}
+        }
+      },
+      "Color": {
+        "oneOf": [
+          {"type": "string", "description": "Color name, #rrggbb or r,g,b"},
+          {"type": "object", "properties": {"r": {"type": "integer"}, "g": {"type": "integer"}, "b": {"type": "integer"}}}
+        ]
+      },
+      "Gradient": {
+        "type": "object",
+        "properties": {
+          "colors": {"type": "array", "items": {"$ref": "#/components/schemas/Color"}},
+          "palette": {"type": "string", "enum": ["aurora", "fire", "forest", "ocean", "pastel", "rainbow", "sunset"]},
+          "reverse": {"type": "boolean", "description": "Run from the last device of the group to the first"}
+        }
+      },
+      "Event": {
+        "type": "object",
+        "properties": {
+          "type": {"type": "string", "enum": ["snapshot", "state", "command"]},
+          "time": {"type": "string", "format": "date-time"},
+          "device": {"type": "string"},
+          "devices": {"type": "array", "items": {"type": "string"}},
+          "changes": {"type": "object", "description": "The fields that changed since the previous state"},
+          "state": {
+            "type": "object",
+            "properties": {
+              "online": {"type": "boolean"},
+              "power": {"type": "string"},
+              "brightness": {"type": "integer"},
+              "color": {"type": "object", "properties": {"r": {"type": "integer"}, "g": {"type": "integer"}, "b": {"type": "integer"}}},
+              "colorTem": {"type": "integer"},
+              "updated": {"type": "string", "format": "date-time"}
+            }
+          },
+          "applied": {"$ref": "#/components/schemas/State"},
+          "error": {"type": "string"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "string"}}
+      }
+    },
+    "responses": {
+      "Error": {"description": "The request failed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    }
+  }
+}
+`
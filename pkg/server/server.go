@@ -0,0 +1,677 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/gradient"
+	"github.com/seanpden/govee_controller/pkg/metrics"
+	"github.com/seanpden/govee_controller/pkg/poller"
+	"github.com/seanpden/govee_controller/pkg/rules"
+	"github.com/seanpden/govee_controller/pkg/segments"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/tokens"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// Server exposes device control as a local HTTP JSON API, so other tools can
+// control the lights without holding the Govee API key.
+//
+// It uses the same devices.json registry, groups.json and scenes.json as the
+// CLI, and the api wrapper's per-key rate-limit budget.
+type Server struct {
+	APIKEY string
+	// Tokens, if set, requires every request to carry a bearer token from the
+	// store and limits it to the token's devices and actions.
+	Tokens *tokens.Store
+	// Audit, if set, records every change and every refused request.
+	Audit *AuditLog
+	// Poller polls device state for the event streams while a stream is
+	// open. ListenAndServe runs it unless its Interval is zero.
+	Poller *poller.Poller
+	// Metrics is served at /metrics. Set apiwrapper.Observer to its Observe
+	// method to collect the API requests.
+	Metrics *metrics.Metrics
+	// Rules, if set, receives the poller's events and the webhooks posted
+	// to /hooks/{name}. ListenAndServe runs it.
+	Rules *rules.Engine
+	mux   *http.ServeMux
+	hub   *hub
+	// lastScrape is when /metrics was last requested, in unix nanoseconds
+	lastScrape atomic.Int64
+}
+
+// New creates a Server sending commands with APIKEY, or with the key of the
+// device's account when accounts are registered.
+func New(APIKEY string) *Server {
+	s := &Server{APIKEY: APIKEY, Poller: poller.New(APIKEY), mux: http.NewServeMux(), hub: newHub()}
+	s.Metrics = metrics.New(APIKEY, s.Poller)
+	s.Poller.Handler = s.publishPoll
+	s.Poller.Active = s.pollActive
+
+	s.mux.HandleFunc("GET /openapi.json", s.handleOpenAPI)
+	s.mux.HandleFunc("GET /devices", s.handleListDevices)
+	s.mux.HandleFunc("GET /devices/{id}/state", s.handleGetState)
+	s.mux.HandleFunc("PUT /devices/{id}", s.handleSetState)
+	s.mux.HandleFunc("PUT /devices/{id}/segments", s.handleSetSegments)
+	s.mux.HandleFunc("GET /groups", s.handleListGroups)
+	s.mux.HandleFunc("POST /groups/{name}/{action}", s.handleGroup)
+	s.mux.HandleFunc("GET /scenes", s.handleListScenes)
+	s.mux.HandleFunc("POST /scenes/{name}/apply", s.handleApplyScene)
+	s.mux.HandleFunc("GET /events", s.handleEvents)
+	s.mux.HandleFunc("GET /events/ws", s.handleWebSocket)
+	s.mux.HandleFunc("GET /metrics", s.handleMetrics)
+	s.mux.HandleFunc("POST /hooks/{name}", s.handleHook)
+	return s
+}
+
+// maxRequestBody is the largest request body the server reads.
+const maxRequestBody = 1 << 20
+
+// ServeHTTP authenticates, logs, audits and dispatches every request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+	// the body is read for the audit trail before the token is checked, so
+	// it is bounded for anonymous requests too
+	var body string
+	var err error
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(rec, r.Body, maxRequestBody)
+	}
+	if s.Audit != nil && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		body, err = readBody(r)
+	}
+
+	if err == nil {
+		r, err = s.authenticate(r)
+	}
+	if err != nil {
+		writeError(rec, err)
+	} else {
+		s.mux.ServeHTTP(rec, r)
+	}
+
+	who := "anonymous"
+	var tokenID string
+	if token := requestToken(r); token != nil {
+		who, tokenID = token.Name, token.ID
+	}
+	log.Printf("%s %s %s %d %s", who, r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Millisecond))
+
+	if s.Audit != nil && audited(r, rec.status) {
+		err := s.Audit.Record(AuditEntry{
+			Time:    start.UTC(),
+			Token:   who,
+			TokenID: tokenID,
+			Remote:  r.RemoteAddr,
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Body:    body,
+			Status:  rec.status,
+		})
+		if err != nil {
+			log.Printf("could not write the audit log: %v", err)
+		}
+	}
+}
+
+// Handle registers an additional handler on the server's mux.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// pollActive keeps the poller running while a stream is open, while a rule
+// waits for a state change or while /metrics is being scraped, so the device
+// gauges stay current.
+func (s *Server) pollActive() bool {
+	if s.hub.subscribers() > 0 {
+		return true
+	}
+	if s.Rules != nil && s.Rules.WantsState() {
+		return true
+	}
+	lastScrape := time.Unix(0, s.lastScrape.Load())
+	return time.Since(lastScrape) < 2*s.Poller.MaxInterval
+}
+
+// RefreshRegistry lists the devices of every account and saves them to
+// devices.json.
+func (s *Server) RefreshRegistry() error {
+	data, err := apiwrapper.ListAllDevices(s.APIKEY)
+	if err != nil {
+		return err
+	}
+	utils.SaveToJSON(data)
+	return nil
+}
+
+// ListenAndServe refreshes the registry, starts the state poller and serves
+// the API on addr until it fails. A failed refresh is logged and the cached
+// registry is used.
+func ListenAndServe(addr string, s *Server) error {
+	err := s.RefreshRegistry()
+	if err != nil {
+		log.Printf("could not refresh devices.json, using the cached registry: %v", err)
+	}
+	if s.Tokens == nil {
+		log.Printf("authentication is off, anyone who can reach %s can control the devices", addr)
+	}
+	if s.Poller.Interval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go s.Poller.Run(ctx)
+	}
+	if s.Rules != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			err := s.Rules.Run(ctx)
+			if err != nil {
+				log.Printf("rules: %v", err)
+			}
+		}()
+	}
+	log.Printf("serving the Govee API on http://%s", addr)
+	return http.ListenAndServe(addr, s)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the WebSocket upgrade take over the connection.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// errNotFound marks lookups of unknown devices, groups and scenes.
+var errNotFound = errors.New("not found")
+
+// errBadRequest marks invalid requests.
+var errBadRequest = errors.New("bad request")
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// writeError maps an error to a status code and writes it as {"error": "..."}.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, errNotFound), errors.Is(err, control.ErrUnknownDevice):
+		status = http.StatusNotFound
+	case errors.Is(err, errBadRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, errUnauthorized):
+		status = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Bearer realm="govee"`)
+	case errors.Is(err, errForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, apiwrapper.ErrRateLimited):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, apiwrapper.ErrNoOpenAPI):
+		status = http.StatusNotImplemented
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// findDevice looks up a device in the registry by name or by device id.
+func findDevice(id string) (structs.Device, error) {
+	devices, err := utils.LoadFromJSON(utils.RegistryFile)
+	if err != nil {
+		return structs.Device{}, err
+	}
+	for _, device := range devices.Data.Devices {
+		if device.DeviceName == id || device.Device == id {
+			return device, nil
+		}
+	}
+	return structs.Device{}, fmt.Errorf("device %q %w", id, errNotFound)
+}
+
+// authorizeDevice finds the device of the request's {id} and checks that the
+// request's token may perform action on it.
+func (s *Server) authorizeDevice(r *http.Request, action string) (structs.Device, error) {
+	err := allow(r, action)
+	if err != nil {
+		return structs.Device{}, err
+	}
+	device, err := findDevice(r.PathValue("id"))
+	if err != nil {
+		return device, err
+	}
+	return device, allowDevices(r, []string{device.DeviceName})
+}
+
+// loadGroups returns the groups, no groups.json means no groups.
+func loadGroups() map[string][]string {
+	groups, err := utils.LoadGroups("groups.json")
+	if err != nil {
+		return map[string][]string{}
+	}
+	return groups
+}
+
+// decodeState reads a control.State from the request body.
+func decodeState(r *http.Request) (control.State, error) {
+	var state control.State
+	err := json.NewDecoder(r.Body).Decode(&state)
+	if err != nil {
+		return state, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	err = state.Validate()
+	if err != nil {
+		return state, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return state, nil
+}
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPISpec))
+}
+
+// handleMetrics serves the metrics to tokens covering every device, the
+// request counters and device gauges are labeled with device names.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	err := allow(r, tokens.ActionRead)
+	if token := requestToken(r); err == nil && token != nil && !token.AllDevices() {
+		err = fmt.Errorf("%w: token %q is limited to some devices, metrics cover them all", errForbidden, token.Name)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if s.lastScrape.Swap(time.Now().UnixNano()) == 0 {
+		// the first scrape starts the poller for the device gauges
+		s.Poller.Wake()
+	}
+	s.Metrics.ServeHTTP(w, r)
+}
+
+func (s *Server) handleListDevices(w http.ResponseWriter, r *http.Request) {
+	err := allow(r, tokens.ActionRead)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if r.URL.Query().Get("refresh") == "true" {
+		err := s.RefreshRegistry()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	devices, err := utils.LoadFromJSON(utils.RegistryFile)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, visibleDevices(r, devices.Data.Devices))
+}
+
+func (s *Server) handleGetState(w http.ResponseWriter, r *http.Request) {
+	device, err := s.authorizeDevice(r, tokens.ActionRead)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	states, err := apiwrapper.GetManyDeviceStates([]string{device.DeviceName}, s.APIKEY)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(states) == 0 {
+		writeError(w, fmt.Errorf("device %q %w", device.DeviceName, errNotFound))
+		return
+	}
+	writeJSON(w, http.StatusOK, states[0])
+}
+
+func (s *Server) handleSetState(w http.ResponseWriter, r *http.Request) {
+	device, err := s.authorizeDevice(r, tokens.ActionControl)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	state, err := decodeState(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = control.Apply([]string{device.DeviceName}, state, s.APIKEY)
+	s.publishCommand([]string{device.DeviceName}, state, err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"device": device.DeviceName, "applied": state})
+}
+
+// segmentsRequest is the body of PUT /devices/{id}/segments: the segments,
+// as "all" or "0-4,7", and a color, colors blending across them or a
+// brightness.
+type segmentsRequest struct {
+	Segments   string          `json:"segments"`
+	Color      *control.Color  `json:"color,omitempty"`
+	Colors     []control.Color `json:"colors,omitempty"`
+	Brightness *int            `json:"brightness,omitempty"`
+}
+
+func (s *Server) handleSetSegments(w http.ResponseWriter, r *http.Request) {
+	device, err := s.authorizeDevice(r, tokens.ActionControl)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var request segmentsRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+		return
+	}
+	colors := make([]structs.Color, 0, len(request.Colors)+1)
+	if request.Color != nil {
+		colors = append(colors, structs.Color(*request.Color))
+	}
+	for _, color := range request.Colors {
+		colors = append(colors, structs.Color(color))
+	}
+	if len(colors) == 0 && request.Brightness == nil {
+		writeError(w, fmt.Errorf("%w: expected color, colors or brightness", errBadRequest))
+		return
+	}
+
+	count, err := apiwrapper.DeviceSegments(device.DeviceName, s.APIKEY, false)
+	if errors.Is(err, apiwrapper.ErrNoSegments) {
+		err = fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	indexes, err := segments.ParseRange(request.Segments, count)
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+		return
+	}
+	if len(colors) > 0 {
+		_, err = segments.Paint(device, indexes, colors, s.APIKEY)
+	}
+	if err == nil && request.Brightness != nil {
+		_, err = apiwrapper.SetSegmentBrightness(device, indexes, *request.Brightness, s.APIKEY)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"device": device.DeviceName, "segments": indexes})
+}
+
+func (s *Server) handleListGroups(w http.ResponseWriter, r *http.Request) {
+	err := allow(r, tokens.ActionRead)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, visibleGroups(r, loadGroups()))
+}
+
+// handleGroup controls every device of a group. The action is "on", "off" or
+// "state", which takes the same body as PUT /devices/{id}.
+func (s *Server) handleGroup(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	err := allow(r, tokens.ActionControl)
+	members, ok := loadGroups()[name]
+	if err == nil && !ok {
+		err = errMissing(r, "group", name)
+	}
+	if err == nil {
+		err = allowGroup(r, name, members)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var state control.State
+	switch action := r.PathValue("action"); action {
+	case "on", "off":
+		state.Power = action
+	case "gradient":
+		s.handleGradient(w, r, name, members)
+		return
+	case "state":
+		var err error
+		state, err = decodeState(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	default:
+		writeError(w, fmt.Errorf("action %q %w, expected on, off, state or gradient", action, errNotFound))
+		return
+	}
+
+	err = control.Apply(members, state, s.APIKEY)
+	s.publishCommand(members, state, err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"group": name, "devices": members, "applied": state})
+}
+
+// gradientRequest is the body of POST /groups/{name}/gradient: the colors,
+// a palette or both, blended across the members of the group in order.
+type gradientRequest struct {
+	Colors  []control.Color `json:"colors,omitempty"`
+	Palette string          `json:"palette,omitempty"`
+	Reverse bool            `json:"reverse,omitempty"`
+}
+
+// handleGradient paints a gradient across the members of a group, each
+// device is published as its own command.
+func (s *Server) handleGradient(w http.ResponseWriter, r *http.Request, name string, members []string) {
+	var request gradientRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+		return
+	}
+	var colors []structs.Color
+	for _, color := range request.Colors {
+		colors = append(colors, structs.Color(color))
+	}
+	if request.Palette != "" {
+		palette, err := gradient.ParseColors([]string{request.Palette})
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		colors = append(colors, palette...)
+	}
+	if len(colors) == 0 {
+		writeError(w, fmt.Errorf("%w: expected colors or a palette", errBadRequest))
+		return
+	}
+	order := slices.Clone(members)
+	if request.Reverse {
+		slices.Reverse(order)
+	}
+
+	assignments, err := gradient.Render(order, colors, s.APIKEY)
+	applied := map[string]control.Color{}
+	for _, assignment := range assignments {
+		color := control.Color(assignment.Color)
+		s.publishCommand([]string{assignment.Device}, control.State{Color: &color}, assignment.Err)
+		applied[assignment.Device] = color
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"group": name, "devices": order, "applied": applied})
+}
+
+func (s *Server) handleListScenes(w http.ResponseWriter, r *http.Request) {
+	err := allow(r, tokens.ActionRead)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	scenes, err := control.LoadScenes("scenes.json")
+	if err != nil {
+		scenes = map[string]control.Scene{}
+	}
+	writeJSON(w, http.StatusOK, scenes)
+}
+
+func (s *Server) handleApplyScene(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	scenes, err := control.LoadScenes("scenes.json")
+	if err != nil {
+		scenes = map[string]control.Scene{}
+	}
+	err = allow(r, tokens.ActionScenes)
+	scene, ok := scenes[name]
+	if err == nil && !ok {
+		err = errMissing(r, "scene", name)
+	}
+	if err == nil {
+		err = allowScene(r, scene)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	groups := loadGroups()
+	err = control.ApplyScene(scene, groups, s.APIKEY)
+	for _, step := range scene {
+		s.publishCommand(utils.ExpandGroups(step.Devices, groups), step.State, err)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"scene": name, "applied": scene})
+}
+
+// allowHook checks that the request's token may control every device the
+// rules of an unsigned webhook would act on for this body. The payload can
+// choose the devices through templates, so they are only known once the
+// actions are filled.
+func (s *Server) allowHook(r *http.Request, name string, body []byte) error {
+	err := allow(r, tokens.ActionControl)
+	if err != nil {
+		return err
+	}
+	token := requestToken(r)
+	if token == nil || token.AllDevices() {
+		return nil
+	}
+
+	devices, names, err := s.Rules.Targets(name, body)
+	if err != nil {
+		return err
+	}
+	err = allowDevices(r, devices)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	scenes, err := control.LoadScenes("scenes.json")
+	if err != nil {
+		scenes = map[string]control.Scene{}
+	}
+	for _, name := range names {
+		err := allowScene(r, scenes[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleHook fires the rules triggered by a webhook. A JSON body is passed
+// to the rules as the variable "payload".
+func (s *Server) handleHook(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if s.Rules == nil {
+		writeError(w, fmt.Errorf("webhook %q %w", name, errNotFound))
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: %w", errBadRequest, err))
+		return
+	}
+	// signed webhooks are authenticated by the engine instead of a token
+	if !s.Rules.Signed(name) {
+		err = s.allowHook(r, name, body)
+	}
+	fired := 0
+	if err == nil {
+		fired, err = s.Rules.Webhook(name, r.Header, body)
+	}
+	switch {
+	case errors.Is(err, errForbidden):
+		writeError(w, err)
+		return
+	case errors.Is(err, rules.ErrUnknownWebhook):
+		writeError(w, fmt.Errorf("webhook %q %w", name, errNotFound))
+		return
+	case errors.Is(err, rules.ErrBadSignature):
+		writeError(w, fmt.Errorf("%w: %v", errUnauthorized, err))
+		return
+	case err != nil:
+		writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"webhook": name, "rules": fired})
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/poller"
+	"github.com/seanpden/govee_controller/pkg/tokens"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// Event types sent to subscribers.
+const (
+	// EventSnapshot carries the last known state of a device, sent once per
+	// device when a subscriber connects.
+	EventSnapshot = "snapshot"
+	// EventState carries the fields of a device's state that changed.
+	EventState = "state"
+	// EventCommand carries the result of a command sent through the server.
+	EventCommand = "command"
+)
+
+// keepAlive is how often an idle stream is pinged, so proxies keep it open.
+const keepAlive = 25 * time.Second
+
+// subscriberBuffer is how many events a slow subscriber can fall behind
+// before events are dropped for it.
+const subscriberBuffer = 64
+
+// Event is a state change or command result pushed to subscribers.
+type Event struct {
+	Type    string         `json:"type"`
+	Time    time.Time      `json:"time"`
+	Device  string         `json:"device,omitempty"`
+	Devices []string       `json:"devices,omitempty"`
+	Changes map[string]any `json:"changes,omitempty"`
+	State   *poller.State  `json:"state,omitempty"`
+	Applied *control.State `json:"applied,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+type subscriber struct {
+	events chan Event
+	wants  func(device string) bool
+}
+
+// hub fans events out to the connected subscribers.
+type hub struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+func newHub() *hub {
+	return &hub{subs: map[*subscriber]struct{}{}}
+}
+
+// subscribe registers a subscriber and queues a snapshot of every known state
+// it wants.
+func (h *hub) subscribe(wants func(device string) bool, states map[string]poller.State) *subscriber {
+	sub := &subscriber{events: make(chan Event, subscriberBuffer), wants: wants}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[sub] = struct{}{}
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if wants(name) && len(sub.events) < cap(sub.events) {
+			state := states[name]
+			sub.events <- Event{Type: EventSnapshot, Time: state.Updated, Device: name, State: &state}
+		}
+	}
+	return sub
+}
+
+func (h *hub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, sub)
+}
+
+// subscribers returns how many subscribers are connected.
+func (h *hub) subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// publish sends an event to every subscriber that wants one of its devices.
+// A subscriber whose buffer is full misses the event rather than stalling the
+// others.
+func (h *hub) publish(event Event) {
+	devices := event.Devices
+	if event.Device != "" {
+		devices = []string{event.Device}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if !slices.ContainsFunc(devices, sub.wants) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+		}
+	}
+}
+
+// publishPoll turns a poller transition into a state event carrying the
+// changed field, and passes it to the rules.
+func (s *Server) publishPoll(event poller.Event) {
+	if s.Rules != nil {
+		s.Rules.HandlePoll(event)
+	}
+	switch event.Kind {
+	case poller.KindError:
+		if event.Device != "" {
+			log.Printf("poll %s: %v", event.Device, event.Err)
+		} else {
+			log.Printf("poll: %v", event.Err)
+		}
+		return
+	case poller.KindInitial:
+		s.hub.publish(Event{Type: EventState, Time: event.Time, Device: event.Device, State: &event.State})
+		return
+	}
+
+	field := string(event.Kind)
+	if event.Kind == poller.KindOnline || event.Kind == poller.KindOffline {
+		field = "online"
+	}
+	s.hub.publish(Event{
+		Type:    EventState,
+		Time:    event.Time,
+		Device:  event.Device,
+		Changes: map[string]any{field: event.Value()},
+		State:   &event.State,
+	})
+}
+
+// publishCommand tells subscribers about a command sent through the server.
+func (s *Server) publishCommand(devices []string, state control.State, err error) {
+	event := Event{Type: EventCommand, Time: time.Now().UTC(), Devices: devices, Applied: &state}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	s.hub.publish(event)
+	// look for the change right away instead of at the next poll
+	s.Poller.Wake()
+}
+
+// subscribe registers a stream subscriber, and polls right away if no state
+// is known yet.
+func (s *Server) subscribe(r *http.Request) *subscriber {
+	states := s.Poller.States()
+	sub := s.hub.subscribe(streamFilter(r), states)
+	if len(states) == 0 {
+		s.Poller.Wake()
+	}
+	return sub
+}
+
+// streamFilter returns which devices a stream request may see: those named in
+// ?devices= (all if empty) that the request's token covers. The devices the
+// token covers are resolved once, the filter runs for every event.
+func streamFilter(r *http.Request) func(device string) bool {
+	requested := strings.Split(r.URL.Query().Get("devices"), ",")
+	requested = slices.DeleteFunc(requested, func(s string) bool { return s == "" })
+	groups := loadGroups()
+	requested = utils.ExpandGroups(requested, groups)
+
+	token := requestToken(r)
+	var covered map[string]bool
+	if token != nil && !token.AllDevices() {
+		covered = map[string]bool{}
+		// tokens may name devices by id, which events don't carry
+		registry, _ := utils.LoadFromJSON(utils.RegistryFile)
+		for _, device := range registry.Data.Devices {
+			covered[device.DeviceName] = token.CoversDevice(device.DeviceName, device.Device, groups)
+		}
+	}
+	return func(device string) bool {
+		if len(requested) > 0 && !slices.Contains(requested, device) {
+			return false
+		}
+		if covered == nil {
+			return true
+		}
+		allowed, ok := covered[device]
+		return allowed || (!ok && token.CoversDevice(device, "", groups))
+	}
+}
+
+// handleEvents streams events as Server-Sent Events.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	err := allow(r, tokens.ActionRead)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	controller := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+
+	sub := s.subscribe(r)
+	defer s.hub.unsubscribe(sub)
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-sub.events:
+			data, _ := json.Marshal(event)
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleWebSocket streams events as JSON text messages over a WebSocket.
+// Messages from the client are ignored.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	err := allow(r, tokens.ActionRead)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	upgrader := websocket.Upgrader{}
+	if s.Tokens != nil {
+		// the token authorizes the client, so pages on other origins may connect
+		upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already written the error response
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// reading handles pings and the close handshake
+	go func() {
+		defer cancel()
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	sub := s.subscribe(r)
+	defer s.hub.unsubscribe(sub)
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+		case event := <-sub.events:
+			err = conn.WriteJSON(event)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
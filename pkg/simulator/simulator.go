@@ -0,0 +1,180 @@
+package simulator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/seanpden/govee_controller/pkg/govetest"
+	"github.com/seanpden/govee_controller/pkg/structs"
+)
+
+// DefaultPath is the file describing the virtual home, in the current
+// directory like devices.json.
+const DefaultPath = "simulate.json"
+
+// RegistryFile is the device registry used while simulating, so the
+// registry of the real devices, and the scenes and segments cached in it,
+// are left alone.
+const RegistryFile = "simulate.devices.json"
+
+// Home is a virtual home: its devices and their current state.
+type Home struct {
+	Devices []Device `json:"devices"`
+}
+
+// Device is a virtual device. SupportCmds defaults to every v1 command and
+// ColorTem to 2000-9000K.
+type Device struct {
+	Device      string         `json:"device"`
+	Model       string         `json:"model"`
+	DeviceName  string         `json:"deviceName"`
+	SupportCmds []string       `json:"supportCmds,omitempty"`
+	ColorTem    *Range         `json:"colorTem,omitempty"`
+	State       govetest.State `json:"state"`
+}
+
+type Range struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// DefaultHome is written to a new simulate.json, to be edited.
+var DefaultHome = Home{Devices: []Device{
+	{Device: "00:00:00:00:00:00:00:01", Model: "H6072", DeviceName: "Floor Lamp", State: govetest.State{Online: true, Power: "off", Brightness: 100, Color: structs.Color{R: 255, G: 255, B: 255}}},
+	{Device: "00:00:00:00:00:00:00:02", Model: "H619A", DeviceName: "Desk Strip", State: govetest.State{Online: true, Power: "on", Brightness: 60, Color: structs.Color{R: 127, B: 255}}},
+	{Device: "00:00:00:00:00:00:00:03", Model: "H6008", DeviceName: "Bedroom Bulb", ColorTem: &Range{Min: 2700, Max: 6500}, State: govetest.State{Online: true, Power: "off", Brightness: 80, ColorTem: 2700}},
+	{Device: "00:00:00:00:00:00:00:04", Model: "H5080", DeviceName: "Porch Plug", SupportCmds: []string{"turn"}, State: govetest.State{Online: true, Power: "off"}},
+}}
+
+// Validate checks that every device has an id, a model and a unique name.
+func (h Home) Validate() error {
+	names := map[string]bool{}
+	ids := map[string]bool{}
+	for i, device := range h.Devices {
+		if device.Device == "" || device.Model == "" || device.DeviceName == "" {
+			return fmt.Errorf("device %d: device, model and deviceName are required", i+1)
+		}
+		if names[device.DeviceName] || ids[device.Device] {
+			return fmt.Errorf("device %q is listed twice", device.DeviceName)
+		}
+		names[device.DeviceName], ids[device.Device] = true, true
+		if device.ColorTem != nil && (device.ColorTem.Min <= 0 || device.ColorTem.Min > device.ColorTem.Max) {
+			return fmt.Errorf("%s: invalid colorTem range %d-%d", device.DeviceName, device.ColorTem.Min, device.ColorTem.Max)
+		}
+	}
+	return nil
+}
+
+// Load reads a virtual home, writing DefaultHome to path first if it doesn't
+// exist.
+func Load(path string) (Home, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return DefaultHome, save(path, DefaultHome)
+	}
+	if err != nil {
+		return Home{}, err
+	}
+	var home Home
+	err = json.Unmarshal(data, &home)
+	if err != nil {
+		return Home{}, fmt.Errorf("%s: %w", path, err)
+	}
+	err = home.Validate()
+	if err != nil {
+		return Home{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return home, nil
+}
+
+func save(path string, home Home) error {
+	data, err := json.MarshalIndent(home, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Simulator serves a virtual home with the fake Govee API of package
+// govetest. The state of a device is saved to the home file whenever a
+// command changes it, so it persists between runs.
+type Simulator struct {
+	// URL is the base URL of the fake API, for apiwrapper.BaseURL.
+	URL string
+
+	server *govetest.Server
+	path   string
+	mu     sync.Mutex
+	err    error
+}
+
+// Start loads the virtual home at path and starts serving it.
+//
+// Parameters:
+// - path: The home file, created with DefaultHome if missing.
+//
+// Returns:
+// - *Simulator: The running simulator, to Close when done.
+// - error: An error if the home file is invalid.
+func Start(path string) (*Simulator, error) {
+	home, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	server, err := govetest.NewServer()
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range home.Devices {
+		server.AddDevice(device.registryEntry())
+		server.SetState(device.Device, device.State)
+	}
+	s := &Simulator{URL: server.URL, server: server, path: path}
+	server.OnChange(s.save)
+	return s, nil
+}
+
+// Close stops serving the home.
+func (s *Simulator) Close() {
+	s.server.Close()
+}
+
+// Err returns the last error saving the home file.
+func (s *Simulator) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// save stores the new state of a device. The file is read again first, so
+// changes made to other devices by another simulating process are kept.
+func (s *Simulator) save(id string, state govetest.State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	home, err := Load(s.path)
+	if err == nil {
+		for i := range home.Devices {
+			if home.Devices[i].Device == id {
+				home.Devices[i].State = state
+			}
+		}
+		err = save(s.path, home)
+	}
+	s.err = err
+}
+
+// registryEntry returns the device as the API lists it.
+func (d Device) registryEntry() structs.Device {
+	device := govetest.NewDevice(d.Device, d.Model, d.DeviceName)
+	if len(d.SupportCmds) > 0 {
+		device.SupportCmds = d.SupportCmds
+	}
+	if d.ColorTem != nil {
+		device.Properties.ColorTem.Range.Min = d.ColorTem.Min
+		device.Properties.ColorTem.Range.Max = d.ColorTem.Max
+	}
+	return device
+}
@@ -0,0 +1,158 @@
+package solar
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Event is a daily solar event, the time the center of the sun crosses an
+// altitude on the way up (dawn, sunrise) or down (sunset, dusk).
+type Event string
+
+// Events accepted in solar schedules.
+const (
+	Sunrise      Event = "sunrise"
+	Sunset       Event = "sunset"
+	CivilDawn    Event = "civil-dawn"
+	CivilDusk    Event = "civil-dusk"
+	NauticalDawn Event = "nautical-dawn"
+	NauticalDusk Event = "nautical-dusk"
+)
+
+// Events lists every event, for help and completion.
+var Events = []Event{CivilDawn, CivilDusk, NauticalDawn, NauticalDusk, Sunrise, Sunset}
+
+// altitude is the altitude of the sun at each event, in degrees. Sunrise and
+// sunset account for refraction and the radius of the sun.
+var altitude = map[Event]float64{
+	Sunrise:      -0.833,
+	Sunset:       -0.833,
+	CivilDawn:    -6,
+	CivilDusk:    -6,
+	NauticalDawn: -12,
+	NauticalDusk: -12,
+}
+
+func (e Event) rising() bool {
+	return e == Sunrise || e == CivilDawn || e == NauticalDawn
+}
+
+// Coordinates is a place on earth, in degrees, north and east positive.
+type Coordinates struct {
+	Latitude  float64
+	Longitude float64
+}
+
+const (
+	julianUnixEpoch = 2440587.5
+	julian2000      = 2451545.0
+	degrees         = math.Pi / 180
+)
+
+// Time returns when an event happens at a place on the day of date, in the
+// location of date. The second result is false when the event does not
+// happen that day, e.g. no sunset during the polar summer.
+//
+// It uses the sunrise equation with the low precision solar coordinates of
+// the Astronomical Almanac, accurate to about a minute away from the poles.
+func (e Event) Time(date time.Time, at Coordinates) (time.Time, bool) {
+	h0, ok := altitude[e]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	// the solar transit nearest to noon of the local day
+	year, month, day := date.Date()
+	noon := time.Date(year, month, day, 12, 0, 0, 0, date.Location())
+	julianNoon := float64(noon.Unix())/86400 + julianUnixEpoch
+	n := math.Round(julianNoon - julian2000 + at.Longitude/360)
+	meanNoon := n - at.Longitude/360
+
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360) * degrees
+	center := 1.9148*math.Sin(anomaly) + 0.02*math.Sin(2*anomaly) + 0.0003*math.Sin(3*anomaly)
+	ecliptic := math.Mod(anomaly/degrees+center+180+102.9372, 360) * degrees
+	transit := julian2000 + meanNoon + 0.0053*math.Sin(anomaly) - 0.0069*math.Sin(2*ecliptic)
+
+	declination := math.Asin(math.Sin(ecliptic) * math.Sin(23.4397*degrees))
+	latitude := at.Latitude * degrees
+	cosHourAngle := (math.Sin(h0*degrees) - math.Sin(latitude)*math.Sin(declination)) / (math.Cos(latitude) * math.Cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		// the sun stays above or below the altitude all day
+		return time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) / degrees
+
+	julian := transit + hourAngle/360
+	if e.rising() {
+		julian = transit - hourAngle/360
+	}
+	seconds := (julian - julianUnixEpoch) * 86400
+	return time.Unix(int64(math.Round(seconds)), 0).In(date.Location()), true
+}
+
+// Schedule runs at a solar event every day, shifted by an offset. It has the
+// Next method of a cron schedule.
+type Schedule struct {
+	Event    Event
+	Offset   time.Duration
+	At       Coordinates
+	Location *time.Location
+}
+
+// Parse parses a solar schedule such as "sunset", "sunset-30m" or
+// "civil-dawn+1h15m".
+func Parse(spec string, at Coordinates, location *time.Location) (Schedule, error) {
+	spec = strings.ToLower(strings.ReplaceAll(spec, " ", ""))
+	for _, event := range Events {
+		rest, found := strings.CutPrefix(spec, string(event))
+		if !found {
+			continue
+		}
+		schedule := Schedule{Event: event, At: at, Location: location}
+		if rest == "" {
+			return schedule, nil
+		}
+		if rest[0] != '+' && rest[0] != '-' {
+			continue
+		}
+		offset, err := time.ParseDuration(rest)
+		if err != nil {
+			return Schedule{}, fmt.Errorf("offset of %q: %w", spec, err)
+		}
+		schedule.Offset = offset
+		return schedule, nil
+	}
+
+	names := make([]string, len(Events))
+	for i, event := range Events {
+		names[i] = string(event)
+	}
+	return Schedule{}, fmt.Errorf("unknown solar event %q, expected one of %s with an optional offset such as -30m", spec, strings.Join(names, ", "))
+}
+
+// Next returns the first time the schedule runs after t, or the zero time if
+// the event does not happen in the coming year.
+func (s Schedule) Next(t time.Time) time.Time {
+	location := s.Location
+	if location == nil {
+		location = time.Local
+	}
+	t = t.In(location)
+	// start a day early, a large negative offset can move an event to the
+	// previous day
+	year, month, day := t.Date()
+	for i := -1; i <= 366; i++ {
+		date := time.Date(year, month, day+i, 12, 0, 0, 0, location)
+		at, ok := s.Event.Time(date, s.At)
+		if !ok {
+			continue
+		}
+		at = at.Add(s.Offset)
+		if at.After(t) {
+			return at
+		}
+	}
+	return time.Time{}
+}
@@ -1,28 +1,41 @@
 package structs
 
+import "time"
+
 type ListDevicesResponse struct {
 	Data struct {
-		Devices []struct {
-			Device       string   `json:"device"`
-			Model        string   `json:"model"`
-			DeviceName   string   `json:"deviceName"`
-			Controllable bool     `json:"controllable"`
-			Retrievable  bool     `json:"retrievable"`
-			SupportCmds  []string `json:"supportCmds"`
-			Properties   struct {
-				ColorTem struct {
-					Range struct {
-						Min int `json:"min"`
-						Max int `json:"max"`
-					} `json:"range"`
-				} `json:"colorTem"`
-			} `json:"properties"`
-		} `json:"devices"`
+		Devices []Device `json:"devices"`
 	} `json:"data"`
 	Message string `json:"message"`
 	Code    int    `json:"code"`
 }
 
+type Device struct {
+	Device       string   `json:"device"`
+	Model        string   `json:"model"`
+	DeviceName   string   `json:"deviceName"`
+	Controllable bool     `json:"controllable"`
+	Retrievable  bool     `json:"retrievable"`
+	SupportCmds  []string `json:"supportCmds"`
+	Properties   struct {
+		ColorTem struct {
+			Range struct {
+				Min int `json:"min"`
+				Max int `json:"max"`
+			} `json:"range"`
+		} `json:"colorTem"`
+	} `json:"properties"`
+	// Account is the name of the account the device belongs to, only set
+	// when more than one account is registered.
+	Account string `json:"account,omitempty"`
+	// Scenes caches the light and DIY scenes of the device, listed by the
+	// v2 API the first time they are needed.
+	Scenes []LightScene `json:"scenes,omitempty"`
+	// Segments caches the number of segments of an RGBIC device, from its
+	// v2 capabilities.
+	Segments int `json:"segments,omitempty"`
+}
+
 type Payload struct {
 	Device string  `json:"device"`
 	Model  string  `json:"model"`
@@ -67,3 +80,92 @@ type ControlDeviceResponse struct {
 	Message string `json:"message"`
 	Data    Data   `json:"data"`
 }
+
+type RateLimit struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+// LightScene is a built-in dynamic scene (Sunrise, Aurora...) or a DIY scene
+// of a device.
+type LightScene struct {
+	Name string `json:"name"`
+	// Type and Instance are the capability setting the scene, Instance is
+	// lightScene or diyScene.
+	Type     string `json:"type"`
+	Instance string `json:"instance"`
+	// Value is the opaque value the capability is set to.
+	Value any `json:"value"`
+}
+
+// V2Request is the body of every request to the v2 API.
+type V2Request struct {
+	RequestID string    `json:"requestId"`
+	Payload   V2Payload `json:"payload"`
+}
+
+type V2Payload struct {
+	SKU        string        `json:"sku"`
+	Device     string        `json:"device"`
+	Capability *V2Capability `json:"capability,omitempty"`
+}
+
+// V2Capability is a feature of a device in the v2 API. Listings describe
+// its possible values in Parameters, control requests set its Value.
+type V2Capability struct {
+	Type       string        `json:"type"`
+	Instance   string        `json:"instance"`
+	Value      any           `json:"value,omitempty"`
+	Parameters *V2Parameters `json:"parameters,omitempty"`
+}
+
+// V2Parameters describes the values of a capability: one of Options for an
+// ENUM, a value per field for a STRUCT.
+type V2Parameters struct {
+	DataType string     `json:"dataType"`
+	Options  []V2Option `json:"options,omitempty"`
+	Fields   []V2Field  `json:"fields,omitempty"`
+}
+
+type V2Option struct {
+	Name  string `json:"name"`
+	Value any    `json:"value"`
+}
+
+// V2Field is a field of a STRUCT capability. Array fields give the range of
+// their elements, e.g. the segments of a strip.
+type V2Field struct {
+	FieldName    string   `json:"fieldName"`
+	DataType     string   `json:"dataType"`
+	ElementRange *V2Range `json:"elementRange,omitempty"`
+	Range        *V2Range `json:"range,omitempty"`
+}
+
+type V2Range struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+type V2Response struct {
+	RequestID string `json:"requestId"`
+	Code      int    `json:"code"`
+	Message   string `json:"msg"`
+	Payload   struct {
+		SKU          string         `json:"sku"`
+		Device       string         `json:"device"`
+		Capabilities []V2Capability `json:"capabilities"`
+	} `json:"payload"`
+}
+
+// V2DevicesResponse lists the devices of a key with their capabilities.
+type V2DevicesResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    []struct {
+		SKU          string         `json:"sku"`
+		Device       string         `json:"device"`
+		DeviceName   string         `json:"deviceName"`
+		Capabilities []V2Capability `json:"capabilities"`
+	} `json:"data"`
+}
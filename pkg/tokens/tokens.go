@@ -0,0 +1,245 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+)
+
+// Actions a token can be allowed.
+const (
+	// ActionRead allows listing devices, groups and scenes and reading state.
+	ActionRead = "read"
+	// ActionControl allows changing the state of devices and groups.
+	ActionControl = "control"
+	// ActionScenes allows applying scenes.
+	ActionScenes = "scenes"
+)
+
+// Actions lists every action, in the order they are shown.
+var Actions = []string{ActionRead, ActionControl, ActionScenes}
+
+// secretPrefix makes tokens recognizable, e.g. in a leaked config file.
+const secretPrefix = "gvt_"
+
+var (
+	// ErrInvalidToken is returned for unknown, malformed and revoked tokens.
+	ErrInvalidToken = errors.New("invalid or revoked token")
+	// ErrNotFound is returned when no token has the given id or name.
+	ErrNotFound = errors.New("no such token")
+)
+
+// Token gives a client of the local server access to some devices and
+// actions. Only a hash of the secret is stored, the secret itself is shown
+// once when the token is created.
+type Token struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name"`
+	Hash    string     `json:"hash"`
+	Devices []string   `json:"devices,omitempty"`
+	Groups  []string   `json:"groups,omitempty"`
+	Actions []string   `json:"actions"`
+	Created time.Time  `json:"created"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+}
+
+// Allows reports whether the token may perform action.
+func (t Token) Allows(action string) bool {
+	return slices.Contains(t.Actions, action)
+}
+
+// AllDevices reports whether the token is not limited to some devices.
+func (t Token) AllDevices() bool {
+	return len(t.Devices) == 0 && len(t.Groups) == 0
+}
+
+// CoversGroup reports whether the token gives access to a group.
+func (t Token) CoversGroup(group string) bool {
+	return t.AllDevices() || slices.Contains(t.Groups, group)
+}
+
+// CoversDevice reports whether the token gives access to a device, given by
+// name or device id, either directly or through one of its groups.
+func (t Token) CoversDevice(name string, id string, groups map[string][]string) bool {
+	if t.AllDevices() || slices.Contains(t.Devices, name) || (id != "" && slices.Contains(t.Devices, id)) {
+		return true
+	}
+	for _, group := range t.Groups {
+		if slices.Contains(groups[group], name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store is the JSON file holding the tokens. It is read on every call, so a
+// revocation takes effect on a running server right away.
+type Store struct {
+	Path string
+}
+
+// Load returns every token, including revoked ones. A missing file holds no
+// tokens.
+func (s Store) Load() ([]Token, error) {
+	file, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []Token
+	err = json.Unmarshal(file, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Path, err)
+	}
+	return tokens, nil
+}
+
+// Save writes the tokens, readable by the owner only.
+func (s Store) Save(tokens []Token) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.Path, data, 0600)
+}
+
+// Enabled reports whether the server should require authentication, which
+// is the case as soon as the store exists. A store whose tokens are all
+// revoked refuses every request instead of letting everyone in.
+func (s Store) Enabled() (bool, error) {
+	_, err := os.Stat(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// an unreadable store must not start the server without authentication
+	_, err = s.Load()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Create issues a new token and returns its secret, which is not stored.
+//
+// Parameters:
+// - name: A name for the client using the token, shown in the audit trail.
+// - devices: The devices the token is limited to, by name or device id.
+// - groups: The groups the token is limited to. No devices and no groups means every device.
+// - actions: The allowed actions, see Actions.
+//
+// Returns:
+// - string: The secret to give to the client.
+// - Token: The stored token.
+// - error: An error if the name is taken, an action is unknown or the store could not be written.
+func (s Store) Create(name string, devices []string, groups []string, actions []string) (string, Token, error) {
+	if name == "" {
+		return "", Token{}, errors.New("a token needs a name")
+	}
+	if len(actions) == 0 {
+		return "", Token{}, fmt.Errorf("a token needs at least one action, expected %v", Actions)
+	}
+	for _, action := range actions {
+		if !slices.Contains(Actions, action) {
+			return "", Token{}, fmt.Errorf("unknown action %q, expected %v", action, Actions)
+		}
+	}
+
+	tokens, err := s.Load()
+	if err != nil {
+		return "", Token{}, err
+	}
+	for _, token := range tokens {
+		if token.Name == name && token.Revoked == nil {
+			return "", Token{}, fmt.Errorf("a token named %q already exists", name)
+		}
+	}
+
+	id, err := randomString(4, hex.EncodeToString)
+	if err != nil {
+		return "", Token{}, err
+	}
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", Token{}, err
+	}
+	secret = secretPrefix + secret
+
+	token := Token{
+		ID:      id,
+		Name:    name,
+		Hash:    hash(secret),
+		Devices: devices,
+		Groups:  groups,
+		Actions: actions,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	err = s.Save(append(tokens, token))
+	if err != nil {
+		return "", Token{}, err
+	}
+	return secret, token, nil
+}
+
+// Revoke revokes the token with the given id or name. Revoked tokens are kept
+// so the audit trail can still be related to them.
+func (s Store) Revoke(idOrName string) (Token, error) {
+	tokens, err := s.Load()
+	if err != nil {
+		return Token{}, err
+	}
+	for i, token := range tokens {
+		if token.Revoked == nil && (token.ID == idOrName || token.Name == idOrName) {
+			now := time.Now().UTC().Truncate(time.Second)
+			tokens[i].Revoked = &now
+			return tokens[i], s.Save(tokens)
+		}
+	}
+	return Token{}, fmt.Errorf("%w: %s", ErrNotFound, idOrName)
+}
+
+// Authenticate returns the token matching secret, unless it is revoked.
+func (s Store) Authenticate(secret string) (Token, error) {
+	tokens, err := s.Load()
+	if err != nil {
+		return Token{}, err
+	}
+	given := hash(secret)
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(given)) == 1 {
+			if token.Revoked != nil {
+				return Token{}, ErrInvalidToken
+			}
+			return token, nil
+		}
+	}
+	return Token{}, ErrInvalidToken
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(size int, encode func([]byte) string) (string, error) {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
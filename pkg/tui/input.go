@@ -0,0 +1,79 @@
+package tui
+
+import (
+	"context"
+	"io"
+)
+
+type key int
+
+const (
+	keyNone key = iota
+	keyQuit
+	keyUp
+	keyDown
+	keyBrighter
+	keyDimmer
+	keyToggle
+	keyNextColor
+	keyPrevColor
+	keyCooler
+	keyWarmer
+	keyRefresh
+	keyRefreshAll
+)
+
+// readKeys reads raw terminal input and sends the decoded keys to keys. The
+// channel is closed once the input ends or ctx is cancelled.
+func readKeys(ctx context.Context, r io.Reader, keys chan<- key) {
+	defer close(keys)
+
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		k := decodeKey(buf[:n])
+		if k == keyNone {
+			continue
+		}
+		select {
+		case keys <- k:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// decodeKey maps a single read of raw terminal input to a key. Arrow keys
+// arrive as ANSI escape sequences, vim style letters are accepted as well.
+func decodeKey(input []byte) key {
+	switch string(input) {
+	case "\x1b[A", "\x1bOA", "k":
+		return keyUp
+	case "\x1b[B", "\x1bOB", "j":
+		return keyDown
+	case "\x1b[C", "\x1bOC", "l", "+":
+		return keyBrighter
+	case "\x1b[D", "\x1bOD", "h", "-":
+		return keyDimmer
+	case " ", "\r", "\n":
+		return keyToggle
+	case "c":
+		return keyNextColor
+	case "C":
+		return keyPrevColor
+	case "t":
+		return keyCooler
+	case "T":
+		return keyWarmer
+	case "r":
+		return keyRefresh
+	case "R":
+		return keyRefreshAll
+	case "q", "Q", "\x03", "\x04":
+		return keyQuit
+	}
+	return keyNone
+}
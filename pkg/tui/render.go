@@ -0,0 +1,153 @@
+package tui
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"golang.org/x/term"
+)
+
+const help = "↑/↓ select  space power  ←/→ brightness  c/C color  t/T temperature  r/R refresh  q quit"
+
+// draw repaints the whole screen. In raw mode every line needs an explicit
+// carriage return.
+func (d *dashboard) draw() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	var lines []string
+	lines = append(lines, bold("Govee Dashboard")+"  "+d.budget())
+	lines = append(lines, "")
+	lines = append(lines, fmt.Sprintf("  %-28s %-7s %-6s %-16s %-7s %-8s", "DEVICE", "ONLINE", "POWER", "BRIGHTNESS", "TEMP", "COLOR"))
+
+	for i, row := range d.rows {
+		cursor := "  "
+		if i == d.cursor {
+			cursor = bold("> ")
+		}
+		lines = append(lines, cursor+d.formatRow(row))
+		if row.LastErr != nil {
+			lines = append(lines, "    "+red("last error: "+row.LastErr.Error()))
+		}
+	}
+
+	if len(d.rows) == 0 {
+		lines = append(lines, "  No devices found")
+	}
+
+	// pin the status and help lines to the bottom of the screen
+	for len(lines) < height-2 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, d.status, dim(help))
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range lines {
+		b.WriteString(truncate(line, width))
+		b.WriteString("\x1b[K")
+		if i < len(lines)-1 {
+			b.WriteString("\r\n")
+		}
+	}
+	b.WriteString("\x1b[J")
+	fmt.Fprint(d.out, b.String())
+}
+
+func (d *dashboard) formatRow(row *deviceRow) string {
+	if !row.Known {
+		return fmt.Sprintf("%-28s %s", truncate(row.Name, 28), dim("waiting for state..."))
+	}
+
+	online := "no"
+	if row.Online {
+		online = "yes"
+	}
+
+	temp := "-"
+	if row.ColorTem != 0 {
+		temp = fmt.Sprintf("%dK", row.ColorTem)
+	}
+
+	color := "-"
+	if row.Color != nil {
+		color = fmt.Sprintf("\x1b[48;2;%d;%d;%dm  \x1b[0m %d,%d,%d", row.Color.R, row.Color.G, row.Color.B, row.Color.R, row.Color.G, row.Color.B)
+	}
+
+	return fmt.Sprintf("%-28s %-7s %-6s %-16s %-7s %s", truncate(row.Name, 28), online, row.Power, bar(row.Brightness), temp, color)
+}
+
+// budget describes the remaining rate-limit budget of the API key, or of
+// every account when several are registered.
+func (d *dashboard) budget() string {
+	accounts := apiwrapper.Accounts()
+	if len(accounts) == 0 {
+		return "API budget: " + formatBudget(d.apiKey)
+	}
+
+	var parts []string
+	for _, name := range accounts {
+		key, _ := apiwrapper.AccountKey(name)
+		parts = append(parts, name+" "+formatBudget(key))
+	}
+	return "API budget: " + strings.Join(parts, "  ")
+}
+
+func formatBudget(APIKEY string) string {
+	limit, ok := apiwrapper.GetRateLimit(APIKEY)
+	if !ok {
+		return dim("unknown")
+	}
+
+	text := fmt.Sprintf("%d/%d", limit.Remaining, limit.Limit)
+	if !limit.Reset.IsZero() {
+		text += " (resets " + limit.Reset.Local().Format(time.Kitchen) + ")"
+	}
+	if limit.Limit > 0 && limit.Remaining*10 < limit.Limit {
+		return red(text)
+	}
+	return text
+}
+
+// bar renders a brightness percentage as a ten segment bar.
+func bar(brightness int) string {
+	filled := clamp(brightness, 0, 100) / 10
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", filled), strings.Repeat(" ", 10-filled), brightness)
+}
+
+// truncate shortens s to width visible characters, ignoring ANSI escape sequences.
+func truncate(s string, width int) string {
+	var b strings.Builder
+	visible := 0
+	inEscape := false
+	for _, r := range s {
+		if r == '\x1b' {
+			inEscape = true
+		}
+		if inEscape {
+			b.WriteRune(r)
+			if r == 'm' || r == 'K' || r == 'J' || r == 'H' {
+				inEscape = false
+			}
+			continue
+		}
+		if visible >= width {
+			continue
+		}
+		b.WriteRune(r)
+		visible++
+	}
+	return b.String()
+}
+
+func bold(s string) string { return "\x1b[1m" + s + "\x1b[0m" }
+func dim(s string) string  { return "\x1b[2m" + s + "\x1b[0m" }
+func red(s string) string  { return "\x1b[31m" + s + "\x1b[0m" }
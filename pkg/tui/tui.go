@@ -0,0 +1,376 @@
+package tui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/poller"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+	"golang.org/x/term"
+)
+
+// settleDelay is how long the dashboard waits after the last key press before
+// sending an adjusted brightness, color or color temperature, so holding an
+// arrow key sends one request instead of one per step.
+const settleDelay = 400 * time.Millisecond
+
+// palette is the list of colors the color keys cycle through.
+var palette = utils.NamedColors
+
+// deviceRow is the dashboard's view of a single device.
+type deviceRow struct {
+	Name         string
+	Controllable bool
+	Retrievable  bool
+	TemMin       int
+	TemMax       int
+
+	Known      bool
+	Online     bool
+	Power      string
+	Brightness int
+	Color      *structs.Color
+	ColorTem   int
+	Updated    time.Time
+	LastErr    error
+
+	paletteIdx int
+	pending    *time.Timer
+}
+
+type dashboard struct {
+	mu       sync.Mutex
+	apiKey   string
+	interval time.Duration
+	rows     []*deviceRow
+	cursor   int
+	status   string
+	out      io.Writer
+	redraw   chan struct{}
+}
+
+// Run starts the full-screen dashboard on the current terminal.
+//
+// The dashboard lists every device on the account, refreshes their state every
+// interval and lets the user control the selected device with the keyboard.
+// It only uses plain ANSI escape sequences so it works over SSH.
+//
+// Parameters:
+// - APIKEY: The API key used to authenticate the requests.
+// - interval: How often the state of every device is refreshed.
+//
+// Returns:
+// - error: An error if the terminal could not be set up or the devices could not be listed.
+func Run(APIKEY string, interval time.Duration) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return errors.New("the dashboard needs an interactive terminal")
+	}
+	if interval <= 0 {
+		return errors.New("refresh interval must be positive")
+	}
+
+	d := &dashboard{
+		apiKey:   APIKEY,
+		interval: interval,
+		out:      os.Stdout,
+		redraw:   make(chan struct{}, 1),
+	}
+	if err := d.loadDevices(); err != nil {
+		return err
+	}
+
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, oldState)
+
+	// switch to the alternate screen and hide the cursor, undo both on exit
+	fmt.Fprint(d.out, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(d.out, "\x1b[?25h\x1b[?1049l")
+
+	// stop reading keys and refreshing once the dashboard is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	keys := make(chan key)
+	go readKeys(ctx, os.Stdin, keys)
+
+	go d.refreshLoop(ctx)
+
+	d.draw()
+	for {
+		select {
+		case k, ok := <-keys:
+			if !ok || k == keyQuit {
+				return nil
+			}
+			d.handleKey(k)
+			d.draw()
+		case <-d.redraw:
+			d.draw()
+		}
+	}
+}
+
+// loadDevices fetches the device list and refreshes the devices.json cache
+// the control functions resolve device names from.
+func (d *dashboard) loadDevices() error {
+	data, err := apiwrapper.ListAllDevices(d.apiKey)
+	if err != nil {
+		return err
+	}
+	utils.SaveToJSON(data)
+
+	for _, device := range data.Data.Devices {
+		row := &deviceRow{
+			Name:         device.DeviceName,
+			Controllable: device.Controllable,
+			Retrievable:  device.Retrievable,
+			TemMin:       device.Properties.ColorTem.Range.Min,
+			TemMax:       device.Properties.ColorTem.Range.Max,
+		}
+		// fall back to the range accepted by SetDeviceColorTemp
+		if row.TemMin == 0 || row.TemMax == 0 {
+			row.TemMin, row.TemMax = 2000, 9000
+		}
+		d.rows = append(d.rows, row)
+	}
+	return nil
+}
+
+// refreshLoop refreshes every device right away and then once per interval,
+// until ctx is cancelled.
+func (d *dashboard) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		d.refreshAll()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshAll fetches the state of every retrievable device one at a time, so
+// a refresh never bursts through the rate limit.
+func (d *dashboard) refreshAll() {
+	d.mu.Lock()
+	rows := append([]*deviceRow(nil), d.rows...)
+	d.mu.Unlock()
+
+	for _, row := range rows {
+		if !row.Retrievable {
+			continue
+		}
+		d.refresh(row)
+	}
+}
+
+func (d *dashboard) refresh(row *deviceRow) {
+	states, err := apiwrapper.GetManyDeviceStates([]string{row.Name}, d.apiKey)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.requestRedraw()
+
+	if err != nil {
+		row.LastErr = err
+		return
+	}
+	if len(states) == 0 {
+		row.LastErr = errors.New("device missing from devices.json")
+		return
+	}
+	if states[0].Code != 200 {
+		row.LastErr = fmt.Errorf("%d %s", states[0].Code, states[0].Message)
+		return
+	}
+
+	row.Known = true
+	row.LastErr = nil
+	row.Updated = time.Now()
+	state := poller.Merge(states[0].Data.Properties)
+	row.Online, row.Power, row.Brightness = state.Online, state.Power, state.Brightness
+	row.Color, row.ColorTem = state.Color, state.ColorTem
+}
+
+func (d *dashboard) requestRedraw() {
+	select {
+	case d.redraw <- struct{}{}:
+	default:
+	}
+}
+
+func (d *dashboard) handleKey(k key) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.rows) == 0 {
+		return
+	}
+	row := d.rows[d.cursor]
+
+	switch k {
+	case keyUp:
+		if d.cursor > 0 {
+			d.cursor--
+		}
+	case keyDown:
+		if d.cursor < len(d.rows)-1 {
+			d.cursor++
+		}
+	case keyRefresh:
+		d.status = "Refreshing " + row.Name
+		go d.refresh(row)
+	case keyRefreshAll:
+		d.status = "Refreshing all devices"
+		go d.refreshAll()
+	case keyToggle:
+		d.togglePower(row)
+	case keyBrighter:
+		d.adjustBrightness(row, 10)
+	case keyDimmer:
+		d.adjustBrightness(row, -10)
+	case keyNextColor:
+		d.cycleColor(row, 1)
+	case keyPrevColor:
+		d.cycleColor(row, -1)
+	case keyCooler:
+		d.adjustColorTem(row, 500)
+	case keyWarmer:
+		d.adjustColorTem(row, -500)
+	}
+}
+
+func (d *dashboard) togglePower(row *deviceRow) {
+	if !row.Controllable {
+		d.status = row.Name + " is not controllable"
+		return
+	}
+
+	turnOn := row.Power != "on"
+	d.status = fmt.Sprintf("Turning %s %s", row.Name, onOff(turnOn))
+	go d.send(row, func() (structs.ControlDeviceResponse, error) {
+		if turnOn {
+			return apiwrapper.TurnDeviceOn([]string{row.Name}, d.apiKey)
+		}
+		return apiwrapper.TurnDeviceOff([]string{row.Name}, d.apiKey)
+	}, func() {
+		row.Power = onOff(turnOn)
+	})
+}
+
+func (d *dashboard) adjustBrightness(row *deviceRow, step int) {
+	if !row.Controllable {
+		d.status = row.Name + " is not controllable"
+		return
+	}
+
+	row.Brightness = clamp(row.Brightness+step, 0, 100)
+	brightness := row.Brightness
+	d.status = fmt.Sprintf("Setting %s brightness to %d%%", row.Name, brightness)
+	d.settle(row, func() {
+		d.send(row, func() (structs.ControlDeviceResponse, error) {
+			return apiwrapper.SetDeviceBrightness([]string{row.Name}, brightness, d.apiKey)
+		}, nil)
+	})
+}
+
+func (d *dashboard) cycleColor(row *deviceRow, step int) {
+	if !row.Controllable {
+		d.status = row.Name + " is not controllable"
+		return
+	}
+
+	row.paletteIdx = (row.paletteIdx + step + len(palette)) % len(palette)
+	picked := palette[row.paletteIdx]
+	color := picked.Color
+	row.Color = &color
+	row.ColorTem = 0
+	d.status = fmt.Sprintf("Setting %s color to %s", row.Name, picked.Name)
+	d.settle(row, func() {
+		d.send(row, func() (structs.ControlDeviceResponse, error) {
+			return apiwrapper.SetDeviceRGB([]string{row.Name}, color.R, color.G, color.B, d.apiKey)
+		}, nil)
+	})
+}
+
+func (d *dashboard) adjustColorTem(row *deviceRow, step int) {
+	if !row.Controllable {
+		d.status = row.Name + " is not controllable"
+		return
+	}
+
+	if row.ColorTem == 0 {
+		row.ColorTem = (row.TemMin + row.TemMax) / 2
+	}
+	row.ColorTem = clamp(row.ColorTem+step, row.TemMin, row.TemMax)
+	colorTem := row.ColorTem
+	d.status = fmt.Sprintf("Setting %s color temperature to %dK", row.Name, colorTem)
+	d.settle(row, func() {
+		d.send(row, func() (structs.ControlDeviceResponse, error) {
+			return apiwrapper.SetDeviceColorTemp([]string{row.Name}, colorTem, d.apiKey)
+		}, nil)
+	})
+}
+
+// settle runs fn once no further adjustment was made for settleDelay.
+func (d *dashboard) settle(row *deviceRow, fn func()) {
+	if row.pending != nil {
+		row.pending.Stop()
+	}
+	row.pending = time.AfterFunc(settleDelay, fn)
+}
+
+// send runs a control command and records its outcome on the row. onSuccess
+// is called with the dashboard locked if the command was accepted.
+func (d *dashboard) send(row *deviceRow, command func() (structs.ControlDeviceResponse, error), onSuccess func()) {
+	response, err := command()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.requestRedraw()
+
+	if err == nil && response.Code != 200 {
+		err = fmt.Errorf("%d %s", response.Code, response.Message)
+	}
+	if err != nil {
+		row.LastErr = err
+		d.status = fmt.Sprintf("%s: %v", row.Name, err)
+		return
+	}
+
+	row.LastErr = nil
+	d.status = "Done"
+	if onSuccess != nil {
+		onSuccess()
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
@@ -0,0 +1,153 @@
+package tui
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+)
+
+// Unlike the rest of the suite in test/, these tests are in package tui: the
+// dashboard only exports Run, which needs a terminal, and the key decoding,
+// layout and key reader worth testing are internal to it.
+
+func TestDecodeKey(t *testing.T) {
+	tests := []struct {
+		input string
+		want  key
+	}{
+		{"\x1b[A", keyUp},
+		{"\x1bOA", keyUp},
+		{"k", keyUp},
+		{"\x1b[B", keyDown},
+		{"j", keyDown},
+		{"\x1b[C", keyBrighter},
+		{"+", keyBrighter},
+		{"\x1b[D", keyDimmer},
+		{"-", keyDimmer},
+		{" ", keyToggle},
+		{"\r", keyToggle},
+		{"c", keyNextColor},
+		{"C", keyPrevColor},
+		{"t", keyCooler},
+		{"T", keyWarmer},
+		{"r", keyRefresh},
+		{"R", keyRefreshAll},
+		{"q", keyQuit},
+		{"\x03", keyQuit},
+		{"x", keyNone},
+		{"kk", keyNone},
+	}
+	for _, test := range tests {
+		if got := decodeKey([]byte(test.input)); got != test.want {
+			t.Errorf("decodeKey(%q) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		input string
+		width int
+		want  string
+	}{
+		{"Floor Lamp", 20, "Floor Lamp"},
+		{"Floor Lamp", 5, "Floor"},
+		{"Floor Lamp", 0, ""},
+		// escape sequences don't count towards the width and are kept
+		{bold("Floor Lamp"), 5, "\x1b[1mFloor\x1b[0m"},
+		{"Lämpchen", 3, "Läm"},
+	}
+	for _, test := range tests {
+		if got := truncate(test.input, test.width); got != test.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.input, test.width, got, test.want)
+		}
+	}
+}
+
+func TestBar(t *testing.T) {
+	tests := []struct {
+		brightness int
+		want       string
+	}{
+		{0, "[          ]   0%"},
+		{45, "[####      ]  45%"},
+		{100, "[##########] 100%"},
+		// out of range values are clamped in the bar only
+		{120, "[##########] 120%"},
+		{-5, "[          ]  -5%"},
+	}
+	for _, test := range tests {
+		if got := bar(test.brightness); got != test.want {
+			t.Errorf("bar(%d) = %q, want %q", test.brightness, got, test.want)
+		}
+	}
+}
+
+func TestFormatBudget(t *testing.T) {
+	var remaining int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("API-RateLimit-Limit", "10000")
+		w.Write([]byte(`{"code": 200, "message": "Success", "data": {"devices": []}}`))
+	}))
+	defer server.Close()
+	baseURL := apiwrapper.BaseURL
+	apiwrapper.BaseURL = server.URL
+	defer func() { apiwrapper.BaseURL = baseURL }()
+
+	tests := []struct {
+		remaining int
+		want      string
+	}{
+		{9000, "9000/10000"},
+		{1000, "1000/10000"},
+		// less than a tenth of the budget left is shown in red
+		{999, red("999/10000")},
+		{0, red("0/10000")},
+	}
+	for _, test := range tests {
+		key := "tui-test-key-" + strconv.Itoa(test.remaining)
+		remaining = test.remaining
+		if _, err := apiwrapper.ListDevices(key); err != nil {
+			t.Fatal(err)
+		}
+		if got := formatBudget(key); got != test.want {
+			t.Errorf("formatBudget with %d left = %q, want %q", test.remaining, got, test.want)
+		}
+	}
+	if got := formatBudget("tui-test-unknown-key"); got != dim("unknown") {
+		t.Errorf("expected an unknown budget, got %q", got)
+	}
+}
+
+func TestReadKeysStops(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	keys := make(chan key)
+	done := make(chan struct{})
+	go func() {
+		readKeys(ctx, r, keys)
+		close(done)
+	}()
+
+	w.Write([]byte("q"))
+	if k := <-keys; k != keyQuit {
+		t.Fatalf("expected keyQuit, got %v", k)
+	}
+
+	// a key nobody receives anymore must not block the reader
+	w.Write([]byte("j"))
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the key reader to stop once cancelled")
+	}
+}
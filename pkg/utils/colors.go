@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/seanpden/govee_controller/pkg/structs"
+)
+
+type NamedColor struct {
+	Name  string
+	Color structs.Color
+}
+
+// NamedColors is the list of color names accepted wherever a color is expected.
+var NamedColors = []NamedColor{
+	{"red", structs.Color{R: 255, G: 0, B: 0}},
+	{"orange", structs.Color{R: 255, G: 127, B: 0}},
+	{"yellow", structs.Color{R: 255, G: 255, B: 0}},
+	{"green", structs.Color{R: 0, G: 255, B: 0}},
+	{"cyan", structs.Color{R: 0, G: 255, B: 255}},
+	{"blue", structs.Color{R: 0, G: 0, B: 255}},
+	{"purple", structs.Color{R: 127, G: 0, B: 255}},
+	{"pink", structs.Color{R: 255, G: 0, B: 127}},
+	{"white", structs.Color{R: 255, G: 255, B: 255}},
+	{"warmwhite", structs.Color{R: 255, G: 180, B: 107}},
+}
+
+// ParseColor parses a color given as a name from NamedColors, as a hex code
+// like "#ff8000", or as "r,g,b" with every component between 0 and 255.
+func ParseColor(value string) (structs.Color, error) {
+	value = strings.TrimSpace(value)
+
+	for _, named := range NamedColors {
+		if strings.EqualFold(named.Name, value) {
+			return named.Color, nil
+		}
+	}
+
+	if strings.HasPrefix(value, "#") {
+		hex := strings.TrimPrefix(value, "#")
+		if len(hex) != 6 {
+			return structs.Color{}, fmt.Errorf("invalid hex color %q", value)
+		}
+		rgb, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return structs.Color{}, fmt.Errorf("invalid hex color %q", value)
+		}
+		return structs.Color{R: int(rgb >> 16 & 0xff), G: int(rgb >> 8 & 0xff), B: int(rgb & 0xff)}, nil
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return structs.Color{}, fmt.Errorf("invalid color %q, expected a name, #rrggbb or r,g,b", value)
+	}
+	var rgb [3]int
+	for i, part := range parts {
+		component, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return structs.Color{}, err
+		}
+		if component < 0 || component > 255 {
+			return structs.Color{}, fmt.Errorf("r, g, and b must be between 0 and 255")
+		}
+		rgb[i] = component
+	}
+	return structs.Color{R: rgb[0], G: rgb[1], B: rgb[2]}, nil
+}
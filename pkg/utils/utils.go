@@ -22,16 +22,48 @@ func PrettyPrintJSON(body any) error {
 	return nil
 }
 
+// RegistryFile is the device registry every command resolves device names
+// from, written by SaveToJSON.
+var RegistryFile = "devices.json"
+
 // SaveToJSON saves data to a JSON file.
 //
 // The function takes in a parameter 'data' of type 'any', which represents the data to be saved.
-// It does not return any value.
+// It does not return any value. Saving a device list keeps the scenes and
+// segments cached for devices that are still listed.
 func SaveToJSON(data any) {
+	if devices, ok := data.(structs.ListDevicesResponse); ok {
+		data = keepCached(devices)
+	}
 	file, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {
 		log.Fatal(err)
 	}
-	os.WriteFile("devices.json", file, 0666)
+	os.WriteFile(RegistryFile, file, 0666)
+}
+
+// keepCached copies the scenes and segments cached in the current
+// devices.json to the devices of a fresh listing, which has none.
+func keepCached(devices structs.ListDevicesResponse) structs.ListDevicesResponse {
+	previous, err := LoadFromJSON(RegistryFile)
+	if err != nil {
+		return devices
+	}
+	cached := map[string]structs.Device{}
+	for _, device := range previous.Data.Devices {
+		cached[device.Device] = device
+	}
+	// copy the slice, the caller's devices are left alone
+	devices.Data.Devices = append([]structs.Device(nil), devices.Data.Devices...)
+	for i, device := range devices.Data.Devices {
+		if len(device.Scenes) == 0 {
+			devices.Data.Devices[i].Scenes = cached[device.Device].Scenes
+		}
+		if device.Segments == 0 {
+			devices.Data.Devices[i].Segments = cached[device.Device].Segments
+		}
+	}
+	return devices
 }
 
 func LoadFromJSON(filepath string) (structs.ListDevicesResponse, error) {
@@ -49,3 +81,37 @@ func LoadFromJSON(filepath string) (structs.ListDevicesResponse, error) {
 
 	return data, nil
 }
+
+// LoadGroups loads the named device groups from a JSON file.
+//
+// The file maps each group name to the device names in it, e.g.
+// {"office": ["Lyra (Office: Left)", "Lyra (Office: Right)"]}.
+// It returns an error if the file can not be read or parsed.
+func LoadGroups(filepath string) (map[string][]string, error) {
+	file, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups map[string][]string
+	err = json.Unmarshal(file, &groups)
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// ExpandGroups replaces every group name in devices with the devices in that
+// group. Names that are not a group are kept as they are.
+func ExpandGroups(devices []string, groups map[string][]string) []string {
+	var expanded []string
+	for _, device := range devices {
+		if members, ok := groups[device]; ok {
+			expanded = append(expanded, members...)
+			continue
+		}
+		expanded = append(expanded, device)
+	}
+	return expanded
+}
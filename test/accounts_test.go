@@ -0,0 +1,98 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// chdirTemp runs the rest of the test in an empty directory, so devices.json
+// is written there.
+func chdirTemp(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+func TestMultipleAccounts(t *testing.T) {
+	chdirTemp(t)
+
+	fake := testapi.Start(t)
+	fake.AddAccount("office-key",
+		structs.Device{Device: "AA", Model: "H6072", DeviceName: "Lyra", Controllable: true},
+		structs.Device{Device: "BB", Model: "H6199", DeviceName: "Desk", Controllable: true},
+	)
+	fake.AddAccount("lab-key",
+		structs.Device{Device: "CC", Model: "H6072", DeviceName: "Lyra", Controllable: true},
+		structs.Device{Device: "DD", Model: "H6199", DeviceName: "Bench", Controllable: true},
+	)
+	// every account has a budget of its own
+	fake.SetRateLimit(4, time.Now().Add(time.Hour))
+
+	apiwrapper.RegisterAccount("office", "office-key")
+	apiwrapper.RegisterAccount("lab", "lab-key")
+	defer apiwrapper.UnregisterAccount("office")
+	defer apiwrapper.UnregisterAccount("lab")
+	t.Cleanup(func() { apiwrapper.ResetRateLimits("office-key", "lab-key") })
+
+	data, err := apiwrapper.ListAllDevices("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]string{}
+	for _, device := range data.Data.Devices {
+		names[device.DeviceName] = device.Account
+	}
+	want := map[string]string{"lab/Lyra": "lab", "Bench": "lab", "office/Lyra": "office", "Desk": "office"}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatalf("got devices %v, want %v", names, want)
+	}
+
+	utils.SaveToJSON(data)
+
+	// commands are sent with the key of the device's account
+	fake.ClearRequests()
+	_, err = apiwrapper.TurnDeviceOn([]string{"office/Lyra", "Desk"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var controlled []string
+	for _, request := range fake.Requests() {
+		controlled = append(controlled, request.Key+" "+request.Device)
+	}
+	if fmt.Sprint(controlled) != "[office-key AA office-key BB]" {
+		t.Fatalf("got commands %v", controlled)
+	}
+
+	// the lab account uses up its budget, the office account is not affected
+	_, err = apiwrapper.TurnDeviceOn([]string{"lab/Lyra", "Bench"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = apiwrapper.TurnDeviceOff([]string{"Bench"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = apiwrapper.TurnDeviceOn([]string{"Bench"}, "")
+	if !errors.Is(err, apiwrapper.ErrRateLimited) {
+		t.Fatalf("got %v, want ErrRateLimited", err)
+	}
+	_, err = apiwrapper.TurnDeviceOff([]string{"Desk"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
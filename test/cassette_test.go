@@ -0,0 +1,116 @@
+package test
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/cassette"
+	"github.com/seanpden/govee_controller/pkg/govetest"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// useTransport sends the api wrapper's requests through transport until the
+// test ends.
+func useTransport(t *testing.T, transport http.RoundTripper) {
+	previous := apiwrapper.HTTPClient.Transport
+	apiwrapper.HTTPClient.Transport = transport
+	t.Cleanup(func() { apiwrapper.HTTPClient.Transport = previous })
+}
+
+func TestCassetteRecordReplay(t *testing.T) {
+	chdirTemp(t)
+	const key = "cassette-test-secret-api-key"
+	fake := testapi.Start(t, govetest.NewDevice(rightID, "H6072", "Lyra (Office: Right)"))
+	useTransport(t, cassette.NewRecorder("cassettes/lamp.json", nil))
+
+	data, err := apiwrapper.ListDevices(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.SaveToJSON(data)
+	if _, err := apiwrapper.GetDeviceState(rightID, "H6072", key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apiwrapper.TurnDeviceOn([]string{"Lyra (Office: Right)"}, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// the fixture has no key and no device id
+	fixture, err := os.ReadFile("cassettes/lamp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(fixture), key) || strings.Contains(string(fixture), rightID) {
+		t.Fatalf("expected the key and the device id to be scrubbed:\n%s", fixture)
+	}
+	if strings.Count(string(fixture), "00:00:00:00:00:00:00:01") != 4 {
+		t.Errorf("expected the device id to be replaced consistently:\n%s", fixture)
+	}
+
+	// replay without the fake server
+	fake.Close()
+	recorded, err := cassette.Load("cassettes/lamp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayer := cassette.NewReplayer(recorded)
+	useTransport(t, replayer)
+	baseURL := apiwrapper.BaseURL
+	apiwrapper.BaseURL = "http://replay.invalid"
+	defer func() { apiwrapper.BaseURL = baseURL }()
+
+	data, err = apiwrapper.ListDevices("any-key")
+	if err != nil || len(data.Data.Devices) != 1 || data.Data.Devices[0].Device != "00:00:00:00:00:00:00:01" {
+		t.Fatalf("unexpected replayed devices %+v %v", data, err)
+	}
+	utils.SaveToJSON(data)
+	state, err := apiwrapper.GetDeviceState("00:00:00:00:00:00:00:01", "H6072", "any-key")
+	if err != nil || state.Data.Properties[1].PowerState != "off" {
+		t.Fatalf("unexpected replayed state %+v %v", state, err)
+	}
+	response, err := apiwrapper.TurnDeviceOn([]string{"Lyra (Office: Right)"}, "any-key")
+	if err != nil || response.Code != 200 {
+		t.Fatalf("unexpected replayed response %+v %v", response, err)
+	}
+	if unused := replayer.Unused(); len(unused) != 0 {
+		t.Errorf("expected every interaction to be replayed, %d were not", len(unused))
+	}
+
+	// the last matching response is served again, other requests fail like
+	// a network error would
+	if _, err := apiwrapper.ListDevices("any-key"); err != nil {
+		t.Errorf("expected the list to be replayed again, got %v", err)
+	}
+	_, err = apiwrapper.SetDeviceBrightness([]string{"Lyra (Office: Right)"}, 10, "any-key")
+	if !errors.Is(err, cassette.ErrNoInteraction) {
+		t.Errorf("expected an unrecorded request to fail, got %v", err)
+	}
+}
+
+func TestCassetteMatching(t *testing.T) {
+	recorded := cassette.Cassette{Interactions: []cassette.Interaction{
+		{
+			Request:  cassette.Request{Method: "POST", URL: "/router/api/v1/device/scenes", Body: `{"requestId":"abc","payload":{"sku":"H6072","device":"00:00:00:00:00:00:00:01"}}`},
+			Response: cassette.Response{Status: 200, Body: `{"code":200}`},
+		},
+	}}
+	client := &http.Client{Transport: cassette.NewReplayer(recorded)}
+
+	// another requestId, other formatting and key order still match
+	body := `{"payload": {"device": "00:00:00:00:00:00:00:01", "sku": "H6072"}, "requestId": "def"}`
+	res, err := client.Post("https://openapi.example/router/api/v1/device/scenes", "application/json", strings.NewReader(body))
+	if err != nil || res.StatusCode != 200 {
+		t.Fatalf("expected the recorded response, got %v %v", res, err)
+	}
+	res.Body.Close()
+
+	_, err = client.Post("https://openapi.example/router/api/v1/device/scenes", "application/json", strings.NewReader(`{"payload":{"sku":"H6008"}}`))
+	if !errors.Is(err, cassette.ErrNoInteraction) {
+		t.Errorf("expected another body not to match, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/circadian"
+	"github.com/seanpden/govee_controller/pkg/govetest"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+func TestCircadianCurve(t *testing.T) {
+	curve := circadian.DefaultCurve()
+	day := time.Date(2026, 3, 20, 0, 0, 0, 0, time.UTC)
+
+	if kelvin, brightness := curve.Target(day.Add(2 * time.Hour)); kelvin != 2200 || brightness != 10 {
+		t.Errorf("unexpected night target %dK %d%%", kelvin, brightness)
+	}
+	if kelvin, brightness := curve.Target(day.Add(13 * time.Hour)); kelvin != 6500 || brightness != 100 {
+		t.Errorf("unexpected midday target %dK %d%%", kelvin, brightness)
+	}
+	morning, _ := curve.Target(day.Add(9 * time.Hour))
+	evening, _ := curve.Target(day.Add(17 * time.Hour))
+	if morning != evening || morning <= 2200 || morning >= 6500 {
+		t.Errorf("expected the curve to be symmetric around midday, got %dK and %dK", morning, evening)
+	}
+	if points := curve.Preview(day, time.Hour); len(points) != 24 {
+		t.Errorf("expected 24 points, got %d", len(points))
+	}
+
+	curve.MaxKelvin = 9500
+	if curve.Validate() == nil {
+		t.Error("expected a color temperature above 9000 to be refused")
+	}
+}
+
+func TestCircadianMode(t *testing.T) {
+	chdirTemp(t)
+	lamp := structs.Device{Device: "AA", Model: "H6072", DeviceName: "Lamp", Controllable: true, Retrievable: true}
+	lamp.Properties.ColorTem.Range.Min = 2700
+	lamp.Properties.ColorTem.Range.Max = 6500
+	fake := testapi.Start(t, lamp)
+	fake.SetState("AA", govetest.State{Online: true, Power: "on", Brightness: 100})
+	data, err := apiwrapper.ListDevices("circadian-test-api-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.SaveToJSON(data)
+
+	mode := circadian.New("circadian-test-api-key", []string{"Lamp"})
+	night := time.Date(2026, 3, 20, 23, 0, 0, 0, time.Local)
+
+	// the night target of 2200K is clamped to the lamp's range
+	updates := mode.Step(night)
+	if len(updates) != 1 || !updates[0].Sent || updates[0].Kelvin != 2700 || updates[0].Brightness != 10 || updates[0].Err != nil {
+		t.Fatalf("unexpected first update: %+v", updates)
+	}
+
+	// nothing moved, nothing is sent
+	commands := len(fake.Commands())
+	updates = mode.Step(night.Add(5 * time.Minute))
+	if updates[0].Skipped != circadian.SkippedUnchanged || len(fake.Commands()) != commands {
+		t.Errorf("expected no command while the curve is flat: %+v", updates)
+	}
+
+	// a brightness set by hand pauses the lamp
+	state, _ := fake.State("AA")
+	state.Brightness = 80
+	fake.SetState("AA", state)
+	morning := time.Date(2026, 3, 21, 9, 0, 0, 0, time.Local)
+	updates = mode.Step(morning)
+	if updates[0].Skipped != circadian.SkippedManual || len(fake.Commands()) != commands {
+		t.Errorf("expected the manual change to pause the lamp: %+v", updates)
+	}
+	updates = mode.Step(morning.Add(time.Hour))
+	if updates[0].Skipped != circadian.SkippedPaused {
+		t.Errorf("expected the lamp to stay paused: %+v", updates)
+	}
+
+	// turning the lamp off and on again resumes the curve
+	state.Power = "off"
+	fake.SetState("AA", state)
+	if updates = mode.Step(morning.Add(time.Hour)); updates[0].Skipped != circadian.SkippedOff {
+		t.Errorf("expected the lamp to be skipped while off: %+v", updates)
+	}
+	state.Power = "on"
+	fake.SetState("AA", state)
+	updates = mode.Step(morning.Add(time.Hour))
+	if !updates[0].Sent || updates[0].Kelvin <= 2700 || updates[0].Err != nil {
+		t.Errorf("expected the curve to resume: %+v", updates)
+	}
+}
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/seanpden/govee_controller/pkg/completion"
+)
+
+var completionSource = completion.Source{
+	Commands: []string{"turn", "list", "brightness", "color", "color_temp"},
+	Flags:    []string{"-CMD", "-DEVICE", "-VALUE"},
+	Devices: []completion.Device{
+		{Name: "Lyra (Office: Left)", TemMin: 2700, TemMax: 6500},
+		{Name: "Lyra (Office: Right)"},
+		{Name: "Desk Strip"},
+	},
+	Groups: []string{"office"},
+}
+
+func TestCompleteCommands(t *testing.T) {
+	got := completion.Complete(completionSource, []string{"co"})
+	want := []string{"color", "color_temp"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestCompleteDevices(t *testing.T) {
+	got := completion.Complete(completionSource, []string{"color", "Ly"})
+	want := []string{"Lyra (Office: Left)", "Lyra (Office: Right)"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// only the device after the last comma is completed
+	got = completion.Complete(completionSource, []string{"-DEVICE", "office,de"})
+	want = []string{"office,Desk Strip"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestCompleteValues(t *testing.T) {
+	got := completion.Complete(completionSource, []string{"-CMD", "turn", "-VALUE", ""})
+	want := []string{"on", "off"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// color temperatures are limited to the device's range
+	got = completion.Complete(completionSource, []string{"color_temp", "Lyra (Office: Left)", ""})
+	if got[0] != "2700" || got[len(got)-1] != "6500" {
+		t.Fatalf("got %v, want values from 2700 to 6500", got)
+	}
+}
+
+func TestBashCandidatesEscaping(t *testing.T) {
+	line := `govee color Lyra\ \(Office:\ R`
+	// bash splits the word at the ':'
+	got := completion.BashCandidates(completionSource, line, len(line), `\ R`)
+	want := []string{`\ Right\)`}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestCompletionScripts(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		script, err := completion.Script(shell, "govee")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(script, "govee __complete "+shell) {
+			t.Fatalf("%s script does not call back into govee:\n%s", shell, script)
+		}
+	}
+
+	_, err := completion.Script("powershell", "govee")
+	if err == nil {
+		t.Fatal("expected an error for an unsupported shell")
+	}
+}
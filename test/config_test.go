@@ -0,0 +1,125 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/config"
+)
+
+const configFile = `{
+  "api_key": "shared-key",
+  "timeout": "5s",
+  "default_profile": "home",
+  "profiles": {
+    "home": {"devices": ["Desk Strip"]},
+    "office": {"api_key": "office-key", "output": "json"}
+  }
+}`
+
+func writeConfig(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(configFile), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func clearConfigEnv(t *testing.T) {
+	for _, name := range []string{"GOVEE_APIKEY", "GOVEE_BASE_URL", "GOVEE_TRANSPORT", "GOVEE_TIMEOUT", "GOVEE_OUTPUT", "GOVEE_DEVICES", "GOVEE_PROFILE", "GOVEE_LATITUDE", "GOVEE_LONGITUDE"} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestConfigDefaultProfile(t *testing.T) {
+	clearConfigEnv(t)
+	cfg, profile, err := config.Load(config.Options{Path: writeConfig(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if profile != "home" {
+		t.Fatalf("got profile %q, want home", profile)
+	}
+	if cfg.APIKey != "shared-key" || time.Duration(cfg.Timeout) != 5*time.Second {
+		t.Fatalf("top level settings not applied: %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.Devices, []string{"Desk Strip"}) {
+		t.Fatalf("got devices %v, want the home profile's", cfg.Devices)
+	}
+	if cfg.BaseURL != config.Defaults().BaseURL {
+		t.Fatalf("got base url %q, want the default", cfg.BaseURL)
+	}
+}
+
+func TestConfigLayering(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("GOVEE_PROFILE", "office")
+	t.Setenv("GOVEE_TIMEOUT", "20s")
+	t.Setenv("GOVEE_OUTPUT", "text")
+
+	cfg, profile, err := config.Load(config.Options{
+		Path:  writeConfig(t),
+		Flags: config.Config{Timeout: config.Duration(time.Second)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if profile != "office" || cfg.APIKey != "office-key" {
+		t.Fatalf("office profile not selected: %q %+v", profile, cfg)
+	}
+	// the environment beats the profile, flags beat the environment
+	if cfg.Output != "text" {
+		t.Fatalf("got output %q, want text from the environment", cfg.Output)
+	}
+	if time.Duration(cfg.Timeout) != time.Second {
+		t.Fatalf("got timeout %v, want 1s from the flags", time.Duration(cfg.Timeout))
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	clearConfigEnv(t)
+	_, _, err := config.Load(config.Options{Path: writeConfig(t), Profile: "cabin"})
+	if err == nil {
+		t.Fatal("expected an error for an unknown profile")
+	}
+
+	t.Setenv("GOVEE_TRANSPORT", "carrier-pigeon")
+	_, _, err = config.Load(config.Options{Path: writeConfig(t)})
+	if err == nil {
+		t.Fatal("expected an error for an unknown transport")
+	}
+	// refused instead of ignored until there is a LAN transport
+	t.Setenv("GOVEE_TRANSPORT", "lan")
+	_, _, err = config.Load(config.Options{Path: writeConfig(t)})
+	if err == nil || !strings.Contains(err.Error(), "not supported yet") {
+		t.Fatalf("expected the LAN transport to be refused, got %v", err)
+	}
+
+	// coordinates are needed together
+	t.Setenv("GOVEE_TRANSPORT", "")
+	t.Setenv("GOVEE_LATITUDE", "48.85")
+	_, _, err = config.Load(config.Options{Path: writeConfig(t)})
+	if err == nil {
+		t.Fatal("expected an error for a latitude without a longitude")
+	}
+	t.Setenv("GOVEE_LONGITUDE", "2.35")
+	cfg, _, err := config.Load(config.Options{Path: writeConfig(t)})
+	if err != nil || *cfg.Latitude != 48.85 || *cfg.Longitude != 2.35 {
+		t.Fatalf("coordinates not read from the environment: %v", err)
+	}
+	t.Setenv("GOVEE_LATITUDE", "")
+	t.Setenv("GOVEE_LONGITUDE", "")
+
+	// a missing config file is fine
+	_, _, err = config.Load(config.Options{Path: filepath.Join(t.TempDir(), "missing.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
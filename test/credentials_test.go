@@ -0,0 +1,119 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/seanpden/govee_controller/pkg/credentials"
+	"github.com/seanpden/govee_controller/pkg/redact"
+)
+
+func TestCredentialStoreKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	store := credentials.Store{
+		Path:    filepath.Join(dir, "credentials.enc"),
+		KeyFile: filepath.Join(dir, "credentials.key"),
+	}
+
+	err := store.Set("home", "secret-home-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret-home-key")) {
+		t.Fatal("the key is stored in plaintext")
+	}
+
+	key, ok, err := store.Get("home")
+	if err != nil || !ok || key != "secret-home-key" {
+		t.Fatalf("got %q %v %v, want the stored key", key, ok, err)
+	}
+
+	removed, err := store.Delete("home")
+	if err != nil || !removed {
+		t.Fatalf("got %v %v, want the key removed", removed, err)
+	}
+	if store.Exists() {
+		t.Fatal("an empty store should be removed")
+	}
+}
+
+func TestCredentialStorePassphrase(t *testing.T) {
+	dir := t.TempDir()
+	store := credentials.Store{
+		Path:       filepath.Join(dir, "credentials.enc"),
+		Passphrase: "correct horse",
+	}
+
+	err := store.Set("default", "secret-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.Passphrase = ""
+	_, err = store.Load()
+	if !errors.Is(err, credentials.ErrPassphraseRequired) {
+		t.Fatalf("got %v, want ErrPassphraseRequired", err)
+	}
+
+	store.Passphrase = "wrong horse"
+	_, err = store.Load()
+	if err == nil {
+		t.Fatal("expected an error for a wrong passphrase")
+	}
+
+	store.Passphrase = "correct horse"
+	key, _, err := store.Get("default")
+	if err != nil || key != "secret-key" {
+		t.Fatalf("got %q %v, want the stored key", key, err)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	redact.Register("super-secret-api-key")
+
+	// errors keep their identity but lose the key
+	cause := errors.New("boom")
+	err := redact.Error(fmt.Errorf("request with super-secret-api-key failed: %w", cause))
+	if strings.Contains(err.Error(), "super-secret-api-key") || !errors.Is(err, cause) {
+		t.Fatalf("got %v", err)
+	}
+
+	header := http.Header{}
+	header.Set("Govee-API-Key", "not-registered-key")
+	header.Set("Accept", "application/json")
+	redacted := redact.Header(header)
+	if redacted.Get("Govee-API-Key") != redact.Placeholder || redacted.Get("Accept") != "application/json" {
+		t.Fatalf("got %v", redacted)
+	}
+	if header.Get("Govee-API-Key") != "not-registered-key" {
+		t.Fatal("the original header must not be changed")
+	}
+
+	var buf bytes.Buffer
+	logger := log.New(redact.NewWriter(&buf), "", 0)
+	logger.Println("using key super-secret-api-key")
+	if strings.Contains(buf.String(), "super-secret-api-key") {
+		t.Fatalf("key leaked into the log: %q", buf.String())
+	}
+
+	// a secret containing another one is replaced whole, whatever the order
+	redact.Register("secret-api")
+	redact.Register("prefix-secret-api-suffix")
+	for range 20 {
+		if got := redact.String("key prefix-secret-api-suffix"); got != "key "+redact.Placeholder {
+			t.Fatalf("got %q", got)
+		}
+	}
+}
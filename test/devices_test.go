@@ -1,171 +1,231 @@
 package test
 
 import (
-	"fmt"
-	"log"
-	"os"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/joho/godotenv"
 	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/govetest"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/structs"
 	"github.com/seanpden/govee_controller/pkg/utils"
 )
 
-// var APIKEY = handleEnvVar()
+const (
+	rightID = "AA:BB:CC:DD:EE:FF:00:11"
+	leftID  = "A1:B2:C3:D4:E5:F6:07:18"
+)
 
-func handleEnvVar() string {
-	err := godotenv.Load("../.env")
+// startFakeGovee starts a fake Govee API with two lamps saved in
+// devices.json, in a temporary working directory.
+func startFakeGovee(t *testing.T) *govetest.Server {
+	chdirTemp(t)
+	fake := testapi.Start(t,
+		govetest.NewDevice(rightID, "H6072", "Lyra (Office: Right)"),
+		govetest.NewDevice(leftID, "H6072", "Lyra (Office: Left)"),
+	)
+	fake.RequireKey("devices-test-api-key")
+	data, err := apiwrapper.ListDevices("devices-test-api-key")
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		t.Fatal(err)
 	}
-
-	APIKEY := os.Getenv("APIKEY")
-	return APIKEY
+	utils.SaveToJSON(data)
+	return fake
 }
 
 func TestListDevices(t *testing.T) {
-	fmt.Println("TestListDevices")
-	APIKEY := handleEnvVar()
-	data, err := apiwrapper.ListDevices(APIKEY)
+	startFakeGovee(t)
+	data, err := apiwrapper.ListDevices("devices-test-api-key")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	if data.Code != 200 || len(data.Data.Devices) != 2 || data.Data.Devices[0].DeviceName != "Lyra (Office: Right)" {
+		t.Errorf("unexpected devices: %+v", data)
 	}
-	// pretty print the list of devices
-	utils.PrettyPrintJSON(data)
-
-	fmt.Println()
 }
 
 func TestListDevicesWrongAPIKEY(t *testing.T) {
-	fmt.Println("TestListDevicesWrongAPIKEY")
-	APIKEY := "invalid"
-	_, err := apiwrapper.ListDevices(APIKEY)
-	if err != nil {
-		fmt.Println(err)
+	startFakeGovee(t)
+	_, err := apiwrapper.ListDevices("invalid")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected a 401, got %v", err)
 	}
-	fmt.Println()
 }
 
 func TestGetDeviceState(t *testing.T) {
-	fmt.Println("TestGetDeviceState")
-	device := "F7:31:D1:39:38:38:5B:62"
-	model := "H6072"
-	APIKEY := handleEnvVar()
-	data, err := apiwrapper.GetDeviceState(device, model, APIKEY)
+	fake := startFakeGovee(t)
+	fake.SetState(rightID, govetest.State{Online: true, Power: "on", Brightness: 40, ColorTem: 3000})
+	data, err := apiwrapper.GetDeviceState(rightID, "H6072", "devices-test-api-key")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	properties := data.Data.Properties
+	if data.Data.Device != rightID || len(properties) != 4 || properties[1].PowerState != "on" || properties[2].Brightness != 40 || *properties[3].ColorTem != 3000 {
+		t.Errorf("unexpected state: %+v", data)
 	}
 
-	// pretty print the device stateA
-	utils.PrettyPrintJSON(data)
-
-	fmt.Println()
+	_, err = apiwrapper.GetDeviceState("00:00", "H6072", "devices-test-api-key")
+	if err == nil {
+		t.Error("expected an unknown device to fail")
+	}
 }
 
 func TestSaveToJSON(t *testing.T) {
-	fmt.Println("TestSaveToJSON")
-	APIKEY := handleEnvVar()
-	data, err := apiwrapper.ListDevices(APIKEY)
+	startFakeGovee(t)
+	data, err := apiwrapper.ListDevices("devices-test-api-key")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 	utils.SaveToJSON(data)
-
-	// pretty print the list of devices
-	utils.PrettyPrintJSON(data)
-	fmt.Println()
+	saved, err := utils.LoadFromJSON("devices.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.Data.Devices, data.Data.Devices) {
+		t.Errorf("expected %+v, got %+v", data.Data.Devices, saved.Data.Devices)
+	}
 }
 
 func TestLoadFromJSON(t *testing.T) {
-	fmt.Println("TestLoadFromJSON")
+	chdirTemp(t)
+	if _, err := utils.LoadFromJSON("devices.json"); err == nil {
+		t.Error("expected a missing devices.json to fail")
+	}
+	startFakeGovee(t)
 	data, err := utils.LoadFromJSON("devices.json")
-	if err != nil {
-		log.Fatal(err)
+	if err != nil || len(data.Data.Devices) != 2 {
+		t.Errorf("unexpected registry %+v %v", data, err)
 	}
-
-	// pretty print the list of devices
-	utils.PrettyPrintJSON(data)
-	fmt.Println()
 }
 
 func TestGetDeviceManyStates(t *testing.T) {
-	fmt.Println("TestGetDeviceManyStates")
-	devices := []string{"Lyra (Office: Right)"}
-	APIKEY := handleEnvVar()
-	data, err := apiwrapper.GetManyDeviceStates(devices, APIKEY)
+	startFakeGovee(t)
+	data, err := apiwrapper.GetManyDeviceStates([]string{"Lyra (Office: Right)", "Nope"}, "devices-test-api-key")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	if len(data) != 1 || data[0].Data.Device != rightID {
+		t.Errorf("unexpected states: %+v", data)
 	}
-
-	// pretty print the list of devices
-	utils.PrettyPrintJSON(data)
-	fmt.Println()
 }
 
 func TestTurnDeviceOn(t *testing.T) {
-	fmt.Println("TestTurnDeviceOn")
-	devices := []string{"F7:31:D1:39:38:38:5B:62"}
-	APIKEY := handleEnvVar()
-	data, err := apiwrapper.TurnDeviceOn(devices, APIKEY)
-	if err != nil {
-		log.Fatal(err)
+	fake := startFakeGovee(t)
+	data, err := apiwrapper.TurnDeviceOn([]string{"Lyra (Office: Right)"}, "devices-test-api-key")
+	if err != nil || data.Code != 200 {
+		t.Fatalf("unexpected response %+v %v", data, err)
+	}
+	if state, _ := fake.State(rightID); state.Power != "on" {
+		t.Errorf("expected the device to be on, got %+v", state)
+	}
+	if state, _ := fake.State(leftID); state.Power != "off" {
+		t.Errorf("expected the other device to stay off, got %+v", state)
 	}
-
-	utils.PrettyPrintJSON(data)
-	fmt.Println()
 }
 
 func TestTurnDeviceOff(t *testing.T) {
-	fmt.Println("TestTurnDeviceOff")
-	devices := []string{"F7:31:D1:39:38:38:5B:62"}
-	APIKEY := handleEnvVar()
-	data, err := apiwrapper.TurnDeviceOff(devices, APIKEY)
+	fake := startFakeGovee(t)
+	fake.SetState(rightID, govetest.State{Online: true, Power: "on", Brightness: 100})
+	_, err := apiwrapper.TurnDeviceOff([]string{"Lyra (Office: Right)"}, "devices-test-api-key")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	if state, _ := fake.State(rightID); state.Power != "off" {
+		t.Errorf("expected the device to be off, got %+v", state)
 	}
-
-	utils.PrettyPrintJSON(data)
-	fmt.Println()
 }
 
 func TestSetDeviceBrightness(t *testing.T) {
-	fmt.Println("TestSetDeviceBrightness")
-	devices := []string{"F7:31:D1:39:38:38:5B:62"}
-	APIKEY := handleEnvVar()
-	data, err := apiwrapper.SetDeviceBrightness(devices, 10, APIKEY)
+	fake := startFakeGovee(t)
+	_, err := apiwrapper.SetDeviceBrightness([]string{"Lyra (Office: Right)", "Lyra (Office: Left)"}, 10, "devices-test-api-key")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	for _, id := range []string{rightID, leftID} {
+		if state, _ := fake.State(id); state.Brightness != 10 {
+			t.Errorf("expected %s at 10%%, got %+v", id, state)
+		}
+	}
+	if _, err := apiwrapper.SetDeviceBrightness([]string{"Lyra (Office: Right)"}, 101, "devices-test-api-key"); err == nil {
+		t.Error("expected an out of range brightness to fail")
 	}
-
-	utils.PrettyPrintJSON(data)
-	fmt.Println()
-
 }
 
 func TestSetDeviceRGB(t *testing.T) {
-	fmt.Println("TestSetDeviceRGB")
-	devices := []string{"Lyra (Office: Left)"}
-	APIKEY := handleEnvVar()
-	data, err := apiwrapper.SetDeviceRGB(devices, 255, 0, 0, APIKEY)
+	fake := startFakeGovee(t)
+	fake.SetState(leftID, govetest.State{Online: true, Power: "on", Brightness: 100, ColorTem: 4000})
+	_, err := apiwrapper.SetDeviceRGB([]string{"Lyra (Office: Left)"}, 255, 0, 0, "devices-test-api-key")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	if state, _ := fake.State(leftID); state.Color != (structs.Color{R: 255}) || state.ColorTem != 0 {
+		t.Errorf("expected the device to be red, got %+v", state)
+	}
+	if got := fake.Commands(); len(got) != 1 || !strings.HasPrefix(got[0], leftID+" color=") {
+		t.Errorf("unexpected commands %v", got)
 	}
-
-	utils.PrettyPrintJSON(data)
-	fmt.Println()
-
 }
 
 func TestSetDeviceColorTemp(t *testing.T) {
-	fmt.Println("TestSetDeviceColorTemp")
-	devices := []string{"F7:31:D1:39:38:38:5B:62"}
-	APIKEY := handleEnvVar()
-	data, err := apiwrapper.SetDeviceColorTemp(devices, 6500, APIKEY)
+	fake := startFakeGovee(t)
+	_, err := apiwrapper.SetDeviceColorTemp([]string{"Lyra (Office: Right)"}, 6500, "devices-test-api-key")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	if state, _ := fake.State(rightID); state.ColorTem != 6500 {
+		t.Errorf("expected 6500K, got %+v", state)
+	}
+}
+
+func TestFakeGoveeFaults(t *testing.T) {
+	fake := startFakeGovee(t)
+	// a 500 is reported, commands are not sent twice
+	fake.Inject(govetest.Fault{Path: "/v1/devices/control", Status: http.StatusInternalServerError, Times: 1})
+	_, err := apiwrapper.TurnDeviceOn([]string{"Lyra (Office: Right)"}, "devices-test-api-key")
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("expected the 500 to be reported, got %v", err)
+	}
+	if requests := len(fake.Requests()); requests != 2 {
+		t.Errorf("expected the list and the failed request, got %d", requests)
 	}
 
-	utils.PrettyPrintJSON(data)
-	fmt.Println()
+	// an API level error of one device
+	fake.Inject(govetest.Fault{Device: leftID, Code: 400, Message: "device offline"})
+	data, err := apiwrapper.TurnDeviceOn([]string{"Lyra (Office: Left)"}, "devices-test-api-key")
+	if err != nil || data.Code != 400 || data.Message != "device offline" {
+		t.Errorf("expected the injected error, got %+v %v", data, err)
+	}
 
+	// the budget is reported and enforced before sending
+	key := "devices-test-rate-limit-key"
+	t.Cleanup(func() { apiwrapper.ResetRateLimits(key) })
+	fake.RequireKey(key)
+	fake.SetRateLimit(1, time.Now().Add(time.Hour))
+	_, err = apiwrapper.ListDevices(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit, ok := apiwrapper.GetRateLimit(key)
+	if !ok || limit.Limit != 1 || limit.Remaining != 0 {
+		t.Errorf("unexpected budget %+v", limit)
+	}
+	sent := len(fake.Requests())
+	_, err = apiwrapper.ListDevices(key)
+	if !errors.Is(err, apiwrapper.ErrRateLimited) || len(fake.Requests()) != sent {
+		t.Errorf("expected the request not to be sent, got %v", err)
+	}
+
+	// latency
+	fake.RequireKey("devices-test-api-key")
+	fake.SetRateLimit(0, time.Time{})
+	fake.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	_, err = apiwrapper.GetDeviceState(rightID, "H6072", "devices-test-api-key")
+	if err != nil || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected a slow response, got %v after %v", err, time.Since(start))
+	}
 }
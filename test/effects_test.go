@@ -0,0 +1,92 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/config"
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/effects"
+	"github.com/seanpden/govee_controller/pkg/govetest"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+func TestEffectFrames(t *testing.T) {
+	red := control.Color{R: 255}
+	frames, err := effects.Effect{Name: effects.Flash, Color: &red, Times: 3}.Frames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// on, off, on, off, on: the effect ends on
+	if len(frames) != 5 || frames[4].State.Power != "on" || frames[1].State.Power != "off" {
+		t.Fatalf("unexpected flash frames: %+v", frames)
+	}
+	first := frames[0].State
+	if first.Power != "on" || first.Color == nil || *first.Color != red || first.Brightness == nil || *first.Brightness != 100 {
+		t.Errorf("expected the first frame to turn the devices on in red: %+v", first)
+	}
+	if cost := effects.Cost(frames); cost != 3+4+4 {
+		t.Errorf("expected 11 requests per device, got %d", cost)
+	}
+
+	frames, _ = effects.Effect{Name: effects.Police, Times: 2, Period: config.Duration(time.Second)}.Frames()
+	if len(frames) != 4 || frames[1].Hold != 500*time.Millisecond || frames[1].State.Color.B != 255 {
+		t.Errorf("unexpected police frames: %+v", frames)
+	}
+
+	if _, err := (effects.Effect{Name: effects.Cycle, Color: &red}).Frames(); err == nil {
+		t.Error("expected a color for the cycle effect to be refused")
+	}
+	if _, err := (effects.Effect{Name: "disco"}).Frames(); err == nil {
+		t.Error("expected an unknown effect to be refused")
+	}
+}
+
+func TestEffectPlay(t *testing.T) {
+	chdirTemp(t)
+	fake := testapi.Start(t, structs.Device{Device: "AA", Model: "H6072", DeviceName: "Lamp", Controllable: true, Retrievable: true})
+	data, err := apiwrapper.ListDevices("effects-test-api-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.SaveToJSON(data)
+	fake.SetState("AA", govetest.State{Online: true, Power: "on", Brightness: 40, Color: structs.Color{B: 255}})
+
+	player := effects.New("effects-test-api-key")
+	player.MinFrame = 5 * time.Millisecond
+	red := control.Color{R: 255}
+	result, err := player.Play(context.Background(), []string{"Lamp"}, effects.Effect{Name: effects.Flash, Color: &red, Times: 2, Period: config.Duration(2 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Frames != 3 || !result.Stretched || !result.Restored {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	// 1+3 frames commands, 1+1 frames, then on, brightness and color restored
+	if commands := fake.Commands(); len(commands) != 3+1+1+3 {
+		t.Errorf("expected 8 commands, got %q", commands)
+	}
+	state, _ := fake.State("AA")
+	if state != (govetest.State{Online: true, Power: "on", Brightness: 40, Color: structs.Color{B: 255}}) {
+		t.Errorf("expected the state to be restored, got %+v", state)
+	}
+
+	// a device that was off is turned off again
+	state.Power = "off"
+	fake.SetState("AA", state)
+	_, err = player.Play(context.Background(), []string{"Lamp"}, effects.Effect{Name: effects.Police, Times: 1, Period: config.Duration(time.Millisecond)})
+	if state, _ = fake.State("AA"); err != nil || state.Power != "off" {
+		t.Errorf("expected the lamp to be off again: %v %+v", err, state)
+	}
+
+	player.Quota = 10
+	_, err = player.Play(context.Background(), []string{"Lamp"}, effects.Effect{Name: effects.Strobe})
+	if !errors.Is(err, effects.ErrOverBudget) {
+		t.Errorf("expected the strobe to be over budget, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/gradient"
+	"github.com/seanpden/govee_controller/pkg/server"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+func TestGradientBlend(t *testing.T) {
+	red, blue := structs.Color{R: 255}, structs.Color{B: 255}
+	blended := gradient.Blend([]structs.Color{red, blue}, 5)
+	if blended[0] != red || blended[4] != blue {
+		t.Errorf("expected the gradient to start and end on the colors, got %v", blended)
+	}
+	// halfway in OKLab is a lighter purple than the RGB average (128, 0, 128)
+	if blended[2] != (structs.Color{R: 140, G: 83, B: 162}) {
+		t.Errorf("unexpected middle color %v", blended[2])
+	}
+
+	// black to white goes through a perceptual middle grey, darker than 128
+	grey := gradient.Blend([]structs.Color{{}, {R: 255, G: 255, B: 255}}, 3)[1]
+	if grey != (structs.Color{R: 99, G: 99, B: 99}) {
+		t.Errorf("unexpected middle grey %v", grey)
+	}
+
+	for _, color := range []structs.Color{{R: 1, G: 2, B: 3}, {R: 200, G: 100, B: 50}, {R: 255, G: 255}} {
+		if got := gradient.Blend([]structs.Color{color, color}, 3); got[1] != color {
+			t.Errorf("expected %v to survive the round trip, got %v", color, got[1])
+		}
+	}
+	for _, color := range gradient.Blend([]structs.Color{red}, 3) {
+		if color != red {
+			t.Errorf("expected a single color to paint every device, got %v", color)
+		}
+	}
+}
+
+func TestParseGradientColors(t *testing.T) {
+	colors, err := gradient.ParseColors([]string{"#ff0000", "Ocean"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]structs.Color{{R: 255}}, gradient.Palettes["ocean"]...)
+	if !reflect.DeepEqual(colors, want) {
+		t.Errorf("expected %v, got %v", want, colors)
+	}
+	_, err = gradient.ParseColors([]string{"red", "sunsett"})
+	if err == nil || !strings.Contains(err.Error(), "sunset") {
+		t.Errorf("expected the error to list the palettes, got %v", err)
+	}
+}
+
+func TestGradientRender(t *testing.T) {
+	chdirTemp(t)
+	devices := []structs.Device{
+		{Device: "AA", Model: "H6072", DeviceName: "Left", Controllable: true, Retrievable: true},
+		{Device: "BB", Model: "H6072", DeviceName: "Middle", Controllable: true, Retrievable: true},
+		{Device: "CC", Model: "H6072", DeviceName: "Right", Controllable: true, Retrievable: true},
+	}
+	fake := testapi.Start(t, devices...)
+	var registry structs.ListDevicesResponse
+	registry.Data.Devices = devices
+	utils.SaveToJSON(registry)
+	os.WriteFile("groups.json", []byte(`{"desk": ["Left", "Middle", "Right"]}`), 0644)
+
+	assignments, err := gradient.Render([]string{"Left", "Middle", "Right"}, []structs.Color{{R: 255}, {B: 255}}, "gradient-test-api-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assignments[0].Color != (structs.Color{R: 255}) || assignments[1].Color != (structs.Color{R: 140, G: 83, B: 162}) || assignments[2].Color != (structs.Color{B: 255}) {
+		t.Errorf("unexpected assignments %+v", assignments)
+	}
+	for _, want := range []string{"AA color=map[b:0 g:0 name:Color r:255]", "BB color=map[b:162 g:83 name:Color r:140]", "CC color=map[b:255 g:0 name:Color r:0]"} {
+		if !strings.Contains(commandsOf(fake), want) {
+			t.Errorf("expected %q in %s", want, commandsOf(fake))
+		}
+	}
+
+	// a mistyped name is reported instead of silently skipped
+	assignments, err = gradient.Render([]string{"Left", "Middel"}, []structs.Color{{R: 255}, {B: 255}}, "gradient-test-api-key")
+	if !errors.Is(err, control.ErrUnknownDevice) || assignments[0].Err != nil || !errors.Is(assignments[1].Err, control.ErrUnknownDevice) {
+		t.Errorf("expected the unknown device to fail alone, got %+v %v", assignments, err)
+	}
+
+	// the server runs the gradient from the last device with reverse
+	s := server.New("gradient-test-api-key")
+	fake.ClearRequests()
+	status, body := request(t, s, "POST", "/groups/desk/gradient", `{"colors": ["red", "blue"], "reverse": true}`)
+	if status != http.StatusOK || !strings.Contains(commandsOf(fake), "CC color=map[b:0 g:0 name:Color r:255]") {
+		t.Errorf("unexpected response %d %s, commands %s", status, body, commandsOf(fake))
+	}
+	status, body = request(t, s, "POST", "/groups/desk/gradient", `{"palette": "sunset"}`)
+	if status != http.StatusOK {
+		t.Errorf("unexpected response %d %s", status, body)
+	}
+	status, body = request(t, s, "POST", "/groups/desk/gradient", `{"palette": "nope"}`)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected an unknown palette to be rejected, got %d %s", status, body)
+	}
+	status, body = request(t, s, "POST", "/groups/desk/gradient", `{}`)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected a gradient without colors to be rejected, got %d %s", status, body)
+	}
+	os.WriteFile("groups.json", []byte(`{"desk": ["Left", "Middel", "Right"]}`), 0644)
+	status, body = request(t, s, "POST", "/groups/desk/gradient", `{"colors": ["red", "blue"]}`)
+	if status != http.StatusNotFound || !strings.Contains(body, "Middel") {
+		t.Errorf("expected the unknown member to be reported, got %d %s", status, body)
+	}
+}
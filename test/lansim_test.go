@@ -0,0 +1,138 @@
+package test
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/lansim"
+	"github.com/seanpden/govee_controller/pkg/structs"
+)
+
+// startLANSim starts a LAN simulator answering to the port requests come
+// from, and returns it with a client connection.
+func startLANSim(t *testing.T, devices ...lansim.Device) (*lansim.Simulator, net.PacketConn) {
+	sim := lansim.New(devices...)
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sim.Close() })
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return sim, client
+}
+
+func sendLAN(t *testing.T, client net.PacketConn, to net.Addr, cmd string, data any) {
+	packet, _ := json.Marshal(map[string]any{"msg": map[string]any{"cmd": cmd, "data": data}})
+	if _, err := client.WriteTo(packet, to); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLAN returns the data of the next answer, and false if none arrives
+// within timeout.
+func readLAN(t *testing.T, client net.PacketConn, cmd string, timeout time.Duration) (map[string]any, bool) {
+	client.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		return nil, false
+	}
+	var msg struct {
+		Msg struct {
+			Cmd  string         `json:"cmd"`
+			Data map[string]any `json:"data"`
+		} `json:"msg"`
+	}
+	if err := json.Unmarshal(buf[:n], &msg); err != nil || msg.Msg.Cmd != cmd {
+		t.Fatalf("unexpected answer %s", buf[:n])
+	}
+	return msg.Msg.Data, true
+}
+
+func TestLANSimulator(t *testing.T) {
+	lamp := lansim.Device{Device: "00:00:00:00:00:00:00:01", SKU: "H6072", State: lansim.State{Brightness: 100}}
+	strip := lansim.Device{Device: "00:00:00:00:00:00:00:02", SKU: "H619A"}
+	sim, client := startLANSim(t, lamp, strip)
+
+	// every device answers a scan
+	sendLAN(t, client, sim.ScanAddress(), "scan", map[string]string{"account_topic": "reserve"})
+	found := map[string]string{}
+	for range 2 {
+		data, ok := readLAN(t, client, "scan", time.Second)
+		if !ok {
+			t.Fatalf("expected two scan answers, got %v", found)
+		}
+		found[data["device"].(string)] = data["sku"].(string)
+		if data["ip"] != "127.0.0.1" {
+			t.Errorf("unexpected ip %v", data["ip"])
+		}
+	}
+	if found[lamp.Device] != "H6072" || found[strip.Device] != "H619A" {
+		t.Errorf("unexpected scan answers %v", found)
+	}
+
+	addr := sim.DeviceAddress(lamp.Device)
+	sendLAN(t, client, addr, "turn", map[string]int{"value": 1})
+	sendLAN(t, client, addr, "brightness", map[string]int{"value": 40})
+	sendLAN(t, client, addr, "brightness", map[string]int{"value": 400})
+	sendLAN(t, client, addr, "colorwc", map[string]any{"color": map[string]int{"r": 255, "g": 0, "b": 0}, "colorTemInKelvin": 0})
+	sendLAN(t, client, addr, "devStatus", map[string]any{})
+	data, ok := readLAN(t, client, "devStatus", time.Second)
+	if !ok {
+		t.Fatal("expected a devStatus answer")
+	}
+	if data["onOff"] != 1.0 || data["brightness"] != 40.0 || data["colorTemInKelvin"] != 0.0 {
+		t.Errorf("unexpected status %v", data)
+	}
+	want := lansim.State{On: true, Brightness: 40, Color: structs.Color{R: 255}}
+	if state, _ := sim.State(lamp.Device); state != want {
+		t.Errorf("expected %+v, got %+v", want, state)
+	}
+	if state, _ := sim.State(strip.Device); state != strip.State {
+		t.Errorf("expected the strip to be left alone, got %+v", state)
+	}
+
+	// a color temperature wins over the color
+	sendLAN(t, client, addr, "colorwc", map[string]any{"color": map[string]int{"r": 0, "g": 0, "b": 255}, "colorTemInKelvin": 3000})
+	sendLAN(t, client, addr, "devStatus", map[string]any{})
+	readLAN(t, client, "devStatus", time.Second)
+	if state, _ := sim.State(lamp.Device); state.ColorTemInKelvin != 3000 || state.Color != want.Color {
+		t.Errorf("unexpected state %+v", state)
+	}
+	if commands := sim.Commands(); len(commands) != 7 || !strings.HasPrefix(commands[0], lamp.Device+" turn ") {
+		t.Errorf("unexpected commands %q", commands)
+	}
+}
+
+func TestLANSimulatorFaults(t *testing.T) {
+	lamp := lansim.Device{Device: "00:00:00:00:00:00:00:01", SKU: "H6072"}
+	sim, client := startLANSim(t, lamp)
+	addr := sim.DeviceAddress(lamp.Device)
+
+	sim.SetLoss(1)
+	sendLAN(t, client, addr, "turn", map[string]int{"value": 1})
+	sendLAN(t, client, sim.ScanAddress(), "scan", map[string]string{"account_topic": "reserve"})
+	if _, ok := readLAN(t, client, "scan", 100*time.Millisecond); ok {
+		t.Error("expected the scan to be lost")
+	}
+	if state, _ := sim.State(lamp.Device); state.On || len(sim.Commands()) != 0 {
+		t.Errorf("expected the command to be lost, got %+v", state)
+	}
+
+	sim.SetLoss(0)
+	sim.SetDelay(200 * time.Millisecond)
+	start := time.Now()
+	sendLAN(t, client, addr, "devStatus", map[string]any{})
+	if _, ok := readLAN(t, client, "devStatus", 100*time.Millisecond); ok {
+		t.Error("expected the answer to be delayed")
+	}
+	if _, ok := readLAN(t, client, "devStatus", time.Second); !ok || time.Since(start) < 200*time.Millisecond {
+		t.Errorf("expected the answer after the delay, got it after %v", time.Since(start))
+	}
+}
@@ -0,0 +1,103 @@
+package test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/govetest"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/metrics"
+	"github.com/seanpden/govee_controller/pkg/poller"
+	"github.com/seanpden/govee_controller/pkg/server"
+	"github.com/seanpden/govee_controller/pkg/tokens"
+)
+
+func TestMetrics(t *testing.T) {
+	chdirTemp(t)
+	fake := testapi.Start(t, govetest.NewDevice("AA", "H6072", "Floor Lamp"))
+	fake.RequireKey("metrics-test-api-key")
+	fake.SetRateLimit(10000, time.Now().Add(time.Hour))
+	fake.SetState("AA", govetest.State{Online: true, Power: "off", Brightness: 35})
+	// the first state request fails
+	fake.Inject(govetest.Fault{Path: "/v1/devices/state", Status: http.StatusBadGateway, Times: 1})
+	t.Cleanup(func() {
+		apiwrapper.Observer = nil
+		apiwrapper.ResetRateLimits("metrics-test-api-key")
+	})
+
+	s := server.New("metrics-test-api-key")
+	apiwrapper.Observer = s.Metrics.Observe
+	err := s.RefreshRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Poller.Quota = 1000000
+	// the failed state request is retried
+	s.Poller.Poll()
+	apiwrapper.TurnDeviceOn([]string{"Floor Lamp"}, "metrics-test-api-key")
+
+	status, body := request(t, s, "GET", "/metrics", "")
+	if status != 200 {
+		t.Fatalf("GET /metrics: %d %s", status, body)
+	}
+	for _, line := range []string{
+		`govee_api_requests_total{endpoint="/v1/devices",method="GET",status="200"} 1`,
+		`govee_api_requests_total{endpoint="/v1/devices/state",method="GET",status="502",device="Floor Lamp"} 1`,
+		`govee_api_requests_total{endpoint="/v1/devices/state",method="GET",status="200",device="Floor Lamp"} 1`,
+		`govee_api_requests_total{endpoint="/v1/devices/control",method="PUT",status="200",device="Floor Lamp"} 1`,
+		`govee_api_retries_total{endpoint="/v1/devices/state"} 1`,
+		`govee_api_request_duration_seconds_count{endpoint="/v1/devices/state"} 2`,
+		`govee_api_request_duration_seconds_bucket{endpoint="/v1/devices/state",le="+Inf"} 2`,
+		// the listing, the failed state request, its retry and the command
+		`govee_api_quota_remaining{account="default"} 9996`,
+		`govee_api_quota_limit{account="default"} 10000`,
+		`govee_device_online{device="Floor Lamp"} 1`,
+		`govee_device_power_on{device="Floor Lamp"} 0`,
+		`govee_device_brightness{device="Floor Lamp"} 35`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %s in\n%s", line, body)
+		}
+	}
+
+	// the series name every device, a token limited to some is refused
+	store := tokens.Store{Path: "tokens.json"}
+	lamp, _, err := store.Create("lamp", []string{"Floor Lamp"}, nil, []string{tokens.ActionRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitoring, _, err := store.Create("monitoring", nil, nil, []string{tokens.ActionRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Tokens = &store
+	if status, body := requestWithToken(t, s, lamp, "GET", "/metrics", ""); status != 403 {
+		t.Errorf("device-scoped token: expected 403, got %d %s", status, body)
+	}
+	if status, body := requestWithToken(t, s, monitoring, "GET", "/metrics", ""); status != 200 || !strings.Contains(body, "govee_device_online") {
+		t.Errorf("unscoped token: %d %s", status, body)
+	}
+}
+
+func TestMetricsRateLimited(t *testing.T) {
+	m := metrics.New("", poller.New(""))
+	m.Observe(apiwrapper.RequestInfo{Method: "PUT", Endpoint: "/v1/devices/control", Account: "home", RateLimited: true})
+	m.Observe(apiwrapper.RequestInfo{Method: "PUT", Endpoint: "/v1/devices/control", Account: "home", Status: 429, Duration: 3 * time.Second})
+
+	var b strings.Builder
+	m.Write(&b)
+	for _, line := range []string{
+		`govee_api_rate_limited_total{account="home",reason="budget"} 1`,
+		`govee_api_rate_limited_total{account="home",reason="429"} 1`,
+		`govee_api_requests_total{endpoint="/v1/devices/control",method="PUT",status="429"} 1`,
+		`govee_api_request_duration_seconds_bucket{endpoint="/v1/devices/control",le="2.5"} 0`,
+		`govee_api_request_duration_seconds_bucket{endpoint="/v1/devices/control",le="5"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %s in\n%s", line, b.String())
+		}
+	}
+}
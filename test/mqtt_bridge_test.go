@@ -0,0 +1,144 @@
+package test
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/govetest"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	mqttbridge "github.com/seanpden/govee_controller/pkg/mqtt_bridge"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+func TestMQTTBridge(t *testing.T) {
+	chdirTemp(t)
+	lamp := structs.Device{Device: "AA:BB", Model: "H6072", DeviceName: "Floor Lamp", Controllable: true, Retrievable: true, SupportCmds: []string{"turn", "brightness", "color", "colorTem"}}
+	lamp.Properties.ColorTem.Range.Min = 2000
+	lamp.Properties.ColorTem.Range.Max = 6500
+	plug := structs.Device{Device: "CC:DD", Model: "H5080", DeviceName: "Plug", Controllable: true, Retrievable: true, SupportCmds: []string{"turn"}}
+	fake := testapi.Start(t, lamp, plug)
+	fake.SetState(lamp.Device, govetest.State{Online: true, Power: "on", Brightness: 100})
+	fake.SetState(plug.Device, govetest.State{Online: true, Power: "on"})
+	data, err := apiwrapper.ListDevices("mqtt-test-api-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.SaveToJSON(data)
+
+	broker := mqttbridge.NewMemoryBroker()
+	bridge := mqttbridge.New(broker.Client(), "mqtt-test-api-key")
+	bridge.Client.Connect()
+	err = bridge.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// discovery follows SupportCmds and the color temperature range
+	var config map[string]any
+	payload, ok := broker.Retained("homeassistant/light/govee_aabb/config")
+	if !ok || json.Unmarshal(payload, &config) != nil {
+		t.Fatalf("missing discovery config for the lamp: %s", payload)
+	}
+	if config["command_topic"] != "govee/floor_lamp/set" || config["max_kelvin"] != 6500.0 || config["brightness"] != true {
+		t.Errorf("unexpected lamp config: %v", config)
+	}
+	if modes, _ := json.Marshal(config["supported_color_modes"]); string(modes) != `["rgb","color_temp"]` {
+		t.Errorf("unexpected lamp color modes: %s", modes)
+	}
+	payload, _ = broker.Retained("homeassistant/light/govee_ccdd/config")
+	if !strings.Contains(string(payload), `"supported_color_modes":["onoff"]`) || !strings.Contains(string(payload), `"brightness":false`) {
+		t.Errorf("unexpected plug config: %s", payload)
+	}
+
+	// a client watching the state topics, like Home Assistant
+	var mu sync.Mutex
+	states := map[string]string{}
+	watcher := broker.Client()
+	watcher.Connect()
+	watcher.Subscribe("govee/+/state", func(topic string, payload []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		states[topic] = string(payload)
+	})
+
+	bridge.Poller.Quota = 1000000
+	bridge.Poller.Poll()
+	mu.Lock()
+	if states["govee/plug/state"] != `{"state":"ON"}` {
+		t.Errorf("unexpected plug state: %q", states["govee/plug/state"])
+	}
+	mu.Unlock()
+	if availability, _ := broker.Retained("govee/plug/availability"); string(availability) != "online" {
+		t.Errorf("unexpected plug availability: %q", availability)
+	}
+
+	fake.ClearRequests()
+	watcher.Publish("govee/floor_lamp/set", false, []byte(`{"state": "ON", "color": {"r": 255, "g": 0, "b": 0}, "brightness": 40}`))
+	if commandsOf(fake) != "AA:BB turn=on; AA:BB brightness=40; AA:BB color=map[b:0 g:0 name:Color r:255]" {
+		t.Errorf("unexpected commands: %s", commandsOf(fake))
+	}
+	mu.Lock()
+	if state := states["govee/floor_lamp/state"]; state != `{"state":"ON","brightness":40,"color_mode":"rgb","color":{"r":255}}` {
+		t.Errorf("unexpected optimistic state: %s", state)
+	}
+	mu.Unlock()
+
+	// with a transition the brightness is stepped in the background
+	fake.ClearRequests()
+	watcher.Publish("govee/plug/set", false, []byte(`{"state": "OFF"}`))
+	watcher.Publish("govee/floor_lamp/set", false, []byte(`{"color_temp": 3000, "brightness": 100, "transition": 0.2}`))
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.HasSuffix(commandsOf(fake), "AA:BB brightness=100") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if commandsOf(fake) != "CC:DD turn=off; AA:BB colorTem=3000; AA:BB brightness=100" {
+		t.Errorf("unexpected commands: %s", commandsOf(fake))
+	}
+
+	var reported []string
+	watcher.Subscribe("govee/+/error", func(topic string, payload []byte) {
+		reported = append(reported, topic+": "+string(payload))
+	})
+	watcher.Publish("govee/floor_lamp/set", false, []byte(`{"brightness": 300}`))
+	if len(reported) != 1 || !strings.HasPrefix(reported[0], "govee/floor_lamp/error: brightness") {
+		t.Errorf("expected the invalid command to be reported, got %v", reported)
+	}
+
+	// after a reconnect the retained topics the will overwrote are restored
+	watcher.Publish(bridge.StatusTopic(), true, []byte("offline"))
+	watcher.Publish("govee/plug/availability", true, []byte("offline"))
+	bridge.Republish()
+	if status, _ := broker.Retained(bridge.StatusTopic()); string(status) != "online" {
+		t.Errorf("unexpected bridge status: %q", status)
+	}
+	if availability, _ := broker.Retained("govee/plug/availability"); string(availability) != "online" {
+		t.Errorf("unexpected plug availability: %q", availability)
+	}
+}
+
+func TestMQTTTopicMatching(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"govee/+/set", "govee/lamp/set", true},
+		{"govee/+/set", "govee/lamp/state", false},
+		{"govee/#", "govee/lamp/state", true},
+		{"govee/+", "govee/lamp/state", false},
+		{"govee/lamp/set", "govee/lamp/set", true},
+	}
+	for _, c := range cases {
+		if mqttbridge.Match(c.filter, c.topic) != c.match {
+			t.Errorf("Match(%q, %q) != %v", c.filter, c.topic, c.match)
+		}
+	}
+	if slug := mqttbridge.Slug("Lyra Left (Office)"); slug != "lyra_left_office" {
+		t.Errorf("unexpected slug %q", slug)
+	}
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/govetest"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/poller"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+func TestPoller(t *testing.T) {
+	chdirTemp(t)
+	fake := testapi.Start(t, []structs.Device{
+		{Device: "AA", Model: "H6072", DeviceName: "Lyra Left", Controllable: true, Retrievable: true},
+		{Device: "BB", Model: "H6072", DeviceName: "Lyra Right", Controllable: true, Retrievable: true},
+		{Device: "CC", Model: "H5080", DeviceName: "Plug", Controllable: true, Retrievable: false},
+	}...)
+	fake.SetState("AA", govetest.State{Online: true, Power: "on", Brightness: 100})
+	data, err := apiwrapper.ListDevices("poller-test-api-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.SaveToJSON(data)
+
+	var events []poller.Event
+	p := poller.New("poller-test-api-key")
+	p.Interval = time.Second
+	p.MaxInterval = 4 * time.Second
+	// a quota high enough that the budget does not limit the interval
+	p.Quota = 1000000
+	p.Handler = func(event poller.Event) { events = append(events, event) }
+
+	p.Poll()
+	if len(events) != 2 || events[0].Kind != poller.KindInitial || events[1].Device != "Lyra Right" {
+		t.Fatalf("expected an initial event per retrievable device, got %+v", events)
+	}
+	state, ok := p.State("Lyra Left")
+	if !ok || !state.Online || state.Power != "on" || state.Updated.IsZero() || state.Changed != state.Updated {
+		t.Fatalf("unexpected state: %+v", state)
+	}
+
+	// quiet polls back off up to MaxInterval
+	var intervals []time.Duration
+	for range 3 {
+		events = nil
+		p.Poll()
+		if len(events) != 0 {
+			t.Fatalf("expected no events, got %+v", events)
+		}
+		intervals = append(intervals, p.CurrentInterval())
+	}
+	if !slices.Equal(intervals, []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second}) {
+		t.Errorf("unexpected back off: %v", intervals)
+	}
+	state, _ = p.State("Lyra Left")
+	if state.Changed == state.Updated {
+		t.Error("Changed should keep the time of the last change")
+	}
+
+	// a change is reported and resets the interval
+	apiwrapper.TurnDeviceOff([]string{"Lyra Left"}, "poller-test-api-key")
+	events = nil
+	p.Poll()
+	if len(events) != 1 || events[0].Kind != poller.KindPower || events[0].Value() != "off" || events[0].Prev.Power != "on" {
+		t.Fatalf("expected a power transition, got %+v", events)
+	}
+	if p.CurrentInterval() != time.Second {
+		t.Errorf("expected the interval to reset, got %s", p.CurrentInterval())
+	}
+
+	// the daily quota of 200 requests, less a quarter for commands, allows
+	// 150 polls of two devices a day
+	p.Quota = 200
+	p.Poll()
+	if want := 24 * time.Hour / 75; p.CurrentInterval() != want {
+		t.Errorf("expected the budget to limit the interval to %s, got %s", want, p.CurrentInterval())
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	prev := poller.State{Online: true, Power: "on", Brightness: 50, Color: &structs.Color{R: 255}}
+	next := poller.State{Online: false, Power: "on", Brightness: 20, Color: &structs.Color{R: 255}, ColorTem: 3000}
+
+	kinds := poller.Transitions(prev, next)
+	if !slices.Equal(kinds, []poller.Kind{poller.KindOffline, poller.KindBrightness, poller.KindColorTem}) {
+		t.Errorf("unexpected transitions: %v", kinds)
+	}
+	if len(poller.Transitions(prev, prev)) != 0 {
+		t.Error("expected no transitions between equal states")
+	}
+	next.Color = &structs.Color{G: 255}
+	if kinds := poller.Transitions(prev, next); !slices.Contains(kinds, poller.KindColor) {
+		t.Errorf("expected a color transition, got %v", kinds)
+	}
+}
@@ -0,0 +1,332 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	mqttbridge "github.com/seanpden/govee_controller/pkg/mqtt_bridge"
+	"github.com/seanpden/govee_controller/pkg/rules"
+	"github.com/seanpden/govee_controller/pkg/server"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/tokens"
+)
+
+func TestRulesValidation(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules string
+		err   string
+	}{
+		{"unknown field", `{rules: [{name: a, trigger: {webhook: a}, actions: [{devices: [Lamp], state: {power: on}}], colour: red}]}`, "colour"},
+		{"two triggers", `{rules: [{name: a, trigger: {webhook: a, file: x}, actions: [{devices: [Lamp], state: {power: on}}]}]}`, "trigger"},
+		{"no action", `{rules: [{name: a, trigger: {webhook: a}}]}`, "action"},
+		{"bad time", `{rules: [{name: a, trigger: {webhook: a}, conditions: [{time: {after: "25:00"}}], actions: [{scene: movie}]}]}`, "25:00"},
+		{"duplicate", `{rules: [{name: a, trigger: {webhook: a}, actions: [{scene: x}]}, {name: a, trigger: {webhook: b}, actions: [{scene: x}]}]}`, "a"},
+		{"unknown rule", `{rules: [{name: a, trigger: {webhook: a}, actions: [{rule: b}]}]}`, "b"},
+		{"effect without devices", `{rules: [{name: a, trigger: {webhook: a}, actions: [{effect: {name: flash}}]}]}`, "devices"},
+		{"unknown effect", `{rules: [{name: a, trigger: {webhook: a}, actions: [{devices: [Lamp], effect: {name: disco}}]}]}`, "disco"},
+		{"loop", `{rules: [{name: a, trigger: {webhook: a}, actions: [{rule: b}]}, {name: b, trigger: {webhook: b}, actions: [{rule: a}]}]}`, "loop"},
+	}
+	for _, c := range cases {
+		_, err := rules.Parse([]byte(c.rules))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected an error mentioning %q, got %v", c.name, c.err, err)
+		}
+	}
+
+	file, err := rules.Parse([]byte(`
+variables:
+  away: false
+rules:
+  - name: porch
+    trigger:
+      schedule: {cron: "30 19 * * *"}
+    conditions:
+      - variable: {name: away, equals: false}
+      - time: {after: "22:00", before: "06:00", days: [sat, sun]}
+    actions:
+      - devices: [Porch]
+        state: {power: on, brightness: 60}
+      - delay: 5h
+      - devices: [Porch]
+        state: {power: off}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := file.Rules[0].Actions[0].State; state == nil || state.Power != "on" {
+		t.Errorf("expected power: on to be read as a string, got %+v", state)
+	}
+}
+
+// evaluationLog collects the evaluations of an engine.
+type evaluationLog struct {
+	mu          sync.Mutex
+	evaluations []rules.Evaluation
+}
+
+func (l *evaluationLog) add(evaluation rules.Evaluation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.evaluations = append(l.evaluations, evaluation)
+}
+
+func (l *evaluationLog) last() rules.Evaluation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.evaluations[len(l.evaluations)-1]
+}
+
+func TestRulesEngine(t *testing.T) {
+	chdirTemp(t)
+	fake := testapi.Start(t, []structs.Device{
+		{Device: "AA", Model: "H6072", DeviceName: "Lamp", Controllable: true, Retrievable: true},
+		{Device: "BB", Model: "H6008", DeviceName: "Porch", Controllable: true, Retrievable: true},
+	}...)
+	os.WriteFile("rules.yaml", []byte(`
+variables:
+  away: false
+rules:
+  - name: doorbell
+    trigger: {webhook: doorbell}
+    conditions:
+      - variable: {name: away, equals: false}
+    actions:
+      - devices: [Porch]
+        state: {power: on}
+      - rule: leave
+  - name: leave
+    trigger: {mqtt: {topic: home/+/presence, payload: away}}
+    actions:
+      - set: {away: true}
+      - devices: [Lamp]
+        state: {power: off}
+`), 0644)
+
+	s := server.New("rules-test-api-key")
+	s.RefreshRegistry()
+	s.Rules = rules.New("rules.yaml", "rules-test-api-key")
+	log := &evaluationLog{}
+	s.Rules.Log = log.add
+	broker := mqttbridge.NewMemoryBroker()
+	s.Rules.MQTT = broker.Client()
+	s.Rules.MQTT.Connect()
+	_, err := s.Rules.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := request(t, s, "POST", "/hooks/doorbell", `{"visitor": "courier"}`)
+	s.Rules.Wait()
+	if status != 202 || !strings.Contains(body, `"rules":1`) {
+		t.Fatalf("POST /hooks/doorbell: %d %s", status, body)
+	}
+	if commandsOf(fake) != "BB turn=on; AA turn=off" {
+		t.Errorf("unexpected commands: %s", commandsOf(fake))
+	}
+	if s.Rules.Variable("away") != true {
+		t.Errorf("expected the invoked rule to set away, got %v", s.Rules.Variable("away"))
+	}
+	if evaluation := log.last(); !evaluation.Ran || !strings.Contains(evaluation.String(), "doorbell") {
+		t.Errorf("unexpected evaluation: %s", evaluation)
+	}
+
+	// the condition no longer holds
+	fake.ClearRequests()
+	request(t, s, "POST", "/hooks/doorbell", "")
+	s.Rules.Wait()
+	if evaluation := log.last(); evaluation.Ran || !strings.Contains(evaluation.String(), "skipped") || commandsOf(fake) != "" {
+		t.Errorf("expected the rule to be skipped: %s, commands: %s", evaluation, commandsOf(fake))
+	}
+
+	if status, _ := request(t, s, "POST", "/hooks/nope", ""); status != 404 {
+		t.Errorf("unknown webhook: expected 404, got %d", status)
+	}
+	if status, _ := request(t, s, "POST", "/hooks/doorbell", "{"); status != 400 {
+		t.Errorf("invalid payload: expected 400, got %d", status)
+	}
+
+	// mqtt triggers match wildcards and payloads
+	fake.ClearRequests()
+	s.Rules.MQTT.Publish("home/alice/presence", false, []byte("home"))
+	s.Rules.MQTT.Publish("home/alice/presence", false, []byte("away"))
+	s.Rules.Wait()
+	if commandsOf(fake) != "AA turn=off" {
+		t.Errorf("unexpected commands after the mqtt message: %s", commandsOf(fake))
+	}
+
+	// an invalid edit keeps the previous rules
+	os.WriteFile("rules.yaml", []byte(`{rules: [{name: broken}]}`), 0644)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes("rules.yaml", future, future)
+	reloaded, err := s.Rules.Reload()
+	if reloaded || err == nil || len(s.Rules.Rules()) != 2 {
+		t.Errorf("expected the invalid rules to be refused: %v %v", reloaded, err)
+	}
+
+	os.WriteFile("rules.yaml", []byte(`{rules: [{name: only, trigger: {webhook: only}, actions: [{scene: movie}]}]}`), 0644)
+	future = future.Add(time.Minute)
+	os.Chtimes("rules.yaml", future, future)
+	reloaded, err = s.Rules.Reload()
+	if !reloaded || err != nil || len(s.Rules.Rules()) != 1 {
+		t.Errorf("expected the new rules to be loaded: %v %v", reloaded, err)
+	}
+	if s.Rules.Variable("away") != true {
+		t.Errorf("expected the variables to survive a reload")
+	}
+}
+
+func TestRulesWebhooks(t *testing.T) {
+	chdirTemp(t)
+	fake := testapi.Start(t, []structs.Device{
+		{Device: "AA", Model: "H6072", DeviceName: "Team Light", Controllable: true, Retrievable: true},
+		{Device: "BB", Model: "H6072", DeviceName: "Other Light", Controllable: true, Retrievable: true},
+	}...)
+	t.Setenv("RULES_TEST_SECRET", "github-webhook-secret")
+	os.WriteFile("rules.yaml", []byte(`
+webhooks:
+  ci:
+    signature: github
+    secretEnv: RULES_TEST_SECRET
+  deploy:
+    signature: gitlab
+    secret: gitlab-webhook-token
+rules:
+  - name: ci result
+    trigger: {webhook: ci}
+    conditions:
+      - variable: {name: payload.workflow_run.status, equals: completed}
+    actions:
+      - devices: ["{{ .payload.team }}"]
+        state: {color: '{{ if eq .payload.workflow_run.conclusion "failure" }}red{{ else }}green{{ end }}'}
+  - name: deployed
+    trigger: {webhook: deploy}
+    actions:
+      - devices: [Team Light]
+        state: {brightness: "{{ .payload.level }}"}
+  - name: team
+    trigger: {webhook: team}
+    actions:
+      - devices: ["{{ .payload.team }}"]
+        state: {power: "on"}
+  - name: paused
+    trigger: {webhook: paused}
+    disabled: true
+    actions:
+      - devices: [Team Light]
+        state: {power: "off"}
+`), 0644)
+
+	store := tokens.Store{Path: "tokens.json"}
+	_, _, err := store.Create("dashboard", nil, nil, []string{tokens.ActionRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lamp, _, err := store.Create("team-lamp", []string{"Team Light"}, nil, []string{tokens.ActionControl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _, err := store.Create("admin", nil, nil, []string{tokens.ActionControl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New("rules-test-api-key")
+	s.Tokens = &store
+	s.RefreshRegistry()
+	s.Rules = rules.New("rules.yaml", "rules-test-api-key")
+	log := &evaluationLog{}
+	s.Rules.Log = log.add
+	_, err = s.Rules.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook := func(path string, header string, value string, body string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		s.Rules.Wait()
+		return rec.Code
+	}
+	sign := func(body string) string {
+		mac := hmac.New(sha256.New, []byte("github-webhook-secret"))
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	failed := `{"team": "Team Light", "workflow_run": {"status": "completed", "conclusion": "failure"}}`
+	if status := hook("/hooks/ci", "X-Hub-Signature-256", sign(failed), failed); status != 202 {
+		t.Fatalf("signed webhook: expected 202, got %d", status)
+	}
+	if commandsOf(fake) != "AA color=map[b:0 g:0 name:Color r:255]" {
+		t.Errorf("unexpected commands: %s", commandsOf(fake))
+	}
+
+	fake.ClearRequests()
+	running := `{"team": "Team Light", "workflow_run": {"status": "in_progress"}}`
+	hook("/hooks/ci", "X-Hub-Signature-256", sign(running), running)
+	if log.last().Ran || commandsOf(fake) != "" {
+		t.Errorf("expected the payload condition to skip the rule: %s", log.last())
+	}
+
+	if status := hook("/hooks/ci", "X-Hub-Signature-256", sign(running), failed); status != 401 {
+		t.Errorf("wrong signature: expected 401, got %d", status)
+	}
+	if status := hook("/hooks/ci", "", "", failed); status != 401 {
+		t.Errorf("missing signature: expected 401, got %d", status)
+	}
+	if status := hook("/hooks/deploy", "X-Gitlab-Token", "wrong", `{"level": 40}`); status != 401 {
+		t.Errorf("wrong gitlab token: expected 401, got %d", status)
+	}
+
+	fake.ClearRequests()
+	if status := hook("/hooks/deploy", "X-Gitlab-Token", "gitlab-webhook-token", `{"level": 40}`); status != 202 || commandsOf(fake) != "AA brightness=40" {
+		t.Errorf("gitlab webhook: %d, commands: %s", status, commandsOf(fake))
+	}
+
+	// the payload can't steer an unsigned webhook out of the token's devices
+	fake.ClearRequests()
+	if status := hook("/hooks/team", "Authorization", "Bearer "+lamp, `{"team": "Team Light"}`); status != 202 || commandsOf(fake) != "AA turn=on" {
+		t.Errorf("scoped webhook: %d, commands: %s", status, commandsOf(fake))
+	}
+	fake.ClearRequests()
+	if status := hook("/hooks/team", "Authorization", "Bearer "+lamp, `{"team": "Other Light"}`); status != 403 || commandsOf(fake) != "" {
+		t.Errorf("out of scope webhook: expected 403, got %d, commands: %s", status, commandsOf(fake))
+	}
+	if status := hook("/hooks/team", "Authorization", "Bearer "+admin, `{"team": "Other Light"}`); status != 202 || commandsOf(fake) != "BB turn=on" {
+		t.Errorf("unscoped webhook: %d, commands: %s", status, commandsOf(fake))
+	}
+
+	// a webhook whose rules are all disabled is unknown
+	if fired, err := s.Rules.Webhook("paused", http.Header{}, nil); !errors.Is(err, rules.ErrUnknownWebhook) {
+		t.Errorf("disabled webhook: expected ErrUnknownWebhook, got %d %v", fired, err)
+	}
+
+	// a template referring to a missing field fails the action, not the request
+	hook("/hooks/deploy", "X-Gitlab-Token", "gitlab-webhook-token", `{}`)
+	if evaluation := log.last(); !evaluation.Ran || evaluation.Actions[0].Err == nil {
+		t.Errorf("expected the action to fail: %s", evaluation)
+	}
+
+	_, err = rules.Parse([]byte(`{webhooks: {ci: {signature: github, secret: x}}, rules: [{name: a, trigger: {webhook: other}, actions: [{scene: "{{ .payload.scene }}"}]}]}`))
+	if err == nil || !strings.Contains(err.Error(), "triggers no rule") {
+		t.Errorf("expected an unused webhook to be refused, got %v", err)
+	}
+	_, err = rules.Parse([]byte(`{rules: [{name: a, trigger: {webhook: a}, actions: [{scene: "{{ .payload.scene "}]}]}`))
+	if err == nil {
+		t.Error("expected an invalid template to be refused")
+	}
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+func TestMatchScene(t *testing.T) {
+	var scenes []structs.LightScene
+	for _, name := range []string{"Sunrise", "Sunset", "Aurora", "Candlelight", "Candle Flicker", "Deep Sea"} {
+		scenes = append(scenes, structs.LightScene{Name: name, Instance: "lightScene"})
+	}
+	cases := []struct {
+		name  string
+		match string
+	}{
+		{"sunrise", "Sunrise"},
+		{"DEEP-SEA", "Deep Sea"},
+		{"aur", "Aurora"},
+		{"flick", "Candle Flicker"},
+		{"auroa", "Aurora"},
+		{"candelight", "Candlelight"},
+		{"sun", ""},
+		{"candle", ""},
+		{"disco", ""},
+	}
+	for _, c := range cases {
+		scene, err := apiwrapper.MatchScene(scenes, c.name)
+		if c.match == "" {
+			if !errors.Is(err, apiwrapper.ErrNoScene) {
+				t.Errorf("%q: expected no match, got %q", c.name, scene.Name)
+			}
+			continue
+		}
+		if err != nil || scene.Name != c.match {
+			t.Errorf("%q: expected %q, got %q %v", c.name, c.match, scene.Name, err)
+		}
+	}
+}
+
+func TestDeviceScenes(t *testing.T) {
+	chdirTemp(t)
+	var mu sync.Mutex
+	requests := map[string]int{}
+	var control structs.V2Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request structs.V2Request
+		json.NewDecoder(r.Body).Decode(&request)
+		mu.Lock()
+		defer mu.Unlock()
+		requests[r.URL.Path]++
+		if request.RequestID == "" || request.Payload.Device != "AA" || request.Payload.SKU != "H6072" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/router/api/v1/device/scenes":
+			fmt.Fprint(w, `{"requestId":"1","code":200,"msg":"success","payload":{"sku":"H6072","device":"AA","capabilities":[
+				{"type":"devices.capabilities.dynamic_scene","instance":"lightScene","parameters":{"dataType":"ENUM","options":[
+					{"name":"Sunrise","value":{"paramId":4280,"id":3853}},{"name":"Aurora","value":{"paramId":4281,"id":3854}}]}}]}}`)
+		case "/router/api/v1/device/diy-scenes":
+			fmt.Fprint(w, `{"requestId":"2","code":200,"msg":"success","payload":{"sku":"H6072","device":"AA","capabilities":[
+				{"type":"devices.capabilities.dynamic_scene","instance":"diyScene","parameters":{"dataType":"ENUM","options":[
+					{"name":"Party Fade","value":8216567}]}}]}}`)
+		case "/router/api/v1/device/control":
+			control = request
+			fmt.Fprint(w, `{"requestId":"3","code":200,"msg":"success"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	openAPIURL := apiwrapper.OpenAPIURL
+	apiwrapper.OpenAPIURL = upstream.URL
+	defer func() { apiwrapper.OpenAPIURL = openAPIURL }()
+
+	var registry structs.ListDevicesResponse
+	registry.Data.Devices = []structs.Device{{Device: "AA", Model: "H6072", DeviceName: "Lamp"}}
+	utils.SaveToJSON(registry)
+
+	scenes, err := apiwrapper.DeviceScenes("Lamp", "scenes-test-api-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scenes) != 3 || scenes[2].Name != "Party Fade" || scenes[2].Instance != "diyScene" {
+		t.Fatalf("unexpected scenes: %+v", scenes)
+	}
+
+	// the scenes are cached, and survive a refresh of the device list
+	utils.SaveToJSON(registry)
+	scenes, err = apiwrapper.DeviceScenes("Lamp", "scenes-test-api-key", false)
+	if err != nil || len(scenes) != 3 || requests["/router/api/v1/device/scenes"] != 1 {
+		t.Fatalf("expected the cached scenes, got %d scenes after %v requests: %v", len(scenes), requests, err)
+	}
+
+	scene, err := apiwrapper.MatchScene(scenes, "party")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = apiwrapper.SetLightScene(registry.Data.Devices[0], scene, "scenes-test-api-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	capability := control.Payload.Capability
+	if capability == nil || capability.Instance != "diyScene" || capability.Value != float64(8216567) {
+		t.Errorf("unexpected control request: %+v", control)
+	}
+
+	if _, err := apiwrapper.DeviceScenes("Nope", "scenes-test-api-key", false); err == nil {
+		t.Error("expected an unknown device to fail")
+	}
+}
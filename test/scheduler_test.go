@@ -0,0 +1,140 @@
+package test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/control"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/scheduler"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+func TestScheduleValidation(t *testing.T) {
+	chdirTemp(t)
+	store := scheduler.Store{Path: "jobs.json"}
+	on := &control.State{Power: "on"}
+
+	invalid := []scheduler.Job{
+		{Name: "bad cron", Cron: "61 * * * *", Devices: []string{"Lamp"}, State: on},
+		{Name: "bad zone", Cron: "@daily", TimeZone: "Mars/Olympus", Devices: []string{"Lamp"}, State: on},
+		{Name: "no action", Cron: "@daily"},
+		{Name: "two actions", Cron: "@daily", Devices: []string{"Lamp"}, State: on, Scene: "movie"},
+		{Name: "no devices", Cron: "@daily", State: on},
+		{Name: "bad policy", Cron: "@daily", Scene: "movie", Missed: "later"},
+	}
+	for _, job := range invalid {
+		if _, err := store.Add(job); err == nil {
+			t.Errorf("expected job %q to be refused", job.Name)
+		}
+	}
+
+	job, err := store.Add(scheduler.Job{Name: "wake", Cron: "0 7 * * *", TimeZone: "America/New_York", Scene: "morning"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Add(scheduler.Job{Name: "wake", Cron: "@daily", Scene: "morning"}); err == nil {
+		t.Error("expected a duplicate name to be refused")
+	}
+
+	// 7:00 in New York is 12:00 UTC in winter
+	next, _ := job.Next(time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC))
+	if !next.Equal(time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next run %v", next)
+	}
+
+	job, err = store.Update(job.ID, func(job *scheduler.Job) { job.Disabled = true })
+	if err != nil || !job.Disabled {
+		t.Errorf("could not disable the job: %v", err)
+	}
+	if _, err = store.Remove("wake"); err != nil {
+		t.Error(err)
+	}
+	if jobs, _ := store.Load(); len(jobs) != 0 {
+		t.Errorf("expected no jobs, got %v", jobs)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	chdirTemp(t)
+	fake := testapi.Start(t, []structs.Device{
+		{Device: "AA", Model: "H6072", DeviceName: "Lamp", Controllable: true},
+		{Device: "BB", Model: "H5080", DeviceName: "Plug", Controllable: true},
+	}...)
+	data, err := apiwrapper.ListDevices("scheduler-test-api-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.SaveToJSON(data)
+	os.WriteFile("groups.json", []byte(`{"all": ["Lamp", "Plug", "Ghost"]}`), 0644)
+
+	// jobs created long ago, so runs were missed while nothing was running
+	created := time.Now().AddDate(-2, 0, 0)
+	off := &control.State{Power: "off"}
+	store := scheduler.Store{Path: "jobs.json"}
+	err = store.Save([]scheduler.Job{
+		{ID: "1", Name: "every minute", Cron: "* * * * *", Devices: []string{"Lamp"}, State: off, Created: time.Now().Add(-time.Hour)},
+		{ID: "2", Name: "new year", Cron: "0 0 1 1 *", Missed: scheduler.MissedRunOnce, Devices: []string{"all"}, State: off, Created: created},
+		{ID: "3", Name: "skipped", Cron: "0 0 1 1 *", Devices: []string{"Plug"}, State: off, Created: created},
+		{ID: "4", Name: "disabled", Cron: "* * * * *", Disabled: true, Devices: []string{"Plug"}, State: off, Created: created},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := scheduler.New("scheduler-test-api-key")
+	wait := s.Tick(context.Background())
+	s.Wait()
+	if wait <= 0 || wait > time.Minute {
+		t.Errorf("unexpected wait until the next run: %v", wait)
+	}
+
+	runs, err := s.History.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("expected the on time and the missed run, got %+v", runs)
+	}
+	byJob := map[string]scheduler.Run{}
+	for _, run := range runs {
+		byJob[run.Job] = run
+	}
+	if run := byJob["every minute"]; run.Missed || !run.OK() || len(run.Outcomes) != 1 {
+		t.Errorf("unexpected on time run: %+v", run)
+	}
+	missed := byJob["new year"]
+	if !missed.Missed || missed.OK() || len(missed.Outcomes) != 3 {
+		t.Fatalf("unexpected missed run: %+v", missed)
+	}
+	if missed.Outcomes[1].Device != "Plug" || missed.Outcomes[1].Error != "" || missed.Outcomes[2].Error != "not in devices.json" {
+		t.Errorf("unexpected outcomes: %+v", missed.Outcomes)
+	}
+	if commandsOf(fake) != "AA turn=off; AA turn=off; BB turn=off" && commandsOf(fake) != "AA turn=off; BB turn=off; AA turn=off" {
+		t.Errorf("unexpected commands: %s", commandsOf(fake))
+	}
+
+	// the runs are remembered, a restarted scheduler doesn't repeat them
+	restarted := scheduler.New("scheduler-test-api-key")
+	restarted.Tick(context.Background())
+	restarted.Wait()
+	if runs, _ := restarted.History.Load(); len(runs) != 2 {
+		t.Errorf("expected no new runs, got %d", len(runs)-2)
+	}
+
+	// a routine reports the scene it applies
+	os.WriteFile("scenes.json", []byte(`{"night": [{"devices": ["Plug"], "state": {"power": "on"}}]}`), 0644)
+	os.WriteFile("routines.json", []byte(`{"bedtime": [{"scene": "night", "wait": "10ms"}, {"devices": ["Lamp"], "state": {"brightness": 5}}]}`), 0644)
+	run := s.RunJob(context.Background(), scheduler.Job{ID: "5", Name: "bedtime", Routine: "bedtime"}, time.Now(), false)
+	if !run.OK() || len(run.Outcomes) != 2 || run.Outcomes[0].Device != "Plug" || run.Outcomes[1].Device != "Lamp" {
+		t.Errorf("unexpected routine run: %+v", run)
+	}
+	run = s.RunJob(context.Background(), scheduler.Job{ID: "6", Name: "unknown", Scene: "party"}, time.Now(), false)
+	if run.OK() || run.Error != `no scene named "party"` {
+		t.Errorf("unexpected run of an unknown scene: %+v", run)
+	}
+}
@@ -0,0 +1,149 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/gradient"
+	"github.com/seanpden/govee_controller/pkg/segments"
+	"github.com/seanpden/govee_controller/pkg/server"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+func TestParseSegments(t *testing.T) {
+	cases := []struct {
+		spec    string
+		indexes []int
+	}{
+		{"all", []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{"0-4,7", []int{0, 1, 2, 3, 4, 7}},
+		{"7, 2-3,3", []int{2, 3, 7}},
+		{"9", []int{9}},
+		{"10", nil},
+		{"4-2", nil},
+		{"-1", nil},
+		{"a-b", nil},
+		{"", nil},
+	}
+	for _, c := range cases {
+		indexes, err := segments.ParseRange(c.spec, 10)
+		if c.indexes == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", c.spec, indexes)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(indexes, c.indexes) {
+			t.Errorf("%q: expected %v, got %v %v", c.spec, c.indexes, indexes, err)
+		}
+	}
+}
+
+func TestDeviceSegments(t *testing.T) {
+	chdirTemp(t)
+	testapi.Start(t, []structs.Device{
+		{Device: "AA", Model: "H619A", DeviceName: "Strip", Controllable: true, Retrievable: true},
+		{Device: "BB", Model: "H6001", DeviceName: "Bulb", Controllable: true, Retrievable: true},
+	}...)
+	var mu sync.Mutex
+	listed := 0
+	var controls []structs.V2Capability
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/router/api/v1/user/devices":
+			listed++
+			fmt.Fprint(w, `{"code":200,"message":"success","data":[
+				{"sku":"H619A","device":"AA","deviceName":"Strip","capabilities":[
+					{"type":"devices.capabilities.segment_color_setting","instance":"segmentedColorRgb","parameters":{"dataType":"STRUCT","fields":[
+						{"fieldName":"segment","dataType":"Array","elementRange":{"min":0,"max":14}},
+						{"fieldName":"rgb","dataType":"INTEGER","range":{"min":0,"max":16777215}}]}}]},
+				{"sku":"H6001","device":"BB","deviceName":"Bulb","capabilities":[]}]}`)
+		case "/router/api/v1/device/control":
+			var request structs.V2Request
+			json.NewDecoder(r.Body).Decode(&request)
+			controls = append(controls, *request.Payload.Capability)
+			fmt.Fprint(w, `{"requestId":"1","code":200,"msg":"success"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	openAPIURL := apiwrapper.OpenAPIURL
+	apiwrapper.OpenAPIURL = upstream.URL
+	defer func() { apiwrapper.OpenAPIURL = openAPIURL }()
+
+	var registry structs.ListDevicesResponse
+	registry.Data.Devices = []structs.Device{
+		{Device: "AA", Model: "H619A", DeviceName: "Strip", Controllable: true, Retrievable: true},
+		{Device: "BB", Model: "H6001", DeviceName: "Bulb", Controllable: true, Retrievable: true},
+	}
+	utils.SaveToJSON(registry)
+
+	count, err := apiwrapper.DeviceSegments("Strip", "segments-test-api-key", false)
+	if err != nil || count != 15 {
+		t.Fatalf("expected 15 segments, got %d %v", count, err)
+	}
+	// the count is cached, and survives a refresh of the device list
+	utils.SaveToJSON(registry)
+	count, err = apiwrapper.DeviceSegments("Strip", "segments-test-api-key", false)
+	if err != nil || count != 15 || listed != 1 {
+		t.Fatalf("expected the cached count, got %d after %d listings: %v", count, listed, err)
+	}
+	if _, err := apiwrapper.DeviceSegments("Bulb", "segments-test-api-key", false); !errors.Is(err, apiwrapper.ErrNoSegments) {
+		t.Errorf("expected a device without segments to fail, got %v", err)
+	}
+
+	// two colors over four segments blend through two intermediate colors
+	requests, err := segments.Paint(registry.Data.Devices[0], []int{0, 1, 2, 3}, []structs.Color{{R: 255}, {B: 255}}, "segments-test-api-key")
+	if err != nil || requests != 4 {
+		t.Fatalf("expected 4 requests, got %d %v", requests, err)
+	}
+	first := controls[0].Value.(map[string]any)
+	if controls[0].Instance != "segmentedColorRgb" || first["rgb"] != float64(0xff0000) || !reflect.DeepEqual(first["segment"], []any{float64(0)}) {
+		t.Errorf("unexpected control request: %+v", controls[0])
+	}
+	// the segments blend in OKLab like device gradients do
+	for i, want := range gradient.Blend([]structs.Color{{R: 255}, {B: 255}}, 4) {
+		value := controls[i].Value.(map[string]any)
+		if value["rgb"] != float64(want.R<<16|want.G<<8|want.B) || !reflect.DeepEqual(value["segment"], []any{float64(i)}) {
+			t.Errorf("expected segment %d to be %v, got %+v", i, want, controls[i])
+		}
+	}
+
+	// segments sharing a color share a request
+	controls = nil
+	requests, err = segments.Paint(registry.Data.Devices[0], []int{0, 1, 2}, []structs.Color{{G: 255}}, "segments-test-api-key")
+	if err != nil || requests != 1 || len(controls) != 1 {
+		t.Fatalf("expected a single request, got %d %v", requests, err)
+	}
+
+	s := server.New("segments-test-api-key")
+	controls = nil
+	status, body := request(t, s, "PUT", "/devices/Strip/segments", `{"segments": "0-4,7", "color": "red", "brightness": 40}`)
+	if status != http.StatusOK || len(controls) != 2 || controls[1].Instance != "segmentedBrightness" {
+		t.Fatalf("unexpected response %d %s, requests %+v", status, body, controls)
+	}
+	status, body = request(t, s, "PUT", "/devices/Strip/segments", `{"segments": "15", "color": "red"}`)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected an out of range segment to be rejected, got %d %s", status, body)
+	}
+	status, body = request(t, s, "PUT", "/devices/Bulb/segments", `{"segments": "all", "color": "red"}`)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected a device without segments to be rejected, got %d %s", status, body)
+	}
+	status, body = request(t, s, "PUT", "/devices/Strip/segments", `{"segments": "all"}`)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected a request without color or brightness to be rejected, got %d %s", status, body)
+	}
+}
@@ -0,0 +1,212 @@
+package test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/seanpden/govee_controller/pkg/govetest"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/server"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/tokens"
+)
+
+// commandsOf joins the control commands received by a fake Govee API, as
+// "device name=value; ...".
+func commandsOf(fake *govetest.Server) string {
+	return strings.Join(fake.Commands(), "; ")
+}
+
+func request(t *testing.T, handler http.Handler, method string, path string, body string) (int, string) {
+	return requestWithToken(t, handler, "", method, path, body)
+}
+
+func requestWithToken(t *testing.T, handler http.Handler, token string, method string, path string, body string) (int, string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	data, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(data)
+}
+
+func TestServer(t *testing.T) {
+	chdirTemp(t)
+	fake := testapi.Start(t, []structs.Device{
+		{Device: "AA", Model: "H6072", DeviceName: "Lyra Left", Controllable: true, Retrievable: true},
+		{Device: "BB", Model: "H6072", DeviceName: "Lyra Right", Controllable: true, Retrievable: true},
+	}...)
+	os.WriteFile("groups.json", []byte(`{"office": ["Lyra Left", "Lyra Right"]}`), 0644)
+	os.WriteFile("scenes.json", []byte(`{"movie": [{"devices": ["office"], "state": {"power": "on", "color": "red"}}]}`), 0644)
+
+	s := server.New("server-test-api-key")
+	err := s.RefreshRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := request(t, s, "GET", "/devices", "")
+	if status != 200 || !strings.Contains(body, "Lyra Right") {
+		t.Fatalf("GET /devices: %d %s", status, body)
+	}
+
+	status, body = request(t, s, "GET", "/devices/AA/state", "")
+	if status != 200 || !strings.Contains(body, `"powerState":"off"`) {
+		t.Fatalf("GET /devices/AA/state: %d %s", status, body)
+	}
+
+	status, body = request(t, s, "PUT", "/devices/Lyra%20Left", `{"power": "on", "brightness": 30}`)
+	if status != 200 || commandsOf(fake) != "AA turn=on; AA brightness=30" {
+		t.Fatalf("PUT /devices/Lyra Left: %d %s, commands: %s", status, body, commandsOf(fake))
+	}
+
+	status, body = request(t, s, "PUT", "/devices/AA", `{"brightness": 300}`)
+	if status != 400 {
+		t.Fatalf("invalid brightness: %d %s", status, body)
+	}
+
+	status, body = request(t, s, "PUT", "/devices/nope", `{"power": "on"}`)
+	if status != 404 {
+		t.Fatalf("unknown device: %d %s", status, body)
+	}
+	status, body = request(t, s, "POST", "/groups/nope/off", "")
+	if status != 404 {
+		t.Fatalf("unknown group: %d %s", status, body)
+	}
+
+	fake.ClearRequests()
+	status, body = request(t, s, "POST", "/groups/office/off", "")
+	if status != 200 || commandsOf(fake) != "AA turn=off; BB turn=off" {
+		t.Fatalf("POST /groups/office/off: %d %s, commands: %s", status, body, commandsOf(fake))
+	}
+
+	fake.ClearRequests()
+	status, body = request(t, s, "POST", "/scenes/movie/apply", "")
+	if status != 200 || commandsOf(fake) != "AA turn=on; BB turn=on; AA color=map[b:0 g:0 name:Color r:255]; BB color=map[b:0 g:0 name:Color r:255]" {
+		t.Fatalf("POST /scenes/movie/apply: %d %s, commands: %s", status, body, commandsOf(fake))
+	}
+
+	status, body = request(t, s, "GET", "/openapi.json", "")
+	var spec map[string]any
+	if status != 200 || json.Unmarshal([]byte(body), &spec) != nil || spec["openapi"] != "3.0.3" {
+		t.Fatalf("GET /openapi.json: %d %s", status, body)
+	}
+}
+
+func TestServerTokens(t *testing.T) {
+	chdirTemp(t)
+	fake := testapi.Start(t, []structs.Device{
+		{Device: "AA", Model: "H6072", DeviceName: "Lyra Left", Controllable: true, Retrievable: true},
+		{Device: "BB", Model: "H6072", DeviceName: "Lyra Right", Controllable: true, Retrievable: true},
+		{Device: "CC", Model: "H6008", DeviceName: "Hallway", Controllable: true, Retrievable: true},
+	}...)
+	os.WriteFile("groups.json", []byte(`{"office": ["Lyra Left", "Lyra Right"]}`), 0644)
+	os.WriteFile("scenes.json", []byte(`{"night": [{"devices": ["Hallway"], "state": {"power": "off"}}]}`), 0644)
+
+	store := tokens.Store{Path: "tokens.json"}
+	enabled, _ := store.Enabled()
+	if enabled {
+		t.Fatal("an empty store should not enable authentication")
+	}
+	office, _, err := store.Create("office-tablet", nil, []string{"office"}, []string{tokens.ActionRead, tokens.ActionControl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, _, err := store.Create("dashboard", nil, nil, []string{tokens.ActionRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = store.Create("dashboard", nil, nil, []string{tokens.ActionRead})
+	if err == nil {
+		t.Fatal("expected duplicate token names to be refused")
+	}
+	_, _, err = store.Create("bad", nil, nil, []string{"admin"})
+	if err == nil {
+		t.Fatal("expected unknown actions to be refused")
+	}
+
+	s := server.New("server-test-api-key")
+	s.Tokens = &store
+	s.Audit = &server.AuditLog{Path: "audit.log"}
+	s.RefreshRegistry()
+
+	cases := []struct {
+		token  string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"", "GET", "/devices", "", 401},
+		{"gvt_wrong", "GET", "/devices", "", 401},
+		{"", "GET", "/openapi.json", "", 200},
+		{viewer, "GET", "/devices/CC/state", "", 200},
+		{viewer, "PUT", "/devices/CC", `{"power": "on"}`, 403},
+		{office, "PUT", "/devices/Lyra%20Left", `{"power": "on"}`, 200},
+		{office, "PUT", "/devices/Hallway", `{"power": "on"}`, 403},
+		{office, "POST", "/groups/office/off", "", 200},
+		{office, "POST", "/scenes/night/apply", "", 403},
+		// a scoped token can't tell a missing group or scene from a forbidden one
+		{office, "POST", "/groups/nope/off", "", 403},
+		{office, "POST", "/scenes/nope/apply", "", 403},
+		// the audit trail reads the body before the token is checked
+		{"", "PUT", "/devices/AA", strings.Repeat(" ", 2<<20), 413},
+	}
+	for _, c := range cases {
+		status, body := requestWithToken(t, s, c.token, c.method, c.path, c.body)
+		if status != c.status {
+			t.Errorf("%s %s: expected %d, got %d %s", c.method, c.path, c.status, status, body)
+		}
+	}
+	if commandsOf(fake) != "AA turn=on; AA turn=off; BB turn=off" {
+		t.Errorf("unexpected commands: %s", commandsOf(fake))
+	}
+
+	// a scoped token only sees its devices
+	_, body := requestWithToken(t, s, office, "GET", "/devices", "")
+	if strings.Contains(body, "Hallway") || !strings.Contains(body, "Lyra Right") {
+		t.Errorf("office token sees the wrong devices: %s", body)
+	}
+
+	_, err = store.Revoke("office-tablet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ := requestWithToken(t, s, office, "GET", "/devices", "")
+	if status != 401 {
+		t.Errorf("revoked token: expected 401, got %d", status)
+	}
+
+	// revoking the last token keeps authentication on
+	_, err = store.Revoke("dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enabled, err = store.Enabled()
+	if !enabled || err != nil {
+		t.Errorf("expected a store without live tokens to still require authentication, got %v %v", enabled, err)
+	}
+
+	entries, err := server.ReadAuditLog("audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every change and every refusal, reads that succeeded are not audited
+	if len(entries) != 11 {
+		t.Fatalf("expected 11 audit entries, got %d: %+v", len(entries), entries)
+	}
+	entry := entries[3]
+	if entry.Token != "office-tablet" || entry.Path != "/devices/Lyra Left" || entry.Body != `{"power": "on"}` || entry.Status != 200 {
+		t.Errorf("unexpected audit entry: %+v", entry)
+	}
+	if entries[0].Token != "anonymous" || entries[0].Status != 401 {
+		t.Errorf("unexpected audit entry: %+v", entries[0])
+	}
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/simulator"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+// startSimulator serves the virtual home of the current directory and points
+// the api wrapper and the registry at it, like -simulate does.
+func startSimulator(t *testing.T) *simulator.Simulator {
+	sim, err := simulator.Start(simulator.DefaultPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL, openAPIURL, registry := apiwrapper.BaseURL, apiwrapper.OpenAPIURL, utils.RegistryFile
+	apiwrapper.BaseURL, apiwrapper.OpenAPIURL, utils.RegistryFile = sim.URL, "", simulator.RegistryFile
+	t.Cleanup(func() {
+		apiwrapper.BaseURL, apiwrapper.OpenAPIURL, utils.RegistryFile = baseURL, openAPIURL, registry
+		sim.Close()
+	})
+	data, err := apiwrapper.ListDevices("simulate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.SaveToJSON(data)
+	return sim
+}
+
+func TestSimulator(t *testing.T) {
+	chdirTemp(t)
+	sim := startSimulator(t)
+	if _, err := os.Stat(simulator.DefaultPath); err != nil {
+		t.Fatalf("expected the default home to be written: %v", err)
+	}
+	if _, err := os.Stat("devices.json"); err == nil {
+		t.Error("expected the real registry to be left alone")
+	}
+	registry, err := utils.LoadFromJSON(simulator.RegistryFile)
+	if err != nil || len(registry.Data.Devices) != len(simulator.DefaultHome.Devices) {
+		t.Fatalf("unexpected simulated registry %+v %v", registry, err)
+	}
+
+	if _, err := apiwrapper.TurnDeviceOn([]string{"Floor Lamp"}, "simulate"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apiwrapper.SetDeviceColorTemp([]string{"Bedroom Bulb"}, 6500, "simulate"); err != nil {
+		t.Fatal(err)
+	}
+	// the models differ in what they support
+	if _, err := apiwrapper.SetDeviceColorTemp([]string{"Bedroom Bulb"}, 9000, "simulate"); err == nil {
+		t.Error("expected a color temperature out of the bulb's range to fail")
+	}
+	if _, err := apiwrapper.SetDeviceBrightness([]string{"Porch Plug"}, 50, "simulate"); err == nil {
+		t.Error("expected a plug to refuse a brightness")
+	}
+	// the simulator has no v2 API, scenes and segments say so
+	lamp, _, _ := apiwrapper.ResolveDevices([]string{"Floor Lamp"})
+	if _, err := apiwrapper.ListDeviceScenes(lamp[0], "simulate"); !errors.Is(err, apiwrapper.ErrNoOpenAPI) {
+		t.Errorf("expected scenes to be unavailable, got %v", err)
+	}
+	if _, err := apiwrapper.DeviceSegments("Floor Lamp", "simulate", false); !errors.Is(err, apiwrapper.ErrNoOpenAPI) {
+		t.Errorf("expected segments to be unavailable, got %v", err)
+	}
+	if err := sim.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the state persists between runs
+	sim.Close()
+	startSimulator(t)
+	state, err := apiwrapper.GetDeviceState("00:00:00:00:00:00:00:01", "H6072", "simulate")
+	if err != nil || state.Data.Properties[1].PowerState != "on" {
+		t.Errorf("expected the lamp to still be on, got %+v %v", state, err)
+	}
+	state, err = apiwrapper.GetDeviceState("00:00:00:00:00:00:00:03", "H6008", "simulate")
+	if err != nil || *state.Data.Properties[3].ColorTem != 6500 {
+		t.Errorf("expected the bulb to still be at 6500K, got %+v %v", state, err)
+	}
+}
+
+func TestSimulatorHomeValidation(t *testing.T) {
+	chdirTemp(t)
+	homes := map[string]string{
+		"duplicate": `{"devices": [{"device": "01", "model": "H6072", "deviceName": "Lamp"}, {"device": "02", "model": "H6072", "deviceName": "Lamp"}]}`,
+		"no model":  `{"devices": [{"device": "01", "deviceName": "Lamp"}]}`,
+		"range":     `{"devices": [{"device": "01", "model": "H6008", "deviceName": "Bulb", "colorTem": {"min": 6500, "max": 2700}}]}`,
+		"json":      `{"devices": [`,
+	}
+	for name, home := range homes {
+		os.WriteFile("home.json", []byte(home), 0644)
+		if _, err := simulator.Load("home.json"); err == nil {
+			t.Errorf("%s: expected the home to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/seanpden/govee_controller/pkg/scheduler"
+	"github.com/seanpden/govee_controller/pkg/solar"
+)
+
+var london = solar.Coordinates{Latitude: 51.5074, Longitude: -0.1278}
+
+// near reports whether two times are within three minutes, the times
+// published by almanacs are rounded and use a slightly different model.
+func near(a time.Time, b time.Time) bool {
+	return a.Sub(b).Abs() < 3*time.Minute
+}
+
+func TestSolarEvents(t *testing.T) {
+	europe, _ := time.LoadLocation("Europe/London")
+	newYork, _ := time.LoadLocation("America/New_York")
+	cases := []struct {
+		event solar.Event
+		at    solar.Coordinates
+		want  time.Time
+	}{
+		{solar.Sunrise, london, time.Date(2024, 6, 21, 4, 43, 0, 0, europe)},
+		{solar.Sunset, london, time.Date(2024, 6, 21, 21, 21, 0, 0, europe)},
+		{solar.CivilDawn, london, time.Date(2024, 6, 21, 3, 56, 0, 0, europe)},
+		{solar.Sunrise, solar.Coordinates{Latitude: 40.7128, Longitude: -74.006}, time.Date(2024, 12, 21, 7, 17, 0, 0, newYork)},
+		{solar.Sunset, solar.Coordinates{Latitude: 40.7128, Longitude: -74.006}, time.Date(2024, 12, 21, 16, 32, 0, 0, newYork)},
+	}
+	for _, c := range cases {
+		got, ok := c.event.Time(c.want, c.at)
+		if !ok || !near(got, c.want) {
+			t.Errorf("%s on %s: got %v, want about %v", c.event, c.want.Format(time.DateOnly), got, c.want)
+		}
+	}
+
+	dawn, _ := solar.NauticalDawn.Time(time.Date(2024, 6, 21, 0, 0, 0, 0, europe), london)
+	civil, _ := solar.CivilDawn.Time(time.Date(2024, 6, 21, 0, 0, 0, 0, europe), london)
+	if !dawn.Before(civil) {
+		t.Errorf("nautical dawn %v should come before civil dawn %v", dawn, civil)
+	}
+
+	// no sunset during the midnight sun, the next one is late in July
+	tromso := solar.Coordinates{Latitude: 69.6492, Longitude: 18.9553}
+	if _, ok := solar.Sunset.Time(time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC), tromso); ok {
+		t.Error("expected no sunset in Tromsø at the solstice")
+	}
+	schedule, _ := solar.Parse("sunset", tromso, time.UTC)
+	if next := schedule.Next(time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC)); next.Month() != time.July {
+		t.Errorf("unexpected next sunset in Tromsø: %v", next)
+	}
+
+	for _, spec := range []string{"moonrise", "sunset30m", "sunset-soon"} {
+		if _, err := solar.Parse(spec, tromso, time.UTC); err == nil {
+			t.Errorf("expected %q to be refused", spec)
+		}
+	}
+}
+
+func TestSolarJobs(t *testing.T) {
+	scheduler.Coordinates = nil
+	job := scheduler.Job{Name: "porch", Solar: "sunset-30m", TimeZone: "Europe/London", Scene: "porch"}
+	if err := job.Validate(); err == nil {
+		t.Error("expected a solar job to need coordinates")
+	}
+
+	scheduler.Coordinates = &london
+	t.Cleanup(func() { scheduler.Coordinates = nil })
+	if err := job.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	location, _ := time.LoadLocation("Europe/London")
+	next, _ := job.Next(time.Date(2024, 6, 21, 12, 0, 0, 0, location))
+	if !near(next, time.Date(2024, 6, 21, 20, 51, 0, 0, location)) {
+		t.Errorf("unexpected next run %v", next)
+	}
+	// once past, the next run is the following evening
+	next, _ = job.Next(next)
+	if next.Day() != 22 {
+		t.Errorf("unexpected run after the first one: %v", next)
+	}
+
+	job.Cron = "0 20 * * *"
+	if err := job.Validate(); err == nil {
+		t.Error("expected a job with both a cron expression and a solar event to be refused")
+	}
+}
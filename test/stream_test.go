@@ -0,0 +1,151 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/seanpden/govee_controller/pkg/govetest"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/server"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/tokens"
+)
+
+// readSSE returns the next event of a Server-Sent Events stream.
+func readSSE(t *testing.T, reader *bufio.Reader) server.Event {
+	t.Helper()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the event stream: %v", err)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var event server.Event
+			err = json.Unmarshal([]byte(data), &event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return event
+		}
+	}
+}
+
+func TestEventStreams(t *testing.T) {
+	chdirTemp(t)
+	fake := testapi.Start(t, []structs.Device{
+		{Device: "AA", Model: "H6072", DeviceName: "Lyra Left", Controllable: true, Retrievable: true},
+		{Device: "CC", Model: "H6008", DeviceName: "Hallway", Controllable: true, Retrievable: true},
+	}...)
+	fake.SetState("AA", govetest.State{Online: true, Power: "on", Brightness: 100})
+
+	store := tokens.Store{Path: "tokens.json"}
+	token, _, err := store.Create("dashboard", []string{"Lyra Left"}, nil, []string{tokens.ActionRead, tokens.ActionControl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a token naming its device by id
+	panel, _, err := store.Create("wall-panel", []string{"AA"}, nil, []string{tokens.ActionRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.New("stream-test-api-key")
+	s.Tokens = &store
+	s.RefreshRegistry()
+	s.Poller.Interval = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.Poller.Run(ctx)
+		close(stopped)
+	}()
+	// the poller must be done before the fake API goes away
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// browsers pass the token in the query string
+	res, err := http.Get(srv.URL + "/events?access_token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET /events: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	sse := bufio.NewReader(res.Body)
+
+	// the first poll reports the full state of the devices the token covers
+	event := readSSE(t, sse)
+	if event.Type != server.EventState || event.Device != "Lyra Left" || event.State.Power != "on" || !event.State.Online {
+		t.Fatalf("unexpected first event: %+v", event)
+	}
+
+	dialer := websocket.Dialer{}
+	header := http.Header{"Authorization": {"Bearer " + panel}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/events/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a late subscriber starts from a snapshot of the known state
+	var wsEvent server.Event
+	err = conn.ReadJSON(&wsEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wsEvent.Type != server.EventSnapshot || wsEvent.Device != "Lyra Left" {
+		t.Fatalf("unexpected snapshot: %+v", wsEvent)
+	}
+
+	req, _ := http.NewRequest("PUT", srv.URL+"/devices/AA", strings.NewReader(`{"power": "off"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	put, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put.Body.Close()
+
+	// both streams see the command, then the change the poller detects
+	for _, next := range []func() server.Event{
+		func() server.Event { return readSSE(t, sse) },
+		func() server.Event {
+			var event server.Event
+			err := conn.ReadJSON(&event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return event
+		},
+	} {
+		event := next()
+		if event.Type != server.EventCommand || event.Applied.Power != "off" || event.Error != "" {
+			t.Fatalf("expected the command result, got %+v", event)
+		}
+		event = next()
+		if event.Type != server.EventState || event.Device != "Lyra Left" || event.Changes["power"] != "off" || len(event.Changes) != 1 {
+			t.Fatalf("expected the power change, got %+v", event)
+		}
+	}
+
+	res, err = http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("stream without token: expected 401, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,66 @@
+package test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	apiwrapper "github.com/seanpden/govee_controller/pkg/api_wrapper"
+	"github.com/seanpden/govee_controller/pkg/govetest"
+	"github.com/seanpden/govee_controller/pkg/govetest/testapi"
+	"github.com/seanpden/govee_controller/pkg/structs"
+	"github.com/seanpden/govee_controller/pkg/utils"
+)
+
+func TestTraceAndDryRun(t *testing.T) {
+	chdirTemp(t)
+
+	lyra := govetest.NewDevice("AA:BB", "H6072", "Lyra")
+	var registry structs.ListDevicesResponse
+	registry.Data.Devices = []structs.Device{lyra}
+	utils.SaveToJSON(registry)
+
+	fake := testapi.Start(t, lyra)
+	fake.RequireKey("trace-test-api-key")
+
+	var trace bytes.Buffer
+	apiwrapper.Trace = &trace
+	defer func() { apiwrapper.Trace = nil }()
+
+	_, err := apiwrapper.SetDeviceBrightness([]string{"Lyra"}, 40, "trace-test-api-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"--> PUT " + fake.URL + "/v1/devices/control", `"value":40`, "<-- 200 OK", `"message":"Success"`} {
+		if !strings.Contains(trace.String(), want) {
+			t.Fatalf("trace is missing %q:\n%s", want, trace.String())
+		}
+	}
+	if strings.Contains(trace.String(), "trace-test-api-key") {
+		t.Fatalf("the API key leaked into the trace:\n%s", trace.String())
+	}
+
+	// a dry run prints the request instead of sending it
+	var dryRun bytes.Buffer
+	dryRunOutput := apiwrapper.DryRunOutput
+	apiwrapper.DryRun = true
+	apiwrapper.DryRunOutput = &dryRun
+	t.Cleanup(func() { apiwrapper.DryRun, apiwrapper.DryRunOutput = false, dryRunOutput })
+
+	response, err := apiwrapper.TurnDeviceOff([]string{"Lyra"}, "trace-test-api-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests := len(fake.Requests()); requests != 1 {
+		t.Fatalf("got %d requests, the dry run must not send any", requests)
+	}
+	if response.Code != 200 || !strings.Contains(dryRun.String(), `"value":"off"`) {
+		t.Fatalf("got %+v and output:\n%s", response, dryRun.String())
+	}
+
+	// values are still validated
+	_, err = apiwrapper.SetDeviceBrightness([]string{"Lyra"}, 400, "trace-test-api-key")
+	if err == nil {
+		t.Fatal("expected an error for an invalid brightness")
+	}
+}